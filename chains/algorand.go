@@ -21,6 +21,30 @@ func (self AlgorandChain) GetClientVersion(context context.Context, ep *nodemuxc
 	return "", nil
 }
 
+type algorandTxParams struct {
+	GenesisId   string `json:"genesis-id"`
+	GenesisHash string `json:"genesis-hash"`
+}
+
+func (self AlgorandChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var params algorandTxParams
+	err := ep.GetJson(context, "/v2/transactions/params", nil, &params)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{
+		ChainId:     params.GenesisId,
+		GenesisHash: params.GenesisHash,
+	}, nil
+}
+
+func (self AlgorandChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "mainnet-v1.0",
+		"testnet": "testnet-v1.0",
+	}, chain)
+}
+
 func (self AlgorandChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -37,6 +37,26 @@ func (api AptosAPI) GetClientVersion(context context.Context, ep *nodemuxcore.En
 	return "", nil
 }
 
+type aptosLedgerInfo struct {
+	ChainId int `json:"chain_id"`
+}
+
+func (api AptosAPI) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info aptosLedgerInfo
+	err := ep.GetJson(context, "", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: strconv.Itoa(info.ChainId)}, nil
+}
+
+func (api AptosAPI) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "1",
+		"testnet": "2",
+	}, chain)
+}
+
 func (api AptosAPI) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -5,22 +5,26 @@ package chains
 import (
 	"context"
 	"fmt"
+	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
+	"sync"
 	"time"
 )
 
 type bitcoinBlockchainInfo struct {
+	Chain         string `json:"chain"`
 	Blocks        int    `json:"blocks"`
 	BestBlockhash string `json:"bestblockhash"`
+	Pruned        bool   `json:"pruned"`
 }
 
-// type bitcoinBlock struct {
-// 	Hash   string
-// 	Height int
-// 	Tx     []string
-// }
+type bitcoinBlock struct {
+	Hash   string
+	Height int
+	Tx     []string
+}
 
 // see bitcoin-cli getnetworkinfo
 type bitcoinNetworkInfo struct {
@@ -30,11 +34,23 @@ type bitcoinNetworkInfo struct {
 }
 
 type BitcoinChain struct {
+	// wallets discovered by listwallets, indexed by endpoint names
+	walletsLock sync.RWMutex
+	wallets     map[string][]string
 }
 
 var (
+	// network names of ChainRef mapped to the chain field of
+	// getblockchaininfo
+	bitcoinNetworks map[string]string = map[string]string{
+		"mainnet":  "main",
+		"testnet":  "test",
+		"testnet4": "testnet4",
+		"signet":   "signet",
+		"regtest":  "regtest",
+	}
+
 	bitcoinCachableMethods map[string]time.Duration = map[string]time.Duration{
-		"gettransaction":       time.Second * 300,
 		"getrawtransaction":    time.Second * 600,
 		"decoderawtransaction": time.Second * 600,
 		"getchaintips":         time.Second * 3,
@@ -45,13 +61,23 @@ var (
 		"getblockhash":         time.Second * 10,
 		"getblockcount":        time.Second * 5,
 	}
+
+	// read methods which can be verified
+	bitcoinVerifiableMethods map[string]bool = map[string]bool{
+		"getblockcount":     true,
+		"getblockhash":      true,
+		"getblock":          true,
+		"getblockheader":    true,
+		"getrawtransaction": true,
+		"gettxout":          true,
+	}
 )
 
 func NewBitcoinChain() *BitcoinChain {
 	return &BitcoinChain{}
 }
 
-func (c BitcoinChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+func (c *BitcoinChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
 	reqmsg := jsoff.NewRequestMessage(1, "getnetworkinfo", nil)
 	var info bitcoinNetworkInfo
 	err := ep.UnwrapCallRPC(ctx, reqmsg, &info)
@@ -62,54 +88,107 @@ func (c BitcoinChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endp
 	return v, nil
 }
 
-func (c BitcoinChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
-	return true, nil
+func (c *BitcoinChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var chainInfo bitcoinBlockchainInfo
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getblockchaininfo", nil), &chainInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "getblockchaininfo")
+	}
+
+	var genesisHash string
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getblockhash", []any{0}), &genesisHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "getblockhash")
+	}
+	return &nodemuxcore.NetworkIdentity{
+		ChainId:     chainInfo.Chain,
+		GenesisHash: genesisHash,
+	}, nil
+}
+
+func (c *BitcoinChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if network, ok := bitcoinNetworks[chain.Network]; ok {
+		return &nodemuxcore.NetworkIdentity{ChainId: network}, true
+	}
+	return nil, false
+}
+
+func (c *BitcoinChain) ProbeCapabilities(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.Capabilities, error) {
+	caps := nodemuxcore.NewCapabilities()
+
+	var chainInfo bitcoinBlockchainInfo
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getblockchaininfo", nil), &chainInfo)
+	if err != nil {
+		return nil, errors.Wrap(err, "getblockchaininfo")
+	}
+	caps.Set("archive", !chainInfo.Pruned)
+
+	// getindexinfo is available since bitcoin core 0.21
+	var indexInfo map[string]any
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getindexinfo", nil), &indexInfo)
+	if err == nil {
+		_, hasTxindex := indexInfo["txindex"]
+		caps.Set("txindex", hasTxindex)
+	}
+
+	c.discoverWallets(ctx, ep)
+	return caps, nil
+}
+
+func (c *BitcoinChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	if !bitcoinHasZMQ(ep) {
+		return true, nil
+	}
+
+	// subscribe block heads and mempool txs from zmq
+	go c.subscribeZMQ(context, m, ep)
+	return false, nil
 }
 
 // update txid cache from mempool
-// func (c BitcoinChain) updateMempoolPresenceCache(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
-// 	redisClient, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain))
-// 	if !ok {
-// 		return
-// 	}
-// 	reqmsg := jsoff.NewRequestMessage(
-// 		1, "getrawmempool", nil)
-
-// 	var txids []string
-// 	err := ep.UnwrapCallRPC(ctx, reqmsg, &txids)
-// 	if err != nil {
-// 		ep.Log().Warnf("getrawmempool error, %s", err)
-// 		return
-// 	}
-// 	presenceCacheUpdate(
-// 		ctx, redisClient,
-// 		ep.Chain,
-// 		txids,
-// 		ep.Name,
-// 		time.Second*600) // expire after 10 mins
-// }
-
-// func (c BitcoinChain) updateBlockPresenceCache(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint, blockHash string) {
-// 	client, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain))
-// 	if !ok {
-// 		return
-// 	}
-// 	reqmsg := jsoff.NewRequestMessage(
-// 		1, "getblock", []interface{}{blockHash})
-
-// 	var blk bitcoinBlock
-// 	err := ep.UnwrapCallRPC(ctx, reqmsg, &blk)
-// 	if err != nil {
-// 		ep.Log().Warnf("get block error, blockhash %s, %s", blockHash, err)
-// 		return
-// 	}
-// 	presenceCacheUpdate(
-// 		ctx, client,
-// 		ep.Chain,
-// 		blk.Tx,
-// 		ep.Name,
-// 		time.Second*1800) // expire after 30 mins
-// }
+func (c *BitcoinChain) updateMempoolPresenceCache(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
+	redisClient, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain))
+	if !ok {
+		return
+	}
+	reqmsg := jsoff.NewRequestMessage(
+		1, "getrawmempool", nil)
+
+	var txids []string
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &txids)
+	if err != nil {
+		ep.Log().Warnf("getrawmempool error, %s", err)
+		return
+	}
+	presenceCacheUpdate(
+		ctx, redisClient,
+		ep.Chain,
+		txids,
+		ep.Name,
+		time.Second*600) // expire after 10 mins
+}
+
+func (c *BitcoinChain) updateBlockPresenceCache(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint, blockHash string) {
+	client, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain))
+	if !ok {
+		return
+	}
+	reqmsg := jsoff.NewRequestMessage(
+		1, "getblock", []interface{}{blockHash})
+
+	var blk bitcoinBlock
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &blk)
+	if err != nil {
+		ep.Log().Warnf("get block error, blockhash %s, %s", blockHash, err)
+		return
+	}
+	presenceCacheUpdate(
+		ctx, client,
+		ep.Chain,
+		blk.Tx,
+		ep.Name,
+		time.Second*1800) // expire after 30 mins
+}
 
 func (c *BitcoinChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
 	reqmsg := jsoff.NewRequestMessage(
@@ -125,10 +204,90 @@ func (c *BitcoinChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiple
 		Height: chainInfo.Blocks,
 		Hash:   chainInfo.BestBlockhash,
 	}
+
+	// zmq subscribers update the block txids on hashblock
+	if !bitcoinHasZMQ(ep) && ep.Blockhead != nil && ep.Blockhead.Hash != block.Hash {
+		go c.updateBlockPresenceCache(ctx, m, ep, block.Hash)
+	}
 	return block, nil
 }
 
+// the height is derived from the confirmations of the tx
+// confirmed txs are found by getrawtransaction only with txindex
+func (c *BitcoinChain) TxStatusCapability() string {
+	return "txindex"
+}
+
+func (c *BitcoinChain) GetTxHeight(ctx context.Context, ep *nodemuxcore.Endpoint, txid string) (int, error) {
+	if !ep.ProbedCapability("txindex") {
+		return c.getTxHeightByUTXO(ctx, ep, txid)
+	}
+	reqmsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "getrawtransaction", []any{txid, true})
+
+	var tx struct {
+		Confirmations int `json:"confirmations"`
+	}
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &tx)
+	if err != nil {
+		return 0, err
+	}
+	return c.confirmedHeight(ep, tx.Confirmations), nil
+}
+
+func (c *BitcoinChain) confirmedHeight(ep *nodemuxcore.Endpoint, confirmations int) int {
+	if confirmations <= 0 || ep.Blockhead == nil {
+		return 0
+	}
+	return ep.Blockhead.Height - confirmations + 1
+}
+
+// find the tx by its first output in the utxo set and the mempool,
+// the status is unknown if it's in neither, e.g. the output is spent
+func (c *BitcoinChain) getTxHeightByUTXO(ctx context.Context, ep *nodemuxcore.Endpoint, txid string) (int, error) {
+	var txout *struct {
+		Confirmations int `json:"confirmations"`
+	}
+	reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), "gettxout", []any{txid, 0, true})
+	if err := ep.UnwrapCallRPC(ctx, reqmsg, &txout); err != nil {
+		return 0, err
+	}
+	if txout != nil {
+		return c.confirmedHeight(ep, txout.Confirmations), nil
+	}
+
+	var entry map[string]any
+	reqmsg = jsoff.NewRequestMessage(jsoff.NewUuid(), "getmempoolentry", []any{txid})
+	if err := ep.UnwrapCallRPC(ctx, reqmsg, &entry); err != nil {
+		var rpcErr *jsoff.RPCError
+		if errors.As(err, &rpcErr) {
+			// not in mempool
+			return 0, nodemuxcore.ErrTxStatusUnknown
+		}
+		return 0, err
+	}
+	return 0, nil
+}
+
+var bitcoinTxSubmitMethods = map[string]nodemuxcore.TxSubmitMethod{
+	"sendrawtransaction": {
+		Classify: classifyTxByMessage(
+			[]string{"already in block chain", "already in utxo set", "txn-already-in-mempool", "txn-already-known"},
+			[]string{"loading block index", "verifying blocks", "rescanning"}),
+		TxId: txIdFromResult,
+	},
+}
+
 func (c *BitcoinChain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if submit, ok := bitcoinTxSubmitMethods[reqmsg.Method]; ok {
+		return broadcastTxRPC(ctx, m, chain, reqmsg, submit)
+	}
+
+	// wallet methods are neither cached nor balanced
+	if isBitcoinWalletMethod(reqmsg.Method) {
+		return c.delegateWalletRPC(ctx, m, chain, reqmsg, r)
+	}
+
 	//useCache := reqmsg.Method == "gettransaction" || reqmsg.Method == "getrawtransaction" || reqmsg.Method == "decoderawtransaction"
 	useCache := false
 	cacheExpire := time.Second * 60
@@ -143,7 +302,6 @@ func (c *BitcoinChain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplex
 
 	if ep, ok := presenceCacheMatchRequest(
 		ctx, m, chain, reqmsg,
-		"gettransaction",
 		"getrawtransaction"); ok {
 		retmsg, err := ep.CallRPC(ctx, reqmsg)
 		if err == nil && useCache && retmsg.IsResult() {
@@ -179,3 +337,18 @@ func (c *BitcoinChain) findBlockHeight(reqmsg *jsoff.RequestMessage) (int, bool)
 	}
 	return 0, false
 }
+
+func (c *BitcoinChain) Verifiable(method string) bool {
+	return bitcoinVerifiableMethods[method]
+}
+
+// Only getblockhash of a given height is pinned, other requests are
+// verified against endpoints at the same tip height
+func (c *BitcoinChain) PinHeight(reqmsg *jsoff.RequestMessage, height int) (*jsoff.RequestMessage, bool) {
+	if reqmsg.Method == "getblockhash" {
+		if _, ok := c.findBlockHeight(reqmsg); ok {
+			return reqmsg, true
+		}
+	}
+	return reqmsg, false
+}
@@ -0,0 +1,195 @@
+package chains
+
+// wallet methods of bitcoind are bound to the wallets loaded by the
+// node, so they are pinned to the endpoints owning the wallets
+// instead of being balanced or cached across endpoints, see
+// https://developer.bitcoin.org/reference/rpc/#wallet-rpcs
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+)
+
+var (
+	ErrWalletMethodDenied = &jsoff.RPCError{Code: -32061, Message: "wallet methods are denied"}
+
+	// the same code and message of bitcoind
+	ErrWalletNotFound = &jsoff.RPCError{Code: -18, Message: "Requested wallet does not exist or is not loaded"}
+
+	bitcoinWalletPathRegex = regexp.MustCompile(`/wallet/([^/]+)/?$`)
+
+	bitcoinWalletMethods = map[string]bool{
+		"abandontransaction":           true,
+		"abortrescan":                  true,
+		"addmultisigaddress":           true,
+		"backupwallet":                 true,
+		"bumpfee":                      true,
+		"createwallet":                 true,
+		"dumpprivkey":                  true,
+		"dumpwallet":                   true,
+		"encryptwallet":                true,
+		"getaddressesbylabel":          true,
+		"getaddressinfo":               true,
+		"getbalance":                   true,
+		"getbalances":                  true,
+		"getnewaddress":                true,
+		"getrawchangeaddress":          true,
+		"getreceivedbyaddress":         true,
+		"getreceivedbylabel":           true,
+		"gettransaction":               true,
+		"getunconfirmedbalance":        true,
+		"getwalletinfo":                true,
+		"importaddress":                true,
+		"importdescriptors":            true,
+		"importmulti":                  true,
+		"importprivkey":                true,
+		"importprunedfunds":            true,
+		"importpubkey":                 true,
+		"importwallet":                 true,
+		"keypoolrefill":                true,
+		"listaddressgroupings":         true,
+		"listdescriptors":              true,
+		"listlabels":                   true,
+		"listlockunspent":              true,
+		"listreceivedbyaddress":        true,
+		"listreceivedbylabel":          true,
+		"listsinceblock":               true,
+		"listtransactions":             true,
+		"listunspent":                  true,
+		"listwalletdir":                true,
+		"listwallets":                  true,
+		"loadwallet":                   true,
+		"lockunspent":                  true,
+		"psbtbumpfee":                  true,
+		"removeprunedfunds":            true,
+		"rescanblockchain":             true,
+		"restorewallet":                true,
+		"send":                         true,
+		"sendall":                      true,
+		"sendmany":                     true,
+		"sendtoaddress":                true,
+		"sethdseed":                    true,
+		"setlabel":                     true,
+		"settxfee":                     true,
+		"signmessage":                  true,
+		"signrawtransactionwithwallet": true,
+		"simulaterawtransaction":       true,
+		"unloadwallet":                 true,
+		"upgradewallet":                true,
+		"walletcreatefundedpsbt":       true,
+		"walletdisplayaddress":         true,
+		"walletlock":                   true,
+		"walletpassphrase":             true,
+		"walletpassphrasechange":       true,
+		"walletprocesspsbt":            true,
+	}
+)
+
+func isBitcoinWalletMethod(method string) bool {
+	return bitcoinWalletMethods[method]
+}
+
+// the wallet name of a /wallet/<name> request path
+func bitcoinWalletFromPath(r *http.Request) (string, bool) {
+	if r == nil || r.URL == nil {
+		return "", false
+	}
+	if matches := bitcoinWalletPathRegex.FindStringSubmatch(r.URL.Path); matches != nil {
+		return matches[1], true
+	}
+	return "", false
+}
+
+// the wallets configured by the endpoint option wallets take
+// precedence over the wallets discovered by listwallets
+func (c *BitcoinChain) endpointWallets(ep *nodemuxcore.Endpoint) []string {
+	if wallets, ok := ep.Config.StringsOption("wallets"); ok {
+		return wallets
+	}
+	c.walletsLock.RLock()
+	defer c.walletsLock.RUnlock()
+	return c.wallets[ep.Name]
+}
+
+func (c *BitcoinChain) setEndpointWallets(ep *nodemuxcore.Endpoint, wallets []string) {
+	c.walletsLock.Lock()
+	defer c.walletsLock.Unlock()
+	if c.wallets == nil {
+		c.wallets = make(map[string][]string)
+	}
+	c.wallets[ep.Name] = wallets
+}
+
+func (c *BitcoinChain) discoverWallets(ctx context.Context, ep *nodemuxcore.Endpoint) {
+	if _, ok := ep.Config.StringsOption("wallets"); ok {
+		return
+	}
+	var wallets []string
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "listwallets", nil), &wallets)
+	if err != nil {
+		// the wallet may be disabled by -disablewallet
+		ep.Log().Debugf("listwallets error, %s", err)
+		wallets = nil
+	}
+	c.setEndpointWallets(ep, wallets)
+}
+
+// Select the endpoint owning the wallet, an empty wallet name selects
+// the endpoint owning any wallet. the endpoint of the least name is
+// selected so that calls of a wallet stick to the same node
+func (c *BitcoinChain) selectWalletEndpoint(m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, method string, wallet string) (*nodemuxcore.Endpoint, bool) {
+	owners := make([]*nodemuxcore.Endpoint, 0)
+	for _, ep := range m.AllHealthyEndpoints(chain, method, 0) {
+		for _, w := range c.endpointWallets(ep) {
+			if wallet == "" || w == wallet {
+				owners = append(owners, ep)
+				break
+			}
+		}
+	}
+	if len(owners) == 0 {
+		return nil, false
+	}
+	sort.Slice(owners, func(i, j int) bool {
+		return owners[i].Name < owners[j].Name
+	})
+	return owners[0], true
+}
+
+// Deny the wallet methods of accounts denying them
+func (c *BitcoinChain) DenyRPC(ctx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, bool) {
+	if !isBitcoinWalletMethod(reqmsg.Method) {
+		return nil, false
+	}
+	if info := nodemuxcore.RequestInfoFromContext(ctx); info != nil && info.DenyWalletMethods {
+		return ErrWalletMethodDenied.ToMessage(reqmsg), true
+	}
+	return nil, false
+}
+
+func (c *BitcoinChain) delegateWalletRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if resmsg, denied := c.DenyRPC(ctx, reqmsg); denied {
+		return resmsg, nil
+	}
+
+	wallet, hasWallet := bitcoinWalletFromPath(r)
+	ep, ok := c.selectWalletEndpoint(m, chain, reqmsg.Method, wallet)
+	if !ok {
+		if hasWallet {
+			return ErrWalletNotFound.ToMessage(reqmsg), nil
+		}
+		// no wallets are known, the method such as createwallet
+		// or loadwallet goes to any endpoint
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -1)
+	}
+	if hasWallet {
+		return ep.CallRPCAt(ctx, "/wallet/"+url.PathEscape(wallet), reqmsg)
+	}
+	return ep.CallRPC(ctx, reqmsg)
+}
@@ -0,0 +1,213 @@
+package chains
+
+// Bitcoin endpoints with a tcp:// streaming url receive block heads
+// and mempool txs from bitcoind's zmq notifications, e.g.
+// bitcoind -zmqpubhashblock=tcp://0.0.0.0:28332 -zmqpubrawtx=tcp://0.0.0.0:28332
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"github.com/pkg/errors"
+	"github.com/superisaac/nodemux/core"
+	"io"
+	"strings"
+	"time"
+)
+
+func bitcoinHasZMQ(ep *nodemuxcore.Endpoint) bool {
+	return strings.HasPrefix(ep.Config.StreamingUrl, "tcp://")
+}
+
+func readVarInt(r *bytes.Reader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	switch b {
+	case 0xfd:
+		var v uint16
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return uint64(v), err
+	case 0xfe:
+		var v uint32
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return uint64(v), err
+	case 0xff:
+		var v uint64
+		err = binary.Read(r, binary.LittleEndian, &v)
+		return v, err
+	default:
+		return uint64(b), nil
+	}
+}
+
+// skip a var int prefixed byte string, returns the bytes skipped
+func skipVarBytes(r *bytes.Reader) error {
+	n, err := readVarInt(r)
+	if err != nil {
+		return err
+	}
+	if n > uint64(r.Len()) {
+		return io.ErrUnexpectedEOF
+	}
+	_, err = r.Seek(int64(n), io.SeekCurrent)
+	return err
+}
+
+// The txid of a serialized tx, which is the reversed double sha256
+// of the tx serialized without witness data
+func bitcoinTxid(raw []byte) (string, error) {
+	r := bytes.NewReader(raw)
+	if _, err := r.Seek(4, io.SeekStart); err != nil || r.Len() < 2 {
+		return "", errors.New("tx too short")
+	}
+
+	// segwit txs have the marker 0x00 and the flag 0x01 after version
+	segwit := raw[4] == 0x00 && raw[5] == 0x01
+	if segwit {
+		r.Seek(2, io.SeekCurrent)
+	}
+	bodyStart := int(r.Size()) - r.Len()
+
+	nIn, err := readVarInt(r)
+	if err != nil {
+		return "", errors.Wrap(err, "read inputs")
+	}
+	for i := uint64(0); i < nIn; i++ {
+		// outpoint
+		if _, err := r.Seek(36, io.SeekCurrent); err != nil {
+			return "", err
+		}
+		if err := skipVarBytes(r); err != nil {
+			return "", errors.Wrap(err, "read script sig")
+		}
+		// sequence
+		if _, err := r.Seek(4, io.SeekCurrent); err != nil {
+			return "", err
+		}
+	}
+	nOut, err := readVarInt(r)
+	if err != nil {
+		return "", errors.Wrap(err, "read outputs")
+	}
+	for i := uint64(0); i < nOut; i++ {
+		// value
+		if _, err := r.Seek(8, io.SeekCurrent); err != nil {
+			return "", err
+		}
+		if err := skipVarBytes(r); err != nil {
+			return "", errors.Wrap(err, "read script pubkey")
+		}
+	}
+	bodyEnd := int(r.Size()) - r.Len()
+
+	if len(raw) < bodyEnd+4 {
+		return "", errors.New("tx too short")
+	}
+	stripped := make([]byte, 0, bodyEnd-bodyStart+8)
+	stripped = append(stripped, raw[:4]...)
+	stripped = append(stripped, raw[bodyStart:bodyEnd]...)
+	stripped = append(stripped, raw[len(raw)-4:]...)
+
+	first := sha256.Sum256(stripped)
+	hash := sha256.Sum256(first[:])
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func (c *BitcoinChain) subscribeZMQ(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
+	for {
+		err := c.connectAndSubZMQ(rootCtx, m, ep)
+		if rootCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ep.Log().Warnf("zmq sub error %s, retrying", err)
+			bs := nodemuxcore.ChainStatus{
+				EndpointName: ep.Name,
+				Chain:        ep.Chain,
+				Healthy:      false,
+			}
+			m.Chainhub().Pub() <- bs
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (c *BitcoinChain) connectAndSubZMQ(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) error {
+	sub, err := dialZMQSubscriber(rootCtx, ep.Config.StreamingUrl, "hashblock", "rawtx")
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	// unblock Recv on cancel, the goroutine ends along with the
+	// connection
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-rootCtx.Done():
+			sub.Close()
+		case <-done:
+		}
+	}()
+
+	// request the chaintip and the mempool
+	if err := c.publishBlockhead(rootCtx, m, ep); err != nil {
+		return err
+	}
+	go c.updateMempoolPresenceCache(rootCtx, m, ep)
+
+	for {
+		parts, err := sub.Recv()
+		if err != nil {
+			return err
+		}
+		if len(parts) < 2 {
+			continue
+		}
+		switch string(parts[0]) {
+		case "hashblock":
+			blockHash := hex.EncodeToString(parts[1])
+			if err := c.publishBlockhead(rootCtx, m, ep); err != nil {
+				return err
+			}
+			go c.updateBlockPresenceCache(rootCtx, m, ep, blockHash)
+		case "rawtx":
+			txid, err := bitcoinTxid(parts[1])
+			if err != nil {
+				ep.Log().Warnf("decode raw tx error %s", err)
+				continue
+			}
+			if redisClient, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain)); ok {
+				presenceCacheUpdate(
+					rootCtx, redisClient,
+					ep.Chain,
+					[]string{txid},
+					ep.Name,
+					time.Second*600) // expire after 10 mins
+			}
+		}
+	}
+}
+
+func (c *BitcoinChain) publishBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) error {
+	headBlock, err := c.GetBlockhead(ctx, m, ep)
+	if err != nil {
+		return err
+	}
+	bs := nodemuxcore.ChainStatus{
+		EndpointName: ep.Name,
+		Chain:        ep.Chain,
+		Healthy:      true,
+		Blockhead:    headBlock,
+	}
+	m.Chainhub().Pub() <- bs
+	return nil
+}
@@ -0,0 +1,142 @@
+package chains
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+	"net/http"
+	"strings"
+)
+
+// broadcast the tx submission by the chain's policy and remember
+// the endpoints accepting the tx in the presence cache
+func broadcastTxRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, submit nodemuxcore.TxSubmitMethod) (jsoff.Message, error) {
+	resmsg, bc, err := m.BroadcastTxRPC(ctx, chain, reqmsg, submit)
+	if bc != nil {
+		presenceCacheAddTx(ctx, m, chain, bc)
+	}
+	return resmsg, err
+}
+
+func broadcastTxREST(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, path string, w http.ResponseWriter, r *http.Request, submit nodemuxcore.TxSubmitPath) error {
+	res, bc, err := m.BroadcastTxREST(ctx, chain, path, r, submit)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("not found"))
+		return nil
+	}
+	presenceCacheAddTx(ctx, m, chain, bc)
+	if res.Err != nil {
+		return res.Err
+	}
+	res.Write(w)
+	return nil
+}
+
+// the txid is the result string
+func txIdFromResult(resmsg jsoff.Message) string {
+	if res, ok := resmsg.(*jsoff.ResultMessage); ok {
+		if txid, ok := res.Result.(string); ok {
+			return txid
+		}
+	}
+	return ""
+}
+
+// the txid is a field of the result object
+func txIdFromResultField(path ...string) func(resmsg jsoff.Message) string {
+	return func(resmsg jsoff.Message) string {
+		if res, ok := resmsg.(*jsoff.ResultMessage); ok {
+			if txid, ok := resolveMap(res.Result, path...); ok {
+				if s, ok := txid.(string); ok {
+					return s
+				}
+			}
+		}
+		return ""
+	}
+}
+
+// classify a submit response by the error message, results are
+// successes, error messages containing one of alreadyKnown or
+// retryable keywords are classified so, other errors are fatal
+func classifyTxByMessage(alreadyKnown []string, retryable []string) func(resmsg jsoff.Message) nodemuxcore.TxOutcome {
+	return func(resmsg jsoff.Message) nodemuxcore.TxOutcome {
+		if resmsg.IsResult() {
+			return nodemuxcore.TxSuccess
+		}
+		if !resmsg.IsError() {
+			return nodemuxcore.TxFatal
+		}
+		rpcErr := resmsg.MustError()
+		text := strings.ToLower(rpcErr.Message)
+		if rpcErr.Data != nil {
+			if data, err := json.Marshal(rpcErr.Data); err == nil {
+				text += " " + strings.ToLower(string(data))
+			}
+		}
+		if containsAny(text, alreadyKnown) {
+			return nodemuxcore.TxAlreadyKnown
+		} else if containsAny(text, retryable) {
+			return nodemuxcore.TxRetryable
+		}
+		return nodemuxcore.TxFatal
+	}
+}
+
+func containsAny(text string, keywords []string) bool {
+	for _, kw := range keywords {
+		if strings.Contains(text, kw) {
+			return true
+		}
+	}
+	return false
+}
+
+// classify a REST submit response by the http status, 5xx responses
+// are retryable and other 4xx responses are fatal
+func classifyHTTPStatus(res *nodemuxcore.HTTPResult) (nodemuxcore.TxOutcome, bool) {
+	if res.StatusCode >= 500 {
+		return nodemuxcore.TxRetryable, true
+	} else if res.StatusCode >= 400 {
+		return nodemuxcore.TxFatal, true
+	}
+	return nodemuxcore.TxSuccess, false
+}
+
+// classify a REST submit response by keywords of the error body, the
+// http status decides when no keyword matches
+func classifyHTTPByBody(alreadyKnown []string, retryable []string) func(res *nodemuxcore.HTTPResult) nodemuxcore.TxOutcome {
+	return func(res *nodemuxcore.HTTPResult) nodemuxcore.TxOutcome {
+		outcome, failed := classifyHTTPStatus(res)
+		if !failed {
+			return outcome
+		}
+		text := strings.ToLower(string(res.Body))
+		if containsAny(text, alreadyKnown) {
+			return nodemuxcore.TxAlreadyKnown
+		} else if containsAny(text, retryable) {
+			return nodemuxcore.TxRetryable
+		}
+		return outcome
+	}
+}
+
+// the txid is a field of the JSON response body
+func txIdFromBodyField(path ...string) func(res *nodemuxcore.HTTPResult) string {
+	return func(res *nodemuxcore.HTTPResult) string {
+		var body any
+		if err := json.Unmarshal(res.Body, &body); err != nil {
+			return ""
+		}
+		if txid, ok := resolveMap(body, path...); ok && txid != nil {
+			return fmt.Sprintf("%v", txid)
+		}
+		return ""
+	}
+}
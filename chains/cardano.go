@@ -4,6 +4,7 @@ import (
 	"context"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
+	"strconv"
 )
 
 type cardanoBlock struct {
@@ -26,6 +27,29 @@ func (c CardanoChain) GetClientVersion(context context.Context, ep *nodemuxcore.
 	return "", nil
 }
 
+type cardanoGenesisResult struct {
+	Genesis struct {
+		Shelley struct {
+			NetworkMagic int
+		}
+	}
+}
+
+func (c CardanoChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var res cardanoGenesisResult
+	err := ep.RequestGraphQL(context, "{genesis{shelley{networkMagic}}}", nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: strconv.Itoa(res.Genesis.Shelley.NetworkMagic)}, nil
+}
+
+func (c CardanoChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "764824073",
+	}, chain)
+}
+
 func (c CardanoChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
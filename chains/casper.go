@@ -27,6 +27,26 @@ func (c CasperChain) GetClientVersion(context context.Context, ep *nodemuxcore.E
 	return "", nil
 }
 
+type casperStatus struct {
+	ChainspecName string `json:"chainspec_name"`
+}
+
+func (c CasperChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var status casperStatus
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "info_get_status", nil), &status)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: status.ChainspecName}, nil
+}
+
+func (c CasperChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "casper",
+		"testnet": "casper-test",
+	}, chain)
+}
+
 func (c CasperChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -1,12 +1,27 @@
 package chains
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
 	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strconv"
 	"testing"
 )
 
@@ -59,3 +74,711 @@ func TestMapTronBlock(t *testing.T) {
 	assert.Equal("def", v.BlockHeader.RawData.ParentHash)
 	assert.Equal(123, v.BlockHeader.RawData.Number)
 }
+
+func TestSplitLogsRange(t *testing.T) {
+	assert := assert.New(t)
+	c := NewWeb3Chain()
+
+	chunks := c.splitLogsRange(100, 350, 100)
+	assert.Equal([]web3LogsChunk{
+		{From: 100, To: 199},
+		{From: 200, To: 299},
+		{From: 300, To: 350},
+	}, chunks)
+
+	height, err := c.resolveLogsBlockTag("0x10", 500)
+	assert.Nil(err)
+	assert.Equal(16, height)
+
+	height, err = c.resolveLogsBlockTag("latest", 500)
+	assert.Nil(err)
+	assert.Equal(500, height)
+}
+
+func TestMergeLogs(t *testing.T) {
+	assert := assert.New(t)
+
+	logs := []map[string]any{
+		{"blockHash": "0xb2", "blockNumber": "0x2", "logIndex": "0x0", "transactionHash": "0xt2"},
+		{"blockHash": "0xb1", "blockNumber": "0x1", "logIndex": "0x1", "transactionHash": "0xt1"},
+		{"blockHash": "0xb1", "blockNumber": "0x1", "logIndex": "0x0", "transactionHash": "0xt1"},
+		{"blockHash": "0xb2", "blockNumber": "0x2", "logIndex": "0x0", "transactionHash": "0xt2"},
+	}
+	merged := mergeLogs(logs)
+	assert.Equal(3, len(merged))
+	assert.Equal("0x0", merged[0]["logIndex"])
+	assert.Equal("0x1", merged[1]["logIndex"])
+	assert.Equal("0xb2", merged[2]["blockHash"])
+}
+
+func TestParseCosmosLatestBlock(t *testing.T) {
+	assert := assert.New(t)
+
+	// Header{chain_id: "cosmoshub-4", height: 12345}
+	var header []byte
+	header = protowire.AppendTag(header, 2, protowire.BytesType)
+	header = protowire.AppendString(header, "cosmoshub-4")
+	header = protowire.AppendTag(header, 3, protowire.VarintType)
+	header = protowire.AppendVarint(header, 12345)
+
+	var block []byte
+	block = protowire.AppendTag(block, 1, protowire.BytesType)
+	block = protowire.AppendBytes(block, header)
+
+	var blockId []byte
+	blockId = protowire.AppendTag(blockId, 1, protowire.BytesType)
+	blockId = protowire.AppendBytes(blockId, []byte{0xab, 0xcd})
+
+	// GetLatestBlockResponse{block_id, sdk_block}
+	var res []byte
+	res = protowire.AppendTag(res, 1, protowire.BytesType)
+	res = protowire.AppendBytes(res, blockId)
+	res = protowire.AppendTag(res, 3, protowire.BytesType)
+	res = protowire.AppendBytes(res, block)
+
+	blk, err := parseCosmosLatestBlock(res)
+	assert.Nil(err)
+	assert.Equal(12345, blk.Height)
+	assert.Equal("q80=", blk.Hash)
+
+	_, err = parseCosmosLatestBlock(blockId)
+	assert.NotNil(err)
+}
+
+func TestCosmosKnownIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	hub := nodemuxcore.ChainRef{Namespace: "cosmos", Network: "mainnet"}
+	ident, ok := NewCosmosGRPCChain().KnownNetworkIdentity(hub)
+	assert.True(ok)
+	assert.Equal("cosmoshub-4", ident.ChainId)
+	ident, ok = NewCometBFTChain().KnownNetworkIdentity(hub)
+	assert.True(ok)
+	assert.Equal("cosmoshub-4", ident.ChainId)
+
+	// aliases are not the cosmos hub
+	osmosis := nodemuxcore.ChainRef{Namespace: "osmosis", Network: "mainnet"}
+	_, ok = NewCosmosGRPCChain().KnownNetworkIdentity(osmosis)
+	assert.False(ok)
+	_, ok = NewCometBFTChain().KnownNetworkIdentity(osmosis)
+	assert.False(ok)
+
+	// the gRPC and CometBFT apis are served along with REST, which
+	// stays the primary api
+	factory := nodemuxcore.GetDelegatorFactory()
+	InstallAdaptors(factory)
+	assert.Equal([]int{nodemuxcore.ApiREST, nodemuxcore.ApiGRPC, nodemuxcore.ApiJSONRPC}, factory.SupportedApis("cosmos"))
+	comet := nodemuxcore.NewEndpoint("comet01", nodemuxcore.EndpointConfig{
+		Chain: "cosmos/mainnet",
+		Url:   "http://127.0.0.1:1317",
+		Urls:  map[string]string{"jsonrpc": "http://127.0.0.1:26657"},
+	})
+	_, ok = factory.GetEndpointDelegator(comet).(*CosmosChain)
+	assert.True(ok)
+}
+
+func TestKnownIdentityRejected(t *testing.T) {
+	assert := assert.New(t)
+
+	InstallAdaptors(nodemuxcore.GetDelegatorFactory())
+	cfg := nodemuxcore.NewConfig()
+	err := cfg.LoadYamldata([]byte(`
+endpoints:
+  btc01:
+    chain: bitcoin/mainnet
+    url: http://127.0.0.1:8332
+  btc02:
+    chain: bitcoin/custom
+    url: http://127.0.0.1:18332
+`))
+	assert.Nil(err)
+	m := nodemuxcore.NewMultiplexer()
+	m.LoadFromConfig(cfg)
+
+	// endpoints of well known networks are refused until verified
+	summary, ok := m.ChainSummary(nodemuxcore.ChainRef{Namespace: "bitcoin", Network: "mainnet"})
+	assert.True(ok)
+	assert.Equal("network identity not verified", summary.Endpoints[0].Rejected)
+	summary, ok = m.ChainSummary(nodemuxcore.ChainRef{Namespace: "bitcoin", Network: "custom"})
+	assert.True(ok)
+	assert.Equal("", summary.Endpoints[0].Rejected)
+}
+
+func TestSolanaSelectBySlot(t *testing.T) {
+	assert := assert.New(t)
+
+	m := nodemuxcore.NewMultiplexer()
+	chain := nodemuxcore.ChainRef{Namespace: "solana", Network: "mainnet"}
+	for _, name := range []string{"sol01", "sol02"} {
+		ep := nodemuxcore.NewEndpoint(name, nodemuxcore.EndpointConfig{
+			Chain: "solana/mainnet",
+			Url:   "http://127.0.0.1:8899/" + name,
+		})
+		ep.Healthy = true
+		m.Add(ep)
+	}
+
+	c := NewSolanaChain()
+	c.setSlots("sol01", solanaSlots{Processed: 1000, Confirmed: 998, Finalized: 960})
+	c.setSlots("sol02", solanaSlots{Processed: 990, Confirmed: 989, Finalized: 970})
+
+	reqmsg := jsoff.NewRequestMessage(1, "getBlock", []any{965, map[string]any{"commitment": "confirmed"}})
+	assert.Equal("confirmed", solanaCommitment(reqmsg, 1))
+	assert.Equal("finalized", solanaCommitment(reqmsg, 2))
+
+	for i := 0; i < 10; i++ {
+		ep, ok := c.selectBySlot(context.Background(), m, chain, "getBlock", "finalized", 965)
+		assert.True(ok)
+		assert.Equal("sol02", ep.Name)
+
+		ep, ok = c.selectBySlot(context.Background(), m, chain, "getBlock", "confirmed", 995)
+		assert.True(ok)
+		assert.Equal("sol01", ep.Name)
+	}
+	_, ok := c.selectBySlot(context.Background(), m, chain, "getBlock", "finalized", 980)
+	assert.False(ok)
+
+	slots := c.updateSlots("sol02", solanaSlotInfo{Slot: 1001, Root: 985})
+	assert.Equal(solanaSlots{Processed: 1001, Confirmed: 989, Finalized: 985}, slots)
+}
+
+func TestClassifyTx(t *testing.T) {
+	assert := assert.New(t)
+
+	res := &nodemuxcore.HTTPResult{StatusCode: 200, Body: []byte(`{"code":"DUP_TRANSACTION_ERROR","txid":"abc"}`)}
+	assert.Equal(nodemuxcore.TxAlreadyKnown, classifyTronTx(res))
+	res = &nodemuxcore.HTTPResult{StatusCode: 200, Body: []byte(`{"result":true,"txid":"abc"}`)}
+	assert.Equal(nodemuxcore.TxSuccess, classifyTronTx(res))
+	assert.Equal("abc", txIdFromBodyField("txid")(res))
+	res = &nodemuxcore.HTTPResult{StatusCode: 503}
+	assert.Equal(nodemuxcore.TxRetryable, classifyTronTx(res))
+
+	res = &nodemuxcore.HTTPResult{StatusCode: 200, Body: []byte(`{"tx_response":{"code":19,"txhash":"FF00"}}`)}
+	assert.Equal(nodemuxcore.TxAlreadyKnown, classifyCosmosTx(res))
+	assert.Equal("FF00", txIdFromBodyField("tx_response", "txhash")(res))
+
+	assert.True(containsAny("txn-already-in-mempool", []string{"txn-already-known", "txn-already-in-mempool"}))
+	assert.False(containsAny("bad-txns-inputs-missingorspent", []string{"txn-already-known"}))
+}
+
+func TestDecodeRawTxSender(t *testing.T) {
+	assert := assert.New(t)
+
+	key, err := crypto.GenerateKey()
+	assert.Nil(err)
+	signer := types.LatestSignerForChainID(big.NewInt(1))
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		Nonce:     42,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(10),
+		Gas:       21000,
+	})
+	assert.Nil(err)
+	data, err := tx.MarshalBinary()
+	assert.Nil(err)
+
+	sender, nonce, err := decodeRawTxSender(hexutil.Encode(data))
+	assert.Nil(err)
+	assert.Equal(crypto.PubkeyToAddress(key.PublicKey).Hex(), sender)
+	assert.Equal(uint64(42), nonce)
+
+	_, _, err = decodeRawTxSender("0x1234")
+	assert.NotNil(err)
+}
+
+func TestNonceTracker(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+
+	cfg := nodemuxcore.NewConfig()
+	err := cfg.LoadYamldata([]byte(`
+stores:
+  nonce-ethereum-mainnet:
+    url: redis://127.0.0.1:6379/15
+`))
+	assert.Nil(err)
+	m := nodemuxcore.NewMultiplexer()
+	m.LoadFromConfig(cfg)
+	chain := nodemuxcore.ChainRef{Namespace: "ethereum", Network: "mainnet"}
+	c, ok := m.RedisClientExact(nonceTrackerRedisSelector(chain))
+	assert.True(ok)
+	if err := c.Ping(ctx).Err(); err != nil {
+		t.Skipf("redis not available, %s", err)
+	}
+
+	key, err := crypto.GenerateKey()
+	assert.Nil(err)
+	signer := types.LatestSignerForChainID(big.NewInt(1))
+	tx, err := types.SignNewTx(key, signer, &types.DynamicFeeTx{
+		ChainID:   big.NewInt(1),
+		Nonce:     7,
+		GasTipCap: big.NewInt(1),
+		GasFeeCap: big.NewInt(10),
+		Gas:       21000,
+	})
+	assert.Nil(err)
+	data, err := tx.MarshalBinary()
+	assert.Nil(err)
+	sender := crypto.PubkeyToAddress(key.PublicKey).Hex()
+	trackerKey := nonceTrackerKey(chain, sender)
+	defer c.Del(ctx, trackerKey)
+
+	nonceTrackerRecord(ctx, m, chain, jsoff.NewRequestMessage(1, "eth_sendRawTransaction", []any{hexutil.Encode(data)}))
+	// tracked nonces expire in case the txs are dropped
+	ttl, err := c.TTL(ctx, trackerKey).Result()
+	assert.Nil(err)
+	assert.True(ttl > 0 && ttl <= nonceTrackerExpiration)
+
+	pending := jsoff.NewRequestMessage(1, "eth_getTransactionCount", []any{sender, "pending"})
+	nonce, ok := nonceTrackerAdjust(ctx, m, chain, pending, 5)
+	assert.True(ok)
+	assert.Equal(uint64(8), nonce)
+
+	// the tracked nonce is removed once the upstream catches up
+	nonce, ok = nonceTrackerAdjust(ctx, m, chain, pending, 8)
+	assert.False(ok)
+	assert.Equal(uint64(8), nonce)
+	assert.Equal(int64(0), c.Exists(ctx, trackerKey).Val())
+
+	latest := jsoff.NewRequestMessage(1, "eth_getTransactionCount", []any{sender, "latest"})
+	_, ok = nonceTrackerAdjust(ctx, m, chain, latest, 5)
+	assert.False(ok)
+}
+
+const genesisCoinbaseTx = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+func TestBitcoinTxid(t *testing.T) {
+	assert := assert.New(t)
+
+	raw, err := hex.DecodeString(genesisCoinbaseTx)
+	assert.Nil(err)
+	txid, err := bitcoinTxid(raw)
+	assert.Nil(err)
+	assert.Equal("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b", txid)
+
+	// witness data doesn't change the txid
+	segwit := append([]byte{}, raw[:4]...)
+	segwit = append(segwit, 0x00, 0x01)
+	segwit = append(segwit, raw[4:len(raw)-4]...)
+	segwit = append(segwit, 0x01, 0x02, 0xab, 0xcd)
+	segwit = append(segwit, raw[len(raw)-4:]...)
+	txid, err = bitcoinTxid(segwit)
+	assert.Nil(err)
+	assert.Equal("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b", txid)
+
+	_, err = bitcoinTxid(raw[:20])
+	assert.NotNil(err)
+}
+
+// a fake zmq publisher standing in for bitcoind
+func fakeZMQPublisher(t *testing.T, ln net.Listener, subscribed chan []string, messages ...[][]byte) {
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	greeting := make([]byte, 64)
+	if _, err := io.ReadFull(reader, greeting); err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Write(zmqGreeting(true))
+	if _, _, err := zmqReadFrame(reader); err != nil {
+		t.Error(err)
+		return
+	}
+	zmqWriteFrame(conn, zmqFlagCommand, zmqReadyCommand("PUB"))
+
+	topics := make([]string, 0)
+	for len(topics) < 2 {
+		_, body, err := zmqReadFrame(reader)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		topics = append(topics, string(body[1:]))
+	}
+	subscribed <- topics
+
+	for _, msg := range messages {
+		for i, part := range msg {
+			flags := zmqFlagMore
+			if i == len(msg)-1 {
+				flags = 0
+			}
+			zmqWriteFrame(conn, flags, part)
+		}
+	}
+	// wait for the subscriber to close
+	io.Copy(io.Discard, reader)
+}
+
+func TestZMQSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer ln.Close()
+
+	raw, _ := hex.DecodeString(genesisCoinbaseTx)
+	blockHash := bytes.Repeat([]byte{0xab}, 32)
+	subscribed := make(chan []string, 1)
+	go fakeZMQPublisher(t, ln, subscribed,
+		[][]byte{[]byte("hashblock"), blockHash, {0, 0, 0, 0}},
+		[][]byte{[]byte("rawtx"), raw, {1, 0, 0, 0}})
+
+	sub, err := dialZMQSubscriber(context.Background(), "tcp://"+ln.Addr().String(), "hashblock", "rawtx")
+	assert.Nil(err)
+	defer sub.Close()
+	assert.Equal([]string{"hashblock", "rawtx"}, <-subscribed)
+
+	parts, err := sub.Recv()
+	assert.Nil(err)
+	assert.Equal(3, len(parts))
+	assert.Equal("hashblock", string(parts[0]))
+	assert.Equal(blockHash, parts[1])
+
+	parts, err = sub.Recv()
+	assert.Nil(err)
+	assert.Equal("rawtx", string(parts[0]))
+	assert.Equal(raw, parts[1])
+}
+
+func TestBitcoinWalletRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	// btc02 serves the wallet alice at /wallet/alice
+	var walletPath string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		walletPath = r.URL.Path
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":1.5}`))
+	}))
+	defer server.Close()
+
+	m := nodemuxcore.NewMultiplexer()
+	chain := nodemuxcore.ChainRef{Namespace: "bitcoin", Network: "mainnet"}
+	ep1 := nodemuxcore.NewEndpoint("btc01", nodemuxcore.EndpointConfig{
+		Chain:   "bitcoin/mainnet",
+		Url:     "http://127.0.0.1:8332",
+		Options: map[string]any{"wallets": []any{"bob"}},
+	})
+	ep2 := nodemuxcore.NewEndpoint("btc02", nodemuxcore.EndpointConfig{
+		Chain: "bitcoin/mainnet",
+		Url:   server.URL,
+	})
+	for _, ep := range []*nodemuxcore.Endpoint{ep1, ep2} {
+		ep.Healthy = true
+		m.Add(ep)
+	}
+
+	c := NewBitcoinChain()
+	c.setEndpointWallets(ep2, []string{"alice"})
+	assert.Equal([]string{"bob"}, c.endpointWallets(ep1))
+
+	for i := 0; i < 10; i++ {
+		ep, ok := c.selectWalletEndpoint(m, chain, "getbalance", "alice")
+		assert.True(ok)
+		assert.Equal("btc02", ep.Name)
+
+		ep, ok = c.selectWalletEndpoint(m, chain, "getbalance", "")
+		assert.True(ok)
+		assert.Equal("btc01", ep.Name)
+	}
+	_, ok := c.selectWalletEndpoint(m, chain, "getbalance", "carol")
+	assert.False(ok)
+
+	ctx := context.Background()
+	r := httptest.NewRequest("POST", "/jsonrpc/acc1/bitcoin/mainnet/wallet/alice", nil)
+	reqmsg := jsoff.NewRequestMessage(1, "getbalance", nil)
+	resmsg, err := c.DelegateRPC(ctx, m, chain, reqmsg, r)
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal("/wallet/alice", walletPath)
+
+	r = httptest.NewRequest("POST", "/jsonrpc/acc1/bitcoin/mainnet/wallet/carol", nil)
+	resmsg, err = c.DelegateRPC(ctx, m, chain, reqmsg, r)
+	assert.Nil(err)
+	assert.Equal(-18, resmsg.MustError().Code)
+
+	info := &nodemuxcore.RequestInfo{DenyWalletMethods: true}
+	resmsg, err = c.DelegateRPC(info.AddTo(ctx), m, chain, reqmsg, r)
+	assert.Nil(err)
+	assert.Equal(ErrWalletMethodDenied.Code, resmsg.MustError().Code)
+}
+
+func TestBitcoinTxHeightWithoutTxindex(t *testing.T) {
+	assert := assert.New(t)
+
+	inMempool := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Method string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case req.Method == "gettxout":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":null}`))
+		case inMempool:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"vsize":141}}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"error":{"code":-5,"message":"Transaction not in mempool"}}`))
+		}
+	}))
+	defer server.Close()
+
+	ep := nodemuxcore.NewEndpoint("btc01", nodemuxcore.EndpointConfig{
+		Chain: "bitcoin/mainnet",
+		Url:   server.URL,
+	})
+	c := NewBitcoinChain()
+	ctx := context.Background()
+
+	height, err := c.GetTxHeight(ctx, ep, "aa")
+	assert.Nil(err)
+	assert.Equal(0, height)
+
+	// neither in the utxo set nor in the mempool
+	inMempool = false
+	_, err = c.GetTxHeight(ctx, ep, "aa")
+	assert.ErrorIs(err, nodemuxcore.ErrTxStatusUnknown)
+}
+
+func TestElectrumHeaderHash(t *testing.T) {
+	assert := assert.New(t)
+
+	// the header of the genesis block
+	genesisHeader := "0100000000000000000000000000000000000000000000000000000000000000000000003ba3edfd7a7b12b27ac72c3e67768f617fc81bc3888a51323a9fb8aa4b1e5e4a29ab5f49ffff001d1dac2b7c"
+	block, err := electrumBlock(electrumHeader{Height: 0, Hex: genesisHeader})
+	assert.Nil(err)
+	assert.Equal(electrumBitcoinGenesis["mainnet"], block.Hash)
+
+	_, err = electrumHeaderHash("0011")
+	assert.NotNil(err)
+}
+
+func TestElectrumEndpoints(t *testing.T) {
+	assert := assert.New(t)
+
+	factory := nodemuxcore.GetDelegatorFactory()
+	InstallAdaptors(factory)
+
+	// electrum servers of bitcoin are told by the url scheme
+	electrs := nodemuxcore.NewEndpoint("electrs01", nodemuxcore.EndpointConfig{
+		Chain: "bitcoin/mainnet",
+		Url:   "tcp://127.0.0.1:50001",
+	})
+	assert.True(electrs.HasApi(nodemuxcore.ApiElectrum))
+	assert.False(electrs.HasApi(nodemuxcore.ApiJSONRPC))
+	_, ok := factory.GetEndpointDelegator(electrs).(*ElectrumChain)
+	assert.True(ok)
+
+	btc := nodemuxcore.NewEndpoint("btc01", nodemuxcore.EndpointConfig{
+		Chain: "bitcoin/mainnet",
+		Url:   "http://127.0.0.1:8332",
+		Urls:  map[string]string{"electrum": "ssl://127.0.0.1:50002"},
+	})
+	assert.True(btc.HasApi(nodemuxcore.ApiJSONRPC))
+	assert.Equal("ssl://127.0.0.1:50002", btc.ApiUrl(nodemuxcore.ApiElectrum))
+	_, ok = factory.GetEndpointDelegator(btc).(*BitcoinChain)
+	assert.True(ok)
+
+	// JSON-RPC requests are not relayed to electrum servers
+	m := nodemuxcore.NewMultiplexer()
+	electrs.Healthy = true
+	m.Add(electrs)
+	resmsg, err := m.DefaultRelayRPC(context.Background(), electrs.Chain, jsoff.NewRequestMessage(1, "getblockcount", nil), -2)
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(nodemuxcore.ErrNotAvailable.Code, resmsg.MustError().Code)
+}
+
+func TestPolkadotStateRouting(t *testing.T) {
+	assert := assert.New(t)
+
+	m := nodemuxcore.NewMultiplexer()
+	chain := nodemuxcore.ChainRef{Namespace: "polkadot", Network: "mainnet"}
+	for name, height := range map[string]int{"dot01": 1000, "dot02": 500} {
+		ep := nodemuxcore.NewEndpoint(name, nodemuxcore.EndpointConfig{
+			Chain: "polkadot/mainnet",
+			Url:   "http://127.0.0.1:9933/" + name,
+		})
+		ep.Healthy = true
+		ep.Blockhead = &nodemuxcore.Block{Height: height}
+		m.Add(ep)
+	}
+
+	c := NewPolkadotChain()
+	heads := c.updateHeads("dot01", func(heads *polkadotHeads) {
+		heads.Best, heads.BestHash = 1000, "0xbest"
+		heads.Finalized, heads.FinalizedHash = 998, "0xfinalized"
+	})
+	assert.Equal(998, heads.Finalized)
+
+	height, ok := c.resolveBlockHeight(context.Background(), m, chain, "0xfinalized")
+	assert.True(ok)
+	assert.Equal(998, height)
+
+	reqmsg := jsoff.NewRequestMessage(1, "state_getStorage", []any{"0x26aa", "0xfinalized"})
+	blockHash, ok := polkadotBlockHashAt(reqmsg, polkadotStateMethods[reqmsg.Method])
+	assert.True(ok)
+	assert.Equal("0xfinalized", blockHash)
+
+	for i := 0; i < 10; i++ {
+		ep, ok := c.selectForState(context.Background(), m, chain, reqmsg.Method, height)
+		assert.True(ok)
+		assert.Equal("dot01", ep.Name)
+	}
+
+	for i := 0; i < polkadotMaxBlockHashes; i++ {
+		c.setBlockHeight(strconv.Itoa(i), i)
+	}
+	_, ok = c.getBlockHeight("0xbest")
+	assert.False(ok)
+	assert.Equal(polkadotMaxBlockHashes, len(c.blockHashes))
+
+	genesis := polkadotBlock{
+		Number:         "0x0",
+		ParentHash:     "0x0000000000000000000000000000000000000000000000000000000000000000",
+		StateRoot:      "0x29d0d972cd27cbc511e9589fcb7a4506d5eb6a9e8df205f00472e5ab354a4e17",
+		ExtrinsicsRoot: "0x03170a2e7597b7b7e3d84c05391d139a62b157e78786d8c082f29dcf4c111314",
+	}
+	genesisHash, err := genesis.Hash()
+	assert.Nil(err)
+	assert.Equal(polkadotGenesisHashes["polkadot/mainnet"], genesisHash)
+	assert.Equal([]byte{0xfe, 0xff, 0x03, 0x00}, scaleCompact(nil, 65535))
+}
+
+func TestGenericChain(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := nodemuxcore.NewConfig()
+	err := cfg.LoadYamldata([]byte(`
+generic_chains:
+  starknet:
+    api: jsonrpc
+    blockhead:
+      method: starknet_blockHashAndNumber
+      height: $.block_number
+      hash: $.block_hash
+    client_version:
+      method: starknet_specVersion
+      version: $
+    height_params:
+      starknet_getBlockWithTxs:
+        index: 0
+        field: block_number
+  tezos:
+    api: rest
+    blockhead:
+      path: /chains/main/blocks/head/header
+      height: $.level
+      hash: $.hash
+    height_paths:
+      - ^/chains/main/blocks/(\d+)
+`))
+	assert.Nil(err)
+
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/chains/main/blocks/head/header" {
+			w.Write([]byte(`{"level":5123,"hash":"BLtezos"}`))
+			return
+		}
+		var req struct {
+			Id     any
+			Method string
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		methods = append(methods, req.Method)
+		switch req.Method {
+		case "starknet_blockHashAndNumber":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"block_hash":"0xabc","block_number":812}}`))
+		case "starknet_specVersion":
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"0.7.1"}`))
+		default:
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"status":"ACCEPTED_ON_L2"}}`))
+		}
+	}))
+	defer server.Close()
+
+	ctx := context.Background()
+	m := nodemuxcore.NewMultiplexer()
+	ep := nodemuxcore.NewEndpoint("stark01", nodemuxcore.EndpointConfig{
+		Chain: "starknet/mainnet",
+		Url:   server.URL,
+	})
+	ep.Healthy = true
+	m.Add(ep)
+
+	c, err := NewGenericChain("starknet", cfg.GenericChains["starknet"])
+	assert.Nil(err)
+	assert.Equal("starknet", c.Namespace())
+	block, err := c.GetBlockhead(ctx, m, ep)
+	assert.Nil(err)
+	assert.Equal(812, block.Height)
+	assert.Equal("0xabc", block.Hash)
+	version, err := c.GetClientVersion(ctx, ep)
+	assert.Nil(err)
+	assert.Equal("0.7.1", version)
+
+	reqmsg := jsoff.NewRequestMessage(1, "starknet_getBlockWithTxs", []any{map[string]any{"block_number": float64(800)}})
+	h, ok := c.findBlockHeight(reqmsg)
+	assert.True(ok)
+	assert.Equal(800, h)
+
+	ep.Blockhead = block
+	resmsg, err := c.DelegateRPC(ctx, m, ep.Chain, reqmsg, nil)
+	assert.Nil(err)
+	assert.True(resmsg.IsResult())
+	assert.Equal("starknet_getBlockWithTxs", methods[len(methods)-1])
+
+	tezos, err := NewGenericChain("tezos", cfg.GenericChains["tezos"])
+	assert.Nil(err)
+	tezosEp := nodemuxcore.NewEndpoint("tezos01", nodemuxcore.EndpointConfig{
+		Chain: "tezos/mainnet",
+		Url:   server.URL,
+	})
+	block, err = tezos.GetBlockhead(ctx, m, tezosEp)
+	assert.Nil(err)
+	assert.Equal(5123, block.Height)
+	assert.Equal("BLtezos", block.Hash)
+	h, ok = tezos.findPathHeight("/chains/main/blocks/5000/operations")
+	assert.True(ok)
+	assert.Equal(5000, h)
+
+	v, ok := genericLookup(map[string]any{"blocks": []any{map[string]any{"number": "0x1f"}}}, "$.blocks[0].number")
+	assert.True(ok)
+	h, ok = genericParseHeight(v, "")
+	assert.True(ok)
+	assert.Equal(31, h)
+
+	assert.NotNil(cfg.LoadYamldata([]byte(`
+generic_chains:
+  bad:
+    api: soap
+`)))
+	assert.NotNil(cfg.LoadYamldata([]byte(`
+generic_chains:
+  tezos:
+    api: rest
+    blockhead:
+      path: /chains/main/blocks/head/header
+      height: $.level
+    cache_methods:
+      /chains/main/blocks/head: 5
+`)))
+
+	// REST broadcasts are classified by keywords of the error body
+	classify := classifyHTTPByBody([]string{"already exists"}, []string{"busy"})
+	assert.Equal(nodemuxcore.TxAlreadyKnown, classify(&nodemuxcore.HTTPResult{StatusCode: 400, Body: []byte(`{"error":"Operation Already Exists"}`)}))
+	assert.Equal(nodemuxcore.TxRetryable, classify(&nodemuxcore.HTTPResult{StatusCode: 400, Body: []byte(`node busy`)}))
+	assert.Equal(nodemuxcore.TxFatal, classify(&nodemuxcore.HTTPResult{StatusCode: 400, Body: []byte(`bad operation`)}))
+	assert.Equal(nodemuxcore.TxSuccess, classify(&nodemuxcore.HTTPResult{StatusCode: 200, Body: []byte(`"already exists"`)}))
+}
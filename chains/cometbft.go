@@ -0,0 +1,90 @@
+package chains
+
+// CometBFT (formerly Tendermint) RPC, which listens on 26657 by default
+// refer to https://docs.cometbft.com/v0.38/rpc/
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+)
+
+type cometbftStatus struct {
+	NodeInfo struct {
+		Network string `json:"network"`
+		Version string `json:"version"`
+	} `json:"node_info"`
+
+	SyncInfo struct {
+		LatestBlockHash   string `json:"latest_block_hash"`
+		LatestBlockHeight string `json:"latest_block_height"`
+	} `json:"sync_info"`
+}
+
+type CometBFTChain struct {
+}
+
+func NewCometBFTChain() *CometBFTChain {
+	return &CometBFTChain{}
+}
+
+func (c CometBFTChain) getStatus(ctx context.Context, ep *nodemuxcore.Endpoint) (*cometbftStatus, error) {
+	var st cometbftStatus
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "status", nil), &st)
+	if err != nil {
+		return nil, err
+	}
+	return &st, nil
+}
+
+func (c CometBFTChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+	st, err := c.getStatus(ctx, ep)
+	if err != nil {
+		return "", err
+	}
+	return st.NodeInfo.Version, nil
+}
+
+func (c CometBFTChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	st, err := c.getStatus(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: st.NodeInfo.Network}, nil
+}
+
+// CometBFT serves many cosmos sdk chains, only the cosmos hub is known
+func (c CometBFTChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "cosmos" {
+		return nil, false
+	}
+	return knownChainId(cosmosNetworks, chain)
+}
+
+func (c CometBFTChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	return true, nil
+}
+
+func (c *CometBFTChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	st, err := c.getStatus(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	height, err := strconv.Atoi(st.SyncInfo.LatestBlockHeight)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse latest block height")
+	}
+	block := &nodemuxcore.Block{
+		Height: height,
+		Hash:   st.SyncInfo.LatestBlockHash,
+	}
+	return block, nil
+}
+
+func (c *CometBFTChain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+}
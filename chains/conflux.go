@@ -18,6 +18,26 @@ func (c ConfluxChain) GetClientVersion(context context.Context, ep *nodemuxcore.
 	return "", nil
 }
 
+type confluxStatus struct {
+	ChainId string `json:"chainId"`
+}
+
+func (c ConfluxChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var status confluxStatus
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "cfx_getStatus", nil), &status)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: status.ChainId}, nil
+}
+
+func (c ConfluxChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "0x405",
+		"testnet": "0x1",
+	}, chain)
+}
+
 func (c ConfluxChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -6,6 +6,7 @@ package chains
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
@@ -72,6 +73,36 @@ func (c CosmosChain) GetClientVersion(context context.Context, ep *nodemuxcore.E
 	return info.String(), nil
 }
 
+var (
+	cosmosNetworks map[string]string = map[string]string{
+		"mainnet": "cosmoshub-4",
+	}
+)
+
+type cosmosNetworkInfo struct {
+	DefaultNodeInfo struct {
+		Network string `json:"network"`
+	} `json:"default_node_info"`
+}
+
+func (c CosmosChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info cosmosNetworkInfo
+	err := ep.GetJson(context,
+		"/cosmos/base/tendermint/v1beta1/node_info",
+		nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.DefaultNodeInfo.Network}, nil
+}
+
+func (c CosmosChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "cosmos" {
+		return nil, false
+	}
+	return knownChainId(cosmosNetworks, chain)
+}
+
 func (c CosmosChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -92,7 +123,41 @@ func (c *CosmosChain) GetBlockhead(context context.Context, b *nodemuxcore.Multi
 	return block, nil
 }
 
+var cosmosTxSubmitPaths = map[string]nodemuxcore.TxSubmitPath{
+	"/cosmos/tx/v1beta1/txs": {
+		Classify: classifyCosmosTx,
+		TxId:     txIdFromBodyField("tx_response", "txhash"),
+	},
+}
+
+// the code of tx_response is the abci code, 0 is ok and 19 means the
+// tx is already in mempool
+func classifyCosmosTx(res *nodemuxcore.HTTPResult) nodemuxcore.TxOutcome {
+	if outcome, ok := classifyHTTPStatus(res); ok {
+		return outcome
+	}
+	var body struct {
+		TxResponse struct {
+			Code int `json:"code"`
+		} `json:"tx_response"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nodemuxcore.TxRetryable
+	}
+	switch body.TxResponse.Code {
+	case 0:
+		return nodemuxcore.TxSuccess
+	case 19:
+		return nodemuxcore.TxAlreadyKnown
+	default:
+		return nodemuxcore.TxFatal
+	}
+}
+
 func (c *CosmosChain) DelegateREST(rootCtx context.Context, b *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, path string, w http.ResponseWriter, r *http.Request) error {
+	if submit, ok := cosmosTxSubmitPaths[path]; ok && r.Method == http.MethodPost {
+		return broadcastTxREST(rootCtx, b, chain, path, w, r, submit)
+	}
 	// Custom relay methods can be defined here
 	return b.DefaultPipeREST(rootCtx, chain, path, w, r, -2)
 }
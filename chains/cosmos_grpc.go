@@ -0,0 +1,153 @@
+package chains
+
+// Cosmos SDK gRPC, the messages of cosmos.base.tendermint.v1beta1.Service
+// are decoded from the wire format so that no generated code is needed,
+// refer to https://buf.build/cosmos/cosmos-sdk/docs/main:cosmos.base.tendermint.v1beta1
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/nodemux/core"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+const (
+	cosmosGetLatestBlock = "/cosmos.base.tendermint.v1beta1.Service/GetLatestBlock"
+	cosmosGetNodeInfo    = "/cosmos.base.tendermint.v1beta1.Service/GetNodeInfo"
+)
+
+// Find the first field numbered num of a protobuf message
+func protoField(msg []byte, num protowire.Number) (protowire.Type, []byte, bool) {
+	for len(msg) > 0 {
+		n, typ, l := protowire.ConsumeTag(msg)
+		if l < 0 {
+			return 0, nil, false
+		}
+		msg = msg[l:]
+		l = protowire.ConsumeFieldValue(n, typ, msg)
+		if l < 0 {
+			return 0, nil, false
+		}
+		if n == num {
+			return typ, msg[:l], true
+		}
+		msg = msg[l:]
+	}
+	return 0, nil, false
+}
+
+// Get the bytes of a nested field by the path of field numbers, an
+// embedded message is also bytes on the wire
+func protoBytes(msg []byte, path ...protowire.Number) ([]byte, bool) {
+	for _, num := range path {
+		typ, raw, ok := protoField(msg, num)
+		if !ok || typ != protowire.BytesType {
+			return nil, false
+		}
+		v, l := protowire.ConsumeBytes(raw)
+		if l < 0 {
+			return nil, false
+		}
+		msg = v
+	}
+	return msg, true
+}
+
+func protoVarint(msg []byte, num protowire.Number) (uint64, bool) {
+	typ, raw, ok := protoField(msg, num)
+	if !ok || typ != protowire.VarintType {
+		return 0, false
+	}
+	v, l := protowire.ConsumeVarint(raw)
+	return v, l >= 0
+}
+
+type CosmosGRPCChain struct {
+}
+
+func NewCosmosGRPCChain() *CosmosGRPCChain {
+	return &CosmosGRPCChain{}
+}
+
+func (c CosmosGRPCChain) getNodeInfo(ctx context.Context, ep *nodemuxcore.Endpoint) ([]byte, error) {
+	return ep.CallGRPC(ctx, cosmosGetNodeInfo, nil)
+}
+
+func (c CosmosGRPCChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+	res, err := c.getNodeInfo(ctx, ep)
+	if err != nil {
+		return "", err
+	}
+	// GetNodeInfoResponse.application_version
+	av, ok := protoBytes(res, 2)
+	if !ok {
+		return "", errors.New("application version not found")
+	}
+	appName, _ := protoBytes(av, 2)
+	version, _ := protoBytes(av, 3)
+	sdkVersion, _ := protoBytes(av, 8)
+	return fmt.Sprintf("%s-%s-%s", appName, version, sdkVersion), nil
+}
+
+func (c CosmosGRPCChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	res, err := c.getNodeInfo(ctx, ep)
+	if err != nil {
+		return nil, err
+	}
+	// GetNodeInfoResponse.default_node_info.network
+	network, ok := protoBytes(res, 1, 4)
+	if !ok {
+		return nil, errors.New("network not found")
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: string(network)}, nil
+}
+
+func (c CosmosGRPCChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	// other cosmos sdk chains may be aliases of the delegator
+	if chain.Namespace != "cosmos" {
+		return nil, false
+	}
+	return knownChainId(cosmosNetworks, chain)
+}
+
+func (c CosmosGRPCChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	return true, nil
+}
+
+func (c *CosmosGRPCChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	res, err := ep.CallGRPC(ctx, cosmosGetLatestBlock, nil)
+	if err != nil {
+		return nil, err
+	}
+	return parseCosmosLatestBlock(res)
+}
+
+// parse GetLatestBlockResponse, the header is taken from block or
+// from sdk_block for newer SDKs
+func parseCosmosLatestBlock(res []byte) (*nodemuxcore.Block, error) {
+	header, ok := protoBytes(res, 2, 1)
+	if !ok {
+		header, ok = protoBytes(res, 3, 1)
+	}
+	if !ok {
+		return nil, errors.New("block header not found")
+	}
+	height, ok := protoVarint(header, 3)
+	if !ok {
+		return nil, errors.New("block height not found")
+	}
+	block := &nodemuxcore.Block{Height: int(height)}
+	if hash, ok := protoBytes(res, 1, 1); ok {
+		// the same encoding as the REST API
+		block.Hash = base64.StdEncoding.EncodeToString(hash)
+	}
+	return block, nil
+}
+
+func (c *CosmosGRPCChain) DelegateGRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, path string, w http.ResponseWriter, r *http.Request) error {
+	return m.DefaultPipeGRPC(ctx, chain, path, w, r, -2)
+}
@@ -0,0 +1,214 @@
+package chains
+
+// Electrum servers such as electrs, ElectrumX and Fulcrum, which
+// index the addresses of bitcoin family chains, see
+// https://electrum-protocol.readthedocs.io/en/latest/protocol-methods.html
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+)
+
+type electrumHeader struct {
+	Height int    `json:"height"`
+	Hex    string `json:"hex"`
+}
+
+type electrumFeatures struct {
+	GenesisHash   string `json:"genesis_hash"`
+	ServerVersion string `json:"server_version"`
+}
+
+type ElectrumChain struct {
+}
+
+var (
+	// genesis block hashes of bitcoin networks
+	electrumBitcoinGenesis = map[string]string{
+		"mainnet": "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		"testnet": "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+		"signet":  "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+		"regtest": "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	}
+)
+
+func NewElectrumChain() *ElectrumChain {
+	return &ElectrumChain{}
+}
+
+// the block hash is the reversed double sha256 of the 80 bytes header
+func electrumHeaderHash(headerHex string) (string, error) {
+	data, err := hex.DecodeString(headerHex)
+	if err != nil {
+		return "", errors.Wrap(err, "hex.DecodeString")
+	}
+	if len(data) != 80 {
+		return "", errors.Errorf("bad header size %d", len(data))
+	}
+	first := sha256.Sum256(data)
+	hash := sha256.Sum256(first[:])
+	for i, j := 0, len(hash)-1; i < j; i, j = i+1, j-1 {
+		hash[i], hash[j] = hash[j], hash[i]
+	}
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func electrumBlock(header electrumHeader) (*nodemuxcore.Block, error) {
+	hash, err := electrumHeaderHash(header.Hex)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.Block{
+		Height: header.Height,
+		Hash:   hash,
+	}, nil
+}
+
+func (c ElectrumChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+	var features electrumFeatures
+	err := ep.UnwrapCallElectrum(ctx, jsoff.NewRequestMessage(1, "server.features", nil), &features)
+	if err != nil {
+		return "", err
+	}
+	return features.ServerVersion, nil
+}
+
+func (c ElectrumChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var features electrumFeatures
+	err := ep.UnwrapCallElectrum(ctx, jsoff.NewRequestMessage(1, "server.features", nil), &features)
+	if err != nil {
+		return nil, errors.Wrap(err, "server.features")
+	}
+	return &nodemuxcore.NetworkIdentity{
+		GenesisHash: features.GenesisHash,
+	}, nil
+}
+
+func (c ElectrumChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "bitcoin" {
+		return nil, false
+	}
+	if genesisHash, ok := electrumBitcoinGenesis[chain.Network]; ok {
+		return &nodemuxcore.NetworkIdentity{GenesisHash: genesisHash}, true
+	}
+	return nil, false
+}
+
+func (c ElectrumChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	var header electrumHeader
+	err := ep.UnwrapCallElectrum(ctx, jsoff.NewRequestMessage(1, "blockchain.headers.subscribe", nil), &header)
+	if err != nil {
+		return nil, err
+	}
+	return electrumBlock(header)
+}
+
+func (c ElectrumChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	go c.subscribeHeaders(context, m, ep)
+	return false, nil
+}
+
+func (c ElectrumChain) subscribeHeaders(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
+	for {
+		err := c.connectAndSubHeaders(rootCtx, m, ep)
+		if rootCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ep.Log().Warnf("electrum headers sub error %s, retrying", err)
+			bs := nodemuxcore.ChainStatus{
+				EndpointName: ep.Name,
+				Chain:        ep.Chain,
+				Healthy:      false,
+			}
+			m.Chainhub().Pub() <- bs
+		}
+		time.Sleep(2 * time.Second)
+	}
+}
+
+func (c ElectrumChain) connectAndSubHeaders(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) error {
+	client, err := ep.DialElectrum(rootCtx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	publish := func(header electrumHeader) {
+		block, err := electrumBlock(header)
+		if err != nil {
+			ep.Log().Warnf("bad electrum header %s", err)
+			return
+		}
+		m.Chainhub().Pub() <- nodemuxcore.ChainStatus{
+			EndpointName: ep.Name,
+			Chain:        ep.Chain,
+			Healthy:      true,
+			Blockhead:    block,
+		}
+	}
+
+	// the params of a notification is [header]
+	client.OnNotify(func(ntfmsg *jsoff.NotifyMessage) {
+		if ntfmsg.Method != "blockchain.headers.subscribe" {
+			return
+		}
+		var params struct {
+			Header electrumHeader
+		}
+		if err := jsoff.DecodeParams(ntfmsg.Params, &params); err != nil {
+			ep.Log().Warnf("decode header notification error %s", err)
+			return
+		}
+		publish(params.Header)
+	})
+
+	var header electrumHeader
+	err = client.UnwrapCall(rootCtx, jsoff.NewRequestMessage(1, "blockchain.headers.subscribe", nil), &header)
+	if err != nil {
+		return errors.Wrap(err, "blockchain.headers.subscribe")
+	}
+	publish(header)
+
+	select {
+	case <-rootCtx.Done():
+		return nil
+	case <-client.Done():
+		return client.Err()
+	}
+}
+
+// the height argument of methods such as blockchain.block.header
+func (c ElectrumChain) findBlockHeight(reqmsg *jsoff.RequestMessage) (int, bool) {
+	var bh struct {
+		Height int
+	}
+	if err := jsoff.DecodeParams(reqmsg.Params, &bh); err == nil && bh.Height > 0 {
+		return bh.Height, true
+	}
+	return 0, false
+}
+
+func (c ElectrumChain) DelegateElectrum(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	switch reqmsg.Method {
+	case "server.version":
+		// the version is negotiated by each upstream connection
+		return jsoff.NewResultMessage(reqmsg, []string{"nodemux", nodemuxcore.ElectrumProtocolVersion}), nil
+	case "server.ping":
+		return jsoff.NewResultMessage(reqmsg, nil), nil
+	}
+
+	heightSpec := -1
+	if reqmsg.Method == "blockchain.block.header" || reqmsg.Method == "blockchain.block.headers" {
+		if h, ok := c.findBlockHeight(reqmsg); ok {
+			heightSpec = h
+		}
+	}
+	return m.DefaultRelayElectrum(ctx, chain, reqmsg, heightSpec)
+}
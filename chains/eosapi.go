@@ -10,6 +10,8 @@ import (
 )
 
 type eosapiChainInfo struct {
+	HeadBlockNum int    `json:"head_block_num"`
+	HeadBlockId  string `json:"head_block_id"`
 	LastBlockNum int    `json:"last_irreversible_block_num"`
 	LastBlockId  string `json:"last_irreversible_block_id"`
 }
@@ -29,6 +31,34 @@ func (api EOSAPI) GetClientVersion(context context.Context, ep *nodemuxcore.Endp
 	return "", nil
 }
 
+var (
+	eosChainIds map[string]string = map[string]string{
+		"mainnet": "aca376f206b8fc25a6ed44dbdc66547c36c6c33e3a119ffbeaef943642f0e906",
+	}
+)
+
+type eosapiChainId struct {
+	ChainId string `json:"chain_id"`
+}
+
+func (api EOSAPI) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info eosapiChainId
+	err := ep.PostJson(context,
+		"/v1/chain/get_info",
+		nil, nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.ChainId}, nil
+}
+
+func (api EOSAPI) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "eosio" {
+		return nil, false
+	}
+	return knownChainId(eosChainIds, chain)
+}
+
 func (api EOSAPI) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -42,9 +72,11 @@ func (api *EOSAPI) GetBlockhead(context context.Context, b *nodemuxcore.Multiple
 		return nil, err
 	}
 
+	// the last irreversible block is the finalized one
 	block := &nodemuxcore.Block{
-		Height: chainInfo.LastBlockNum,
-		Hash:   chainInfo.LastBlockId,
+		Height:    chainInfo.HeadBlockNum,
+		Hash:      chainInfo.HeadBlockId,
+		Finalized: chainInfo.LastBlockNum,
 	}
 	return block, nil
 }
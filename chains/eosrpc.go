@@ -8,6 +8,8 @@ import (
 )
 
 type eosrpcChainInfo struct {
+	HeadBlockNum int    `json:"head_block_num"`
+	HeadBlockId  string `json:"head_block_id"`
 	LastBlockNum int    `json:"last_irreversible_block_num"`
 	LastBlockId  string `json:"last_irreversible_block_id"`
 }
@@ -27,6 +29,22 @@ func (c EOSRPC) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoi
 	return "", nil
 }
 
+func (c EOSRPC) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info eosapiChainId
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "get_info", nil), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.ChainId}, nil
+}
+
+func (c EOSRPC) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "eosio-rpc" {
+		return nil, false
+	}
+	return knownChainId(eosChainIds, chain)
+}
+
 func (c EOSRPC) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -41,9 +59,11 @@ func (c *EOSRPC) GetBlockhead(context context.Context, b *nodemuxcore.Multiplexe
 		return nil, err
 	}
 
+	// the last irreversible block is the finalized one
 	block := &nodemuxcore.Block{
-		Height: info.LastBlockNum,
-		Hash:   info.LastBlockId,
+		Height:    info.HeadBlockNum,
+		Hash:      info.HeadBlockId,
+		Finalized: info.LastBlockNum,
 	}
 	return block, nil
 }
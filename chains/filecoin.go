@@ -22,6 +22,22 @@ func (c FilecoinChain) GetClientVersion(context context.Context, ep *nodemuxcore
 	return "", nil
 }
 
+func (c FilecoinChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var networkName string
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "Filecoin.StateNetworkName", nil), &networkName)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: networkName}, nil
+}
+
+func (c FilecoinChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet":  "mainnet",
+		"calibnet": "calibrationnet",
+	}, chain)
+}
+
 func (c FilecoinChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
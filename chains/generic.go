@@ -0,0 +1,297 @@
+package chains
+
+// Generic chains are defined by the generic_chains section of the
+// config rather than Go code, e.g. a starknet chain
+//
+//	generic_chains:
+//	  starknet:
+//	    api: jsonrpc
+//	    blockhead:
+//	      method: starknet_blockHashAndNumber
+//	      height: $.block_number
+//	      hash: $.block_hash
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+)
+
+var (
+	genericPathRegex  = regexp.MustCompile(`^([^\[\]]*)((\[\d+\])*)$`)
+	genericIndexRegex = regexp.MustCompile(`\[(\d+)\]`)
+)
+
+type GenericChain struct {
+	namespace   string
+	cfg         nodemuxcore.GenericChainConfig
+	heightPaths []*regexp.Regexp
+}
+
+func NewGenericChain(namespace string, cfg nodemuxcore.GenericChainConfig) (*GenericChain, error) {
+	c := &GenericChain{namespace: namespace, cfg: cfg}
+	for _, pattern := range cfg.HeightPaths {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "height path %s", pattern)
+		}
+		c.heightPaths = append(c.heightPaths, re)
+	}
+	return c, nil
+}
+
+// register the generic chains of the config
+func installGenericChains(factory *nodemuxcore.DelegatorFactory) {
+	cfg := factory.Config()
+	if cfg == nil {
+		return
+	}
+	for namespace, gencfg := range cfg.GenericChains {
+		c, err := NewGenericChain(namespace, gencfg)
+		if err != nil {
+			log.Warnf("generic chain %s error %s", namespace, err)
+			continue
+		}
+		if gencfg.Api == "rest" {
+			factory.RegisterREST(c, namespace)
+		} else {
+			factory.RegisterRPC(c, namespace)
+		}
+	}
+}
+
+// Look up a value by a JSONPath like path, such as $.header.level or
+// $.blocks[0].hash, $ is the root value
+func genericLookup(root any, path string) (any, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	v := root
+	if path == "" {
+		return v, true
+	}
+	for _, hop := range strings.Split(path, ".") {
+		matches := genericPathRegex.FindStringSubmatch(hop)
+		if matches == nil {
+			return nil, false
+		}
+		if matches[1] != "" {
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, false
+			}
+			if v, ok = m[matches[1]]; !ok {
+				return nil, false
+			}
+		}
+		for _, idx := range genericIndexRegex.FindAllStringSubmatch(matches[2], -1) {
+			arr, ok := v.([]any)
+			if !ok {
+				return nil, false
+			}
+			i, _ := strconv.Atoi(idx[1])
+			if i >= len(arr) {
+				return nil, false
+			}
+			v = arr[i]
+		}
+	}
+	return v, true
+}
+
+// Parse a height of the format, hex, decimal or auto
+func genericParseHeight(v any, format string) (int, bool) {
+	switch hv := v.(type) {
+	case float64:
+		return int(hv), true
+	case int:
+		return hv, true
+	case json.Number:
+		if h, err := hv.Int64(); err == nil {
+			return int(h), true
+		}
+	case string:
+		if format == "hex" || (format != "decimal" && strings.HasPrefix(hv, "0x")) {
+			if h, err := strconv.ParseInt(strings.TrimPrefix(hv, "0x"), 16, 64); err == nil {
+				return int(h), true
+			}
+		} else if h, err := strconv.Atoi(hv); err == nil {
+			return h, true
+		}
+	}
+	return 0, false
+}
+
+// run a probe against the endpoint and return the decoded result
+func (c GenericChain) probe(ctx context.Context, ep *nodemuxcore.Endpoint, probe nodemuxcore.GenericProbeConfig) (any, error) {
+	params := nodemuxcore.NormalizeYamlValue(probe.Params)
+	var res any
+	if c.cfg.Api == "rest" {
+		var err error
+		if params != nil {
+			err = ep.PostJson(ctx, probe.Path, params, nil, &res)
+		} else {
+			err = ep.GetJson(ctx, probe.Path, nil, &res)
+		}
+		return res, err
+	}
+
+	var rpcParams []any
+	if arr, ok := params.([]any); ok {
+		rpcParams = arr
+	} else if params != nil {
+		rpcParams = []any{params}
+	}
+	reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), probe.Method, rpcParams)
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &res)
+	return res, err
+}
+
+func (c GenericChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+	if c.cfg.ClientVersion == nil {
+		return "", nil
+	}
+	res, err := c.probe(ctx, ep, *c.cfg.ClientVersion)
+	if err != nil {
+		return "", err
+	}
+	if v, ok := genericLookup(res, c.cfg.ClientVersion.Version); ok && v != nil {
+		return fmt.Sprintf("%v", v), nil
+	}
+	return "", nil
+}
+
+func (c GenericChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	return true, nil
+}
+
+func (c *GenericChain) GetBlockhead(ctx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	res, err := c.probe(ctx, ep, c.cfg.Blockhead)
+	if err != nil {
+		return nil, err
+	}
+	v, ok := genericLookup(res, c.cfg.Blockhead.Height)
+	if !ok {
+		return nil, errors.Errorf("height %s not found", c.cfg.Blockhead.Height)
+	}
+	height, ok := genericParseHeight(v, c.cfg.Blockhead.Format)
+	if !ok {
+		return nil, errors.Errorf("bad height %v", v)
+	}
+	block := &nodemuxcore.Block{Height: height}
+	if c.cfg.Blockhead.Hash != "" {
+		if hash, ok := genericLookup(res, c.cfg.Blockhead.Hash); ok {
+			if s, ok := hash.(string); ok {
+				block.Hash = s
+			}
+		}
+	}
+	return block, nil
+}
+
+func (c GenericChain) heightSpec() int {
+	if c.cfg.MaxLag > 0 {
+		return -c.cfg.MaxLag
+	}
+	return -2
+}
+
+// the block height param of a JSON-RPC request
+func (c GenericChain) findBlockHeight(reqmsg *jsoff.RequestMessage) (int, bool) {
+	hp, ok := c.cfg.HeightParams[reqmsg.Method]
+	if !ok || hp.Index >= len(reqmsg.Params) {
+		return 0, false
+	}
+	v := reqmsg.Params[hp.Index]
+	if hp.Field != "" {
+		if v, ok = genericLookup(v, hp.Field); !ok {
+			return 0, false
+		}
+	}
+	return genericParseHeight(v, hp.Format)
+}
+
+// the block height in the REST path
+func (c GenericChain) findPathHeight(path string) (int, bool) {
+	for _, re := range c.heightPaths {
+		if matches := re.FindStringSubmatch(path); len(matches) > 1 {
+			if h, err := strconv.Atoi(matches[1]); err == nil {
+				return h, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (c GenericChain) txIdFromValue(path string, v any) string {
+	if path == "" {
+		return ""
+	}
+	if txid, ok := genericLookup(v, path); ok && txid != nil {
+		return fmt.Sprintf("%v", txid)
+	}
+	return ""
+}
+
+func (c *GenericChain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if bcfg, ok := c.cfg.BroadcastMethods[reqmsg.Method]; ok {
+		submit := nodemuxcore.TxSubmitMethod{
+			Classify: classifyTxByMessage(bcfg.AlreadyKnown, bcfg.Retryable),
+			TxId: func(resmsg jsoff.Message) string {
+				if res, ok := resmsg.(*jsoff.ResultMessage); ok {
+					return c.txIdFromValue(bcfg.TxId, res.Result)
+				}
+				return ""
+			},
+		}
+		return broadcastTxRPC(ctx, m, chain, reqmsg, submit)
+	}
+
+	heightSpec := c.heightSpec()
+	if h, ok := c.findBlockHeight(reqmsg); ok && h > 0 {
+		heightSpec = h
+	}
+
+	ttl, useCache := c.cfg.CacheMethods[reqmsg.Method]
+	if useCache {
+		if resmsgFromCache, found := jsonrpcCacheFetch(ctx, m, chain, reqmsg, heightSpec); found {
+			return resmsgFromCache, nil
+		}
+	}
+
+	retmsg, ep, err := m.DefaultRelayRPCTakingEndpoint(ctx, chain, reqmsg, heightSpec)
+	if err == nil && useCache && retmsg.IsResult() {
+		jsonrpcCacheUpdate(ctx, m, ep, chain, reqmsg, retmsg.(*jsoff.ResultMessage), time.Duration(ttl)*time.Second)
+	}
+	return retmsg, err
+}
+
+func (c *GenericChain) DelegateREST(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, path string, w http.ResponseWriter, r *http.Request) error {
+	if bcfg, ok := c.cfg.BroadcastMethods[path]; ok && r.Method == http.MethodPost {
+		submit := nodemuxcore.TxSubmitPath{
+			Classify: classifyHTTPByBody(bcfg.AlreadyKnown, bcfg.Retryable),
+			TxId: func(res *nodemuxcore.HTTPResult) string {
+				var body any
+				if err := json.Unmarshal(res.Body, &body); err != nil {
+					return ""
+				}
+				return c.txIdFromValue(bcfg.TxId, body)
+			},
+		}
+		return broadcastTxREST(ctx, m, chain, path, w, r, submit)
+	}
+
+	heightSpec := c.heightSpec()
+	if h, ok := c.findPathHeight(path); ok && h > 0 {
+		heightSpec = h
+	}
+	return m.DefaultPipeREST(ctx, chain, path, w, r, heightSpec)
+}
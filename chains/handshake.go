@@ -43,6 +43,27 @@ func (c HandshakeChain) GetClientVersion(ctx context.Context, ep *nodemuxcore.En
 	return info.Version, nil
 }
 
+type handshakeBlockchainInfo struct {
+	Chain string `json:"chain"`
+}
+
+func (c HandshakeChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info handshakeBlockchainInfo
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getblockchaininfo", nil), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.Chain}, nil
+}
+
+func (c HandshakeChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "main",
+		"testnet": "testnet",
+		"regtest": "regtest",
+	}, chain)
+}
+
 func (c HandshakeChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
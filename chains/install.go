@@ -47,6 +47,20 @@ func InstallAdaptors(factory *nodemuxcore.DelegatorFactory) {
 	factory.RegisterGraphQL(NewFantomChain(), "fantom")
 	factory.RegisterGraphQL(NewCardanoChain(), "cardano")
 	factory.RegisterGraphQL(NewMinaChain(), "mina")
+
+	// gRPC handlers
+	factory.RegisterGRPC(NewCosmosGRPCChain(), "cosmos", "luna")
+
+	// CometBFT RPC of cosmos chains, registered after REST which
+	// stays the primary api
+	factory.RegisterRPC(NewCometBFTChain(), "cosmos", "luna")
+
+	// Electrum handlers
+	factory.RegisterElectrum(NewElectrumChain(),
+		"bitcoin", "litecoin", "dogecoin", "bitcoin-cash")
+
+	// chains defined by the config
+	installGenericChains(factory)
 }
 
 // func init() {
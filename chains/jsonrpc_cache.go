@@ -71,8 +71,10 @@ func jsonrpcCacheRedisSelector(chain nodemuxcore.ChainRef) string {
 func jsonrpcCacheFetch(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, heightSpec int) (*jsoff.ResultMessage, bool) {
 	if c, ok := m.RedisClientExact(jsonrpcCacheRedisSelector(chain)); ok {
 		if resFromCache, ok := jsonrpcCacheGet(ctx, m, c, chain, reqmsg, heightSpec); ok {
+			nodemuxcore.RecordCacheResult(ctx, chain, "jsonrpc", true)
 			return jsoff.NewResultMessage(reqmsg, resFromCache), true
 		} else {
+			nodemuxcore.RecordCacheResult(ctx, chain, "jsonrpc", false)
 			return nil, false
 		}
 	}
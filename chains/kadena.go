@@ -27,6 +27,26 @@ func (c KadenaChain) GetClientVersion(context context.Context, ep *nodemuxcore.E
 	return "", nil
 }
 
+type kadenaInfo struct {
+	NodeVersion string `json:"nodeVersion"`
+}
+
+func (c KadenaChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info kadenaInfo
+	err := ep.GetJson(context, "/info", nil, &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.NodeVersion}, nil
+}
+
+func (c KadenaChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "mainnet01",
+		"testnet": "testnet04",
+	}, chain)
+}
+
 func (c KadenaChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -30,6 +30,25 @@ func (c MinaChain) GetClientVersion(context context.Context, ep *nodemuxcore.End
 	return "", nil
 }
 
+type minaDaemonStatus struct {
+	DaemonStatus struct {
+		ChainId string
+	}
+}
+
+func (c MinaChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var res minaDaemonStatus
+	err := ep.RequestGraphQL(context, "{daemonStatus{chainId}}", nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: res.DaemonStatus.ChainId}, nil
+}
+
+func (c MinaChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return nil, false
+}
+
 func (c MinaChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -24,6 +24,27 @@ func (c MoneroChain) GetClientVersion(context context.Context, ep *nodemuxcore.E
 	return "", nil
 }
 
+type moneroInfo struct {
+	Nettype string `json:"nettype"`
+}
+
+func (c MoneroChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var info moneroInfo
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "get_info", nil), &info)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: info.Nettype}, nil
+}
+
+func (c MoneroChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet":  "mainnet",
+		"stagenet": "stagenet",
+		"testnet":  "testnet",
+	}, chain)
+}
+
 func (c MoneroChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -8,7 +8,7 @@ func (api AptosAPI) Namespace() string {
 	return "aptos"
 }
 
-func (c BitcoinChain) Namespace() string {
+func (c *BitcoinChain) Namespace() string {
 	return "bitcoin"
 }
 
@@ -24,10 +24,18 @@ func (c ConfluxChain) Namespace() string {
 	return "conflux"
 }
 
+func (c CometBFTChain) Namespace() string {
+	return "cosmos"
+}
+
 func (c CosmosChain) Namespace() string {
 	return "cosmos"
 }
 
+func (c CosmosGRPCChain) Namespace() string {
+	return "cosmos"
+}
+
 func (api EOSAPI) Namespace() string {
 	return "eosio"
 }
@@ -36,6 +44,10 @@ func (c EOSRPC) Namespace() string {
 	return "eosio-rpc"
 }
 
+func (c ElectrumChain) Namespace() string {
+	return "bitcoin"
+}
+
 func (c FantomChain) Namespace() string {
 	return "fantom"
 }
@@ -44,6 +56,10 @@ func (c FilecoinChain) Namespace() string {
 	return "filecoin"
 }
 
+func (c GenericChain) Namespace() string {
+	return c.namespace
+}
+
 func (c HandshakeChain) Namespace() string {
 	return "handshake"
 }
@@ -64,7 +80,7 @@ func (c NearChain) Namespace() string {
 	return "near"
 }
 
-func (c PolkadotChain) Namespace() string {
+func (c *PolkadotChain) Namespace() string {
 	return "polkadot"
 }
 
@@ -72,7 +88,7 @@ func (c RippleChain) Namespace() string {
 	return "ripple"
 }
 
-func (c SolanaChain) Namespace() string {
+func (c *SolanaChain) Namespace() string {
 	return "solana"
 }
 
@@ -92,6 +108,6 @@ func (c TronChain) Namespace() string {
 	return "tron"
 }
 
-func (c Web3Chain) Namespace() string {
+func (c *Web3Chain) Namespace() string {
 	return "web3"
 }
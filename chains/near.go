@@ -28,12 +28,32 @@ func (c NearChain) GetClientVersion(context context.Context, ep *nodemuxcore.End
 	return "", nil
 }
 
+type nearStatus struct {
+	ChainId string `json:"chain_id"`
+}
+
+func (c NearChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var status nearStatus
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "status", []any{}), &status)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: status.ChainId}, nil
+}
+
+func (c NearChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"mainnet": "mainnet",
+		"testnet": "testnet",
+	}, chain)
+}
+
 func (c NearChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
 
-func (c *NearChain) GetBlockhead(context context.Context, b *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
-	params := map[string]interface{}{"finality": "final"}
+func (c *NearChain) getBlock(context context.Context, ep *nodemuxcore.Endpoint, finality string) (*nearBlock, error) {
+	params := map[string]interface{}{"finality": finality}
 	reqmsg := jsoff.NewRequestMessage(
 		1, "block", params)
 
@@ -42,15 +62,68 @@ func (c *NearChain) GetBlockhead(context context.Context, b *nodemuxcore.Multipl
 	if err != nil {
 		return nil, err
 	}
+	return &bt, nil
+}
+
+// the head is the optimistic block, the final block is the finalized one
+func (c *NearChain) GetBlockhead(context context.Context, b *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	head, err := c.getBlock(context, ep, "optimistic")
+	if err != nil {
+		return nil, err
+	}
+	final, err := c.getBlock(context, ep, "final")
+	if err != nil {
+		return nil, err
+	}
 
 	block := &nodemuxcore.Block{
-		Height: bt.Header.Height,
-		Hash:   bt.Header.Hash,
+		Height:    head.Header.Height,
+		Hash:      head.Header.Hash,
+		Finalized: final.Header.Height,
 	}
 	return block, nil
 }
 
+// the finality param of query methods such as block and query
+func (c *NearChain) findFinality(reqmsg *jsoff.RequestMessage) (string, bool) {
+	if len(reqmsg.Params) == 0 {
+		return "", false
+	}
+	if params, ok := reqmsg.Params[0].(map[string]any); ok {
+		if finality, ok := params["finality"].(string); ok && finality != "" {
+			return finality, true
+		}
+	}
+	return "", false
+}
+
+var (
+	nearClassifyTx = classifyTxByMessage(
+		nil,
+		[]string{"timeout_error"})
+
+	nearTxSubmitMethods = map[string]nodemuxcore.TxSubmitMethod{
+		"broadcast_tx_async": {Classify: nearClassifyTx, TxId: txIdFromResult},
+		"broadcast_tx_commit": {
+			Classify: nearClassifyTx,
+			TxId:     txIdFromResultField("transaction", "hash"),
+		},
+		"send_tx": {
+			Classify: nearClassifyTx,
+			TxId:     txIdFromResultField("transaction", "hash"),
+		},
+	}
+)
+
 func (c *NearChain) DelegateRPC(rootCtx context.Context, b *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if submit, ok := nearTxSubmitMethods[reqmsg.Method]; ok {
+		return broadcastTxRPC(rootCtx, b, chain, reqmsg, submit)
+	}
+	if finality, ok := c.findFinality(reqmsg); ok && finality == "final" {
+		if ep, found := b.SelectAtCommitment(rootCtx, chain, reqmsg.Method, nodemuxcore.CommitmentFinalized, 0); found {
+			return b.CallEndpointRPC(rootCtx, ep, reqmsg)
+		}
+	}
 	// Custom relay methods can be defined here
 	return b.DefaultRelayRPC(rootCtx, chain, reqmsg, -3)
 }
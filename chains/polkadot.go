@@ -1,16 +1,31 @@
 package chains
 
+// docsite: https://polkadot.js.org/docs/substrate/rpc
+
 import (
 	"context"
+	"encoding/binary"
+	"encoding/hex"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/nodemux/core"
+	"golang.org/x/crypto/blake2b"
 	"net/http"
+	"sync"
+	"time"
 )
 
 type polkadotBlock struct {
 	//Hash   string
-	Number string
+	Number         string
+	ParentHash     string `json:"parentHash"`
+	StateRoot      string `json:"stateRoot"`
+	ExtrinsicsRoot string `json:"extrinsicsRoot"`
+	Digest         struct {
+		Logs []string `json:"logs"`
+	} `json:"digest"`
 
 	height int `json:"-"`
 }
@@ -26,39 +41,455 @@ func (blk *polkadotBlock) Height() int {
 	return blk.height
 }
 
+// Hash returns the blake2b-256 hash of the SCALE encoded header
+func (blk *polkadotBlock) Hash() (string, error) {
+	height, err := hexutil.DecodeUint64(blk.Number)
+	if err != nil {
+		return "", errors.Wrap(err, "decode number")
+	}
+	var buf []byte
+	for _, h := range []string{blk.ParentHash, blk.StateRoot, blk.ExtrinsicsRoot} {
+		data, err := hexutil.Decode(h)
+		if err != nil || len(data) != 32 {
+			return "", errors.Errorf("bad header hash %#v", h)
+		}
+		buf = append(buf, data...)
+		if len(buf) == 32 {
+			// the block number follows the parent hash
+			buf = scaleCompact(buf, height)
+		}
+	}
+	buf = scaleCompact(buf, uint64(len(blk.Digest.Logs)))
+	for _, item := range blk.Digest.Logs {
+		data, err := hexutil.Decode(item)
+		if err != nil {
+			return "", errors.Wrap(err, "decode digest log")
+		}
+		buf = append(buf, data...)
+	}
+	sum := blake2b.Sum256(buf)
+	return "0x" + hex.EncodeToString(sum[:]), nil
+}
+
+// scaleCompact appends the SCALE compact encoding of n to buf
+func scaleCompact(buf []byte, n uint64) []byte {
+	switch {
+	case n < 1<<6:
+		return append(buf, byte(n<<2))
+	case n < 1<<14:
+		return binary.LittleEndian.AppendUint16(buf, uint16(n<<2|1))
+	case n < 1<<30:
+		return binary.LittleEndian.AppendUint32(buf, uint32(n<<2|2))
+	}
+	var data []byte
+	for ; n > 0; n >>= 8 {
+		data = append(data, byte(n))
+	}
+	buf = append(buf, byte((len(data)-4)<<2|3))
+	return append(buf, data...)
+}
+
+type polkadotRPCMethods struct {
+	Methods []string `json:"methods"`
+}
+
+// the best and the finalized heads of an endpoint
+type polkadotHeads struct {
+	Best          int
+	BestHash      string
+	Finalized     int
+	FinalizedHash string
+}
+
+func (heads polkadotHeads) block() *nodemuxcore.Block {
+	return &nodemuxcore.Block{
+		Height:    heads.Best,
+		Hash:      heads.BestHash,
+		Finalized: heads.Finalized,
+	}
+}
+
+type polkadotHeadSub struct {
+	Subscription any
+	Result       polkadotBlock
+}
+
 type PolkadotChain struct {
+	mutex sync.RWMutex
+	heads map[string]polkadotHeads
+
+	// heights of recent block hashes, the oldest hashes are
+	// evicted first
+	blockHeights map[string]int
+	blockHashes  []string
 }
 
+const (
+	// non-archive nodes keep the states of recent 256 blocks
+	polkadotStateRetention = 256
+
+	// the max count of block hashes whose heights are remembered
+	polkadotMaxBlockHashes = 10000
+)
+
+var (
+	polkadotGenesisHashes map[string]string = map[string]string{
+		"polkadot/mainnet": "0x91b171bb158e2d3848fa23a9f1c25182fb8e20313b2c1eb49219da7a70ce90c3",
+		"kusama/mainnet":   "0xb0a8d493285c2df73290dfb7e61f870f17b41801197a149ca93654499ea3dafe",
+	}
+
+	// state methods mapped to the index of the block hash argument
+	polkadotStateMethods map[string]int = map[string]int{
+		"state_call":              2,
+		"state_getStorage":        1,
+		"state_getStorageAt":      1,
+		"state_getStorageHash":    1,
+		"state_getStorageSize":    1,
+		"state_getKeys":           1,
+		"state_getKeysPaged":      3,
+		"state_getPairs":          1,
+		"state_getMetadata":       0,
+		"state_getRuntimeVersion": 0,
+		"state_getReadProof":      1,
+		"state_getChildReadProof": 2,
+		"state_queryStorageAt":    1,
+	}
+)
+
 func NewPolkadotChain() *PolkadotChain {
-	return &PolkadotChain{}
+	return &PolkadotChain{
+		heads:        make(map[string]polkadotHeads),
+		blockHeights: make(map[string]int),
+	}
 }
 
-func (c PolkadotChain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+func (c *PolkadotChain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
 	return "", nil
 }
 
-func (c PolkadotChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
-	return true, nil
+func (c *PolkadotChain) ProbeCapabilities(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.Capabilities, error) {
+	caps := nodemuxcore.NewCapabilities()
+
+	// rpc_methods lists all the methods the node provides
+	var rpcMethods polkadotRPCMethods
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "rpc_methods", nil), &rpcMethods)
+	if err != nil {
+		return nil, err
+	}
+	if len(rpcMethods.Methods) > 0 {
+		caps.Methods = make(map[string]bool)
+		for _, method := range rpcMethods.Methods {
+			caps.Methods[method] = true
+		}
+	}
+
+	// pruned nodes fail to get the runtime version at block 1 as
+	// the state is discarded
+	var blockHash string
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "chain_getBlockHash", []any{1}), &blockHash)
+	if err == nil && blockHash != "" {
+		var version map[string]any
+		err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "state_getRuntimeVersion", []any{blockHash}), &version)
+		caps.Set("archive", err == nil && version != nil)
+	}
+	return caps, nil
 }
 
-func (c *PolkadotChain) GetBlockhead(context context.Context, b *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
-	reqmsg := jsoff.NewRequestMessage(
-		1, "chain_getHeader", []interface{}{})
+func (c *PolkadotChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var chainName string
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "system_chain", nil), &chainName)
+	if err != nil {
+		return nil, err
+	}
+
+	var genesisHash string
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "chain_getBlockHash", []any{0}), &genesisHash)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{
+		ChainId:     chainName,
+		GenesisHash: genesisHash,
+	}, nil
+}
+
+func (c *PolkadotChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if genesisHash, ok := polkadotGenesisHashes[chain.String()]; ok {
+		return &nodemuxcore.NetworkIdentity{GenesisHash: genesisHash}, true
+	}
+	return nil, false
+}
+
+func (c *PolkadotChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	if !ep.HasWebsocket() {
+		return true, nil
+	}
+
+	// subscribe new heads from websocket
+	go c.subscribeHeads(context, m, ep)
+	return false, nil
+}
+
+func (c *PolkadotChain) getHeads(epName string) (polkadotHeads, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	heads, ok := c.heads[epName]
+	return heads, ok
+}
+
+// Update the heads of an endpoint, the heads never go backwards
+func (c *PolkadotChain) updateHeads(epName string, update func(heads *polkadotHeads)) polkadotHeads {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	heads := c.heads[epName]
+	update(&heads)
+	c.heads[epName] = heads
+	if heads.BestHash != "" {
+		c.rememberBlock(heads.BestHash, heads.Best)
+	}
+	if heads.FinalizedHash != "" {
+		c.rememberBlock(heads.FinalizedHash, heads.Finalized)
+	}
+	return heads
+}
+
+func (c *PolkadotChain) setBlockHeight(blockHash string, height int) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.rememberBlock(blockHash, height)
+}
+
+// must be called with the mutex locked
+func (c *PolkadotChain) rememberBlock(blockHash string, height int) {
+	if _, ok := c.blockHeights[blockHash]; ok {
+		return
+	}
+	c.blockHeights[blockHash] = height
+	c.blockHashes = append(c.blockHashes, blockHash)
+	if len(c.blockHashes) > polkadotMaxBlockHashes {
+		delete(c.blockHeights, c.blockHashes[0])
+		c.blockHashes = c.blockHashes[1:]
+	}
+}
 
-	var bt polkadotBlock
-	err := ep.UnwrapCallRPC(context, reqmsg, &bt)
+func (c *PolkadotChain) getBlockHeight(blockHash string) (int, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	height, ok := c.blockHeights[blockHash]
+	return height, ok
+}
+
+func (c *PolkadotChain) getHeader(ctx context.Context, ep *nodemuxcore.Endpoint, params ...any) (*polkadotBlock, error) {
+	reqmsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "chain_getHeader", params)
+	var bt *polkadotBlock
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &bt)
 	if err != nil {
 		return nil, err
 	}
-	block := &nodemuxcore.Block{
-		Height: bt.Height(),
-		Hash:   "", //bt.Hash,
+	return bt, nil
+}
+
+func (c *PolkadotChain) getBlockHash(ctx context.Context, ep *nodemuxcore.Endpoint, params ...any) (string, error) {
+	reqmsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "chain_getBlockHash", params)
+	var blockHash string
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &blockHash)
+	return blockHash, err
+}
+
+func (c *PolkadotChain) GetBlockhead(ctx context.Context, b *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	// the header of the best hash, so that the height and the hash
+	// are of the same block
+	bestHash, err := c.getBlockHash(ctx, ep)
+	if err != nil {
+		return nil, errors.Wrap(err, "chain_getBlockHash")
+	}
+	best, err := c.getHeader(ctx, ep, bestHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "chain_getHeader")
+	} else if best == nil {
+		return nil, errors.Errorf("header %s not found", bestHash)
+	}
+
+	var finalizedHash string
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(jsoff.NewUuid(), "chain_getFinalizedHead", nil), &finalizedHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "chain_getFinalizedHead")
+	}
+	finalized, err := c.getHeader(ctx, ep, finalizedHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "chain_getHeader")
+	} else if finalized == nil {
+		return nil, errors.Errorf("header %s not found", finalizedHash)
+	}
+
+	heads := c.updateHeads(ep.Name, func(heads *polkadotHeads) {
+		heads.Best, heads.BestHash = best.Height(), bestHash
+		heads.Finalized, heads.FinalizedHash = finalized.Height(), finalizedHash
+	})
+	return heads.block(), nil
+}
+
+func (c *PolkadotChain) subscribeHeads(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
+	wsClient, ok := ep.NewJSONRPCWSClient()
+	if !ok {
+		ep.Log().Panicf("endpoint has no websocket client, %s", ep.Name)
+		return
+	}
+
+	wsClient.OnMessage(func(msg jsoff.Message) {
+		ntf, ok := msg.(*jsoff.NotifyMessage)
+		if !ok || ntf == nil || len(ntf.Params) == 0 {
+			return
+		}
+		if ntf.Method != "chain_newHead" && ntf.Method != "chain_finalizedHead" {
+			return
+		}
+		var headSub polkadotHeadSub
+		err := jsoff.DecodeInterface(ntf.Params[0], &headSub)
+		if err != nil {
+			ep.Log().Warnf("decode head sub error %s", err)
+			return
+		}
+		height := headSub.Result.Height()
+
+		// headers don't carry their own hashes, so the hash is
+		// computed from the header, the parent hash is remembered
+		// too as it is of the same fork
+		if headSub.Result.ParentHash != "" && height > 0 {
+			c.setBlockHeight(headSub.Result.ParentHash, height-1)
+		}
+		hash, err := headSub.Result.Hash()
+		if err != nil {
+			ep.Log().Warnf("hash head error %s", err)
+		}
+
+		heads := c.updateHeads(ep.Name, func(heads *polkadotHeads) {
+			if ntf.Method == "chain_newHead" {
+				heads.Best, heads.BestHash = height, hash
+			} else if height > heads.Finalized {
+				heads.Finalized, heads.FinalizedHash = height, hash
+			}
+		})
+		if heads.Best == 0 {
+			// the best head is not known yet
+			return
+		}
+		bs := nodemuxcore.ChainStatus{
+			EndpointName: ep.Name,
+			Chain:        ep.Chain,
+			Healthy:      true,
+			Blockhead:    heads.block(),
+		}
+		m.Chainhub().Pub() <- bs
+	}) // end of wsClient.OnMessage
+
+	for {
+		err := c.connectAndSub(rootCtx, wsClient, m, ep)
+		if rootCtx.Err() != nil {
+			return
+		}
+		if err != nil {
+			ep.Log().Warnf("connsub error %s, retrying", err)
+			bs := nodemuxcore.ChainStatus{
+				EndpointName: ep.Name,
+				Chain:        ep.Chain,
+				Healthy:      false,
+			}
+			m.Chainhub().Pub() <- bs
+			time.Sleep(2 * time.Second)
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+func (c *PolkadotChain) connectAndSub(rootCtx context.Context, wsClient *jsoffnet.WSClient, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) error {
+	connectCtx, cancel := context.WithCancel(rootCtx)
+	defer cancel()
+
+	err := wsClient.Connect(connectCtx)
+	if err != nil {
+		return err
+	}
+
+	// request the heads
+	headBlock, err := c.GetBlockhead(connectCtx, m, ep)
+	if err != nil {
+		return err
+	}
+	bs := nodemuxcore.ChainStatus{
+		EndpointName: ep.Name,
+		Chain:        ep.Chain,
+		Healthy:      true,
+		Blockhead:    headBlock,
+	}
+	m.Chainhub().Pub() <- bs
+
+	for _, method := range []string{"chain_subscribeNewHeads", "chain_subscribeFinalizedHeads"} {
+		var subscribeToken any
+		submsg := jsoff.NewRequestMessage(jsoff.NewUuid(), method, nil)
+		err = wsClient.UnwrapCall(connectCtx, submsg, &subscribeToken)
+		if err != nil {
+			return errors.Wrap(err, method)
+		}
+		ep.Log().Infof("polkadot got %s token %v", method, subscribeToken)
+	}
+	return wsClient.Wait()
+}
+
+// the block hash argument of a state method
+func polkadotBlockHashAt(reqmsg *jsoff.RequestMessage, idx int) (string, bool) {
+	if len(reqmsg.Params) > idx {
+		if blockHash, ok := reqmsg.Params[idx].(string); ok && blockHash != "" {
+			return blockHash, true
+		}
 	}
-	// TODO: get block hash using chain_getBlockHash
-	return block, nil
+	return "", false
+}
+
+// The height of a block hash, unknown hashes are resolved by
+// chain_getHeader on an endpoint
+func (c *PolkadotChain) resolveBlockHeight(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, blockHash string) (int, bool) {
+	if height, ok := c.getBlockHeight(blockHash); ok {
+		return height, true
+	}
+	ep, found := m.SelectOverHeight(ctx, chain, "chain_getHeader", -2)
+	if !found {
+		return 0, false
+	}
+	header, err := c.getHeader(ctx, ep, blockHash)
+	if err != nil || header == nil {
+		return 0, false
+	}
+	c.setBlockHeight(blockHash, header.Height())
+	return header.Height(), true
+}
+
+// Select an endpoint which has the state at the height, states older
+// than the retention are only available on archive nodes
+func (c *PolkadotChain) selectForState(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, method string, height int) (*nodemuxcore.Endpoint, bool) {
+	if tip, ok := m.MaxTipHeight(chain); ok && height < tip-polkadotStateRetention {
+		return m.SelectWithCapability(ctx, chain, method, height, "archive")
+	}
+	return m.SelectOverHeight(ctx, chain, method, height)
 }
 
 func (c *PolkadotChain) DelegateRPC(rootCtx context.Context, b *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
-	// Custom relay methods can be defined here
+	if reqmsg.Method == "chain_getFinalizedHead" {
+		if ep, found := b.SelectAtCommitment(rootCtx, chain, reqmsg.Method, nodemuxcore.CommitmentFinalized, 0); found {
+			return b.CallEndpointRPC(rootCtx, ep, reqmsg)
+		}
+	}
+	if idx, ok := polkadotStateMethods[reqmsg.Method]; ok {
+		if blockHash, ok := polkadotBlockHashAt(reqmsg, idx); ok {
+			if height, ok := c.resolveBlockHeight(rootCtx, b, chain, blockHash); ok {
+				if ep, found := c.selectForState(rootCtx, b, chain, reqmsg.Method, height); found {
+					return b.CallEndpointRPC(rootCtx, ep, reqmsg)
+				}
+			}
+		}
+	}
 	return b.DefaultRelayRPC(rootCtx, chain, reqmsg, -2)
 }
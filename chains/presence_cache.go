@@ -20,17 +20,28 @@ func presenceCacheKey(chain nodemuxcore.ChainRef, txid string) string {
 }
 
 func presenceCacheUpdate(ctx context.Context, c *redis.Client, chain nodemuxcore.ChainRef, txids []string, epName string, expireAfter time.Duration) {
-	for _, txid := range txids {
-		key := presenceCacheKey(chain, txid)
-		err := c.SAdd(ctx, key, epName).Err()
-		if err != nil {
-			log.Warnf("error while set %s: %s", key, err)
-			return
+	// txids of a block are sent in one pipeline
+	_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, txid := range txids {
+			key := presenceCacheKey(chain, txid)
+			pipe.SAdd(ctx, key, epName)
+			pipe.Expire(ctx, key, expireAfter)
 		}
-		err = c.Expire(ctx, key, expireAfter).Err()
-		if err != nil {
-			log.Warnf("error while expiring key %s: %s", key, err)
-			return
+		return nil
+	})
+	if err != nil {
+		log.Warnf("error while updating presence cache of %s: %s", chain, err)
+	}
+}
+
+// remember the endpoints accepting a broadcasted tx
+func presenceCacheAddTx(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, bc *nodemuxcore.TxBroadcast) {
+	if bc.TxId == "" {
+		return
+	}
+	if c, ok := m.RedisClient(presenceCacheRedisSelector(chain)); ok {
+		for _, ep := range bc.Accepted {
+			presenceCacheUpdate(ctx, c, chain, []string{bc.TxId}, ep.Name, time.Second*600)
 		}
 	}
 }
@@ -90,7 +101,9 @@ func presenceCacheMatchRequest(ctx context.Context, m *nodemuxcore.Multiplexer,
 	if err != nil {
 		reqmsg.Log().Warnf("error decoding params for txid: %s", err)
 	} else if txidExtractor.Txid != "" {
-		return presenceCacheGetEndpoint(ctx, m, chain, txidExtractor.Txid)
+		ep, hit := presenceCacheGetEndpoint(ctx, m, chain, txidExtractor.Txid)
+		nodemuxcore.RecordCacheResult(ctx, chain, "presence", hit)
+		return ep, hit
 	}
 	return nil, false
 }
@@ -4,9 +4,12 @@ package chains
 
 import (
 	"context"
+	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -18,54 +21,420 @@ var (
 	}
 )
 
+var (
+	// genesis hashes of solana clusters
+	solanaGenesisHashes map[string]string = map[string]string{
+		"mainnet":      "5eykt4UsFv8P8NJdTREpY1vzqKqZKvdpKuc147dw2N9d",
+		"mainnet-beta": "5eykt4UsFv8P8NJdTREpY1vzqKqZKvdpKuc147dw2N9d",
+		"devnet":       "EtWTRABZaYq6iMfeYKouRu166VU2xqa1wcaWoxPkrZBG",
+		"testnet":      "4uhcVJyU9pJkvQyS88uRDiswHXSCkY3zQawwpjk2NsNY",
+	}
+)
+
+// slots of an endpoint at each commitment level
+type solanaSlots struct {
+	Processed int
+	Confirmed int
+	Finalized int
+}
+
+func (s solanaSlots) At(commitment string) int {
+	switch commitment {
+	case "processed":
+		return s.Processed
+	case "confirmed":
+		return s.Confirmed
+	default:
+		return s.Finalized
+	}
+}
+
+// the confirmed slot is reported as the safe height
+func (s solanaSlots) block() *nodemuxcore.Block {
+	return &nodemuxcore.Block{
+		Height:    s.Processed,
+		Safe:      s.Confirmed,
+		Finalized: s.Finalized,
+	}
+}
+
+type solanaSlotInfo struct {
+	Parent int
+	Root   int
+	Slot   int
+}
+
+type solanaSlotSub struct {
+	Subscription int
+	Result       solanaSlotInfo
+}
+
+type solanaSubkey struct {
+	EpName string
+	Token  int
+}
+
 type SolanaChain struct {
+	mutex     sync.RWMutex
+	slots     map[string]solanaSlots
+	subTokens map[solanaSubkey]bool
 }
 
 func NewSolanaChain() *SolanaChain {
-	return &SolanaChain{}
+	return &SolanaChain{
+		slots:     make(map[string]solanaSlots),
+		subTokens: make(map[solanaSubkey]bool),
+	}
 }
 
-func (c SolanaChain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+func (c *SolanaChain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
 	return "", nil
 }
 
-func (c SolanaChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
-	return true, nil
+func (c *SolanaChain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var genesisHash string
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getGenesisHash", nil), &genesisHash)
+	if err != nil {
+		return nil, errors.Wrap(err, "getGenesisHash")
+	}
+	return &nodemuxcore.NetworkIdentity{GenesisHash: genesisHash}, nil
 }
 
-func (c *SolanaChain) GetBlockhead(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
-	config := map[string]string{"commitement": "confirmed"}
+func (c *SolanaChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if genesisHash, ok := solanaGenesisHashes[chain.Network]; ok {
+		return &nodemuxcore.NetworkIdentity{GenesisHash: genesisHash}, true
+	}
+	return nil, false
+}
+
+func (c *SolanaChain) ProbeCapabilities(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.Capabilities, error) {
+	caps := nodemuxcore.NewCapabilities()
+
+	// nodes holding the full ledger can serve blocks since slot 0
+	var firstSlot int
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "getFirstAvailableBlock", nil), &firstSlot)
+	if err == nil {
+		caps.Set("archive", firstSlot == 0)
+	}
+	return caps, nil
+}
+
+func (c *SolanaChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	if !ep.HasWebsocket() {
+		return true, nil
+	}
+
+	// subscribe slots from websocket
+	go c.subscribeSlots(context, m, ep)
+	return false, nil
+}
+
+func (c *SolanaChain) getSlot(ctx context.Context, ep *nodemuxcore.Endpoint, commitment string) (int, error) {
+	config := map[string]string{"commitment": commitment}
 	reqmsg := jsoff.NewRequestMessage(
-		1, "getSlot", []any{config})
+		jsoff.NewUuid(), "getSlot", []any{config})
 
 	var slot int
-	err := ep.UnwrapCallRPC(context, reqmsg, &slot)
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &slot)
 	if err != nil {
+		return 0, errors.Wrapf(err, "getSlot %s", commitment)
+	}
+	return slot, nil
+}
+
+// The blockhead height is the processed slot, the confirmed and
+// finalized slots are tracked along for commitment aware routing
+func (c *SolanaChain) GetBlockhead(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
+	var slots solanaSlots
+	var err error
+	if slots.Processed, err = c.getSlot(context, ep, "processed"); err != nil {
 		return nil, err
 	}
-	block := &nodemuxcore.Block{
-		Height: slot,
+	if slots.Confirmed, err = c.getSlot(context, ep, "confirmed"); err != nil {
+		return nil, err
+	}
+	if slots.Finalized, err = c.getSlot(context, ep, "finalized"); err != nil {
+		return nil, err
 	}
-	return block, nil
+	c.setSlots(ep.Name, slots)
+
+	return slots.block(), nil
+}
+
+func (c *SolanaChain) setSlots(epName string, slots solanaSlots) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots[epName] = slots
+}
+
+func (c *SolanaChain) getSlots(epName string) (solanaSlots, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	slots, ok := c.slots[epName]
+	return slots, ok
+}
+
+// update slots from a slot notification, the root slot is finalized
+func (c *SolanaChain) updateSlots(epName string, info solanaSlotInfo) solanaSlots {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	slots := c.slots[epName]
+	if info.Slot > slots.Processed {
+		slots.Processed = info.Slot
+	}
+	if info.Root > slots.Finalized {
+		slots.Finalized = info.Root
+	}
+	if slots.Confirmed < slots.Finalized {
+		slots.Confirmed = slots.Finalized
+	}
+	c.slots[epName] = slots
+	return slots
+}
+
+func (c *SolanaChain) hasSubToken(subkey solanaSubkey) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.subTokens[subkey]
+	return ok
+}
+
+func (c *SolanaChain) setSubToken(subkey solanaSubkey, on bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if on {
+		c.subTokens[subkey] = true
+	} else {
+		delete(c.subTokens, subkey)
+	}
+}
+
+func (c *SolanaChain) subscribeSlots(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
+	wsClient, ok := ep.NewJSONRPCWSClient()
+	if !ok {
+		ep.Log().Panicf("endpoint has no websocket client, %s", ep.Name)
+		return
+	}
+
+	var confirmedAt time.Time
+	wsClient.OnMessage(func(msg jsoff.Message) {
+		ntf, ok := msg.(*jsoff.NotifyMessage)
+		if !ok || ntf == nil {
+			return
+		}
+		if ntf.Method != "slotNotification" || len(ntf.Params) == 0 {
+			return
+		}
+		var slotSub solanaSlotSub
+		err := jsoff.DecodeInterface(ntf.Params[0], &slotSub)
+		if err != nil {
+			ep.Log().Warnf("decode slot sub error %s", err)
+			return
+		}
+		subkey := solanaSubkey{EpName: ep.Name, Token: slotSub.Subscription}
+		if !c.hasSubToken(subkey) {
+			ep.Log().Warnf("subscription %d not found", slotSub.Subscription)
+			return
+		}
+		slots := c.updateSlots(ep.Name, slotSub.Result)
+
+		// slot notifications don't carry the confirmed slot, so
+		// poll it at most every second
+		if time.Since(confirmedAt) >= time.Second {
+			confirmedAt = time.Now()
+			go c.updateConfirmedSlot(rootCtx, ep)
+		}
+
+		bs := nodemuxcore.ChainStatus{
+			EndpointName: ep.Name,
+			Chain:        ep.Chain,
+			Healthy:      true,
+			Blockhead:    slots.block(),
+		}
+		m.Chainhub().Pub() <- bs
+	}) // end of wsClient.OnMessage
+
+	for {
+		err := c.connectAndSub(rootCtx, wsClient, m, ep)
+		if err != nil {
+			ep.Log().Warnf("connsub error %s, retrying", err)
+			bs := nodemuxcore.ChainStatus{
+				EndpointName: ep.Name,
+				Chain:        ep.Chain,
+				Healthy:      false,
+			}
+			m.Chainhub().Pub() <- bs
+			time.Sleep(2 * time.Second)
+		} else {
+			time.Sleep(1 * time.Second)
+		}
+	}
+}
+
+func (c *SolanaChain) updateConfirmedSlot(ctx context.Context, ep *nodemuxcore.Endpoint) {
+	confirmed, err := c.getSlot(ctx, ep, "confirmed")
+	if err != nil {
+		ep.Log().Warnf("get confirmed slot error %s", err)
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	slots := c.slots[ep.Name]
+	if confirmed > slots.Confirmed {
+		slots.Confirmed = confirmed
+		c.slots[ep.Name] = slots
+	}
+}
+
+func (c *SolanaChain) connectAndSub(rootCtx context.Context, wsClient *jsoffnet.WSClient, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) error {
+	connectCtx, cancel := context.WithCancel(rootCtx)
+	defer cancel()
+
+	// connect websocket
+	err := wsClient.Connect(connectCtx)
+	if err != nil {
+		return err
+	}
+
+	// request slots
+	headBlock, err := c.GetBlockhead(connectCtx, m, ep)
+	if err != nil {
+		return err
+	}
+	bs := nodemuxcore.ChainStatus{
+		EndpointName: ep.Name,
+		Chain:        ep.Chain,
+		Healthy:      true,
+		Blockhead:    headBlock,
+	}
+	m.Chainhub().Pub() <- bs
+
+	// send sub command
+	var subscribeToken int
+	submsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "slotSubscribe", nil)
+	err = wsClient.UnwrapCall(connectCtx, submsg, &subscribeToken)
+	if err != nil {
+		return err
+	}
+	subkey := solanaSubkey{
+		EpName: ep.Name,
+		Token:  subscribeToken,
+	}
+	c.setSubToken(subkey, true)
+	ep.Log().Infof("solana got subscribe token %d", subscribeToken)
+	defer c.setSubToken(subkey, false)
+
+	return wsClient.Wait()
+}
+
+// The commitment of a request, which is in the config object at
+// params[idx], the default is finalized
+func solanaCommitment(reqmsg *jsoff.RequestMessage, idx int) string {
+	if len(reqmsg.Params) > idx {
+		if config, ok := reqmsg.Params[idx].(map[string]any); ok {
+			if commitment, ok := config["commitment"].(string); ok {
+				return commitment
+			}
+		}
+	}
+	return "finalized"
+}
+
+// Select an endpoint whose slot at the commitment level is at least
+// minSlot, minSlot <= 0 means within -minSlot behind the best slot
+// at that level among the endpoints
+func (c *SolanaChain) selectBySlot(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, method string, commitment string, minSlot int) (*nodemuxcore.Endpoint, bool) {
+	if minSlot <= 0 {
+		best := 0
+		for _, ep := range m.AllHealthyEndpoints(chain, method, 0) {
+			if slots, ok := c.getSlots(ep.Name); ok && slots.At(commitment) > best {
+				best = slots.At(commitment)
+			}
+		}
+		minSlot = best + minSlot
+	}
+	return m.SelectAccepted(ctx, chain, method, func(ep *nodemuxcore.Endpoint) bool {
+		slots, ok := c.getSlots(ep.Name)
+		return ok && slots.At(commitment) >= minSlot
+	})
+}
+
+// the tx is regarded as mined once it's confirmed
+func (c *SolanaChain) GetTxHeight(ctx context.Context, ep *nodemuxcore.Endpoint, txid string) (int, error) {
+	reqmsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "getSignatureStatuses", []any{[]string{txid}})
+
+	var statuses struct {
+		Value []*struct {
+			Slot               int    `json:"slot"`
+			ConfirmationStatus string `json:"confirmationStatus"`
+		} `json:"value"`
+	}
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &statuses)
+	if err != nil {
+		return 0, err
+	}
+	if len(statuses.Value) == 0 || statuses.Value[0] == nil || statuses.Value[0].ConfirmationStatus == "processed" {
+		return 0, nil
+	}
+	return statuses.Value[0].Slot, nil
+}
+
+var solanaTxSubmitMethods = map[string]nodemuxcore.TxSubmitMethod{
+	"sendTransaction": {
+		Classify: classifyTxByMessage(
+			[]string{"already been processed"},
+			[]string{"blockhash not found", "node is behind", "node is unhealthy"}),
+		TxId: txIdFromResult,
+	},
 }
 
 func (c *SolanaChain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if submit, ok := solanaTxSubmitMethods[reqmsg.Method]; ok {
+		// broadcast the transaction to endpoints
+		return broadcastTxRPC(ctx, m, chain, reqmsg, submit)
+	}
+
+	var ep *nodemuxcore.Endpoint
 	useCache := false
 	cacheExpire := time.Second * 60
+	switch reqmsg.Method {
+	case "getBlock":
+		var slot int
+		commitment := solanaCommitment(reqmsg, 1)
+		if len(reqmsg.Params) > 0 && jsoff.DecodeInterface(reqmsg.Params[0], &slot) == nil && slot > 0 {
+			ep, _ = c.selectBySlot(ctx, m, chain, reqmsg.Method, commitment, slot)
+		}
+		// only finalized blocks are immutable
+		useCache = commitment == "finalized"
+	case "getTransaction":
+		commitment := solanaCommitment(reqmsg, 1)
+		ep, _ = c.selectBySlot(ctx, m, chain, reqmsg.Method, commitment, -60)
+		useCache = commitment == "finalized"
+	default:
+		_, useCache = solanaCachableMethods[reqmsg.Method]
+	}
 	if exp, ok := solanaCachableMethods[reqmsg.Method]; ok {
-		useCache = true
 		cacheExpire = exp
+	}
+
+	if useCache {
 		if resmsgFromCache, found := jsonrpcCacheFetch(ctx, m, chain, reqmsg, -60); found {
 			reqmsg.Log().Infof("get result from cache")
 			return resmsgFromCache, nil
 		}
 	}
 
-	retmsg, ep, err := m.DefaultRelayRPCTakingEndpoint(ctx, chain, reqmsg, -60)
+	var retmsg jsoff.Message
+	var err error
+	if ep != nil {
+		retmsg, err = m.CallEndpointRPC(ctx, ep, reqmsg)
+	} else {
+		retmsg, ep, err = m.DefaultRelayRPCTakingEndpoint(ctx, chain, reqmsg, -60)
+	}
 	if err == nil && ep != nil && useCache && retmsg.IsResult() {
 		jsonrpcCacheUpdate(ctx, m, ep, chain, reqmsg, retmsg.(*jsoff.ResultMessage), cacheExpire)
 	}
 	return retmsg, err
-
-	// return m.DefaultRelayRPC(ctx, chain, reqmsg, -10)
 }
@@ -27,6 +27,27 @@ func (c StarcoinChain) GetClientVersion(context context.Context, ep *nodemuxcore
 	return "", nil
 }
 
+type starcoinChainId struct {
+	Name string `json:"name"`
+	Id   int    `json:"id"`
+}
+
+func (c StarcoinChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var chainId starcoinChainId
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "chain.id", nil), &chainId)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: chainId.Name}, nil
+}
+
+func (c StarcoinChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	return knownChainId(map[string]string{
+		"main":    "main",
+		"barnard": "barnard",
+	}, chain)
+}
+
 func (c StarcoinChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
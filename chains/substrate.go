@@ -48,6 +48,25 @@ func (c SubstrateAPI) GetClientVersion(context context.Context, ep *nodemuxcore.
 	return "", nil
 }
 
+type substrateRuntimeSpec struct {
+	SpecName string `json:"specName"`
+}
+
+func (c SubstrateAPI) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var spec substrateRuntimeSpec
+	err := ep.GetJson(context, "/runtime/spec", nil, &spec)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: spec.SpecName}, nil
+}
+
+func (c SubstrateAPI) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	// sidecars of different chains share the namespace, the spec
+	// name should be configured
+	return nil, false
+}
+
 func (c SubstrateAPI) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -46,6 +46,25 @@ func (c SuiChain) GetClientVersion(context context.Context, ep *nodemuxcore.Endp
 	return rpc.ToString(), nil
 }
 
+func (c SuiChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var chainId string
+	err := ep.UnwrapCallRPC(context, jsoff.NewRequestMessage(1, "sui_getChainIdentifier", []any{}), &chainId)
+	if err != nil {
+		return nil, errors.Wrap(err, "call.chainIdentifier")
+	}
+	return &nodemuxcore.NetworkIdentity{ChainId: chainId}, nil
+}
+
+func (c SuiChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Namespace != "sui" {
+		return nil, false
+	}
+	return knownChainId(map[string]string{
+		"mainnet": "35834a8a",
+		"testnet": "4c78adac",
+	}, chain)
+}
+
 func (c SuiChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
@@ -76,7 +95,19 @@ func (c *SuiChain) GetBlockhead(context context.Context, b *nodemuxcore.Multiple
 	return block, nil
 }
 
+var suiTxSubmitMethods = map[string]nodemuxcore.TxSubmitMethod{
+	"sui_executeTransactionBlock": {
+		Classify: classifyTxByMessage(
+			nil,
+			[]string{"timeout", "overload"}),
+		TxId: txIdFromResultField("digest"),
+	},
+}
+
 func (c *SuiChain) DelegateRPC(rootCtx context.Context, b *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if submit, ok := suiTxSubmitMethods[reqmsg.Method]; ok {
+		return broadcastTxRPC(rootCtx, b, chain, reqmsg, submit)
+	}
 	// Custom relay methods can be defined here
 	return b.DefaultRelayRPC(rootCtx, chain, reqmsg, -3)
 }
@@ -2,8 +2,10 @@ package chains
 
 import (
 	"context"
+	"encoding/json"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
+	"strings"
 )
 
 type tronBlock struct {
@@ -28,28 +30,107 @@ func (c TronChain) GetClientVersion(context context.Context, ep *nodemuxcore.End
 	return "", nil
 }
 
+type tronGetBlockByNum struct {
+	Num int `json:"num"`
+}
+
+func (c TronChain) GetNetworkIdentity(context context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var genesis tronBlock
+	err := ep.PostJson(context,
+		"/wallet/getblockbynum",
+		tronGetBlockByNum{Num: 0}, nil, &genesis)
+	if err != nil {
+		return nil, err
+	}
+	return &nodemuxcore.NetworkIdentity{GenesisHash: genesis.BlockID}, nil
+}
+
+func (c TronChain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chain.Network == "mainnet" {
+		return &nodemuxcore.NetworkIdentity{
+			GenesisHash: "00000000000000001ebf88508a03865c71d452e25f4d51194196a1d22b6653dc",
+		}, true
+	}
+	return nil, false
+}
+
 func (c TronChain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
 	return true, nil
 }
 
+// the head is the now block of the full node, the solidified block
+// of walletsolidity is the finalized one
 func (c *TronChain) GetBlockhead(context context.Context, b *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (*nodemuxcore.Block, error) {
 	var res tronBlock
 	err := ep.PostJson(context,
-		"/walletsolidity/getnowblock",
+		"/wallet/getnowblock",
 		nil, nil, &res)
 	if err != nil {
 		return nil, err
 	}
 
+	var solid tronBlock
+	err = ep.PostJson(context,
+		"/walletsolidity/getnowblock",
+		nil, nil, &solid)
+	if err != nil {
+		return nil, err
+	}
+
 	height := res.BlockHeader.RawData.Number
 	block := &nodemuxcore.Block{
-		Height: height,
-		Hash:   res.BlockID,
+		Height:    height,
+		Hash:      res.BlockID,
+		Finalized: solid.BlockHeader.RawData.Number,
 	}
 	return block, nil
 }
 
+var tronTxSubmitPaths = map[string]nodemuxcore.TxSubmitPath{
+	"/wallet/broadcasttransaction": {
+		Classify: classifyTronTx,
+		TxId:     txIdFromBodyField("txid"),
+	},
+	"/wallet/broadcasthex": {
+		Classify: classifyTronTx,
+		TxId:     txIdFromBodyField("txid"),
+	},
+}
+
+func classifyTronTx(res *nodemuxcore.HTTPResult) nodemuxcore.TxOutcome {
+	if outcome, ok := classifyHTTPStatus(res); ok {
+		return outcome
+	}
+	var body struct {
+		Result bool   `json:"result"`
+		Code   string `json:"code"`
+	}
+	if err := json.Unmarshal(res.Body, &body); err != nil {
+		return nodemuxcore.TxRetryable
+	}
+	switch {
+	case body.Result:
+		return nodemuxcore.TxSuccess
+	case body.Code == "DUP_TRANSACTION_ERROR":
+		return nodemuxcore.TxAlreadyKnown
+	case body.Code == "SERVER_BUSY" || body.Code == "NO_CONNECTION" || body.Code == "NOT_ENOUGH_EFFECTIVE_CONNECTION":
+		return nodemuxcore.TxRetryable
+	default:
+		return nodemuxcore.TxFatal
+	}
+}
+
 func (c *TronChain) DelegateREST(rootCtx context.Context, b *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, path string, w http.ResponseWriter, r *http.Request) error {
+	if submit, ok := tronTxSubmitPaths[path]; ok && r.Method == http.MethodPost {
+		return broadcastTxREST(rootCtx, b, chain, path, w, r, submit)
+	}
+	if strings.HasPrefix(path, "/walletsolidity/") {
+		// solidified data are served by the endpoints near the
+		// best solidified block
+		if ep, found := b.SelectAtCommitment(rootCtx, chain, path, nodemuxcore.CommitmentFinalized, -30); found {
+			return ep.PipeApiRequest(rootCtx, nodemuxcore.ApiREST, path, w, r)
+		}
+	}
 	// Custom relay methods can be defined here
 	return b.DefaultPipeREST(rootCtx, chain, path, w, r, -30)
 }
@@ -1,5 +1,9 @@
 package chains
 
+import (
+	"github.com/superisaac/nodemux/core"
+)
+
 func resolveMap(root interface{}, path ...string) (interface{}, bool) {
 	v := root
 	for {
@@ -21,3 +25,11 @@ func resolveMap(root interface{}, path ...string) (interface{}, bool) {
 		}
 	}
 }
+
+// look up the well known chain id of a network
+func knownChainId(chainIds map[string]string, chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chainId, ok := chainIds[chain.Network]; ok {
+		return &nodemuxcore.NetworkIdentity{ChainId: chainId}, true
+	}
+	return nil, false
+}
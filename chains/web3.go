@@ -6,10 +6,12 @@ import (
 	"context"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 	// "fmt"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/nodemux/core"
@@ -91,6 +93,67 @@ var (
 		"eth_getTransactionByBlockNumberAndIndex": time.Second * 30,
 		"eth_getTransactionReceipt":               time.Second * 10,
 	}
+
+	// the chain ids of well known networks, endpoints reporting
+	// other chain ids are rejected unless the chain is configured
+	web3ChainIds map[string]string = map[string]string{
+		"ethereum/mainnet":         "0x1",
+		"ethereum/sepolia":         "0xaa36a7",
+		"ethereum/holesky":         "0x4268",
+		"ethereum-classic/mainnet": "0x3d",
+		"binance-chain/mainnet":    "0x38",
+		"binance-chain/testnet":    "0x61",
+		"polygon/mainnet":          "0x89",
+		"polygon/amoy":             "0x13882",
+		"okex-token/mainnet":       "0x42",
+		"huobi-token/mainnet":      "0x80",
+		"fantom-web3/mainnet":      "0xfa",
+		"base/mainnet":             "0x2105",
+		"base/sepolia":             "0x14a34",
+		"avax/mainnet":             "0xa86a",
+		"arb/mainnet":              "0xa4b1",
+		"optimism/mainnet":         "0xa",
+		"x-layer/mainnet":          "0xc4",
+	}
+
+	// methods taking block tags and the index of the tag parameter
+	web3BlockTagMethods map[string]int = map[string]int{
+		"eth_getBlockByNumber":                    0,
+		"eth_getBlockTransactionCountByNumber":    0,
+		"eth_getTransactionByBlockNumberAndIndex": 0,
+		"eth_getBalance":                          1,
+		"eth_getCode":                             1,
+		"eth_getTransactionCount":                 1,
+		"eth_call":                                1,
+		"eth_getStorageAt":                        2,
+		"eth_getProof":                            2,
+	}
+
+	// state methods and the index of their block parameter
+	web3StateMethods map[string]int = map[string]int{
+		"eth_getBalance":          1,
+		"eth_getCode":             1,
+		"eth_getTransactionCount": 1,
+		"eth_call":                1,
+		"eth_getStorageAt":        2,
+		"eth_getProof":            2,
+	}
+
+	// read methods without block tags which can be verified
+	web3VerifiableMethods map[string]bool = map[string]bool{
+		"eth_chainId":               true,
+		"eth_getBlockByHash":        true,
+		"eth_getTransactionByHash":  true,
+		"eth_getTransactionReceipt": true,
+	}
+)
+
+const (
+	// non-archive nodes keep the states of recent 128 blocks
+	web3StateRetention = 128
+
+	web3ZeroAddress = "0x0000000000000000000000000000000000000000"
+	web3ZeroHash    = "0x0000000000000000000000000000000000000000000000000000000000000000"
 )
 
 type web3Block struct {
@@ -113,6 +176,15 @@ func (blk *web3Block) Height() int {
 	return blk.height
 }
 
+var web3TxSubmitMethods = map[string]nodemuxcore.TxSubmitMethod{
+	"eth_sendRawTransaction": {
+		Classify: classifyTxByMessage(
+			[]string{"already known", "known transaction", "already imported"},
+			[]string{"txpool is full", "timeout"}),
+		TxId: txIdFromResult,
+	},
+}
+
 type web3HeadSub struct {
 	Subscription string
 	Result       web3Block
@@ -123,17 +195,29 @@ type web3Subkey struct {
 	Token  string
 }
 
+// the default interval in seconds of refreshing the safe and finalized heights
+const web3CommittedInterval = 30
+
+// the safe and finalized heights of an endpoint
+type web3Committed struct {
+	Safe      int
+	Finalized int
+}
+
 type Web3Chain struct {
+	mutex     sync.RWMutex
+	committed map[string]web3Committed
 	subTokens map[web3Subkey]bool
 }
 
 func NewWeb3Chain() *Web3Chain {
 	return &Web3Chain{
+		committed: make(map[string]web3Committed),
 		subTokens: make(map[web3Subkey]bool),
 	}
 }
 
-func (c Web3Chain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
+func (c *Web3Chain) GetClientVersion(context context.Context, ep *nodemuxcore.Endpoint) (string, error) {
 	reqmsg := jsoff.NewRequestMessage(
 		1, "web3_clientVersion", nil)
 	var v string
@@ -145,7 +229,86 @@ func (c Web3Chain) GetClientVersion(context context.Context, ep *nodemuxcore.End
 	return v, nil
 }
 
-func (c Web3Chain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+func (c *Web3Chain) GetNetworkIdentity(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.NetworkIdentity, error) {
+	var chainId string
+	err := ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "eth_chainId", nil), &chainId)
+	if err != nil {
+		return nil, errors.Wrap(err, "eth_chainId")
+	}
+
+	// the genesis block is fetched only if its hash is checked
+	if expected, ok := nodemuxcore.ExpectedIdentityFromContext(ctx); ok && expected.GenesisHash == "" {
+		return &nodemuxcore.NetworkIdentity{ChainId: chainId}, nil
+	}
+
+	var genesis web3Block
+	err = ep.UnwrapCallRPC(ctx, jsoff.NewRequestMessage(1, "eth_getBlockByNumber", []any{"0x0", false}), &genesis)
+	if err != nil {
+		return nil, errors.Wrap(err, "get genesis block")
+	}
+	return &nodemuxcore.NetworkIdentity{
+		ChainId:     chainId,
+		GenesisHash: genesis.Hash,
+	}, nil
+}
+
+func (c *Web3Chain) KnownNetworkIdentity(chain nodemuxcore.ChainRef) (*nodemuxcore.NetworkIdentity, bool) {
+	if chainId, ok := web3ChainIds[chain.String()]; ok {
+		return &nodemuxcore.NetworkIdentity{ChainId: chainId}, true
+	}
+	return nil, false
+}
+
+func (c *Web3Chain) ProbeCapabilities(ctx context.Context, ep *nodemuxcore.Endpoint) (*nodemuxcore.Capabilities, error) {
+	caps := nodemuxcore.NewCapabilities()
+	prev := ep.Capabilities
+
+	// the method exists if it doesn't return method not found, the
+	// previous state is kept if the probe fails
+	resmsg, err := c.probeCall(ctx, ep, "debug_traceTransaction", web3ZeroHash)
+	if err != nil {
+		caps.Keep(prev, "debug", "debug_")
+	} else {
+		caps.Set("debug", !web3MethodNotFound(resmsg), "debug_")
+	}
+
+	resmsg, err = c.probeCall(ctx, ep, "trace_block", "0x1")
+	if err != nil {
+		caps.Keep(prev, "trace", "trace_")
+	} else {
+		caps.Set("trace", !web3MethodNotFound(resmsg), "trace_")
+	}
+
+	// non-archive nodes fail with missing trie node
+	resmsg, err = c.probeCall(ctx, ep, "eth_getBalance", web3ZeroAddress, "0x1")
+	if err != nil {
+		caps.Keep(prev, "archive")
+	} else {
+		caps.Set("archive", resmsg.IsResult())
+	}
+
+	// chains without the block tags reject the finalized tag
+	resmsg, err = c.probeCall(ctx, ep, "eth_getBlockByNumber", nodemuxcore.CommitmentFinalized, false)
+	if err != nil {
+		caps.Keep(prev, "finalized")
+	} else {
+		caps.Set("finalized", resmsg.IsResult())
+	}
+	return caps, nil
+}
+
+func (c *Web3Chain) probeCall(ctx context.Context, ep *nodemuxcore.Endpoint, method string, params ...any) (jsoff.Message, error) {
+	reqmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), method, params)
+	return ep.JSONRPCClient().Call(ctx, reqmsg)
+}
+
+func web3MethodNotFound(resmsg jsoff.Message) bool {
+	return resmsg.IsError() && resmsg.MustError().Code == jsoff.ErrMethodNotFound.Code
+}
+
+func (c *Web3Chain) StartSync(context context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) (bool, error) {
+	go c.syncCommitted(context, ep)
+
 	if !ep.HasWebsocket() {
 		return true, nil
 	}
@@ -170,6 +333,7 @@ func (c *Web3Chain) GetBlockhead(context context.Context, m *nodemuxcore.Multipl
 		Height: bt.Height(),
 		Hash:   bt.Hash,
 	}
+	c.fillCommitted(ep, block)
 
 	if ep.Blockhead == nil || ep.Blockhead.Height != bt.Height() {
 		if c, ok := m.RedisClient(presenceCacheRedisSelector(ep.Chain)); ok {
@@ -183,42 +347,74 @@ func (c *Web3Chain) GetBlockhead(context context.Context, m *nodemuxcore.Multipl
 	return block, nil
 }
 
-func (c *Web3Chain) sendRawTransaction(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
-	resMsgs := m.BroadcastRPC(ctx, chain, reqmsg, -10)
-	if len(resMsgs) == 0 {
-		return m.DefaultRelayRPC(ctx, chain, reqmsg, -5)
+// Fill the heights of the safe and finalized blocks from the last
+// refresh, the levels stay unreported on chains which don't support
+// the block tags
+func (c *Web3Chain) fillCommitted(ep *nodemuxcore.Endpoint, block *nodemuxcore.Block) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if committed, ok := c.committed[ep.Name]; ok {
+		block.Safe = committed.Safe
+		block.Finalized = committed.Finalized
 	}
+}
 
-	// try find the correct response
-	// return the first correct response
-	for _, res := range resMsgs {
-		if res.Err == nil && res.Response.IsResult() {
-			return res.Response, nil
+// Refresh the safe and finalized heights periodically, they move
+// slower than the head so they are not fetched along with every head
+func (c *Web3Chain) syncCommitted(rootCtx context.Context, ep *nodemuxcore.Endpoint) {
+	interval := ep.Config.IntOption("committed_interval", web3CommittedInterval)
+	for {
+		if ep.HasCapability("finalized") {
+			c.fetchCommitted(rootCtx, ep)
 		}
-	}
-
-	// return the first -32000, already known result
-	for _, res := range resMsgs {
-		if res.Err == nil && res.Response.IsError() && res.Response.MustError().Code == -32000 {
-			return res.Response, nil
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
 		}
 	}
+}
 
-	// return the first error msg
-	for _, res := range resMsgs {
-		if res.Err == nil && res.Response.IsError() {
-			return res.Response, nil
+func (c *Web3Chain) fetchCommitted(ctx context.Context, ep *nodemuxcore.Endpoint) {
+	var committed web3Committed
+	for _, tag := range []string{nodemuxcore.CommitmentSafe, nodemuxcore.CommitmentFinalized} {
+		reqmsg := jsoff.NewRequestMessage(
+			jsoff.NewUuid(), "eth_getBlockByNumber",
+			[]any{tag, false})
+		var bt *web3Block
+		if err := ep.UnwrapCallRPC(ctx, reqmsg, &bt); err != nil || bt == nil || bt.Number == "" {
+			continue
+		}
+		if tag == nodemuxcore.CommitmentSafe {
+			committed.Safe = bt.Height()
+		} else {
+			committed.Finalized = bt.Height()
 		}
 	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.committed[ep.Name] = committed
+}
 
-	// return the first item that has a message
-	for _, res := range resMsgs {
-		if res.Err == nil && res.Response != nil {
-			return res.Response, nil
-		}
+func (c *Web3Chain) GetTxHeight(ctx context.Context, ep *nodemuxcore.Endpoint, txid string) (int, error) {
+	reqmsg := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "eth_getTransactionReceipt", []any{txid})
+
+	var receipt *struct {
+		BlockNumber string `json:"blockNumber"`
 	}
-	// reutrn error
-	return nil, resMsgs[0].Err
+	err := ep.UnwrapCallRPC(ctx, reqmsg, &receipt)
+	if err != nil {
+		return 0, err
+	}
+	if receipt == nil || receipt.BlockNumber == "" {
+		return 0, nil
+	}
+	height, err := hexutil.DecodeUint64(receipt.BlockNumber)
+	if err != nil {
+		return 0, errors.Wrap(err, "decode block number")
+	}
+	return int(height), nil
 }
 
 func (c *Web3Chain) getTransactionCount(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
@@ -256,6 +452,9 @@ func (c *Web3Chain) getTransactionCount(ctx context.Context, m *nodemuxcore.Mult
 	}
 
 	if maxResMsg != nil {
+		if nonce, ok := nonceTrackerAdjust(ctx, m, chain, reqmsg, maxNonce); ok {
+			return jsoff.NewResultMessage(reqmsg, hexutil.EncodeUint64(nonce)), nil
+		}
 		return maxResMsg, nil
 	}
 
@@ -315,6 +514,16 @@ func (c *Web3Chain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer,
 		}
 	}
 
+	if idx, ok := web3BlockTagMethods[reqmsg.Method]; ok {
+		// finalized data are served by endpoints which have
+		// finalized the head
+		if commitment, ok := c.findCommitmentAt(reqmsg, idx); ok {
+			if ep, found := m.SelectAtCommitment(ctx, chain, reqmsg.Method, commitment, 0); found {
+				return m.CallEndpointRPC(ctx, ep, reqmsg)
+			}
+		}
+	}
+
 	if reqmsg.Method == "eth_getBlockByNumber" {
 		return c.getBlockByNumber(ctx, m, chain, reqmsg, r)
 	}
@@ -331,15 +540,34 @@ func (c *Web3Chain) DelegateRPC(ctx context.Context, m *nodemuxcore.Multiplexer,
 		return retmsg, nil
 	}
 
-	if reqmsg.Method == "eth_sendRawTransaction" {
-		// broadcast raw transactions to all endpoints
-		return c.sendRawTransaction(ctx, m, chain, reqmsg)
+	if submit, ok := web3TxSubmitMethods[reqmsg.Method]; ok {
+		// broadcast raw transactions to endpoints
+		resmsg, err := broadcastTxRPC(ctx, m, chain, reqmsg, submit)
+		if err == nil && resmsg != nil && resmsg.IsResult() {
+			nonceTrackerRecord(ctx, m, chain, reqmsg)
+		}
+		return resmsg, err
 	}
 
 	if reqmsg.Method == "eth_getTransactionCount" {
 		return c.getTransactionCount(ctx, m, chain, reqmsg)
 	}
 
+	if reqmsg.Method == "eth_getLogs" {
+		return c.getLogs(ctx, m, chain, reqmsg)
+	}
+
+	if idx, ok := web3StateMethods[reqmsg.Method]; ok {
+		// states of old blocks are only available on archive nodes
+		if height, ok := c.findBlockHeightAt(reqmsg, idx); ok && height > 0 {
+			if tip, ok := m.MaxTipHeight(chain); ok && height < tip-web3StateRetention {
+				if ep, found := m.SelectWithCapability(ctx, chain, reqmsg.Method, height, "archive"); found {
+					return m.CallEndpointRPC(ctx, ep, reqmsg)
+				}
+			}
+		}
+	}
+
 	heightSpec := -2
 
 	retmsg, ep, err := m.DefaultRelayRPCTakingEndpoint(ctx, chain, reqmsg, heightSpec)
@@ -375,6 +603,60 @@ func (c *Web3Chain) findBlockHeight(reqmsg *jsoff.RequestMessage) (int, bool) {
 	return 0, false
 }
 
+// find the block height from the param at a given index
+func (c *Web3Chain) findBlockHeightAt(reqmsg *jsoff.RequestMessage, idx int) (int, bool) {
+	if idx >= len(reqmsg.Params) {
+		return 0, false
+	}
+	if tag, ok := reqmsg.Params[idx].(string); ok && strings.HasPrefix(tag, "0x") {
+		if height, err := hexutil.DecodeUint64(tag); err == nil {
+			return int(height), true
+		}
+	}
+	return 0, false
+}
+
+// the commitment level of the block tag at a given index, such as "finalized"
+func (c *Web3Chain) findCommitmentAt(reqmsg *jsoff.RequestMessage, idx int) (string, bool) {
+	if idx >= len(reqmsg.Params) {
+		return "", false
+	}
+	if tag, ok := reqmsg.Params[idx].(string); ok {
+		if tag == nodemuxcore.CommitmentSafe || tag == nodemuxcore.CommitmentFinalized {
+			return tag, true
+		}
+	}
+	return "", false
+}
+
+func (c *Web3Chain) Verifiable(method string) bool {
+	if _, ok := web3BlockTagMethods[method]; ok {
+		return true
+	}
+	return web3VerifiableMethods[method]
+}
+
+// Pin the block tag of the request to the height, requests with an
+// explicit height or block hash are already pinned
+func (c *Web3Chain) PinHeight(reqmsg *jsoff.RequestMessage, height int) (*jsoff.RequestMessage, bool) {
+	idx, ok := web3BlockTagMethods[reqmsg.Method]
+	if !ok {
+		return reqmsg, false
+	}
+	if idx < len(reqmsg.Params) {
+		tag, ok := reqmsg.Params[idx].(string)
+		if !ok || strings.HasPrefix(tag, "0x") {
+			return reqmsg, true
+		} else if tag != "latest" {
+			return reqmsg, false
+		}
+	}
+	params := make([]interface{}, idx+1)
+	copy(params, reqmsg.Params)
+	params[idx] = hexutil.EncodeUint64(uint64(height))
+	return jsoff.NewRequestMessage(reqmsg.Id, reqmsg.Method, params), true
+}
+
 func (c *Web3Chain) subscribeBlockhead(rootCtx context.Context, m *nodemuxcore.Multiplexer, ep *nodemuxcore.Endpoint) {
 	wsClient, ok := ep.NewJSONRPCWSClient()
 	if !ok {
@@ -407,6 +689,7 @@ func (c *Web3Chain) subscribeBlockhead(rootCtx context.Context, m *nodemuxcore.M
 				Height: headSub.Result.Height(),
 				Hash:   headSub.Result.Hash,
 			}
+			c.fillCommitted(ep, headBlock)
 			bs := nodemuxcore.ChainStatus{
 				EndpointName: ep.Name,
 				Chain:        ep.Chain,
@@ -0,0 +1,318 @@
+package chains
+
+// eth_getLogs planner, a large fromBlock..toBlock range is split into
+// chunks which are queried on multiple endpoints in parallel, then the
+// logs are merged in order
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+)
+
+const (
+	// the default block range an endpoint can serve in one
+	// eth_getLogs call, can be overrided by the endpoint option
+	// logs_range
+	web3DefaultLogsRange = 2000
+
+	// blocks deeper than this are regarded as final and the logs
+	// of them can be cached
+	web3FinalityDepth = 64
+
+	// the max parallel chunk queries of a getLogs request
+	web3MaxLogsWorkers = 8
+)
+
+var (
+	ErrLogsRangeTooLarge = &jsoff.RPCError{Code: -32005, Message: "query block range exceeds limit"}
+	ErrInvalidLogsFilter = &jsoff.RPCError{Code: -32602, Message: "invalid block range"}
+)
+
+type web3LogsChunk struct {
+	From int
+	To   int
+}
+
+type web3LogsChunkResult struct {
+	Chunk web3LogsChunk
+	Logs  []map[string]any
+	Err   error
+}
+
+// chunk query failed and the chunk should be split into halves, e.g.
+// the endpoint limits the count of results
+type web3LogsSplitError struct {
+	rpcErr *jsoff.RPCError
+}
+
+func (e web3LogsSplitError) Error() string {
+	return fmt.Sprintf("split required, %d %s", e.rpcErr.Code, e.rpcErr.Message)
+}
+
+func web3IsTooManyResults(rpcErr *jsoff.RPCError) bool {
+	if rpcErr.Code == -32005 {
+		return true
+	}
+	msg := strings.ToLower(rpcErr.Message)
+	return strings.Contains(msg, "more than") ||
+		strings.Contains(msg, "too many") ||
+		strings.Contains(msg, "limit exceeded") ||
+		strings.Contains(msg, "range too large")
+}
+
+// resolve a block tag of eth_getLogs to a block height
+func (c *Web3Chain) resolveLogsBlockTag(tag string, tipHeight int) (int, error) {
+	switch tag {
+	case "", "latest", "pending", "safe", "finalized":
+		return tipHeight, nil
+	case "earliest":
+		return 0, nil
+	}
+	height, err := hexutil.DecodeUint64(tag)
+	if err != nil {
+		return 0, errors.Wrapf(err, "decode block number %s", tag)
+	}
+	return int(height), nil
+}
+
+func (c *Web3Chain) splitLogsRange(from, to, size int) []web3LogsChunk {
+	var chunks []web3LogsChunk
+	for start := from; start <= to; start += size {
+		end := start + size - 1
+		if end > to {
+			end = to
+		}
+		chunks = append(chunks, web3LogsChunk{From: start, To: end})
+	}
+	return chunks
+}
+
+// the chunk size is the smallest logs range among the endpoints, so
+// that a chunk can be retried on any other endpoint
+func (c *Web3Chain) logsChunkSize(eps []*nodemuxcore.Endpoint) int {
+	size := 0
+	for _, ep := range eps {
+		r := ep.Config.IntOption("logs_range", web3DefaultLogsRange)
+		if r > 0 && (size == 0 || r < size) {
+			size = r
+		}
+	}
+	if size <= 0 {
+		size = web3DefaultLogsRange
+	}
+	return size
+}
+
+func (c *Web3Chain) getLogs(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	if len(reqmsg.Params) != 1 {
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+	}
+	filter, ok := reqmsg.Params[0].(map[string]any)
+	if !ok {
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+	}
+	if _, ok := filter["blockHash"]; ok {
+		// the query of a single block
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+	}
+
+	tipHeight, ok := m.MaxTipHeight(chain)
+	if !ok || tipHeight <= 0 {
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+	}
+
+	fromTag, _ := filter["fromBlock"].(string)
+	toTag, _ := filter["toBlock"].(string)
+	from, err := c.resolveLogsBlockTag(fromTag, tipHeight)
+	if err != nil {
+		return ErrInvalidLogsFilter.ToMessage(reqmsg), nil
+	}
+	to, err := c.resolveLogsBlockTag(toTag, tipHeight)
+	if err != nil {
+		return ErrInvalidLogsFilter.ToMessage(reqmsg), nil
+	}
+	if to < from {
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, -2)
+	}
+
+	if info := nodemuxcore.RequestInfoFromContext(ctx); info != nil && info.MaxLogsRange > 0 {
+		if to-from+1 > info.MaxLogsRange {
+			return ErrLogsRangeTooLarge.ToMessage(reqmsg), nil
+		}
+	}
+
+	eps := m.AllHealthyEndpoints(chain, reqmsg.Method, 0)
+	if len(eps) == 0 {
+		return nodemuxcore.ErrNotAvailable.ToMessage(reqmsg), nil
+	}
+	chunkSize := c.logsChunkSize(eps)
+	if to-from+1 <= chunkSize {
+		return m.DefaultRelayRPC(ctx, chain, reqmsg, to)
+	}
+
+	chunks := c.splitLogsRange(from, to, chunkSize)
+	reqmsg.Log().Infof("split getLogs %d..%d into %d chunks", from, to, len(chunks))
+
+	results := c.queryLogsChunks(ctx, m, chain, filter, chunks, tipHeight)
+	var merged []map[string]any
+	for _, res := range results {
+		if res.Err != nil {
+			var rpcErr *jsoff.RPCError
+			if errors.As(res.Err, &rpcErr) {
+				return rpcErr.ToMessage(reqmsg), nil
+			}
+			return nil, res.Err
+		}
+		merged = append(merged, res.Logs...)
+	}
+	return jsoff.NewResultMessage(reqmsg, mergeLogs(merged)), nil
+}
+
+func (c *Web3Chain) queryLogsChunks(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, filter map[string]any, chunks []web3LogsChunk, tipHeight int) []web3LogsChunkResult {
+	results := make([]web3LogsChunkResult, len(chunks))
+
+	workers := web3MaxLogsWorkers
+	if len(chunks) < workers {
+		workers = len(chunks)
+	}
+
+	wg := new(sync.WaitGroup)
+	idxCh := make(chan int, len(chunks))
+	for i := range chunks {
+		idxCh <- i
+	}
+	close(idxCh)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := range idxCh {
+				logs, err := c.queryLogsChunk(ctx, m, chain, filter, chunks[i], tipHeight, worker)
+				results[i] = web3LogsChunkResult{
+					Chunk: chunks[i],
+					Logs:  logs,
+					Err:   err,
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	return results
+}
+
+// query a chunk, the chunk is tried on endpoints one by one starting
+// from the worker's endpoint, and is split into halves if the endpoint
+// complains too many results
+func (c *Web3Chain) queryLogsChunk(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, filter map[string]any, chunk web3LogsChunk, tipHeight int, worker int) ([]map[string]any, error) {
+	chunkFilter := make(map[string]any)
+	for k, v := range filter {
+		chunkFilter[k] = v
+	}
+	chunkFilter["fromBlock"] = hexutil.EncodeUint64(uint64(chunk.From))
+	chunkFilter["toBlock"] = hexutil.EncodeUint64(uint64(chunk.To))
+	chunkReq := jsoff.NewRequestMessage(
+		jsoff.NewUuid(), "eth_getLogs",
+		[]any{chunkFilter})
+
+	finalized := chunk.To <= tipHeight-web3FinalityDepth
+	if finalized {
+		if resmsgFromCache, found := jsonrpcCacheFetch(ctx, m, chain, chunkReq, chunk.To); found {
+			var logs []map[string]any
+			if err := jsoff.DecodeInterface(resmsgFromCache.Result, &logs); err == nil {
+				return logs, nil
+			}
+		}
+	}
+
+	eps := m.SessionHealthyEndpoints(ctx, chain, "eth_getLogs", chunk.To)
+	if len(eps) == 0 {
+		return nil, nodemuxcore.ErrNotAvailable
+	}
+
+	var lastErr error
+	for i := 0; i < len(eps); i++ {
+		ep := eps[(worker+i)%len(eps)]
+		resmsg, err := ep.CallRPC(ctx, chunkReq)
+		if err != nil {
+			ep.Log().Warnf("getLogs chunk %d..%d error %s, retrying", chunk.From, chunk.To, err)
+			lastErr = err
+			continue
+		}
+		if resmsg.IsError() {
+			rpcErr := resmsg.MustError()
+			if web3IsTooManyResults(rpcErr) && chunk.To > chunk.From {
+				lastErr = web3LogsSplitError{rpcErr: rpcErr}
+				break
+			}
+			lastErr = rpcErr
+			continue
+		}
+
+		var logs []map[string]any
+		if err := jsoff.DecodeInterface(resmsg.(*jsoff.ResultMessage).Result, &logs); err != nil {
+			lastErr = errors.Wrap(err, "decode logs")
+			continue
+		}
+		if finalized {
+			jsonrpcCacheUpdate(ctx, m, ep, chain, chunkReq, resmsg.(*jsoff.ResultMessage), time.Second*600)
+		}
+		return logs, nil
+	}
+
+	var splitErr web3LogsSplitError
+	if errors.As(lastErr, &splitErr) {
+		mid := chunk.From + (chunk.To-chunk.From)/2
+		left, err := c.queryLogsChunk(ctx, m, chain, filter, web3LogsChunk{From: chunk.From, To: mid}, tipHeight, worker)
+		if err != nil {
+			return nil, err
+		}
+		right, err := c.queryLogsChunk(ctx, m, chain, filter, web3LogsChunk{From: mid + 1, To: chunk.To}, tipHeight, worker)
+		if err != nil {
+			return nil, err
+		}
+		return append(left, right...), nil
+	}
+	return nil, lastErr
+}
+
+func logOrderKey(log map[string]any, field string) uint64 {
+	if s, ok := log[field].(string); ok {
+		if v, err := hexutil.DecodeUint64(s); err == nil {
+			return v
+		}
+	}
+	return 0
+}
+
+// dedupe logs by block hash and log index then sort them by block
+// number and log index
+func mergeLogs(logs []map[string]any) []map[string]any {
+	seen := make(map[string]bool)
+	merged := make([]map[string]any, 0, len(logs))
+	for _, log := range logs {
+		key := fmt.Sprintf("%v/%v/%v", log["blockHash"], log["transactionHash"], log["logIndex"])
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, log)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		bi, bj := logOrderKey(merged[i], "blockNumber"), logOrderKey(merged[j], "blockNumber")
+		if bi != bj {
+			return bi < bj
+		}
+		return logOrderKey(merged[i], "logIndex") < logOrderKey(merged[j], "logIndex")
+	})
+	return merged
+}
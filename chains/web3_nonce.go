@@ -0,0 +1,121 @@
+package chains
+
+// Nonce tracker remembers the nonces of raw transactions relayed
+// through eth_sendRawTransaction, so that
+// eth_getTransactionCount(addr, "pending") counts the txs not yet
+// seen by the upstream endpoints. It is enabled by configuring the
+// redis store nonce-<namespace>-<network>, which is shared among
+// nodemux instances.
+
+import (
+	"context"
+	"fmt"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+	"strings"
+	"time"
+)
+
+const (
+	// tracked nonces expire in case the txs are dropped
+	nonceTrackerExpiration = time.Minute * 30
+)
+
+// set the key to the nonce if it's greater than the existing one
+var nonceTrackerSetMax = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur == false or tonumber(cur) < tonumber(ARGV[1]) then
+  redis.call('SET', KEYS[1], ARGV[1], 'EX', ARGV[2])
+end
+return 1
+`)
+
+// get the tracked nonce, which is removed and -1 is returned instead
+// once the upstream nonce ARGV[1] is over it
+var nonceTrackerAdjustScript = redis.NewScript(`
+local cur = redis.call('GET', KEYS[1])
+if cur == false then
+  return -1
+end
+if tonumber(cur) < tonumber(ARGV[1]) then
+  redis.call('DEL', KEYS[1])
+  return -1
+end
+return tonumber(cur)
+`)
+
+func nonceTrackerRedisSelector(chain nodemuxcore.ChainRef) string {
+	return fmt.Sprintf("nonce-%s-%s", chain.Namespace, chain.Network)
+}
+
+func nonceTrackerKey(chain nodemuxcore.ChainRef, address string) string {
+	return fmt.Sprintf("N:%s/%s", chain, strings.ToLower(address))
+}
+
+// decode the sender and nonce of a raw transaction
+func decodeRawTxSender(rawTx string) (string, uint64, error) {
+	data, err := hexutil.Decode(rawTx)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "decode hex")
+	}
+	tx := new(types.Transaction)
+	if err := tx.UnmarshalBinary(data); err != nil {
+		return "", 0, errors.Wrap(err, "unmarshal tx")
+	}
+	sender, err := types.Sender(types.LatestSignerForChainID(tx.ChainId()), tx)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "recover sender")
+	}
+	return sender.Hex(), tx.Nonce(), nil
+}
+
+// record the nonce of a relayed raw transaction
+func nonceTrackerRecord(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage) {
+	c, ok := m.RedisClientExact(nonceTrackerRedisSelector(chain))
+	if !ok || len(reqmsg.Params) == 0 {
+		return
+	}
+	rawTx, ok := reqmsg.Params[0].(string)
+	if !ok {
+		return
+	}
+	sender, nonce, err := decodeRawTxSender(rawTx)
+	if err != nil {
+		reqmsg.Log().Warnf("nonce tracker: %s", err)
+		return
+	}
+	key := nonceTrackerKey(chain, sender)
+	err = nonceTrackerSetMax.Run(ctx, c, []string{key}, nonce, int(nonceTrackerExpiration.Seconds())).Err()
+	if err != nil {
+		reqmsg.Log().Warnf("nonce tracker: error setting %s, %s", key, err)
+	}
+}
+
+// adjust the pending nonce of an address to max(upstream,
+// tracked+1), the tracked nonce is removed once the upstream catches
+// up with it
+func nonceTrackerAdjust(ctx context.Context, m *nodemuxcore.Multiplexer, chain nodemuxcore.ChainRef, reqmsg *jsoff.RequestMessage, upstream uint64) (uint64, bool) {
+	c, ok := m.RedisClientExact(nonceTrackerRedisSelector(chain))
+	if !ok || len(reqmsg.Params) < 2 || reqmsg.Params[1] != "pending" {
+		return upstream, false
+	}
+	address, ok := reqmsg.Params[0].(string)
+	if !ok {
+		return upstream, false
+	}
+
+	key := nonceTrackerKey(chain, address)
+	tracked, err := nonceTrackerAdjustScript.Run(ctx, c, []string{key}, upstream).Int64()
+	if err != nil {
+		reqmsg.Log().Warnf("nonce tracker: error adjusting %s, %s", key, err)
+		return upstream, false
+	}
+	if tracked < 0 {
+		return upstream, false
+	}
+	return uint64(tracked) + 1, true
+}
@@ -0,0 +1,191 @@
+package chains
+
+// A minimal ZMTP 3.0 SUB socket with the NULL security mechanism,
+// which is sufficient to receive the notifications published by
+// bitcoind's -zmqpub* options. See https://rfc.zeromq.org/spec/23/
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+const (
+	zmqFlagMore    byte = 0x01
+	zmqFlagLong    byte = 0x02
+	zmqFlagCommand byte = 0x04
+
+	// frames larger than it are refused
+	zmqMaxFrameSize = 64 * 1024 * 1024
+)
+
+type zmqSubscriber struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// the 64 bytes greeting of ZMTP 3.0 with the NULL mechanism
+func zmqGreeting(asServer bool) []byte {
+	greeting := make([]byte, 64)
+	greeting[0] = 0xff
+	greeting[9] = 0x7f
+	greeting[10] = 3
+	greeting[11] = 0
+	copy(greeting[12:32], "NULL")
+	if asServer {
+		greeting[32] = 1
+	}
+	return greeting
+}
+
+// the READY command carrying the socket type property
+func zmqReadyCommand(socketType string) []byte {
+	var body bytes.Buffer
+	body.WriteByte(byte(len("READY")))
+	body.WriteString("READY")
+	body.WriteByte(byte(len("Socket-Type")))
+	body.WriteString("Socket-Type")
+	binary.Write(&body, binary.BigEndian, uint32(len(socketType)))
+	body.WriteString(socketType)
+	return body.Bytes()
+}
+
+func zmqWriteFrame(w io.Writer, flags byte, body []byte) error {
+	var header []byte
+	if len(body) > 255 {
+		header = make([]byte, 9)
+		header[0] = flags | zmqFlagLong
+		binary.BigEndian.PutUint64(header[1:], uint64(len(body)))
+	} else {
+		header = []byte{flags, byte(len(body))}
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+func zmqReadFrame(r *bufio.Reader) (byte, []byte, error) {
+	flags, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	var size uint64
+	if flags&zmqFlagLong != 0 {
+		var buf [8]byte
+		if _, err := io.ReadFull(r, buf[:]); err != nil {
+			return 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(buf[:])
+	} else {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		size = uint64(b)
+	}
+	if size > zmqMaxFrameSize {
+		return 0, nil, errors.Errorf("zmq frame too large, %d bytes", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return flags, body, nil
+}
+
+// Dial a ZMQ PUB socket at tcp://host:port and subscribe the topics
+func dialZMQSubscriber(ctx context.Context, zmqUrl string, topics ...string) (*zmqSubscriber, error) {
+	u, err := url.Parse(zmqUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse zmq url")
+	}
+	if u.Scheme != "tcp" {
+		return nil, errors.Errorf("unsupported zmq url %s", zmqUrl)
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, errors.Wrap(err, "dial zmq")
+	}
+	sub := &zmqSubscriber{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+	if err := sub.handshake(topics); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (sub *zmqSubscriber) handshake(topics []string) error {
+	sub.conn.SetDeadline(time.Now().Add(10 * time.Second))
+	defer sub.conn.SetDeadline(time.Time{})
+
+	if _, err := sub.conn.Write(zmqGreeting(false)); err != nil {
+		return errors.Wrap(err, "write greeting")
+	}
+	peerGreeting := make([]byte, 64)
+	if _, err := io.ReadFull(sub.reader, peerGreeting); err != nil {
+		return errors.Wrap(err, "read greeting")
+	}
+	if peerGreeting[0] != 0xff || peerGreeting[9] != 0x7f || peerGreeting[10] < 3 {
+		return errors.New("bad zmq greeting")
+	}
+	if mechanism := string(bytes.TrimRight(peerGreeting[12:32], "\x00")); mechanism != "NULL" {
+		return errors.Errorf("unsupported zmq mechanism %s", mechanism)
+	}
+
+	if err := zmqWriteFrame(sub.conn, zmqFlagCommand, zmqReadyCommand("SUB")); err != nil {
+		return errors.Wrap(err, "write ready")
+	}
+	flags, body, err := zmqReadFrame(sub.reader)
+	if err != nil {
+		return errors.Wrap(err, "read ready")
+	}
+	if flags&zmqFlagCommand == 0 || len(body) < 6 || string(body[1:6]) != "READY" {
+		return errors.New("zmq peer not ready")
+	}
+
+	// subscriptions of ZMTP 3.0 are messages starting with 0x01
+	for _, topic := range topics {
+		if err := zmqWriteFrame(sub.conn, 0, append([]byte{0x01}, topic...)); err != nil {
+			return errors.Wrap(err, "write subscription")
+		}
+	}
+	return nil
+}
+
+// Receive a multipart message, commands such as PING are skipped
+func (sub *zmqSubscriber) Recv() ([][]byte, error) {
+	parts := make([][]byte, 0, 3)
+	for {
+		flags, body, err := zmqReadFrame(sub.reader)
+		if err != nil {
+			return nil, err
+		}
+		if flags&zmqFlagCommand != 0 {
+			continue
+		}
+		parts = append(parts, body)
+		if flags&zmqFlagMore == 0 {
+			return parts, nil
+		}
+	}
+}
+
+func (sub *zmqSubscriber) Close() error {
+	return sub.conn.Close()
+}
@@ -64,7 +64,7 @@ func main() {
 	multiplexer := nodemuxcore.NewMultiplexer()
 	nodemuxcore.SetMultiplexer(multiplexer)
 
-	delegator := factory.GetBlockheadDelegator(endpoint.Chain.Namespace)
+	delegator := factory.GetEndpointDelegator(endpoint)
 	start := time.Now()
 	block, err := delegator.GetBlockhead(context.Background(), multiplexer, endpoint)
 	delta := time.Since(start) //time.Now().Sub(start)
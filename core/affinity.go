@@ -0,0 +1,151 @@
+package nodemuxcore
+
+// Affinity keeps the requests of the same key on the same healthy
+// endpoint by rendezvous hashing, when endpoints come or go only the
+// keys of the changed endpoints move
+
+import (
+	"context"
+	"hash/fnv"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/jsoff"
+)
+
+const (
+	AffinityAccount = "account"
+	AffinityIP      = "ip"
+	AffinityHeader  = "header"
+	AffinityFrom    = "from"
+)
+
+type AffinityConfig struct {
+	// what the key is, account, ip, header or from
+	Key string `yaml:"key" json:"key"`
+
+	// the header name of the header key
+	Header string `yaml:"header,omitempty" json:"header,omitempty"`
+}
+
+func (acfg AffinityConfig) validate() error {
+	switch acfg.Key {
+	case AffinityAccount, AffinityIP, AffinityFrom:
+	case AffinityHeader:
+		if acfg.Header == "" {
+			return errors.New("affinity header is empty")
+		}
+	default:
+		return errors.Errorf("unknown affinity key %s", acfg.Key)
+	}
+	return nil
+}
+
+// The affinity key of the request, empty if the key is absent, e.g. the
+// from address of a request without one
+func (acfg AffinityConfig) KeyOf(account string, r *http.Request, reqmsg *jsoff.RequestMessage) string {
+	switch acfg.Key {
+	case AffinityAccount:
+		return account
+	case AffinityIP:
+		if r == nil {
+			return ""
+		}
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host
+		}
+		return r.RemoteAddr
+	case AffinityHeader:
+		if r == nil {
+			return ""
+		}
+		return r.Header.Get(acfg.Header)
+	case AffinityFrom:
+		if reqmsg == nil {
+			return ""
+		}
+		// the from field of the first object param, such as the
+		// transaction of eth_call
+		for _, param := range reqmsg.Params {
+			if obj, ok := param.(map[string]interface{}); ok {
+				if from, ok := obj["from"].(string); ok {
+					return strings.ToLower(from)
+				}
+			}
+		}
+	}
+	return ""
+}
+
+type affinityKeyType int
+
+var affinityKey affinityKeyType
+
+// Attach the affinity key of the request to the context according to
+// the affinity config of the chain
+func (m *Multiplexer) AffinityContext(ctx context.Context, chain ChainRef, account string, r *http.Request, reqmsg *jsoff.RequestMessage) context.Context {
+	if m.cfg == nil {
+		return ctx
+	}
+	chaincfg, ok := m.cfg.Chains[chain.String()]
+	if !ok || chaincfg.Affinity == nil {
+		return ctx
+	}
+	if key := chaincfg.Affinity.KeyOf(account, r, reqmsg); key != "" {
+		return context.WithValue(ctx, affinityKey, key)
+	}
+	return ctx
+}
+
+func affinityKeyFromContext(ctx context.Context) string {
+	if key, ok := ctx.Value(affinityKey).(string); ok {
+		return key
+	}
+	return ""
+}
+
+// the weighted rendezvous score of the endpoint for the key
+func affinityScore(key string, ep *Endpoint) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(ep.Name))
+	// map the hash into (0, 1)
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	w := ep.Config.Weight
+	if w <= 0 {
+		w = 100
+	}
+	return -float64(w) / math.Log(u)
+}
+
+// select the accepted endpoint of the highest score for the key
+func (m *Multiplexer) selectByAffinity(chain ChainRef, key string, height int, accept func(ep *Endpoint, height int) bool) (*Endpoint, bool) {
+	endpoints, ok := m.chainIndex[chain]
+	if !ok {
+		return nil, false
+	}
+	var selected *Endpoint
+	maxScore := 0.0
+	for _, ep := range endpoints.items {
+		if !accept(ep, height) {
+			continue
+		}
+		if score := affinityScore(key, ep); selected == nil || score > maxScore {
+			selected = ep
+			maxScore = score
+		}
+	}
+	return selected, selected != nil
+}
+
+// Select a websocket endpoint honoring the session and the affinity
+// of the context
+func (m *Multiplexer) SelectWebsocketEndpointFor(ctx context.Context, chain ChainRef, method string, heightSpec int) (*Endpoint, bool) {
+	return m.selectOverHeight(ctx, chain, heightSpec, func(ep *Endpoint, height int) bool {
+		return ep.HasWebsocket() && ep.Available(method, height)
+	})
+}
@@ -0,0 +1,305 @@
+package nodemuxcore
+
+// Transactions are broadcasted to the healthy endpoints of a chain
+// by the chain's broadcast policy, delegators declare the methods or
+// paths submitting transactions along with a classifier telling
+// whether an endpoint accepted the tx.
+
+import (
+	"bytes"
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+)
+
+const (
+	// broadcast to all endpoints and wait for all responses
+	BroadcastAll = "all"
+
+	// broadcast to all endpoints and return once quorum endpoints
+	// accepted the tx
+	BroadcastQuorum = "n-of-m"
+
+	// submit to endpoints one by one until one accepts the tx
+	BroadcastFirstSuccess = "first-success"
+)
+
+// The outcome of submitting a tx to an endpoint, smaller ones are
+// preferred when choosing the response returned to client
+type TxOutcome int
+
+const (
+	TxSuccess TxOutcome = iota
+	TxAlreadyKnown
+	TxFatal
+	TxRetryable
+
+	// the endpoint didn't respond
+	txNoResponse
+)
+
+func (o TxOutcome) Accepted() bool {
+	return o == TxSuccess || o == TxAlreadyKnown
+}
+
+func (o TxOutcome) String() string {
+	switch o {
+	case TxSuccess:
+		return "success"
+	case TxAlreadyKnown:
+		return "already-known"
+	case TxFatal:
+		return "fatal"
+	case TxRetryable:
+		return "retryable"
+	default:
+		return "no-response"
+	}
+}
+
+// A JSON-RPC method submitting transactions
+type TxSubmitMethod struct {
+	// classify the response message of an endpoint
+	Classify func(resmsg jsoff.Message) TxOutcome
+
+	// the txid of an accepted response, empty if unknown
+	TxId func(resmsg jsoff.Message) string
+}
+
+// A REST path submitting transactions
+type TxSubmitPath struct {
+	// classify the response of an endpoint
+	Classify func(res *HTTPResult) TxOutcome
+
+	// the txid of an accepted response, empty if unknown
+	TxId func(res *HTTPResult) string
+}
+
+// The result of broadcasting a tx
+type TxBroadcast struct {
+	TxId    string
+	Outcome TxOutcome
+
+	// the endpoints which accepted the tx
+	Accepted []*Endpoint
+}
+
+// A buffered http response of an endpoint
+type HTTPResult struct {
+	Endpoint   *Endpoint
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	Err        error
+}
+
+// Write the buffered response to client
+func (res HTTPResult) Write(w http.ResponseWriter) {
+	for hn, hvs := range res.Header {
+		if strings.ToLower(hn) == "server" {
+			w.Header().Set("Server", "nodemux")
+		} else {
+			for _, hv := range hvs {
+				w.Header().Set(hn, hv)
+			}
+		}
+	}
+	w.Header().Set("X-Real-Endpoint", res.Endpoint.Name)
+	w.WriteHeader(res.StatusCode)
+	w.Write(res.Body)
+}
+
+// Request the REST api of the endpoint and buffer the response
+func (ep *Endpoint) RequestREST(rootCtx context.Context, path string, r *http.Request, body []byte) *HTTPResult {
+	r1 := r.Clone(rootCtx)
+	r1.Body = io.NopCloser(bytes.NewReader(body))
+	resp, err := ep.doResponse(rootCtx, ep.ApiFullUrl(ApiREST, path), apiMethodLabel(ApiREST), path, r1)
+	if err != nil {
+		return &HTTPResult{Endpoint: ep, Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	ep.addUpstreamBytes("received", int64(len(data)))
+	if err != nil {
+		return &HTTPResult{Endpoint: ep, Err: errors.Wrap(err, "read body")}
+	}
+	return &HTTPResult{
+		Endpoint:   ep,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       data,
+	}
+}
+
+// The broadcast config of a chain, the default policy is all
+func (m *Multiplexer) BroadcastConfig(chain ChainRef) BroadcastConfig {
+	if m.cfg != nil {
+		if chaincfg, ok := m.cfg.Chains[chain.String()]; ok && chaincfg.Broadcast.Policy != "" {
+			return chaincfg.Broadcast
+		}
+	}
+	return BroadcastConfig{Policy: BroadcastAll}
+}
+
+// Call submit on n endpoints by the policy, submit returns the
+// outcome of the i-th endpoint. It returns the index of the preferred
+// response, its outcome and the indices of the accepting endpoints.
+func broadcastTx(ctx context.Context, bcfg BroadcastConfig, n int, submit func(ctx context.Context, i int) TxOutcome) (int, TxOutcome, []int) {
+	best := -1
+	bestOutcome := txNoResponse
+	accepted := make([]int, 0)
+	collect := func(i int, outcome TxOutcome) {
+		if best < 0 || outcome < bestOutcome {
+			best = i
+			bestOutcome = outcome
+		}
+		if outcome.Accepted() {
+			accepted = append(accepted, i)
+		}
+	}
+
+	if bcfg.Policy == BroadcastFirstSuccess {
+		// start from a random endpoint to spread the load
+		offset := rand.Intn(n)
+		for k := 0; k < n; k++ {
+			i := (offset + k) % n
+			outcome := submit(ctx, i)
+			collect(i, outcome)
+			if outcome.Accepted() || outcome == TxFatal {
+				break
+			}
+		}
+		return best, bestOutcome, accepted
+	}
+
+	type txAttempt struct {
+		idx     int
+		outcome TxOutcome
+	}
+	// the submissions are not canceled with the request, and
+	// under the n-of-m policy they outlive the broadcast
+	submitCtx := context.WithoutCancel(ctx)
+	attempts := make(chan txAttempt, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			attempts <- txAttempt{idx: i, outcome: submit(submitCtx, i)}
+		}(i)
+	}
+	for k := 0; k < n; k++ {
+		attempt := <-attempts
+		collect(attempt.idx, attempt.outcome)
+		if bcfg.Policy == BroadcastQuorum && len(accepted) >= bcfg.Quorum {
+			break
+		}
+	}
+	return best, bestOutcome, accepted
+}
+
+// Broadcast a JSON-RPC tx submission to the healthy endpoints
+func (m *Multiplexer) BroadcastTxRPC(rootCtx context.Context, chain ChainRef, reqmsg *jsoff.RequestMessage, submit TxSubmitMethod) (jsoff.Message, *TxBroadcast, error) {
+	bcfg := m.BroadcastConfig(chain)
+	ctx, span := StartSpan(rootCtx, "broadcast", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(reqmsg.Method))
+	defer span.End()
+
+	eps := m.AllHealthyApiEndpoints(chain, ApiJSONRPC, reqmsg.Method, 0)
+	if len(eps) == 0 {
+		return ErrNotAvailable.ToMessage(reqmsg), nil, nil
+	}
+
+	results := make([]RPCResult, len(eps))
+	best, outcome, accepted := broadcastTx(ctx, bcfg, len(eps), func(ctx context.Context, i int) TxOutcome {
+		resmsg, err := m.CallEndpointRPC(ctx, eps[i], reqmsg)
+		results[i] = RPCResult{Response: resmsg, Endpoint: eps[i], Err: err}
+		if err != nil || resmsg == nil {
+			return txNoResponse
+		}
+		return submit.Classify(resmsg)
+	})
+
+	bc := &TxBroadcast{Outcome: outcome}
+	for _, i := range accepted {
+		bc.Accepted = append(bc.Accepted, eps[i])
+	}
+	res := results[best]
+	if outcome.Accepted() && submit.TxId != nil {
+		bc.TxId = submit.TxId(res.Response)
+	}
+	m.trackTx(chain, bc, func(ctx context.Context, ep *Endpoint) TxOutcome {
+		resmsg, err := ep.CallRPC(ctx, reqmsg)
+		if err != nil || resmsg == nil {
+			return txNoResponse
+		}
+		return submit.Classify(resmsg)
+	})
+	chain.Log().WithFields(RequestLogFields(ctx, log.Fields{
+		"method":    reqmsg.Method,
+		"policy":    bcfg.Policy,
+		"outcome":   outcome.String(),
+		"accepted":  len(bc.Accepted),
+		"endpoints": len(eps),
+	})).Info("broadcast tx")
+	return res.Response, bc, res.Err
+}
+
+// Broadcast a REST tx submission to the healthy endpoints, the
+// returned result is nil if there are no endpoints available
+func (m *Multiplexer) BroadcastTxREST(rootCtx context.Context, chain ChainRef, path string, r *http.Request, submit TxSubmitPath) (*HTTPResult, *TxBroadcast, error) {
+	bcfg := m.BroadcastConfig(chain)
+	ctx, span := StartSpan(rootCtx, "broadcast", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(path))
+	defer span.End()
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "read body")
+	}
+
+	eps := m.AllHealthyApiEndpoints(chain, ApiREST, path, 0)
+	if len(eps) == 0 {
+		return nil, nil, nil
+	}
+
+	results := make([]*HTTPResult, len(eps))
+	best, outcome, accepted := broadcastTx(ctx, bcfg, len(eps), func(ctx context.Context, i int) TxOutcome {
+		res := eps[i].RequestREST(ctx, path, r, body)
+		results[i] = res
+		if res.Err != nil {
+			return txNoResponse
+		}
+		return submit.Classify(res)
+	})
+
+	bc := &TxBroadcast{Outcome: outcome}
+	for _, i := range accepted {
+		bc.Accepted = append(bc.Accepted, eps[i])
+	}
+	res := results[best]
+	if outcome.Accepted() && submit.TxId != nil {
+		bc.TxId = submit.TxId(res)
+	}
+	m.trackTx(chain, bc, func(ctx context.Context, ep *Endpoint) TxOutcome {
+		res := ep.RequestREST(ctx, path, r, body)
+		if res.Err != nil {
+			return txNoResponse
+		}
+		return submit.Classify(res)
+	})
+	chain.Log().WithFields(RequestLogFields(ctx, log.Fields{
+		"method":    path,
+		"policy":    bcfg.Policy,
+		"outcome":   outcome.String(),
+		"accepted":  len(bc.Accepted),
+		"endpoints": len(eps),
+	})).Info("broadcast tx")
+	return res, bc, res.Err
+}
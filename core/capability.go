@@ -0,0 +1,149 @@
+package nodemuxcore
+
+// Capability discovery, delegators which implement
+// CapabilityDelegator probe what an endpoint actually supports and
+// the result feeds Endpoint.Available()
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// the default interval of re-probing capabilities
+	capabilityProbeInterval = 600
+)
+
+var (
+	// the endpoint serves a different network than the configured one
+	ErrNetworkMismatch = errors.New("network mismatch")
+)
+
+type Capabilities struct {
+	// optional features supported by the endpoint, e.g. trace, debug, archive
+	Features map[string]bool `json:"features,omitempty"`
+
+	// methods and method prefixes the endpoint doesn't provide
+	SkipMethods  map[string]bool `json:"-"`
+	SkipPrefixes []string        `json:"-"`
+
+	// the complete set of methods the endpoint provides, nil means
+	// unknown
+	Methods map[string]bool `json:"-"`
+}
+
+func NewCapabilities() *Capabilities {
+	return &Capabilities{
+		Features:    make(map[string]bool),
+		SkipMethods: make(map[string]bool),
+	}
+}
+
+// Mark a feature as supported or not, if it's not supported the given
+// methods or method prefixes (ends with "_" or "/") are skipped
+func (caps *Capabilities) Set(feature string, supported bool, methods ...string) {
+	caps.Features[feature] = supported
+	if supported {
+		return
+	}
+	for _, method := range methods {
+		if strings.HasSuffix(method, "_") || strings.HasSuffix(method, "/") {
+			caps.SkipPrefixes = append(caps.SkipPrefixes, method)
+		} else {
+			caps.SkipMethods[method] = true
+		}
+	}
+}
+
+// Keep the state of a feature from the previous probe, which is used
+// when probing the feature fails without an answer, e.g. on timeout
+func (caps *Capabilities) Keep(prev *Capabilities, feature string, methods ...string) {
+	if prev == nil {
+		return
+	}
+	if supported, ok := prev.Features[feature]; ok {
+		caps.Set(feature, supported, methods...)
+	}
+}
+
+func (caps Capabilities) Supports(method string) bool {
+	if caps.Methods != nil && !caps.Methods[method] {
+		return false
+	}
+	if _, ok := caps.SkipMethods[method]; ok {
+		return false
+	}
+	for _, prefix := range caps.SkipPrefixes {
+		if strings.HasPrefix(method, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Optional interface of a delegator that can probe the capabilities
+// of an endpoint
+type CapabilityDelegator interface {
+	ProbeCapabilities(ctx context.Context, ep *Endpoint) (*Capabilities, error)
+}
+
+// Whether the endpoint has a feature, features not probed are regarded
+// as supported
+func (ep Endpoint) HasCapability(feature string) bool {
+	if ep.Capabilities == nil {
+		return true
+	}
+	if supported, ok := ep.Capabilities.Features[feature]; ok {
+		return supported
+	}
+	return true
+}
+
+// Whether the feature is probed and supported, unlike HasCapability
+// unprobed features are not assumed
+func (ep Endpoint) ProbedCapability(feature string) bool {
+	return ep.Capabilities != nil && ep.Capabilities.Features[feature]
+}
+
+func (ep *Endpoint) ProbeCapabilities(ctx context.Context) {
+	delegator := GetDelegatorFactory().GetEndpointDelegator(ep)
+	probeDelegator, ok := delegator.(CapabilityDelegator)
+	if !ok {
+		return
+	}
+	caps, err := probeDelegator.ProbeCapabilities(ctx, ep)
+	if err != nil {
+		ep.Log().Warnf("error while probing capabilities %s", err)
+		return
+	}
+	ep.Capabilities = caps
+	ep.Log().Infof("capabilities set to %v", caps.Features)
+}
+
+// Verify the network identity and probe the capabilities at startup,
+// then re-probe periodically
+func (m *Multiplexer) runEndpointProbe(rootCtx context.Context, ep *Endpoint) {
+	ctx, cancel := context.WithCancel(rootCtx)
+	defer cancel()
+
+	interval := ep.Config.IntOption("probe_interval", capabilityProbeInterval)
+	for {
+		m.VerifyNetworkIdentity(ctx, ep)
+		ep.ProbeCapabilities(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+	}
+}
+
+// Select an endpoint over height which has the given feature
+func (m *Multiplexer) SelectWithCapability(ctx context.Context, chain ChainRef, method string, heightSpec int, feature string) (*Endpoint, bool) {
+	return m.selectOverHeight(ctx, chain, heightSpec, func(ep *Endpoint, height int) bool {
+		return ep.HasCapability(feature) && ep.Available(method, height)
+	})
+}
@@ -40,3 +40,16 @@ func (c ChainRef) Log() *log.Entry {
 		"chain": c.String(),
 	})
 }
+
+func ApiName(api int) string {
+	return apiNames[api]
+}
+
+func ParseApiName(name string) (int, bool) {
+	for api, apiName := range apiNames {
+		if apiName == name {
+			return api, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,98 @@
+package nodemuxcore
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// commitment levels of block heads
+const (
+	CommitmentLatest    = "latest"
+	CommitmentSafe      = "safe"
+	CommitmentFinalized = "finalized"
+)
+
+// The height of the block head at the commitment level, the latest
+// height is returned if the level is not reported, the safe height
+// falls back to the finalized one
+func (block Block) HeightAt(commitment string) int {
+	switch commitment {
+	case CommitmentSafe:
+		if block.Safe > 0 {
+			return block.Safe
+		} else if block.Finalized > 0 {
+			return block.Finalized
+		}
+	case CommitmentFinalized:
+		if block.Finalized > 0 {
+			return block.Finalized
+		}
+	}
+	return block.Height
+}
+
+// Whether the endpoint is available and its head at the commitment
+// level reaches minHeight
+func (ep Endpoint) AvailableAt(method string, commitment string, minHeight int) bool {
+	if !ep.Available(method, 0) {
+		return false
+	}
+	if minHeight > 0 {
+		if ep.Blockhead == nil || ep.Blockhead.HeightAt(commitment) < minHeight {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the max height at the commitment level among the healthy
+// endpoints of a chain
+func (m *Multiplexer) MaxHeightAt(chain ChainRef, commitment string) (int, bool) {
+	endpoints, ok := m.chainIndex[chain]
+	if !ok {
+		return 0, false
+	}
+	if commitment == CommitmentLatest {
+		return endpoints.maxTipHeight, true
+	}
+	maxHeight := 0
+	for _, ep := range endpoints.items {
+		if ep.Healthy && ep.Blockhead != nil {
+			if h := ep.Blockhead.HeightAt(commitment); h > maxHeight {
+				maxHeight = h
+			}
+		}
+	}
+	return maxHeight, true
+}
+
+// Select an endpoint whose head at the commitment level is over
+// height, heightSpec <= 0 is relative to the max height of the level
+func (m *Multiplexer) SelectAtCommitment(ctx context.Context, chain ChainRef, method string, commitment string, heightSpec int) (*Endpoint, bool) {
+	height := heightSpec
+	if heightSpec <= 0 {
+		maxHeight, ok := m.MaxHeightAt(chain, commitment)
+		if !ok {
+			return nil, false
+		}
+		height = maxHeight + heightSpec
+	}
+	// the height is resolved at the commitment level, the tips are
+	// only checked against the session height
+	return m.selectOverHeight(ctx, chain, anyHeightSpec, func(ep *Endpoint, tipHeight int) bool {
+		return ep.AvailableAt(method, commitment, height) && overHeight(ep, tipHeight)
+	})
+}
+
+// set the height gauge of a commitment level, unreported levels are skipped
+func (ep Endpoint) observeCommitted(commitment string, height int) {
+	if height <= 0 {
+		return
+	}
+	metricsEndpointBlockCommitted.With(prometheus.Labels{
+		"chain":      ep.Chain.String(),
+		"endpoint":   ep.Name,
+		"commitment": commitment,
+	}).Set(float64(height))
+}
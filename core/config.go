@@ -9,12 +9,17 @@ import (
 	"encoding/json"
 	"net/url"
 	"os"
+	"regexp"
 )
 
 // configs
 type EndpointConfig struct {
-	Chain         string            `yaml:"chain" json:"chain"`
-	Url           string            `yaml:"url" json:"url"`
+	Chain string `yaml:"chain" json:"chain"`
+	Url   string `yaml:"url" json:"url"`
+	// the urls of api kinds other than the namespace's primary api,
+	// e.g. rest: https://node/sidecar, keyed by jsonrpc, rest,
+	// graphql or grpc
+	Urls          map[string]string `yaml:"urls,omitempty" json:"urls,omitempty"`
 	StreamingUrl  string            `yaml:"streaming_url,omitempty" json:"streaming_url:omitempty"`
 	Headers       map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
 	Weight        int               `yaml:"weight,omitempty" json:"weight,omitempty"`
@@ -26,6 +31,112 @@ type EndpointConfig struct {
 	Options map[string]interface{} `yaml:"options,omitempty" json:"options,omitempty"`
 }
 
+// chain specific configs, keyed by namespace/network
+type ChainConfig struct {
+	// the expected chain id or network name reported by endpoints
+	ExpectedChainId string `yaml:"expected_chain_id,omitempty" json:"expected_chain_id,omitempty"`
+
+	// the expected hash of the genesis block
+	GenesisHash string `yaml:"genesis_hash,omitempty" json:"genesis_hash,omitempty"`
+
+	// how transactions are broadcasted to endpoints
+	Broadcast BroadcastConfig `yaml:"broadcast,omitempty" json:"broadcast,omitempty"`
+
+	// hooks of JSON-RPC requests, see HookConfig
+	Hooks []HookConfig `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+
+	// keep the requests of the same key on the same endpoint
+	Affinity *AffinityConfig `yaml:"affinity,omitempty" json:"affinity,omitempty"`
+}
+
+type BroadcastConfig struct {
+	// all, n-of-m or first-success, default is all
+	Policy string `yaml:"policy,omitempty" json:"policy,omitempty"`
+
+	// the number of endpoints accepting the tx under the n-of-m policy
+	Quorum int `yaml:"quorum,omitempty" json:"quorum,omitempty"`
+}
+
+// A chain defined by config instead of a delegator in Go code,
+// keyed by the namespace in NodemuxConfig.GenericChains
+type GenericChainConfig struct {
+	// jsonrpc or rest
+	Api string `yaml:"api" json:"api"`
+
+	// how the block head is fetched
+	Blockhead GenericProbeConfig `yaml:"blockhead" json:"blockhead"`
+
+	// how the client version is fetched, optional
+	ClientVersion *GenericProbeConfig `yaml:"client_version,omitempty" json:"client_version,omitempty"`
+
+	// JSON-RPC methods whose results are cached and the ttls in
+	// seconds, REST responses are not cached
+	CacheMethods map[string]int `yaml:"cache_methods,omitempty" json:"cache_methods,omitempty"`
+
+	// JSON-RPC methods and where their block height params are
+	HeightParams map[string]GenericHeightParam `yaml:"height_params,omitempty" json:"height_params,omitempty"`
+
+	// REST path patterns whose first group is the block height
+	HeightPaths []string `yaml:"height_paths,omitempty" json:"height_paths,omitempty"`
+
+	// JSON-RPC methods or REST paths submitting transactions
+	BroadcastMethods map[string]GenericBroadcastConfig `yaml:"broadcast_methods,omitempty" json:"broadcast_methods,omitempty"`
+
+	// requests without height params are relayed to endpoints
+	// within max_lag blocks behind the tip, default is 2
+	MaxLag int `yaml:"max_lag,omitempty" json:"max_lag,omitempty"`
+}
+
+// A probe is a JSON-RPC call or a REST request, values are taken out
+// of the result by JSONPath like paths such as $.header.level
+type GenericProbeConfig struct {
+	// the JSON-RPC method
+	Method string `yaml:"method,omitempty" json:"method,omitempty"`
+
+	// the REST path, the request is a POST if params is set
+	Path string `yaml:"path,omitempty" json:"path,omitempty"`
+
+	// the JSON-RPC params or the REST body
+	Params interface{} `yaml:"params,omitempty" json:"params,omitempty"`
+
+	Height  string `yaml:"height,omitempty" json:"height,omitempty"`
+	Hash    string `yaml:"hash,omitempty" json:"hash,omitempty"`
+	Version string `yaml:"version,omitempty" json:"version,omitempty"`
+
+	// the format of the height, hex, decimal or auto which is
+	// hex if prefixed by 0x, default is auto
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+type GenericHeightParam struct {
+	// the index of the param
+	Index int `yaml:"index" json:"index"`
+
+	// the path of the height inside an object param, optional
+	Field string `yaml:"field,omitempty" json:"field,omitempty"`
+
+	// hex, decimal or auto, default is auto
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+}
+
+type GenericBroadcastConfig struct {
+	// the path of the txid in the result or the response body
+	TxId string `yaml:"txid,omitempty" json:"txid,omitempty"`
+
+	// lowercase keywords of JSON-RPC error messages or REST error
+	// bodies telling the tx is already known or the submission is
+	// retryable
+	AlreadyKnown []string `yaml:"already_known,omitempty" json:"already_known,omitempty"`
+	Retryable    []string `yaml:"retryable,omitempty" json:"retryable,omitempty"`
+}
+
+func (chaincfg ChainConfig) Identity() *NetworkIdentity {
+	return &NetworkIdentity{
+		ChainId:     chaincfg.ExpectedChainId,
+		GenesisHash: chaincfg.GenesisHash,
+	}
+}
+
 type StoreConfig struct {
 	Url string `yaml:"url" json:"url"`
 }
@@ -43,6 +154,26 @@ type NodemuxConfig struct {
 	ExtraChains map[string][]string       `yaml:"extra_chains,omitempty" json:"extra_chains,omitempty"`
 	Endpoints   map[string]EndpointConfig `yaml:"endpoints" json:"endpoints"`
 	Stores      map[string]StoreConfig    `yaml:"stores,omitempty" json:"stores,omitempty"`
+	Chains      map[string]ChainConfig    `yaml:"chains,omitempty" json:"chains,omitempty"`
+	TxTracking  TxTrackingConfig          `yaml:"tx_tracking,omitempty" json:"tx_tracking,omitempty"`
+
+	GenericChains map[string]GenericChainConfig `yaml:"generic_chains,omitempty" json:"generic_chains,omitempty"`
+}
+
+type TxTrackingConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+
+	// seconds between checks of pending txs, default is 15
+	Interval int `yaml:"interval,omitempty" json:"interval,omitempty"`
+
+	// rebroadcast pending txs to endpoints not accepting them
+	Rebroadcast bool `yaml:"rebroadcast,omitempty" json:"rebroadcast,omitempty"`
+
+	// seconds before a pending tx is dropped, default is 3600
+	MaxAge int `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+
+	// max number of tracked txs, default is 10000
+	MaxTxs int `yaml:"max_txs,omitempty" json:"max_txs,omitempty"`
 }
 
 // methods
@@ -66,6 +197,16 @@ func (cfg *NodemuxConfig) validateValues() error {
 		cfg.Version = "1.0"
 	}
 
+	if cfg.TxTracking.Interval <= 0 {
+		cfg.TxTracking.Interval = 15
+	}
+	if cfg.TxTracking.MaxAge <= 0 {
+		cfg.TxTracking.MaxAge = 3600
+	}
+	if cfg.TxTracking.MaxTxs <= 0 {
+		cfg.TxTracking.MaxTxs = 10000
+	}
+
 	// currently nodemux store uses redis
 	for _, store := range cfg.Stores {
 		_, err := url.Parse(store.Url)
@@ -74,6 +215,37 @@ func (cfg *NodemuxConfig) validateValues() error {
 		}
 	}
 
+	for chainRepr, chaincfg := range cfg.Chains {
+		if _, err := ParseChain(chainRepr); err != nil {
+			return errors.Wrapf(err, "chain config %s", chainRepr)
+		}
+		switch chaincfg.Broadcast.Policy {
+		case "", BroadcastAll, BroadcastFirstSuccess:
+		case BroadcastQuorum:
+			if chaincfg.Broadcast.Quorum <= 0 {
+				return errors.Errorf("chain config %s, broadcast quorum must be positive", chainRepr)
+			}
+		default:
+			return errors.Errorf("chain config %s, unknown broadcast policy %s", chainRepr, chaincfg.Broadcast.Policy)
+		}
+		for i := range chaincfg.Hooks {
+			if err := chaincfg.Hooks[i].Compile(); err != nil {
+				return errors.Wrapf(err, "chain config %s, hook %d", chainRepr, i)
+			}
+		}
+		if chaincfg.Affinity != nil {
+			if err := chaincfg.Affinity.validate(); err != nil {
+				return errors.Wrapf(err, "chain config %s", chainRepr)
+			}
+		}
+	}
+
+	for namespace, gencfg := range cfg.GenericChains {
+		if err := gencfg.validate(); err != nil {
+			return errors.Wrapf(err, "generic chain %s", namespace)
+		}
+	}
+
 	for _, epcfg := range cfg.Endpoints {
 		if epcfg.Chain == "" {
 			return errors.New("empty chain")
@@ -90,6 +262,15 @@ func (cfg *NodemuxConfig) validateValues() error {
 			}
 		}
 
+		for apiName, apiUrl := range epcfg.Urls {
+			if api, ok := ParseApiName(apiName); !ok || api == ApiJSONRPCWS {
+				return errors.Errorf("unknown api %s of endpoint urls", apiName)
+			}
+			if _, err := url.Parse(apiUrl); err != nil {
+				return errors.Wrapf(err, "parse endpoint %s url", apiName)
+			}
+		}
+
 		for _, skipmtd := range epcfg.SkipMethods {
 			if skipmtd == "" {
 				return errors.New("empty skip method")
@@ -107,6 +288,70 @@ func (cfg *NodemuxConfig) validateValues() error {
 	return nil
 }
 
+func (gencfg GenericChainConfig) validate() error {
+	switch gencfg.Api {
+	case "jsonrpc":
+		if gencfg.Blockhead.Method == "" {
+			return errors.New("empty blockhead method")
+		}
+	case "rest":
+		if gencfg.Blockhead.Path == "" {
+			return errors.New("empty blockhead path")
+		}
+		if len(gencfg.CacheMethods) > 0 {
+			return errors.New("cache_methods are not supported by rest")
+		}
+	default:
+		return errors.Errorf("unknown api %s", gencfg.Api)
+	}
+	if gencfg.Blockhead.Height == "" {
+		return errors.New("empty blockhead height")
+	}
+	for _, pattern := range gencfg.HeightPaths {
+		if _, err := regexp.Compile(pattern); err != nil {
+			return errors.Wrapf(err, "height path %s", pattern)
+		}
+	}
+	return nil
+}
+
+// Get an integer node specific option, options parsed from JSON are
+// float64 while options parsed from yaml are int
+func (epcfg EndpointConfig) IntOption(name string, defaultValue int) int {
+	if v, ok := epcfg.Options[name]; ok {
+		switch iv := v.(type) {
+		case int:
+			return iv
+		case int64:
+			return int(iv)
+		case float64:
+			return int(iv)
+		}
+	}
+	return defaultValue
+}
+
+// Get a string list node specific option
+func (epcfg EndpointConfig) StringsOption(name string) ([]string, bool) {
+	v, ok := epcfg.Options[name]
+	if !ok {
+		return nil, false
+	}
+	switch lv := v.(type) {
+	case []string:
+		return lv, true
+	case []interface{}:
+		values := make([]string, 0, len(lv))
+		for _, item := range lv {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values, true
+	}
+	return nil, false
+}
+
 func (cfg *NodemuxConfig) Load(configPath string) error {
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		if err != nil {
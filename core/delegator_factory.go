@@ -19,9 +19,12 @@ func GetDelegatorFactory() *DelegatorFactory {
 
 func newDelegatorFactory() *DelegatorFactory {
 	return &DelegatorFactory{
-		rpcDelegators:   make(map[string]RPCDelegator),
-		restDelegators:  make(map[string]RESTDelegator),
-		graphDelegators: make(map[string]GraphQLDelegator),
+		rpcDelegators:      make(map[string]RPCDelegator),
+		restDelegators:     make(map[string]RESTDelegator),
+		graphDelegators:    make(map[string]GraphQLDelegator),
+		grpcDelegators:     make(map[string]GRPCDelegator),
+		electrumDelegators: make(map[string]ElectrumDelegator),
+		apis:               make(map[string][]int),
 	}
 }
 
@@ -29,6 +32,10 @@ func (self *DelegatorFactory) SetConfig(config *NodemuxConfig) {
 	self.config = config
 }
 
+func (self DelegatorFactory) Config() *NodemuxConfig {
+	return self.config
+}
+
 func (self DelegatorFactory) registeredChains(delegator BlockheadDelegator, chains []string) []string {
 	registered := append([]string{}, chains...)
 	if self.config == nil || self.config.ExtraChains == nil {
@@ -40,36 +47,77 @@ func (self DelegatorFactory) registeredChains(delegator BlockheadDelegator, chai
 	return registered
 }
 
+// Whether the namespace is supported, the primary api kind of the
+// namespace is returned, which is the first registered kind
 func (self DelegatorFactory) SupportChain(namespace string) (bool, int) {
-	if _, ok := self.rpcDelegators[namespace]; ok {
-		return true, ApiJSONRPC
+	if apis := self.apis[namespace]; len(apis) > 0 {
+		return true, apis[0]
 	}
-	if _, ok := self.restDelegators[namespace]; ok {
-		return true, ApiREST
+	return false, 0
+}
+
+// All api kinds registered for the namespace, the primary one comes first
+func (self DelegatorFactory) SupportedApis(namespace string) []int {
+	return append([]int{}, self.apis[namespace]...)
+}
+
+func (self *DelegatorFactory) addApi(chain string, api int) {
+	for _, a := range self.apis[chain] {
+		if a == api {
+			return
+		}
 	}
+	self.apis[chain] = append(self.apis[chain], api)
+}
 
-	if _, ok := self.graphDelegators[namespace]; ok {
-		return true, ApiGraphQL
+func (self DelegatorFactory) delegatorOf(chain string, api int) (BlockheadDelegator, bool) {
+	var delg BlockheadDelegator
+	var ok bool
+	switch api {
+	case ApiJSONRPC:
+		delg, ok = self.rpcDelegators[chain]
+	case ApiREST:
+		delg, ok = self.restDelegators[chain]
+	case ApiGraphQL:
+		delg, ok = self.graphDelegators[chain]
+	case ApiGRPC:
+		delg, ok = self.grpcDelegators[chain]
+	case ApiElectrum:
+		delg, ok = self.electrumDelegators[chain]
 	}
-	return false, 0
+	return delg, ok
 }
 
+// The delegator of the primary api kind of the namespace
 func (self DelegatorFactory) GetBlockheadDelegator(chain string) BlockheadDelegator {
-	if delg, ok := self.rpcDelegators[chain]; ok {
-		return delg
-	} else if delg, ok := self.restDelegators[chain]; ok {
-		return delg
-	} else if delg, ok := self.graphDelegators[chain]; ok {
-		return delg
+	if ok, api := self.SupportChain(chain); ok {
+		if delg, ok := self.delegatorOf(chain, api); ok {
+			return delg
+		}
 	}
 	log.Panicf("chain %s not supported", chain)
 	return nil
 }
 
+// The delegator syncing an endpoint, which is the one of the first
+// api kind the endpoint serves, e.g. an electrum server of bitcoin is
+// synced by the electrum delegator
+func (self DelegatorFactory) GetEndpointDelegator(ep *Endpoint) BlockheadDelegator {
+	for _, api := range self.apis[ep.Chain.Namespace] {
+		if ep.HasApi(api) {
+			if delg, ok := self.delegatorOf(ep.Chain.Namespace, api); ok {
+				return delg
+			}
+		}
+	}
+	return self.GetBlockheadDelegator(ep.Chain.Namespace)
+}
+
 // RPC delegators
 func (self *DelegatorFactory) RegisterRPC(delegator RPCDelegator, chains ...string) {
 	for _, chain := range self.registeredChains(delegator, chains) {
 		self.rpcDelegators[chain] = delegator
+		self.addApi(chain, ApiJSONRPC)
 	}
 }
 
@@ -85,6 +133,7 @@ func (self DelegatorFactory) GetRPCDelegator(chain string) RPCDelegator {
 func (self *DelegatorFactory) RegisterREST(delegator RESTDelegator, chains ...string) {
 	for _, chain := range self.registeredChains(delegator, chains) {
 		self.restDelegators[chain] = delegator
+		self.addApi(chain, ApiREST)
 	}
 }
 
@@ -100,6 +149,7 @@ func (self DelegatorFactory) GetRESTDelegator(chain string) RESTDelegator {
 func (self *DelegatorFactory) RegisterGraphQL(delegator GraphQLDelegator, chains ...string) {
 	for _, chain := range self.registeredChains(delegator, chains) {
 		self.graphDelegators[chain] = delegator
+		self.addApi(chain, ApiGraphQL)
 	}
 }
 
@@ -110,3 +160,35 @@ func (self DelegatorFactory) GetGraphQLDelegator(chain string) GraphQLDelegator
 	log.Panicf("chain %s not supported", chain)
 	return nil
 }
+
+// gRPC delegators
+func (self *DelegatorFactory) RegisterGRPC(delegator GRPCDelegator, chains ...string) {
+	for _, chain := range self.registeredChains(delegator, chains) {
+		self.grpcDelegators[chain] = delegator
+		self.addApi(chain, ApiGRPC)
+	}
+}
+
+func (self DelegatorFactory) GetGRPCDelegator(chain string) GRPCDelegator {
+	if delegator, ok := self.grpcDelegators[chain]; ok {
+		return delegator
+	}
+	log.Panicf("chain %s not supported", chain)
+	return nil
+}
+
+// Electrum delegators
+func (self *DelegatorFactory) RegisterElectrum(delegator ElectrumDelegator, chains ...string) {
+	for _, chain := range self.registeredChains(delegator, chains) {
+		self.electrumDelegators[chain] = delegator
+		self.addApi(chain, ApiElectrum)
+	}
+}
+
+func (self DelegatorFactory) GetElectrumDelegator(chain string) ElectrumDelegator {
+	if delegator, ok := self.electrumDelegators[chain]; ok {
+		return delegator
+	}
+	log.Panicf("chain %s not supported", chain)
+	return nil
+}
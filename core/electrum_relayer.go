@@ -0,0 +1,374 @@
+package nodemuxcore
+
+// Electrum protocol client, the protocol is JSON-RPC over TCP or TLS
+// whose messages are delimited by newlines, see
+// https://electrum-protocol.readthedocs.io/en/latest/protocol-basics.html
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// the protocol version negotiated with electrum servers
+	ElectrumProtocolVersion = "1.4"
+
+	// the max size of a message line, the connection is closed
+	// once a longer line is read
+	ElectrumMaxLineSize = 4 * 1024 * 1024
+)
+
+var (
+	// the shared electrum connections of endpoints
+	electrumClients     = make(map[string]*electrumSlot)
+	electrumClientsLock sync.Mutex
+)
+
+// the shared connection of an endpoint, dialing holds the lock of the
+// endpoint only so that a slow endpoint doesn't block the others
+type electrumSlot struct {
+	lock   sync.Mutex
+	client *ElectrumClient
+}
+
+type ElectrumClient struct {
+	conn      net.Conn
+	writeLock sync.Mutex
+
+	lock     sync.Mutex
+	pending  map[string]chan jsoff.Message
+	onNotify func(*jsoff.NotifyMessage)
+
+	done chan struct{}
+	err  error
+}
+
+func isElectrumUrl(serverUrl string) bool {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "tcp" || u.Scheme == "ssl" || u.Scheme == "tls"
+}
+
+// Dial an electrum server, the url scheme is tcp for plain TCP, ssl
+// or tls for TLS, e.g. ssl://electrum.example.com:50002
+func DialElectrum(ctx context.Context, serverUrl string, timeout time.Duration) (*ElectrumClient, error) {
+	u, err := url.Parse(serverUrl)
+	if err != nil {
+		return nil, errors.Wrap(err, "url.Parse")
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp":
+		conn, err = dialer.DialContext(ctx, "tcp", u.Host)
+	case "ssl", "tls":
+		tlsDialer := &tls.Dialer{
+			NetDialer: dialer,
+			Config:    &tls.Config{ServerName: u.Hostname()},
+		}
+		conn, err = tlsDialer.DialContext(ctx, "tcp", u.Host)
+	default:
+		return nil, errors.Errorf("unsupported electrum url scheme %s", u.Scheme)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "dial electrum")
+	}
+	c := NewElectrumClient(conn)
+	go c.readLoop()
+	return c, nil
+}
+
+func NewElectrumClient(conn net.Conn) *ElectrumClient {
+	return &ElectrumClient{
+		conn:    conn,
+		pending: make(map[string]chan jsoff.Message),
+		done:    make(chan struct{}),
+	}
+}
+
+// Set the handler of notifications such as blockchain.headers.subscribe
+func (c *ElectrumClient) OnNotify(f func(*jsoff.NotifyMessage)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onNotify = f
+}
+
+// Closed when the connection is broken or closed
+func (c *ElectrumClient) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *ElectrumClient) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+func (c *ElectrumClient) Close() {
+	c.conn.Close()
+}
+
+// Scan the newline delimited messages of r, scanning fails with
+// bufio.ErrTooLong on a line longer than ElectrumMaxLineSize
+func NewElectrumScanner(r io.Reader) *bufio.Scanner {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), ElectrumMaxLineSize)
+	return scanner
+}
+
+func (c *ElectrumClient) readLoop() {
+	scanner := NewElectrumScanner(c.conn)
+	for scanner.Scan() {
+		msg, err := jsoff.ParseBytes(scanner.Bytes())
+		if err != nil {
+			log.Warnf("bad electrum message, %s", err)
+			continue
+		}
+		c.dispatch(msg)
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	} else {
+		// stop the server from writing the rest of the line
+		c.conn.Close()
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.err = err
+	for _, ch := range c.pending {
+		close(ch)
+	}
+	c.pending = make(map[string]chan jsoff.Message)
+	close(c.done)
+}
+
+func (c *ElectrumClient) dispatch(msg jsoff.Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if msg.IsNotify() {
+		if onNotify := c.onNotify; onNotify != nil {
+			// the handler may call methods of the client
+			c.lock.Unlock()
+			onNotify(msg.(*jsoff.NotifyMessage))
+			c.lock.Lock()
+		}
+	} else if msg.IsResultOrError() {
+		key := fmt.Sprint(msg.MustId())
+		if ch, ok := c.pending[key]; ok {
+			delete(c.pending, key)
+			ch <- msg
+		}
+	}
+}
+
+// Write a message followed by a newline
+func (c *ElectrumClient) Send(msg jsoff.Message) error {
+	data, err := json.Marshal(msg.Interface())
+	if err != nil {
+		return errors.Wrap(err, "json.Marshal")
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.conn.Write(append(data, '\n'))
+	return err
+}
+
+// Call a method, the request id is replaced by a unique one over the
+// connection and restored in the response
+func (c *ElectrumClient) Call(ctx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	callmsg := jsoff.NewRequestMessage(jsoff.NewUuid(), reqmsg.Method, reqmsg.Params)
+	key := fmt.Sprint(callmsg.Id)
+	ch := make(chan jsoff.Message, 1)
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, errors.Wrap(c.err, "electrum connection closed")
+	}
+	c.pending[key] = ch
+	c.lock.Unlock()
+
+	if err := c.Send(callmsg); err != nil {
+		c.lock.Lock()
+		delete(c.pending, key)
+		c.lock.Unlock()
+		return nil, errors.Wrap(err, "electrum send")
+	}
+
+	select {
+	case <-ctx.Done():
+		c.lock.Lock()
+		delete(c.pending, key)
+		c.lock.Unlock()
+		return nil, ctx.Err()
+	case resmsg, ok := <-ch:
+		if !ok {
+			return nil, errors.New("electrum connection closed")
+		}
+		if resmsg.IsError() {
+			return jsoff.NewErrorMessage(reqmsg, resmsg.MustError()), nil
+		}
+		return jsoff.NewResultMessage(reqmsg, resmsg.(*jsoff.ResultMessage).Result), nil
+	}
+}
+
+func (c *ElectrumClient) UnwrapCall(ctx context.Context, reqmsg *jsoff.RequestMessage, output interface{}) error {
+	resmsg, err := c.Call(ctx, reqmsg)
+	if err != nil {
+		return err
+	}
+	if resmsg.IsError() {
+		return resmsg.MustError()
+	}
+	return jsoff.DecodeInterface(resmsg.(*jsoff.ResultMessage).Result, output)
+}
+
+// the url of electrum calls
+func (ep Endpoint) electrumUrl() string {
+	return ep.ApiUrl(ApiElectrum)
+}
+
+func (ep Endpoint) electrumTimeout() time.Duration {
+	timeout := ep.Config.Timeout
+	if timeout <= 0 {
+		timeout = 90
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// Dial a dedicated electrum connection to the endpoint, which is used
+// by subscriptions. server.version is negotiated as the first message
+func (ep *Endpoint) DialElectrum(ctx context.Context) (*ElectrumClient, error) {
+	c, err := DialElectrum(ctx, ep.electrumUrl(), ep.electrumTimeout())
+	if err != nil {
+		return nil, err
+	}
+	reqmsg := jsoff.NewRequestMessage(
+		1, "server.version", []any{"nodemux", ElectrumProtocolVersion})
+	var version []string
+	if err := c.UnwrapCall(ctx, reqmsg, &version); err != nil {
+		c.Close()
+		return nil, errors.Wrap(err, "server.version")
+	}
+	return c, nil
+}
+
+// the shared electrum connection of the endpoint, redialed if broken
+func (ep *Endpoint) electrumClient(ctx context.Context) (*ElectrumClient, error) {
+	electrumClientsLock.Lock()
+	slot, ok := electrumClients[ep.Name]
+	if !ok {
+		slot = &electrumSlot{}
+		electrumClients[ep.Name] = slot
+	}
+	electrumClientsLock.Unlock()
+
+	slot.lock.Lock()
+	defer slot.lock.Unlock()
+	if slot.client != nil {
+		select {
+		case <-slot.client.Done():
+		default:
+			return slot.client, nil
+		}
+	}
+	c, err := ep.DialElectrum(ctx)
+	if err != nil {
+		return nil, err
+	}
+	slot.client = c
+	return c, nil
+}
+
+func (ep *Endpoint) CallElectrum(rootCtx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	ep.incrRelayCount()
+
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(reqmsg.Method))
+	recordAttempt(ctx, ep)
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
+
+	start := time.Now()
+	var res jsoff.Message
+	c, err := ep.electrumClient(ctx)
+	if err == nil {
+		res, err = c.Call(ctx, reqmsg)
+	}
+	delta := time.Since(start)
+	methodLabel := ResponseMethodLabel(reqmsg.Method, res)
+	ep.observeUpstream(methodLabel, delta.Seconds())
+	recordUpstreamTime(ctx, delta)
+
+	fields := RequestLogFields(ctx, log.Fields{
+		"method":      reqmsg.Method,
+		"timeSpentMS": delta.Milliseconds(),
+	})
+	if err != nil {
+		fields["err"] = err.Error()
+		errType, code := upstreamErrorLabels(err)
+		ep.incrUpstreamError(methodLabel, reqmsg.Method, errType, code)
+	} else if res.IsError() {
+		fields["err"] = fmt.Sprintf("RPC %d %s", res.MustError().Code, res.MustError().Message)
+		span.SetAttributes(AttrRPCError.Int(res.MustError().Code))
+		ep.incrUpstreamError(methodLabel, reqmsg.Method, "rpc", strconv.Itoa(res.MustError().Code))
+	}
+	EndSpan(span, err)
+	ep.Log().WithFields(fields).Info("call electrum")
+	return res, err
+}
+
+func (ep *Endpoint) UnwrapCallElectrum(ctx context.Context, reqmsg *jsoff.RequestMessage, output interface{}) error {
+	resmsg, err := ep.CallElectrum(ctx, reqmsg)
+	if err != nil {
+		return err
+	}
+	if resmsg.IsError() {
+		return resmsg.MustError()
+	}
+	return jsoff.DecodeInterface(resmsg.(*jsoff.ResultMessage).Result, output)
+}
+
+func (m *Multiplexer) DefaultRelayElectrum(
+	rootCtx context.Context,
+	chain ChainRef,
+	reqmsg *jsoff.RequestMessage,
+	overHeight int) (jsoff.Message, error) {
+	ctx, span := StartSpan(rootCtx, "relay", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(reqmsg.Method),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	ep, found := m.SelectApiOverHeight(ctx, chain, ApiElectrum, reqmsg.Method, overHeight)
+	if !found {
+		if overHeight > 0 {
+			return m.DefaultRelayElectrum(ctx, chain, reqmsg, -2)
+		}
+		return ErrNotAvailable.ToMessage(reqmsg), nil
+	}
+	span.SetAttributes(AttrEndpoint.String(ep.Name))
+	return ep.CallElectrum(ctx, reqmsg)
+}
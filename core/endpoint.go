@@ -10,6 +10,7 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +18,8 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff/net"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // / Create an endpoint instance
@@ -93,19 +96,61 @@ func (ep *Endpoint) Connect() {
 	}
 }
 
-func (ep Endpoint) FullUrl(path string) string {
+func joinUrl(baseUrl string, path string) string {
 	if path == "" {
-		return ep.Config.Url
-	} else if strings.HasSuffix(ep.Config.Url, "/") && strings.HasPrefix(path, "/") {
-		return ep.Config.Url + path[1:]
+		return baseUrl
+	} else if strings.HasSuffix(baseUrl, "/") && strings.HasPrefix(path, "/") {
+		return baseUrl + path[1:]
 	} else {
-		return ep.Config.Url + path
+		return baseUrl + path
 	}
 }
 
+func (ep Endpoint) FullUrl(path string) string {
+	return joinUrl(ep.Config.Url, path)
+}
+
+// The url serving the api kind, empty if the endpoint doesn't serve
+// it. An endpoint without urls serves all api kinds by url, otherwise
+// url serves the primary api kind of the namespace. gRPC-Web is only
+// served by its own url as native gRPC servers don't speak it. As
+// electrum is not over http, an electrum url serves electrum only
+func (ep Endpoint) ApiUrl(api int) string {
+	if apiUrl, ok := ep.Config.Urls[ApiName(api)]; ok {
+		return apiUrl
+	}
+	if api == ApiGRPCWeb || isElectrumUrl(ep.Config.Url) != (api == ApiElectrum) {
+		return ""
+	}
+	if len(ep.Config.Urls) == 0 || api == ApiElectrum {
+		return ep.Config.Url
+	}
+	if _, primary := GetDelegatorFactory().SupportChain(ep.Chain.Namespace); primary == api {
+		return ep.Config.Url
+	}
+	return ""
+}
+
+func (ep Endpoint) HasApi(api int) bool {
+	return ep.ApiUrl(api) != ""
+}
+
+func (ep Endpoint) ApiFullUrl(api int, path string) string {
+	return joinUrl(ep.ApiUrl(api), path)
+}
+
 // RESTful methods
 func (ep *Endpoint) PipeRequest(rootCtx context.Context, path string, w http.ResponseWriter, r *http.Request) error {
-	resp, err := ep.doResponse(rootCtx, path, r)
+	return ep.pipeRequest(rootCtx, ep.FullUrl(path), apiMethodLabel(ApiREST), path, w, r)
+}
+
+// Pipe the request to the url of the api kind
+func (ep *Endpoint) PipeApiRequest(rootCtx context.Context, api int, path string, w http.ResponseWriter, r *http.Request) error {
+	return ep.pipeRequest(rootCtx, ep.ApiFullUrl(api, path), apiMethodLabel(api), path, w, r)
+}
+
+func (ep *Endpoint) pipeRequest(rootCtx context.Context, fullUrl string, methodLabel string, path string, w http.ResponseWriter, r *http.Request) error {
+	resp, err := ep.doResponse(rootCtx, fullUrl, methodLabel, path, r)
 	if err != nil {
 		if os.IsTimeout(err) {
 			w.WriteHeader(http.StatusRequestTimeout)
@@ -127,7 +172,9 @@ func (ep *Endpoint) PipeRequest(rootCtx context.Context, path string, w http.Res
 	}
 	w.Header().Set("X-Real-Endpoint", ep.Name)
 	w.WriteHeader(resp.StatusCode)
-	if written, err := io.Copy(w, resp.Body); err != nil {
+	written, err := io.Copy(w, resp.Body)
+	ep.addUpstreamBytes("received", written)
+	if err != nil {
 		ep.Log().WithFields(log.Fields{
 			"written": written,
 			"path":    path,
@@ -138,17 +185,28 @@ func (ep *Endpoint) PipeRequest(rootCtx context.Context, path string, w http.Res
 	return nil
 }
 
-func (ep *Endpoint) doResponse(rootCtx context.Context, path string, r *http.Request) (*http.Response, error) {
+func (ep *Endpoint) doResponse(rootCtx context.Context, fullUrl string, methodLabel string, path string, r *http.Request) (resp *http.Response, err error) {
 	ep.Connect()
 	ep.incrRelayCount()
+
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(path))
+	defer func() { EndSpan(span, err) }()
+	recordAttempt(ctx, ep)
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
+
 	// prepare request
 
-	url := ep.FullUrl(path)
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequestWithContext(rootCtx, r.Method, url, io.NopCloser(bytes.NewBuffer(body)))
+	req, err := http.NewRequestWithContext(ctx, r.Method, fullUrl, io.NopCloser(bytes.NewBuffer(body)))
 	if err != nil {
 		return nil, errors.Wrap(err, "http.NewRequestWithContext")
 	}
@@ -166,21 +224,31 @@ func (ep *Endpoint) doResponse(rootCtx context.Context, path string, r *http.Req
 		}
 	}
 	req.Header.Set("X-Forwarded-For", r.RemoteAddr)
+	injectUpstreamHeaders(ctx, req.Header)
+
+	ep.addUpstreamBytes("sent", int64(len(body)))
 
 	start := time.Now()
-	resp, err := ep.client.Do(req)
+	resp, err = ep.client.Do(req)
 	delta := time.Since(start)
-	fields := log.Fields{
+	ep.observeUpstream(methodLabel, delta.Seconds())
+	recordUpstreamTime(ctx, delta)
+	fields := RequestLogFields(ctx, log.Fields{
 		"method":      path,
 		"httpMethod":  r.Method,
 		"timeSpentMS": delta.Milliseconds(),
-	}
+	})
 	if err != nil {
 		fields["err"] = err.Error()
+		ep.incrUpstreamError(methodLabel, path, "network", "")
 	}
 
 	if resp != nil {
 		fields["status"] = resp.StatusCode
+		span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		if resp.StatusCode >= 400 {
+			ep.incrUpstreamError(methodLabel, path, "http", strconv.Itoa(resp.StatusCode))
+		}
 	}
 
 	ep.Log().WithFields(fields).Info("relay http")
@@ -228,11 +296,22 @@ func (ep *Endpoint) PostJson(rootCtx context.Context, path string, body interfac
 }
 
 // Generic way of performing a HTTP request and shift the response as JSON
-func (ep *Endpoint) RequestJson(rootCtx context.Context, method string, path string, data []byte, headers map[string]string, output interface{}) error {
+func (ep *Endpoint) RequestJson(rootCtx context.Context, method string, path string, data []byte, headers map[string]string, output interface{}) (err error) {
 	ep.Connect()
 
-	ctx, cancel := context.WithCancel(rootCtx)
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(path))
+	defer func() { EndSpan(span, err) }()
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
+	recordAttempt(ctx, ep)
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
 
 	// prepare request
 	// TODO: join the server url and path
@@ -251,14 +330,21 @@ func (ep *Endpoint) RequestJson(rootCtx context.Context, method string, path str
 	for k, v := range headers {
 		req.Header.Set(k, v)
 	}
+	injectUpstreamHeaders(ctx, req.Header)
+	ep.addUpstreamBytes("sent", int64(len(data)))
 
+	start := time.Now()
 	resp, err := ep.client.Do(req)
+	ep.observeUpstream(apiMethodLabel(ApiREST), time.Since(start).Seconds())
+	recordUpstreamTime(ctx, time.Since(start))
 	if err != nil {
+		ep.incrUpstreamError(apiMethodLabel(ApiREST), path, "network", "")
 		return errors.Wrap(err, "get Do")
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
+		ep.incrUpstreamError(apiMethodLabel(ApiREST), path, "http", strconv.Itoa(resp.StatusCode))
 		ep.Log().Warnf("invalid response status %d", resp.StatusCode)
 		abnResp := &jsoffnet.WrappedResponse{
 			Response: resp,
@@ -270,6 +356,7 @@ func (ep *Endpoint) RequestJson(rootCtx context.Context, method string, path str
 	if err != nil {
 		return errors.Wrap(err, "io.ReadAll")
 	}
+	ep.addUpstreamBytes("received", int64(len(respBody)))
 
 	err = json.Unmarshal(respBody, output)
 	if err != nil {
@@ -320,7 +407,7 @@ func (ep *Endpoint) RequestGraphQL(ctx context.Context, query string, variables
 }
 
 func (ep *Endpoint) GetClientVersion(ctx context.Context) {
-	delegator := GetDelegatorFactory().GetBlockheadDelegator(ep.Chain.Namespace)
+	delegator := GetDelegatorFactory().GetEndpointDelegator(ep)
 	version, err := delegator.GetClientVersion(ctx, ep)
 	if err != nil {
 		ep.Log().Warnf("error while getting client version %s", err)
@@ -338,11 +425,14 @@ func (ep Endpoint) Info() EndpointInfo {
 		Healthy:       ep.Healthy,
 		Blockhead:     ep.Blockhead,
 		ClientVersion: ep.ClientVersion,
+		Capabilities:  ep.Capabilities,
+		Identity:      ep.Identity,
+		Rejected:      ep.Rejected,
 	}
 }
 
 func (ep Endpoint) Available(method string, minHeight int) bool {
-	if !ep.Healthy {
+	if !ep.Healthy || ep.Rejected != "" {
 		return false
 	}
 
@@ -358,5 +448,10 @@ func (ep Endpoint) Available(method string, minHeight int) bool {
 			return false
 		}
 	}
+
+	if method != "" && ep.Capabilities != nil && !ep.Capabilities.Supports(method) {
+		// the method is not supported according to the capability probe
+		return false
+	}
 	return true
 }
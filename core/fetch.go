@@ -9,12 +9,13 @@ func blockIsEqual(a, b *Block) bool {
 	if a == nil || b == nil {
 		return false
 	}
-	return a.Height == b.Height && a.Hash == b.Hash
+	return a.Height == b.Height && a.Hash == b.Hash &&
+		a.Safe == b.Safe && a.Finalized == b.Finalized
 }
 
 func (m *Multiplexer) getBlockhead(rootCtx context.Context, ep *Endpoint, lastBlock *Block) (*Block, error) {
 	logger := ep.Log()
-	delegator := GetDelegatorFactory().GetBlockheadDelegator(ep.Chain.Namespace)
+	delegator := GetDelegatorFactory().GetEndpointDelegator(ep)
 	block, err := delegator.GetBlockhead(rootCtx, m, ep)
 	ep.incrBlockheadCount()
 
@@ -58,7 +59,7 @@ func (m *Multiplexer) UpdateBlockIfChanged(ep *Endpoint, block *Block) {
 }
 
 func (m *Multiplexer) syncEndpoint(rootCtx context.Context, ep *Endpoint) {
-	delegator := GetDelegatorFactory().GetBlockheadDelegator(ep.Chain.Namespace)
+	delegator := GetDelegatorFactory().GetEndpointDelegator(ep)
 	started, err := delegator.StartSync(rootCtx, m, ep)
 	if err != nil {
 		panic(err)
@@ -0,0 +1,215 @@
+package nodemuxcore
+
+// gRPC and gRPC-Web relaying, native gRPC goes over HTTP/2 (h2c for
+// plain http endpoints) and gRPC-Web goes over the endpoint's http
+// client to the grpc-web url of the endpoint, e.g. a grpc-web proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/net/http2"
+)
+
+func IsGRPCWeb(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc-web")
+}
+
+// the api kind of a gRPC request
+func grpcApi(r *http.Request) int {
+	if IsGRPCWeb(r) {
+		return ApiGRPCWeb
+	}
+	return ApiGRPC
+}
+
+func (ep *Endpoint) grpcRoundTripper() http.RoundTripper {
+	if ep.grpcTransport == nil {
+		if strings.HasPrefix(ep.ApiUrl(ApiGRPC), "https://") {
+			ep.grpcTransport = &http2.Transport{}
+		} else {
+			// h2c, HTTP/2 over plain TCP
+			ep.grpcTransport = &http2.Transport{
+				AllowHTTP: true,
+				DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, addr)
+				},
+			}
+		}
+	}
+	return ep.grpcTransport
+}
+
+// Pipe a gRPC or gRPC-Web request to the endpoint, streaming calls
+// are piped as they go and trailers are kept
+func (ep *Endpoint) PipeGRPC(rootCtx context.Context, path string, w http.ResponseWriter, r *http.Request) (err error) {
+	ep.Connect()
+	ep.incrRelayCount()
+
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(path))
+	defer func() { EndSpan(span, err) }()
+	recordAttempt(ctx, ep)
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
+
+	api := grpcApi(r)
+	if !ep.HasApi(api) {
+		return errors.Errorf("endpoint has no %s url", ApiName(api))
+	}
+	target, err := url.Parse(ep.ApiFullUrl(api, path))
+	if err != nil {
+		return errors.Wrap(err, "url.Parse")
+	}
+
+	transport := ep.grpcRoundTripper()
+	if api == ApiGRPCWeb {
+		transport = ep.client.Transport
+	}
+
+	var proxyErr error
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL = target
+			req.Host = target.Host
+			for k, v := range ep.Config.Headers {
+				req.Header.Set(k, v)
+			}
+			injectUpstreamHeaders(ctx, req.Header)
+		},
+		Transport:     transport,
+		FlushInterval: -1,
+		ModifyResponse: func(resp *http.Response) error {
+			resp.Header.Set("X-Real-Endpoint", ep.Name)
+			if resp.StatusCode >= 400 {
+				ep.incrUpstreamError(apiMethodLabel(api), path, "http", strconv.Itoa(resp.StatusCode))
+			}
+			return nil
+		},
+		ErrorHandler: func(_ http.ResponseWriter, _ *http.Request, e error) {
+			// the response is left to the caller
+			proxyErr = e
+		},
+	}
+
+	start := time.Now()
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+	delta := time.Since(start)
+	ep.observeUpstream(apiMethodLabel(api), delta.Seconds())
+	recordUpstreamTime(ctx, delta)
+
+	fields := RequestLogFields(ctx, log.Fields{
+		"method":      path,
+		"timeSpentMS": delta.Milliseconds(),
+	})
+	if proxyErr != nil {
+		fields["err"] = proxyErr.Error()
+		ep.incrUpstreamError(apiMethodLabel(api), path, "network", "")
+	}
+	ep.Log().WithFields(fields).Info("relay grpc")
+	return proxyErr
+}
+
+// Call a unary gRPC method, data is the protobuf encoded request
+// message and the protobuf encoded response message is returned
+func (ep *Endpoint) CallGRPC(rootCtx context.Context, path string, data []byte) (res []byte, err error) {
+	ep.Connect()
+
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(path))
+	defer func() { EndSpan(span, err) }()
+	recordAttempt(ctx, ep)
+
+	timeout := ep.Config.Timeout
+	if timeout <= 0 {
+		timeout = 90
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
+
+	// a length prefixed message which is not compressed
+	frame := make([]byte, 5+len(data))
+	binary.BigEndian.PutUint32(frame[1:5], uint32(len(data)))
+	copy(frame[5:], data)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ep.ApiFullUrl(ApiGRPC, path), bytes.NewReader(frame))
+	if err != nil {
+		return nil, errors.Wrap(err, "http.NewRequestWithContext")
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	for k, v := range ep.Config.Headers {
+		req.Header.Set(k, v)
+	}
+	injectUpstreamHeaders(ctx, req.Header)
+	ep.addUpstreamBytes("sent", int64(len(frame)))
+
+	start := time.Now()
+	resp, err := ep.grpcRoundTripper().RoundTrip(req)
+	ep.observeUpstream(apiMethodLabel(ApiGRPC), time.Since(start).Seconds())
+	recordUpstreamTime(ctx, time.Since(start))
+	if err != nil {
+		ep.incrUpstreamError(apiMethodLabel(ApiGRPC), path, "network", "")
+		return nil, errors.Wrap(err, "grpc RoundTrip")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "io.ReadAll")
+	}
+	ep.addUpstreamBytes("received", int64(len(body)))
+
+	if resp.StatusCode != 200 {
+		ep.incrUpstreamError(apiMethodLabel(ApiGRPC), path, "http", strconv.Itoa(resp.StatusCode))
+		return nil, errors.Errorf("grpc abnormal response status %d", resp.StatusCode)
+	}
+
+	// a trailers only response carries the status in headers
+	status := resp.Trailer.Get("Grpc-Status")
+	message := resp.Trailer.Get("Grpc-Message")
+	if status == "" {
+		status = resp.Header.Get("Grpc-Status")
+		message = resp.Header.Get("Grpc-Message")
+	}
+	if status != "0" {
+		ep.incrUpstreamError(apiMethodLabel(ApiGRPC), path, "rpc", status)
+		return nil, errors.Errorf("grpc status %s %s", status, message)
+	}
+
+	if len(body) < 5 {
+		return nil, errors.New("grpc response message missing")
+	}
+	if body[0] != 0 {
+		return nil, errors.New("grpc compressed response not supported")
+	}
+	size := binary.BigEndian.Uint32(body[1:5])
+	if int(size) > len(body)-5 {
+		return nil, errors.New("grpc response message truncated")
+	}
+	return body[5 : 5+size], nil
+}
@@ -0,0 +1,622 @@
+package nodemuxcore
+
+// Hooks are Starlark scripts configured per chain or per account which
+// customize the delegation of JSON-RPC requests without forking the
+// chain delegators, a script defines either or both of
+//
+//	def before(req):
+//	    # req is a dict of id, method, params, chain, account and
+//	    # endpoints, the healthy endpoints as dicts of name and height.
+//	    # method and params can be modified in place, the returned
+//	    # dict may have an endpoint to relay to, or a result or an
+//	    # error {code, message} to respond without relaying
+//	    if req["method"] == "web3_clientVersion":
+//	        return {"result": "nodemux"}
+//
+//	def after(req, resp):
+//	    # resp is a dict of result or error, the returned dict
+//	    # replaces the response
+//	    resp["result"].pop("logsBloom", None)
+//	    return resp
+//
+// Scripts run in a sandbox with the json module only, they can neither
+// load modules nor touch files or the network, each call is bounded by
+// max_steps and timeout. Script files are reloaded once they change.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	starjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const (
+	// the default bound of the steps of a hook call
+	hookMaxSteps = 100000
+
+	// the default timeout of a hook call in milliseconds
+	hookTimeout = 100
+
+	// the interval to check whether a script file is changed
+	hookReloadInterval = time.Second
+)
+
+type HookConfig struct {
+	// the methods the hook applies to, a trailing * matches a
+	// prefix, empty means all methods
+	Methods []string `yaml:"methods,omitempty" json:"methods,omitempty"`
+
+	// the path of the Starlark script
+	Script string `yaml:"script,omitempty" json:"script,omitempty"`
+
+	// the inline Starlark source, used when script is empty
+	Source string `yaml:"source,omitempty" json:"source,omitempty"`
+
+	// the max execution steps of a call, default is 100000
+	MaxSteps uint64 `yaml:"max_steps,omitempty" json:"max_steps,omitempty"`
+
+	// the timeout of a call in milliseconds, default is 100
+	Timeout int `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+
+	script *hookScript
+}
+
+// Compile the script of the hook, hooks must be compiled before use
+func (hook *HookConfig) Compile() error {
+	if hook.Script == "" && hook.Source == "" {
+		return errors.New("hook has neither script nor source")
+	}
+	if hook.Timeout < 0 {
+		return errors.New("negative hook timeout")
+	}
+	s := &hookScript{
+		path:     hook.Script,
+		source:   hook.Source,
+		maxSteps: hook.MaxSteps,
+		timeout:  time.Duration(hook.Timeout) * time.Millisecond,
+	}
+	if s.maxSteps == 0 {
+		s.maxSteps = hookMaxSteps
+	}
+	if s.timeout == 0 {
+		s.timeout = hookTimeout * time.Millisecond
+	}
+	if err := s.load(); err != nil {
+		return err
+	}
+	hook.script = s
+	return nil
+}
+
+// Whether the hook applies to the method
+func (hook HookConfig) Match(method string) bool {
+	if len(hook.Methods) == 0 {
+		return true
+	}
+	for _, pattern := range hook.Methods {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(method, prefix) {
+				return true
+			}
+		} else if pattern == method {
+			return true
+		}
+	}
+	return false
+}
+
+// a compiled script, which is reloaded if the file changes
+type hookScript struct {
+	path     string
+	source   string
+	maxSteps uint64
+	timeout  time.Duration
+
+	lock      sync.Mutex
+	globals   starlark.StringDict
+	modTime   time.Time
+	checkedAt time.Time
+}
+
+func (s *hookScript) name() string {
+	if s.path != "" {
+		return s.path
+	}
+	return "<source>"
+}
+
+func (s *hookScript) newThread() (*starlark.Thread, func()) {
+	thread := &starlark.Thread{
+		Name: "hook",
+		Print: func(_ *starlark.Thread, msg string) {
+			log.Debugf("hook %s: %s", s.name(), msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(s.maxSteps)
+	timer := time.AfterFunc(s.timeout, func() {
+		thread.Cancel("timeout")
+	})
+	return thread, func() { timer.Stop() }
+}
+
+// read and execute the script, the globals are frozen so that they are
+// shared by concurrent calls
+func (s *hookScript) load() error {
+	var src interface{} = s.source
+	var modTime time.Time
+	if s.path != "" {
+		fi, err := os.Stat(s.path)
+		if err != nil {
+			return errors.Wrapf(err, "hook script %s", s.path)
+		}
+		data, err := os.ReadFile(s.path)
+		if err != nil {
+			return errors.Wrapf(err, "hook script %s", s.path)
+		}
+		src = data
+		modTime = fi.ModTime()
+	}
+
+	thread, stop := s.newThread()
+	defer stop()
+	predeclared := starlark.StringDict{"json": starjson.Module}
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, s.name(), src, predeclared)
+	if err != nil {
+		return errors.Wrapf(err, "hook script %s", s.name())
+	}
+	for _, fn := range []string{"before", "after"} {
+		if v, ok := globals[fn]; ok {
+			if _, ok := v.(starlark.Callable); !ok {
+				return errors.Errorf("hook script %s, %s is not a function", s.name(), fn)
+			}
+		}
+	}
+	globals.Freeze()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.globals = globals
+	s.modTime = modTime
+	s.checkedAt = time.Now()
+	return nil
+}
+
+// the globals of the script, the script file is reloaded if it's
+// changed, the old globals are kept if the new script fails
+func (s *hookScript) current() starlark.StringDict {
+	s.lock.Lock()
+	globals := s.globals
+	reload := false
+	if s.path != "" && time.Since(s.checkedAt) > hookReloadInterval {
+		s.checkedAt = time.Now()
+		if fi, err := os.Stat(s.path); err == nil && !fi.ModTime().Equal(s.modTime) {
+			reload = true
+		}
+	}
+	s.lock.Unlock()
+
+	if reload {
+		if err := s.load(); err != nil {
+			log.Warnf("reload hook script error %s", err)
+		} else {
+			log.Infof("hook script %s reloaded", s.path)
+			s.lock.Lock()
+			globals = s.globals
+			s.lock.Unlock()
+		}
+	}
+	return globals
+}
+
+// call the function of the script, false is returned if the script
+// doesn't define the function
+func (s *hookScript) call(fname string, args ...starlark.Value) (starlark.Value, bool, error) {
+	fn, ok := s.current()[fname]
+	if !ok {
+		return nil, false, nil
+	}
+	thread, stop := s.newThread()
+	defer stop()
+	v, err := starlark.Call(thread, fn, starlark.Tuple(args), nil)
+	return v, true, err
+}
+
+// Values decoded from yaml have map[interface{}]interface{} maps
+// which cannot be marshaled to JSON, convert them to string keyed maps
+func NormalizeYamlValue(v interface{}) interface{} {
+	switch tv := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(tv))
+		for k, item := range tv {
+			m[fmt.Sprintf("%v", k)] = NormalizeYamlValue(item)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(tv))
+		for k, item := range tv {
+			m[k] = NormalizeYamlValue(item)
+		}
+		return m
+	case []interface{}:
+		arr := make([]interface{}, len(tv))
+		for i, item := range tv {
+			arr[i] = NormalizeYamlValue(item)
+		}
+		return arr
+	}
+	return v
+}
+
+// convert a JSON value to a Starlark value
+func toStarlark(v interface{}) (starlark.Value, error) {
+	switch tv := v.(type) {
+	case nil:
+		return starlark.None, nil
+	case bool:
+		return starlark.Bool(tv), nil
+	case string:
+		return starlark.String(tv), nil
+	case int:
+		return starlark.MakeInt(tv), nil
+	case int64:
+		return starlark.MakeInt64(tv), nil
+	case float64:
+		if tv == math.Trunc(tv) && math.Abs(tv) < 1<<53 {
+			return starlark.MakeInt64(int64(tv)), nil
+		}
+		return starlark.Float(tv), nil
+	case json.Number:
+		if i, err := tv.Int64(); err == nil {
+			return starlark.MakeInt64(i), nil
+		}
+		f, err := tv.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return starlark.Float(f), nil
+	case []interface{}:
+		items := make([]starlark.Value, len(tv))
+		for i, item := range tv {
+			sv, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			items[i] = sv
+		}
+		return starlark.NewList(items), nil
+	case map[string]interface{}:
+		dict := starlark.NewDict(len(tv))
+		for k, item := range tv {
+			sv, err := toStarlark(item)
+			if err != nil {
+				return nil, err
+			}
+			dict.SetKey(starlark.String(k), sv)
+		}
+		return dict, nil
+	}
+
+	// other values such as structs are converted by their JSON form
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var jv interface{}
+	if err := json.Unmarshal(data, &jv); err != nil {
+		return nil, err
+	}
+	return toStarlark(jv)
+}
+
+// convert a Starlark value to a JSON value
+func fromStarlark(v starlark.Value) (interface{}, error) {
+	switch tv := v.(type) {
+	case starlark.NoneType:
+		return nil, nil
+	case starlark.Bool:
+		return bool(tv), nil
+	case starlark.String:
+		return string(tv), nil
+	case starlark.Int:
+		if i, ok := tv.Int64(); ok {
+			return i, nil
+		}
+		return nil, errors.Errorf("int %s out of range", tv)
+	case starlark.Float:
+		return float64(tv), nil
+	case starlark.Indexable:
+		// list and tuple
+		arr := make([]interface{}, tv.Len())
+		for i := 0; i < tv.Len(); i++ {
+			item, err := fromStarlark(tv.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			arr[i] = item
+		}
+		return arr, nil
+	case *starlark.Dict:
+		m := make(map[string]interface{}, tv.Len())
+		for _, kv := range tv.Items() {
+			k, ok := starlark.AsString(kv[0])
+			if !ok {
+				return nil, errors.Errorf("non-string key %s", kv[0])
+			}
+			item, err := fromStarlark(kv[1])
+			if err != nil {
+				return nil, err
+			}
+			m[k] = item
+		}
+		return m, nil
+	}
+	return nil, errors.Errorf("cannot convert %s to JSON", v.Type())
+}
+
+// the returned dict of the before and after functions
+type hookAction struct {
+	Endpoint string      `json:"endpoint"`
+	Result   interface{} `json:"result"`
+	Error    *HookError  `json:"error"`
+}
+
+type HookError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func (e HookError) toMessage(reqmsg *jsoff.RequestMessage) jsoff.Message {
+	rpcErr := &jsoff.RPCError{Code: e.Code, Message: e.Message, Data: e.Data}
+	return rpcErr.ToMessage(reqmsg)
+}
+
+// run the before function, the request is rewritten in place
+func (hook HookConfig) before(m *Multiplexer, ctx context.Context, chain ChainRef, reqmsg *jsoff.RequestMessage) (*hookAction, error) {
+	var endpoints []interface{}
+	for _, ep := range m.AllHealthyEndpoints(chain, reqmsg.Method, 0) {
+		height := 0
+		if ep.Blockhead != nil {
+			height = ep.Blockhead.Height
+		}
+		endpoints = append(endpoints, map[string]interface{}{"name": ep.Name, "height": height})
+	}
+	account := ""
+	if info := RequestInfoFromContext(ctx); info != nil {
+		account = info.Account
+	}
+	sreq, err := toStarlark(map[string]interface{}{
+		"id":        reqmsg.Id,
+		"method":    reqmsg.Method,
+		"params":    reqmsg.Params,
+		"chain":     chain.String(),
+		"account":   account,
+		"endpoints": endpoints,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ret, called, err := hook.script.call("before", sreq)
+	if !called || err != nil {
+		return nil, err
+	}
+
+	req, err := fromStarlark(sreq)
+	if err != nil {
+		return nil, err
+	}
+	reqmap := req.(map[string]interface{})
+	if method, ok := reqmap["method"].(string); ok {
+		reqmsg.Method = method
+	}
+	if params, ok := reqmap["params"].([]interface{}); ok {
+		reqmsg.Params = params
+	} else if reqmap["params"] == nil {
+		reqmsg.Params = nil
+	}
+
+	if ret == starlark.None {
+		return nil, nil
+	}
+	v, err := fromStarlark(ret)
+	if err != nil {
+		return nil, err
+	}
+	var action hookAction
+	if err := jsoff.DecodeInterface(v, &action); err != nil {
+		return nil, errors.Wrap(err, "bad return value of before")
+	}
+	return &action, nil
+}
+
+// run the after function, the returned response replaces the response
+func (hook HookConfig) after(reqmsg *jsoff.RequestMessage, resmsg jsoff.Message) (jsoff.Message, error) {
+	resp := make(map[string]interface{})
+	if resmsg.IsError() {
+		rpcErr := resmsg.MustError()
+		resp["error"] = map[string]interface{}{"code": rpcErr.Code, "message": rpcErr.Message, "data": rpcErr.Data}
+	} else if res, ok := resmsg.(*jsoff.ResultMessage); ok {
+		resp["result"] = res.Result
+	} else {
+		return resmsg, nil
+	}
+	sreq, err := toStarlark(map[string]interface{}{
+		"id":     reqmsg.Id,
+		"method": reqmsg.Method,
+		"params": reqmsg.Params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	sresp, err := toStarlark(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	ret, called, err := hook.script.call("after", sreq, sresp)
+	if !called || err != nil {
+		return resmsg, err
+	}
+	if ret == starlark.None {
+		// the response may be modified in place
+		ret = sresp
+	}
+	v, err := fromStarlark(ret)
+	if err != nil {
+		return nil, err
+	}
+	var action hookAction
+	if err := jsoff.DecodeInterface(v, &action); err != nil {
+		return nil, errors.Wrap(err, "bad return value of after")
+	}
+	var newmsg jsoff.Message
+	if action.Error != nil {
+		newmsg = action.Error.toMessage(reqmsg)
+	} else {
+		newmsg = jsoff.NewResultMessage(reqmsg, action.Result)
+	}
+	// keep the response headers such as X-Real-Endpoint
+	res, ok1 := resmsg.(jsoff.ResponseMessage)
+	newres, ok2 := newmsg.(jsoff.ResponseMessage)
+	if ok1 && ok2 {
+		for k, vs := range res.ResponseHeader() {
+			newres.ResponseHeader()[k] = vs
+		}
+	}
+	return newmsg, nil
+}
+
+func observeHookError(chain ChainRef, phase string, err error) {
+	metricsHookErrors.With(prometheus.Labels{
+		"chain": chain.String(),
+		"phase": phase,
+	}).Inc()
+	chain.Log().Warnf("hook %s error %s", phase, err)
+}
+
+// the hooks of the chain followed by the hooks of the account which
+// apply to the method
+func (m *Multiplexer) matchHooks(ctx context.Context, chain ChainRef, method string) []HookConfig {
+	var hooks []HookConfig
+	if m.cfg != nil {
+		if chaincfg, ok := m.cfg.Chains[chain.String()]; ok {
+			for _, hook := range chaincfg.Hooks {
+				if hook.script != nil && hook.Match(method) {
+					hooks = append(hooks, hook)
+				}
+			}
+		}
+	}
+	if info := RequestInfoFromContext(ctx); info != nil {
+		for _, hook := range info.Hooks {
+			if hook.script != nil && hook.Match(method) {
+				hooks = append(hooks, hook)
+			}
+		}
+	}
+	return hooks
+}
+
+// Whether the request must be delegated rather than relayed verbatim
+// to an endpoint, i.e. hooks or the denial of the delegator apply
+func (m *Multiplexer) Intercepts(ctx context.Context, delegator RPCDelegator, chain ChainRef, reqmsg *jsoff.RequestMessage) bool {
+	if len(m.matchHooks(ctx, chain, reqmsg.Method)) > 0 {
+		return true
+	}
+	if denier, ok := delegator.(DenyDelegator); ok {
+		_, denied := denier.DenyRPC(ctx, reqmsg)
+		return denied
+	}
+	return false
+}
+
+// Delegate the request by the delegator and run the hooks around, a
+// failing hook is skipped so that requests are still served
+func (m *Multiplexer) DelegateRPCWithHooks(ctx context.Context, delegator RPCDelegator, chain ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	return m.DelegateRPCTo(ctx, delegator, chain, "", reqmsg, r)
+}
+
+// Delegate the request to the named endpoint, e.g. selected by the
+// X-Nodemux-Select header, the hooks still run around and may select
+// another endpoint, requests denied by the delegator are refused. An
+// empty name leaves the selection to the delegator
+func (m *Multiplexer) DelegateRPCTo(ctx context.Context, delegator RPCDelegator, chain ChainRef, epName string, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	hooks := m.matchHooks(ctx, chain, reqmsg.Method)
+	if len(hooks) == 0 && epName == "" {
+		return m.delegateRPC(ctx, delegator, chain, reqmsg, r)
+	}
+
+	for _, hook := range hooks {
+		action, err := hook.before(m, ctx, chain, reqmsg)
+		if err != nil {
+			observeHookError(chain, "before", err)
+			continue
+		}
+		if action == nil {
+			continue
+		}
+		if action.Error != nil {
+			return action.Error.toMessage(reqmsg), nil
+		} else if action.Result != nil {
+			return jsoff.NewResultMessage(reqmsg, action.Result), nil
+		}
+		if action.Endpoint != "" {
+			// the later hooks take precedence
+			epName = action.Endpoint
+		}
+	}
+
+	if epName != "" {
+		// a selected endpoint skips the delegator, so do the denial
+		if denier, ok := delegator.(DenyDelegator); ok {
+			if resmsg, denied := denier.DenyRPC(ctx, reqmsg); denied {
+				return resmsg, nil
+			}
+		}
+	}
+
+	var resmsg jsoff.Message
+	var err error
+	if ep := m.SelectEndpointByName(chain, epName, reqmsg.Method); epName != "" && ep != nil {
+		resmsg, err = m.CallEndpointRPC(ctx, ep, reqmsg)
+	} else {
+		resmsg, err = m.delegateRPC(ctx, delegator, chain, reqmsg, r)
+	}
+	if err != nil || resmsg == nil {
+		return resmsg, err
+	}
+	for _, hook := range hooks {
+		newmsg, err := hook.after(reqmsg, resmsg)
+		if err != nil {
+			observeHookError(chain, "after", err)
+			continue
+		}
+		resmsg = newmsg
+	}
+	return resmsg, nil
+}
+
+// delegate the request, in the verify mode verifiable requests are
+// verified against several endpoints
+func (m *Multiplexer) delegateRPC(ctx context.Context, delegator RPCDelegator, chain ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error) {
+	if info := RequestInfoFromContext(ctx); info != nil && info.Verify != nil {
+		if verifier, ok := delegator.(VerifyDelegator); ok && verifier.Verifiable(reqmsg.Method) {
+			return m.VerifyRPC(ctx, verifier, chain, reqmsg, *info.Verify)
+		}
+	}
+	return delegator.DelegateRPC(ctx, m, chain, reqmsg, r)
+}
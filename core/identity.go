@@ -0,0 +1,136 @@
+package nodemuxcore
+
+// Network identity verification, endpoints serving a network other
+// than the configured chain are refused, so that a testnet URL
+// configured under mainnet won't mix data with the others
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/pkg/errors"
+)
+
+const (
+	identityNotVerified = "network identity not verified"
+)
+
+type NetworkIdentity struct {
+	// chain id or network name, e.g. eth_chainId or the chain
+	// field of bitcoin's getblockchaininfo
+	ChainId string `yaml:"chain_id,omitempty" json:"chain_id,omitempty"`
+
+	// the hash of the genesis block
+	GenesisHash string `yaml:"genesis_hash,omitempty" json:"genesis_hash,omitempty"`
+}
+
+// Optional interface of a delegator which can tell the network an
+// endpoint is serving
+type IdentityDelegator interface {
+	// Get the network identity reported by the endpoint, fields
+	// the delegator cannot tell are left empty, so may the fields
+	// not expected by ExpectedIdentityFromContext(ctx)
+	GetNetworkIdentity(ctx context.Context, ep *Endpoint) (*NetworkIdentity, error)
+
+	// The well known identity of a chain, which is checked against
+	// when the chain has no identity configured
+	KnownNetworkIdentity(chain ChainRef) (*NetworkIdentity, bool)
+}
+
+// normalize a chain id, hex numbers are converted to decimal
+func chainIdValue(v string) string {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if i, err := hexutil.DecodeUint64(v); err == nil {
+		return strconv.FormatUint(i, 10)
+	}
+	return v
+}
+
+func hashValue(v string) string {
+	return strings.TrimPrefix(strings.ToLower(strings.TrimSpace(v)), "0x")
+}
+
+// Check whether the identity reported by an endpoint matches the
+// expected one, empty fields of expected are not checked
+func (expected NetworkIdentity) Check(reported NetworkIdentity) error {
+	if expected.ChainId != "" && chainIdValue(expected.ChainId) != chainIdValue(reported.ChainId) {
+		return errors.Wrapf(ErrNetworkMismatch, "chain id %s, expect %s",
+			reported.ChainId, expected.ChainId)
+	}
+	if expected.GenesisHash != "" && hashValue(expected.GenesisHash) != hashValue(reported.GenesisHash) {
+		return errors.Wrapf(ErrNetworkMismatch, "genesis hash %s, expect %s",
+			reported.GenesisHash, expected.GenesisHash)
+	}
+	return nil
+}
+
+func (m Multiplexer) expectedIdentity(chain ChainRef, delegator IdentityDelegator) (*NetworkIdentity, bool) {
+	if m.cfg != nil {
+		if chaincfg, ok := m.cfg.Chains[chain.String()]; ok && !chaincfg.Identity().Empty() {
+			return chaincfg.Identity(), true
+		}
+	}
+	return delegator.KnownNetworkIdentity(chain)
+}
+
+// whether the network identity of the endpoint is to be verified,
+// either configured for the chain or well known by the delegator
+func (m Multiplexer) identityExpected(ep *Endpoint) bool {
+	identDelegator, ok := GetDelegatorFactory().GetEndpointDelegator(ep).(IdentityDelegator)
+	if !ok {
+		return false
+	}
+	_, ok = m.expectedIdentity(ep.Chain, identDelegator)
+	return ok
+}
+
+type expectedIdentityKeyType int
+
+var expectedIdentityKey expectedIdentityKeyType
+
+// The identity the reported one is checked against, delegators may
+// skip fetching the fields which are empty
+func ExpectedIdentityFromContext(ctx context.Context) (*NetworkIdentity, bool) {
+	if v, ok := ctx.Value(expectedIdentityKey).(*NetworkIdentity); ok && v != nil {
+		return v, true
+	}
+	return nil, false
+}
+
+func (ident NetworkIdentity) Empty() bool {
+	return ident.ChainId == "" && ident.GenesisHash == ""
+}
+
+// Verify the network identity of an endpoint, the endpoint is rejected
+// on mismatch
+func (m *Multiplexer) VerifyNetworkIdentity(ctx context.Context, ep *Endpoint) {
+	delegator := GetDelegatorFactory().GetEndpointDelegator(ep)
+	identDelegator, ok := delegator.(IdentityDelegator)
+	if !ok {
+		return
+	}
+	expected, ok := m.expectedIdentity(ep.Chain, identDelegator)
+	if !ok {
+		return
+	}
+
+	reported, err := identDelegator.GetNetworkIdentity(
+		context.WithValue(ctx, expectedIdentityKey, expected), ep)
+	if err != nil {
+		ep.Log().Warnf("error while getting network identity %s", err)
+		return
+	}
+	ep.Identity = reported
+
+	if err := expected.Check(*reported); err != nil {
+		if ep.Rejected != err.Error() {
+			ep.Log().Warnf("endpoint rejected, %s", err)
+		}
+		ep.Rejected = err.Error()
+	} else if ep.Rejected != "" {
+		ep.Log().Infof("network identity verified, endpoint accepted")
+		ep.Rejected = ""
+	}
+}
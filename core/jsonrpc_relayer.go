@@ -2,8 +2,13 @@ package nodemuxcore
 
 // JSONRPC client from http or websocket
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,12 +16,22 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// the url of JSON-RPC calls, url is used if the endpoint doesn't
+// declare one for JSON-RPC
+func (ep Endpoint) rpcUrl() string {
+	if rpcUrl := ep.ApiUrl(ApiJSONRPC); rpcUrl != "" {
+		return rpcUrl
+	}
+	return ep.Config.Url
+}
+
 func (ep *Endpoint) ensureRPCClient() {
 	if ep.rpcHttpClient == nil {
 		opts := jsoffnet.ClientOptions{Timeout: ep.Config.Timeout}
-		c, err := jsoffnet.NewClient(ep.Config.Url, opts)
+		c, err := jsoffnet.NewClient(ep.rpcUrl(), opts)
 		if err != nil {
 			panic(err)
 		}
@@ -42,55 +57,127 @@ func (ep *Endpoint) NewJSONRPCWSClient() (*jsoffnet.WSClient, bool) {
 }
 
 func (ep *Endpoint) CallRPC(rootCtx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	ep.incrRelayCount()
+	return ep.callRPC(rootCtx, "", reqmsg)
+}
+
+// Call the JSON-RPC method at a path under the url, such as
+// /wallet/<name> of bitcoind
+func (ep *Endpoint) CallRPCAt(rootCtx context.Context, path string, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	if !ep.isHttpURL() {
+		return nil, errors.Errorf("cannot call rpc at path %s of a non http url", path)
+	}
+	ep.incrRelayCount()
+	return ep.callRPC(rootCtx, path, reqmsg)
+}
+
+func (ep *Endpoint) callRPC(rootCtx context.Context, path string, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
 	//ep.Connect()
 	ep.ensureRPCClient()
-	ep.incrRelayCount()
+
+	ctx, span := StartSpan(rootCtx, "upstream", trace.SpanKindClient,
+		AttrChain.String(ep.Chain.String()),
+		AttrEndpoint.String(ep.Name),
+		AttrMethod.String(reqmsg.Method))
+	recordAttempt(ctx, ep)
+
+	inflight := ep.upstreamInflight()
+	inflight.Inc()
+	defer inflight.Dec()
 
 	start := time.Now()
-	res, err := ep.rpcHttpClient.Call(rootCtx, reqmsg)
+	var res jsoff.Message
+	var err error
+	if ep.isHttpURL() {
+		// the jsoff client cannot take per request headers, nor
+		// count the bytes
+		res, err = ep.postRPC(ctx, joinUrl(ep.rpcUrl(), path), reqmsg)
+	} else {
+		res, err = ep.rpcHttpClient.Call(ctx, reqmsg)
+	}
 	// metrics the call time
 	delta := time.Since(start)
+	methodLabel := ResponseMethodLabel(reqmsg.Method, res)
+	ep.observeUpstream(methodLabel, delta.Seconds())
+	recordUpstreamTime(ctx, delta)
 
 	msecs := delta.Milliseconds()
 
-	fields := log.Fields{
+	fields := RequestLogFields(ctx, log.Fields{
 		"method":      reqmsg.Method,
 		"timeSpentMS": msecs,
-	}
+	})
 	if delta.Microseconds() > 1000 {
 		fields["showRequest"] = true
 	}
 
 	if err != nil {
 		fields["err"] = err.Error()
+		errType, code := upstreamErrorLabels(err)
+		ep.incrUpstreamError(methodLabel, reqmsg.Method, errType, code)
 	} else if res.IsError() {
 		fields["err"] = fmt.Sprintf("RPC %d %s", res.MustError().Code, res.MustError().Message)
+		span.SetAttributes(AttrRPCError.Int(res.MustError().Code))
+		ep.incrUpstreamError(methodLabel, reqmsg.Method, "rpc", strconv.Itoa(res.MustError().Code))
 	}
+	EndSpan(span, err)
 	ep.Log().WithFields(fields).Info("call jsonrpc")
 	return res, err
 } // CallRPC
 
+// Call the method and decode the result into output, an error
+// response is returned as *jsoff.RPCError
 func (ep *Endpoint) UnwrapCallRPC(rootCtx context.Context, reqmsg *jsoff.RequestMessage, output interface{}) error {
-	//ep.Connect()
-	ep.ensureRPCClient()
-	start := time.Now()
-	err := ep.rpcHttpClient.UnwrapCall(rootCtx, reqmsg, output)
+	res, err := ep.callRPC(rootCtx, "", reqmsg)
+	if err != nil {
+		return err
+	}
+	if res.IsError() {
+		return res.MustError()
+	}
+	return jsoff.DecodeInterface(res.(*jsoff.ResultMessage).Result, output)
+} // UnwrapCallRPC
 
-	// metrics the call time
-	delta := time.Since(start)
-	fields := log.Fields{
-		"method":      reqmsg.Method,
-		"timeSpentMS": delta.Milliseconds(),
+func (ep Endpoint) isHttpURL() bool {
+	rpcUrl := ep.rpcUrl()
+	return strings.HasPrefix(rpcUrl, "http://") || strings.HasPrefix(rpcUrl, "https://")
+}
+
+// Post a request to the http endpoint with the request id and the
+// trace context injected
+func (ep *Endpoint) postRPC(ctx context.Context, rpcUrl string, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	ep.Connect()
+	data, err := json.Marshal(reqmsg.Interface())
+	if err != nil {
+		return nil, errors.Wrap(err, "json.Marshal")
 	}
-	var rpcErr *jsoff.RPCError
+	req, err := http.NewRequestWithContext(ctx, "POST", rpcUrl, bytes.NewReader(data))
 	if err != nil {
-		fields["err"] = err.Error()
-	} else if errors.As(err, &rpcErr) {
-		fields["err"] = fmt.Sprintf("RPCError %d %s", rpcErr.Code, rpcErr.Error())
+		return nil, errors.Wrap(err, "http.NewRequestWithContext")
 	}
-	ep.Log().WithFields(fields).Info("call jsonrpc")
-	return err
-} // UnwrapCallRPC
+	req.Header.Set("Content-Type", "application/json")
+	injectUpstreamHeaders(ctx, req.Header)
+	ep.addUpstreamBytes("sent", int64(len(data)))
+
+	resp, err := ep.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "http Do")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		abnResp := &jsoffnet.WrappedResponse{
+			Response: resp,
+		}
+		return nil, errors.Wrap(abnResp, "abnormal response")
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "io.ReadAll")
+	}
+	ep.addUpstreamBytes("received", int64(len(respBody)))
+	return jsoff.ParseBytes(respBody)
+}
 
 func (ep Endpoint) HasWebsocket() bool {
 	if ep.Config.StreamingUrl == "" {
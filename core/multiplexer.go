@@ -6,6 +6,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
+	"go.opentelemetry.io/otel/trace"
 	"net/http"
 	"sync"
 )
@@ -36,6 +37,8 @@ func SetMultiplexer(b *Multiplexer) {
 func NewMultiplexer() *Multiplexer {
 	m := new(Multiplexer)
 	m.chainHub = NewMemoryChainhub()
+	m.txTracker = NewTxTracker()
+	m.sessionHeights = NewSessionHeights()
 	m.Reset()
 	return m
 }
@@ -132,6 +135,17 @@ func (m *Multiplexer) AllHealthyEndpoints(chain ChainRef, method string, height
 	return nil
 }
 
+// All healthy endpoints serving the api kind
+func (m *Multiplexer) AllHealthyApiEndpoints(chain ChainRef, api int, method string, height int) []*Endpoint {
+	apiEndpoints := make([]*Endpoint, 0)
+	for _, ep := range m.AllHealthyEndpoints(chain, method, height) {
+		if ep.HasApi(api) {
+			apiEndpoints = append(apiEndpoints, ep)
+		}
+	}
+	return apiEndpoints
+}
+
 func (m *Multiplexer) SelectEndpointByName(chain ChainRef, name string, method string) *Endpoint {
 	if endpoints, ok := m.chainIndex[chain]; ok {
 		for _, ep := range endpoints.items {
@@ -151,7 +165,28 @@ func (m *Multiplexer) SelectEndpointFromHttp(chain ChainRef, method string, r *h
 	return m.SelectEndpointByName(chain, selectNode, method)
 }
 
-func (m *Multiplexer) SelectOverHeight(chain ChainRef, method string, heightSpec int) (*Endpoint, bool) {
+func (m *Multiplexer) SelectOverHeight(ctx context.Context, chain ChainRef, method string, heightSpec int) (*Endpoint, bool) {
+	return m.selectOverHeight(ctx, chain, heightSpec, func(ep *Endpoint, height int) bool {
+		return ep.Available(method, height)
+	})
+}
+
+// Select an endpoint serving the api kind
+func (m *Multiplexer) SelectApiOverHeight(ctx context.Context, chain ChainRef, api int, method string, heightSpec int) (*Endpoint, bool) {
+	return m.selectOverHeight(ctx, chain, heightSpec, func(ep *Endpoint, height int) bool {
+		return ep.HasApi(api) && ep.Available(method, height)
+	})
+}
+
+// Select an available endpoint which is also accepted by the function
+func (m *Multiplexer) SelectAccepted(ctx context.Context, chain ChainRef, method string, accept func(ep *Endpoint) bool) (*Endpoint, bool) {
+	return m.selectOverHeight(ctx, chain, anyHeightSpec, func(ep *Endpoint, height int) bool {
+		return ep.Available(method, 0) && overHeight(ep, height) && accept(ep)
+	})
+}
+
+// select a random endpoint by weights over the height spec
+func (m *Multiplexer) selectByWeight(chain ChainRef, heightSpec int, accept func(ep *Endpoint, height int) bool) (*Endpoint, bool) {
 	if endpoints, ok := m.chainIndex[chain]; ok {
 		height := heightSpec
 		if heightSpec <= 0 {
@@ -161,12 +196,12 @@ func (m *Multiplexer) SelectOverHeight(chain ChainRef, method string, heightSpec
 		// select a random endpoint by weights, if it's not available then select by sequence
 		if epName, ok := endpoints.WeightedRandom(); ok {
 			ep := endpoints.MustGet(epName)
-			if ep.Available(method, height) {
+			if accept(ep, height) {
 				return ep, true
 			}
 
 			for _, ep := range endpoints.items {
-				if ep.Available(method, height) {
+				if accept(ep, height) {
 					return ep, true
 				}
 			}
@@ -175,6 +210,20 @@ func (m *Multiplexer) SelectOverHeight(chain ChainRef, method string, heightSpec
 	return nil, false
 }
 
+// Whether there are endpoints of the chain
+func (m *Multiplexer) HasChain(chain ChainRef) bool {
+	_, ok := m.chainIndex[chain]
+	return ok
+}
+
+// Get the max block head height among the endpoints of a chain
+func (m *Multiplexer) MaxTipHeight(chain ChainRef) (int, bool) {
+	if endpoints, ok := m.chainIndex[chain]; ok {
+		return endpoints.maxTipHeight, true
+	}
+	return 0, false
+}
+
 func (m *Multiplexer) RequestCacheKeys(chain ChainRef, reqmsg *jsoff.RequestMessage, prefix string, heightSpec int) []string {
 	if endpoints, ok := m.chainIndex[chain]; ok {
 		height := heightSpec
@@ -227,6 +276,10 @@ func (m *Multiplexer) LoadFromConfig(nbcfg *NodemuxConfig) {
 		}
 
 		ep := NewEndpoint(name, epcfg)
+		if m.identityExpected(ep) {
+			// endpoints are refused until the network identity is verified
+			ep.Rejected = identityNotVerified
+		}
 		m.Add(ep)
 	}
 }
@@ -236,7 +289,13 @@ func (m *Multiplexer) BroadcastRPC(
 	chain ChainRef,
 	reqmsg *jsoff.RequestMessage,
 	overHeight int) []RPCResult {
-	eps := m.AllHealthyEndpoints(chain, reqmsg.Method, overHeight)
+	ctx, span := StartSpan(rootCtx, "broadcast", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(reqmsg.Method),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	eps := m.AllHealthyApiEndpoints(chain, ApiJSONRPC, reqmsg.Method, overHeight)
 	if len(eps) == 0 {
 		return nil
 	}
@@ -248,7 +307,7 @@ func (m *Multiplexer) BroadcastRPC(
 	for _, ep := range eps {
 		wg.Add(1)
 		go func(ep *Endpoint) {
-			resmsg, err := ep.CallRPC(rootCtx, reqmsg)
+			resmsg, err := ep.CallRPC(ctx, reqmsg)
 			lock.Lock()
 			defer lock.Unlock()
 			results = append(results, RPCResult{
@@ -268,6 +327,7 @@ func (m *Multiplexer) CallEndpointRPC(rootCtx context.Context, ep *Endpoint, req
 	if err != nil {
 		return resmsg, err
 	}
+	m.recordSessionHeight(rootCtx, ep)
 	if responseMsg, ok := resmsg.(jsoff.ResponseMessage); ok {
 		responseMsg.ResponseHeader().Set("X-Real-Endpoint", ep.Name)
 	}
@@ -279,15 +339,8 @@ func (m *Multiplexer) DefaultRelayRPC(
 	chain ChainRef,
 	reqmsg *jsoff.RequestMessage,
 	overHeight int) (jsoff.Message, error) {
-	ep, found := m.SelectOverHeight(chain, reqmsg.Method, overHeight)
-	if !found {
-		if overHeight > 0 {
-			// if not find then relay to any healthy endpoint
-			return m.DefaultRelayRPC(rootCtx, chain, reqmsg, -2)
-		}
-		return ErrNotAvailable.ToMessage(reqmsg), nil
-	}
-	return m.CallEndpointRPC(rootCtx, ep, reqmsg)
+	msg, _, err := m.DefaultRelayRPCTakingEndpoint(rootCtx, chain, reqmsg, overHeight)
+	return msg, err
 }
 
 func (m *Multiplexer) DefaultRelayRPCTakingEndpoint(
@@ -295,46 +348,106 @@ func (m *Multiplexer) DefaultRelayRPCTakingEndpoint(
 	chain ChainRef,
 	reqmsg *jsoff.RequestMessage,
 	overHeight int) (jsoff.Message, *Endpoint, error) {
-	ep, found := m.SelectOverHeight(chain, reqmsg.Method, overHeight)
+	ctx, span := StartSpan(rootCtx, "relay", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(reqmsg.Method),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	ep, found := m.selectOverHeight(ctx, chain, overHeight, func(ep *Endpoint, height int) bool {
+		return ep.HasApi(ApiJSONRPC) && ep.Available(reqmsg.Method, height)
+	})
 	if !found {
 		if overHeight > 0 {
 			// if not find then relay to any healthy endpoint
-			return m.DefaultRelayRPCTakingEndpoint(rootCtx, chain, reqmsg, -2)
+			return m.DefaultRelayRPCTakingEndpoint(ctx, chain, reqmsg, -2)
 		}
 		return ErrNotAvailable.ToMessage(reqmsg), nil, nil
 	}
-	msg, err := m.CallEndpointRPC(rootCtx, ep, reqmsg)
+	span.SetAttributes(AttrEndpoint.String(ep.Name))
+	msg, err := m.CallEndpointRPC(ctx, ep, reqmsg)
 	return msg, ep, err
 }
 
 // Pipe the request to response
 func (m *Multiplexer) DefaultPipeREST(rootCtx context.Context, chain ChainRef, path string, w http.ResponseWriter, r *http.Request, overHeight int) error {
-	ep, found := m.SelectOverHeight(chain, path, overHeight)
+	ctx, span := StartSpan(rootCtx, "relay", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(path),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	ep, found := m.selectOverHeight(ctx, chain, overHeight, func(ep *Endpoint, height int) bool {
+		return ep.HasApi(ApiREST) && ep.Available(path, height)
+	})
 	if !found {
 		if overHeight > 0 {
 			// if not find then relay to any healthy endpoint
-			return m.DefaultPipeREST(rootCtx, chain, path, w, r, -2)
+			return m.DefaultPipeREST(ctx, chain, path, w, r, -2)
 		}
 		w.WriteHeader(404)
 		w.Write([]byte("not found"))
 		return nil
 	}
-	err := ep.PipeRequest(rootCtx, path, w, r)
+	span.SetAttributes(AttrEndpoint.String(ep.Name))
+	err := ep.PipeApiRequest(ctx, ApiREST, path, w, r)
+	if err == nil {
+		m.recordSessionHeight(ctx, ep)
+	}
+	return err
+}
+
+// Pipe the gRPC request to an endpoint
+func (m *Multiplexer) DefaultPipeGRPC(rootCtx context.Context, chain ChainRef, path string, w http.ResponseWriter, r *http.Request, overHeight int) error {
+	ctx, span := StartSpan(rootCtx, "relay", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(path),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	// gRPC-Web requests are only piped to endpoints with grpc-web urls
+	api := grpcApi(r)
+	ep, found := m.selectOverHeight(ctx, chain, overHeight, func(ep *Endpoint, height int) bool {
+		return ep.HasApi(api) && ep.Available(path, height)
+	})
+	if !found {
+		if overHeight > 0 {
+			// if not find then relay to any healthy endpoint
+			return m.DefaultPipeGRPC(ctx, chain, path, w, r, -2)
+		}
+		return ErrNotAvailable
+	}
+	span.SetAttributes(AttrEndpoint.String(ep.Name))
+	err := ep.PipeGRPC(ctx, path, w, r)
+	if err == nil {
+		m.recordSessionHeight(ctx, ep)
+	}
 	return err
 }
 
 func (m *Multiplexer) DefaultPipeGraphQL(rootCtx context.Context, chain ChainRef, path string, w http.ResponseWriter, r *http.Request, overHeight int) error {
-	ep, found := m.SelectOverHeight(chain, "", overHeight)
+	ctx, span := StartSpan(rootCtx, "relay", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrHeightSpec.Int(overHeight))
+	defer span.End()
+
+	ep, found := m.selectOverHeight(ctx, chain, overHeight, func(ep *Endpoint, height int) bool {
+		return ep.HasApi(ApiGraphQL) && ep.Available("", height)
+	})
 	if !found {
 		if overHeight > 0 {
 			// if not find then relay to any healthy endpoint
-			return m.DefaultPipeGraphQL(rootCtx, chain, path, w, r, -2)
+			return m.DefaultPipeGraphQL(ctx, chain, path, w, r, -2)
 		}
 		w.WriteHeader(404)
 		w.Write([]byte("not found"))
 		return nil
 	}
-	err := ep.PipeRequest(rootCtx, path, w, r)
+	span.SetAttributes(AttrEndpoint.String(ep.Name))
+	err := ep.PipeApiRequest(ctx, ApiGraphQL, path, w, r)
+	if err == nil {
+		m.recordSessionHeight(ctx, ep)
+	}
 	return err
 }
 
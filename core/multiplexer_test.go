@@ -1,12 +1,32 @@
 package nodemuxcore
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/superisaac/jsoff"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -95,11 +115,40 @@ func TestMultiplexer(t *testing.T) {
 	assert.Equal(1, len(b.nameIndex))
 	assert.Equal(1, len(b.chainIndex))
 
-	ep1, ok := b.SelectOverHeight(chain, "", -1)
+	ep1, ok := b.SelectOverHeight(context.Background(), chain, "", -1)
 	assert.True(ok)
 	assert.Equal(ep.Config.Url, ep1.Config.Url)
 }
 
+func TestApiUrls(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewMultiplexer()
+	chain := ChainRef{Namespace: "enu", Network: "mainnet"}
+	ep1 := NewEndpoint("enu01", EndpointConfig{
+		Chain: "enu/mainnet",
+		Url:   "http://127.0.0.1:8888",
+		Urls:  map[string]string{"rest": "http://127.0.0.1:8889/"},
+	})
+	ep2 := NewEndpoint("enu02", EndpointConfig{
+		Chain: "enu/mainnet",
+		Url:   "http://127.0.0.1:9888",
+	})
+	b.Add(ep1)
+	b.Add(ep2)
+
+	assert.Equal("http://127.0.0.1:8888", ep1.ApiUrl(ApiJSONRPC))
+	assert.Equal("http://127.0.0.1:8889/v1/chain/get_info", ep1.ApiFullUrl(ApiREST, "/v1/chain/get_info"))
+	assert.False(ep1.HasApi(ApiGraphQL))
+	assert.True(ep2.HasApi(ApiGraphQL))
+
+	for i := 0; i < 10; i++ {
+		ep, ok := b.SelectApiOverHeight(context.Background(), chain, ApiGraphQL, "", -1)
+		assert.True(ok)
+		assert.Equal("enu02", ep.Name)
+	}
+}
+
 func TestUrlParse(t *testing.T) {
 	assert := assert.New(t)
 
@@ -115,3 +164,704 @@ func TestUrlParse(t *testing.T) {
 	assert.Nil(err)
 	assert.Equal("redis", u.Scheme)
 }
+
+func TestCapabilities(t *testing.T) {
+	assert := assert.New(t)
+
+	ep := NewEndpoint("eth01", EndpointConfig{
+		Chain: "ethereum/mainnet",
+		Url:   "http://127.0.0.1:8545",
+	})
+	assert.True(ep.Available("debug_traceTransaction", 0))
+	assert.True(ep.HasCapability("archive"))
+
+	caps := NewCapabilities()
+	caps.Set("debug", false, "debug_")
+	caps.Set("archive", false)
+	caps.Set("trace", true, "trace_")
+	ep.Capabilities = caps
+
+	assert.False(ep.Available("debug_traceTransaction", 0))
+	assert.True(ep.Available("trace_block", 0))
+	assert.True(ep.Available("eth_call", 0))
+	assert.False(ep.HasCapability("archive"))
+
+	// failed probes keep the previous states
+	next := NewCapabilities()
+	next.Keep(ep.Capabilities, "debug", "debug_")
+	next.Keep(ep.Capabilities, "finalized")
+	ep.Capabilities = next
+	assert.False(ep.Available("debug_traceTransaction", 0))
+	assert.True(ep.HasCapability("finalized"))
+
+	ep.Rejected = "network mismatch"
+	assert.False(ep.Available("eth_call", 0))
+}
+
+func TestNetworkIdentity(t *testing.T) {
+	assert := assert.New(t)
+
+	expected := NetworkIdentity{ChainId: "1"}
+	assert.Nil(expected.Check(NetworkIdentity{ChainId: "0x1"}))
+	assert.Nil(expected.Check(NetworkIdentity{ChainId: "1", GenesisHash: "0xabcd"}))
+
+	err := expected.Check(NetworkIdentity{ChainId: "0x5"})
+	assert.True(errors.Is(err, ErrNetworkMismatch))
+
+	expected = NetworkIdentity{GenesisHash: "0xABCD"}
+	assert.Nil(expected.Check(NetworkIdentity{GenesisHash: "abcd"}))
+	assert.NotNil(expected.Check(NetworkIdentity{GenesisHash: "0xabce"}))
+	assert.True(NetworkIdentity{}.Empty())
+}
+
+func TestTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	exporter, err := NewStdoutSpanExporter(&buf)
+	assert.Nil(err)
+	provider := NewTracerProvider(&TracingConfig{}, sdktrace.WithSyncer(exporter))
+	installTracerProvider(provider, true)
+	defer installTracerProvider(noop.NewTracerProvider(), false)
+
+	// no span is started outside a trace
+	_, span := StartSpan(context.Background(), "relay", trace.SpanKindInternal)
+	assert.False(span.IsRecording())
+
+	header := http.Header{}
+	header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ExtractTraceContext(context.Background(), header)
+	ctx, serverSpan := StartSpan(ctx, "POST /jsonrpc", trace.SpanKindServer)
+	assert.Equal("4bf92f3577b34da6a3ce929d0e0e4736", serverSpan.SpanContext().TraceID().String())
+
+	ctx, span = StartSpan(ctx, "relay", trace.SpanKindInternal,
+		AttrChain.String("ethereum/mainnet"),
+		AttrHeightSpec.Int(-2))
+	assert.True(span.IsRecording())
+
+	upstreamHeader := http.Header{}
+	injectTraceContext(ctx, upstreamHeader)
+	assert.Contains(upstreamHeader.Get("traceparent"), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Contains(upstreamHeader.Get("traceparent"), span.SpanContext().SpanID().String())
+
+	EndSpan(span, errors.New("upstream error"))
+	serverSpan.End()
+	assert.Contains(buf.String(), `"Name":"relay"`)
+	assert.Contains(buf.String(), "nodemux.chain")
+	assert.Contains(buf.String(), "upstream error")
+}
+
+func TestMethodLabel(t *testing.T) {
+	assert := assert.New(t)
+	defer SetMetricsMethods(nil, 0)
+
+	SetMetricsMethods([]string{"eth_call", "eth_blockNumber"}, 0)
+	assert.Equal("eth_call", MethodLabel("eth_call"))
+	assert.Equal("other", MethodLabel("eth_foo"))
+
+	SetMetricsMethods(nil, 2)
+	assert.Equal("eth_call", MethodLabel("eth_call"))
+	assert.Equal("eth_chainId", MethodLabel("eth_chainId"))
+	assert.Equal("other", MethodLabel("eth_foo"))
+	assert.Equal("eth_call", MethodLabel("eth_call"))
+
+	// methods not found don't take the labels
+	SetMetricsMethods(nil, 2)
+	notFound := jsoff.ErrMethodNotFound.ToMessage(jsoff.NewRequestMessage(1, "junk_1", nil))
+	assert.Equal("other", ResponseMethodLabel("junk_1", notFound))
+	assert.Equal("eth_call", ResponseMethodLabel("eth_call", nil))
+	assert.Equal("eth_call", ResponseMethodLabel("eth_call", notFound))
+	assert.Equal("eth_chainId", MethodLabel("eth_chainId"))
+	assert.Equal("rest", apiMethodLabel(ApiREST))
+}
+
+func TestRequestInfo(t *testing.T) {
+	assert := assert.New(t)
+
+	info := &RequestInfo{RequestId: "req-1", SessionId: "sess-1"}
+	ctx := info.AddTo(context.Background())
+	info.AddAttempt("ep1")
+	info.AddAttempt("ep2")
+	info.AddAttempt("ep1")
+	info.AddUpstreamTime(20 * time.Millisecond)
+	info.AddUpstreamTime(30 * time.Millisecond)
+	assert.Equal([]string{"ep1", "ep2"}, info.Endpoints())
+	assert.Equal(3, info.Attempts())
+	assert.Equal(50*time.Millisecond, info.UpstreamTime())
+
+	header := http.Header{}
+	injectUpstreamHeaders(ctx, header)
+	assert.Equal("req-1", header.Get(RequestIdHeader))
+
+	fields := RequestLogFields(ctx, log.Fields{})
+	assert.Equal("req-1", fields["requestId"])
+	assert.Equal("sess-1", fields["session"])
+}
+
+// add healthy ethereum/mainnet endpoints of the names
+func addTestEndpoints(m *Multiplexer, names ...string) ChainRef {
+	for _, name := range names {
+		ep := NewEndpoint(name, EndpointConfig{
+			Chain: "ethereum/mainnet",
+			Url:   "http://127.0.0.1:8545/" + name,
+		})
+		ep.Healthy = true
+		m.Add(ep)
+	}
+	return ChainRef{Namespace: "ethereum", Network: "mainnet"}
+}
+
+// set the block heads of endpoints and the max tip height of the chain
+func setTestBlockheads(m *Multiplexer, chain ChainRef, heads map[string]*Block) {
+	for name, head := range heads {
+		m.nameIndex[name].Blockhead = head
+	}
+	m.chainIndex[chain].resetMaxTipHeight()
+}
+
+func TestChainSummary(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewMultiplexer()
+	chain := addTestEndpoints(b, "eth02", "eth01")
+	setTestBlockheads(b, chain, map[string]*Block{
+		"eth01": {Height: 100},
+		"eth02": {Height: 90},
+	})
+
+	summary, ok := b.ChainSummary(chain)
+	assert.True(ok)
+	assert.Equal(100, summary.MaxTipHeight)
+	assert.Equal(2, summary.HealthyCount)
+	assert.Equal("eth01", summary.Endpoints[0].Name)
+	assert.Equal(10, summary.Endpoints[1].Lag)
+	assert.Equal(1, summary.UsableCount(5))
+	assert.Equal(2, summary.UsableCount(0))
+
+	_, ok = b.ChainSummary(ChainRef{Namespace: "bitcoin", Network: "mainnet"})
+	assert.False(ok)
+}
+
+func TestCommitmentLevels(t *testing.T) {
+	assert := assert.New(t)
+
+	b := NewMultiplexer()
+	chain := addTestEndpoints(b, "eth01", "eth02")
+	// eth01 is at the tip but lags at finalization
+	setTestBlockheads(b, chain, map[string]*Block{
+		"eth01": {Height: 100, Safe: 90, Finalized: 60},
+		"eth02": {Height: 98, Finalized: 68},
+	})
+
+	assert.Equal(90, Block{Height: 100, Safe: 90, Finalized: 60}.HeightAt(CommitmentSafe))
+	assert.Equal(68, Block{Height: 98, Finalized: 68}.HeightAt(CommitmentSafe))
+	assert.Equal(98, Block{Height: 98}.HeightAt(CommitmentFinalized))
+
+	h, ok := b.MaxHeightAt(chain, CommitmentFinalized)
+	assert.True(ok)
+	assert.Equal(68, h)
+	h, _ = b.MaxHeightAt(chain, CommitmentLatest)
+	assert.Equal(100, h)
+
+	for i := 0; i < 10; i++ {
+		ep, found := b.SelectAtCommitment(context.Background(), chain, "eth_call", CommitmentFinalized, 0)
+		assert.True(found)
+		assert.Equal("eth02", ep.Name)
+	}
+	_, found := b.SelectAtCommitment(context.Background(), chain, "eth_call", CommitmentFinalized, 70)
+	assert.False(found)
+	_, found = b.SelectAtCommitment(context.Background(), chain, "eth_call", CommitmentFinalized, -10)
+	assert.True(found)
+
+	assert.False(blockIsEqual(&Block{Height: 100, Finalized: 60}, &Block{Height: 100, Finalized: 61}))
+
+	summary, _ := b.ChainSummary(chain)
+	assert.Equal(60, summary.Endpoints[0].Finalized)
+	assert.Equal(90, summary.Endpoints[0].Safe)
+}
+
+func TestRecentErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	ring := &errorRing{}
+	for i := 0; i < recentErrorsSize+5; i++ {
+		ring.add(UpstreamError{Code: strconv.Itoa(i)})
+	}
+	errs := ring.list()
+	assert.Equal(recentErrorsSize, len(errs))
+	assert.Equal(strconv.Itoa(recentErrorsSize+4), errs[0].Code)
+	assert.Equal("5", errs[len(errs)-1].Code)
+}
+
+func TestCallGRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/test.Service/Echo", r.URL.Path)
+		assert.Equal(2, r.ProtoMajor)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Trailer", "Grpc-Status")
+		// echo the request message back
+		w.Write(body)
+		w.Header().Set("Grpc-Status", "0")
+	})
+	server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+	defer server.Close()
+
+	ep := NewEndpoint("grpc01", EndpointConfig{
+		Chain: "cosmos/mainnet",
+		Url:   server.URL,
+	})
+	res, err := ep.CallGRPC(context.Background(), "/test.Service/Echo", []byte("hello"))
+	assert.Nil(err)
+	assert.Equal("hello", string(res))
+
+	// gRPC-Web is only served by the grpc-web url
+	r := httptest.NewRequest("POST", "/test.Service/Echo", nil)
+	r.Header.Set("Content-Type", "application/grpc-web+proto")
+	assert.Equal(ApiGRPCWeb, grpcApi(r))
+	assert.False(ep.HasApi(ApiGRPCWeb))
+	assert.NotNil(ep.PipeGRPC(context.Background(), "/test.Service/Echo", httptest.NewRecorder(), r))
+
+	ep.Config.Urls = map[string]string{"grpc-web": "http://127.0.0.1:9091"}
+	assert.Equal("http://127.0.0.1:9091/test.Service/Echo", ep.ApiFullUrl(ApiGRPCWeb, "/test.Service/Echo"))
+}
+
+func TestBroadcastTx(t *testing.T) {
+	assert := assert.New(t)
+
+	outcomes := []TxOutcome{TxRetryable, TxFatal, TxSuccess, TxAlreadyKnown, txNoResponse}
+	submit := func(ctx context.Context, i int) TxOutcome {
+		return outcomes[i]
+	}
+
+	best, outcome, accepted := broadcastTx(context.Background(), BroadcastConfig{Policy: BroadcastAll}, len(outcomes), submit)
+	assert.Equal(2, best)
+	assert.Equal(TxSuccess, outcome)
+	assert.ElementsMatch([]int{2, 3}, accepted)
+
+	_, outcome, accepted = broadcastTx(context.Background(), BroadcastConfig{Policy: BroadcastQuorum, Quorum: 1}, len(outcomes), submit)
+	assert.True(outcome < txNoResponse)
+	assert.True(len(accepted) >= 1)
+
+	// first-success stops at a fatal or accepted outcome
+	_, outcome, accepted = broadcastTx(context.Background(), BroadcastConfig{Policy: BroadcastFirstSuccess}, len(outcomes), submit)
+	assert.True(outcome.Accepted() || outcome == TxFatal)
+	assert.True(len(accepted) <= 1)
+
+	best, outcome, accepted = broadcastTx(context.Background(), BroadcastConfig{Policy: BroadcastAll}, 2, func(ctx context.Context, i int) TxOutcome {
+		return txNoResponse
+	})
+	assert.Equal(txNoResponse, outcome)
+	assert.False(outcome.Accepted())
+	assert.Equal(0, len(accepted))
+	assert.True(best >= 0)
+}
+
+func TestTxTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := NewConfig()
+	cfg.TxTracking.Enabled = true
+	cfg.TxTracking.Rebroadcast = true
+
+	m := NewMultiplexer()
+	m.cfg = cfg
+	chain := addTestEndpoints(m, "eth01", "eth02")
+
+	resubmitted := make([]string, 0)
+	bc := &TxBroadcast{
+		TxId:     "0xabcd",
+		Outcome:  TxSuccess,
+		Accepted: []*Endpoint{m.MustGet("eth01")},
+	}
+	m.trackTx(chain, bc, func(ctx context.Context, ep *Endpoint) TxOutcome {
+		resubmitted = append(resubmitted, ep.Name)
+		return TxAlreadyKnown
+	})
+
+	tx, ok := m.TrackedTx(chain, "0xabcd")
+	assert.True(ok)
+	assert.Equal(TxPending, tx.Status)
+	assert.Equal([]string{"eth01"}, tx.Accepted)
+
+	m.checkTrackedTxs(context.Background(), cfg.TxTracking)
+	assert.Equal([]string{"eth02"}, resubmitted)
+	tx, _ = m.TrackedTx(chain, "0xabcd")
+	assert.Equal(1, tx.Rebroadcasts)
+	assert.ElementsMatch([]string{"eth01", "eth02"}, tx.Accepted)
+
+	// txs without txid are not tracked
+	m.trackTx(chain, &TxBroadcast{Outcome: TxSuccess}, nil)
+	_, ok = m.TrackedTx(chain, "")
+	assert.False(ok)
+}
+
+func TestElectrumClient(t *testing.T) {
+	assert := assert.New(t)
+
+	// a fake electrum server answers a request with the height and
+	// sends a header notification
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		reader := bufio.NewReader(serverConn)
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		var req struct {
+			Id     any    `json:"id"`
+			Method string `json:"method"`
+		}
+		json.Unmarshal(line, &req)
+		ntf := `{"jsonrpc":"2.0","method":"blockchain.headers.subscribe","params":[{"height":101}]}` + "\n"
+		serverConn.Write([]byte(ntf))
+		res, _ := json.Marshal(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      req.Id,
+			"result":  map[string]any{"height": 100, "method": req.Method},
+		})
+		serverConn.Write(append(res, '\n'))
+	}()
+
+	c := NewElectrumClient(clientConn)
+	go c.readLoop()
+	notified := make(chan string, 1)
+	c.OnNotify(func(ntfmsg *jsoff.NotifyMessage) {
+		notified <- ntfmsg.Method
+	})
+
+	var header struct {
+		Height int
+		Method string
+	}
+	reqmsg := jsoff.NewRequestMessage(5, "blockchain.headers.subscribe", nil)
+	resmsg, err := c.Call(context.Background(), reqmsg)
+	assert.Nil(err)
+	// the id of the request is restored
+	assert.Equal(5, resmsg.MustId())
+	err = jsoff.DecodeInterface(resmsg.(*jsoff.ResultMessage).Result, &header)
+	assert.Nil(err)
+	assert.Equal(100, header.Height)
+	assert.Equal("blockchain.headers.subscribe", header.Method)
+	assert.Equal("blockchain.headers.subscribe", <-notified)
+
+	serverConn.Close()
+	<-c.Done()
+	_, err = c.Call(context.Background(), reqmsg)
+	assert.NotNil(err)
+}
+
+func TestHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	var lastParams []any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Params []any
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		lastParams = req.Params
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":{"number":"0x10","extra":"x"}}`))
+	}))
+	defer server.Close()
+
+	cfg := NewConfig()
+	err := cfg.LoadYamldata([]byte(`
+chains:
+  ethereum/mainnet:
+    hooks:
+      - methods: ["eth_*"]
+        source: |
+          def before(req):
+              if req["method"] == "eth_chainId":
+                  return {"result": "0x1"}
+              if req["method"] == "eth_getBlockByNumber":
+                  req["params"][1] = False
+                  names = [ep["name"] for ep in req["endpoints"]]
+                  return {"endpoint": names[-1]}
+`))
+	assert.Nil(err)
+
+	m := NewMultiplexer()
+	m.cfg = cfg
+	chain := ChainRef{Namespace: "ethereum", Network: "mainnet"}
+	m.Add(NewEndpoint("eth01", EndpointConfig{Chain: "ethereum/mainnet", Url: server.URL}))
+	m.Add(NewEndpoint("eth02", EndpointConfig{Chain: "ethereum/mainnet", Url: server.URL}))
+	delegator := &testDelegator{namespace: "ethereum"}
+
+	ctx := context.Background()
+	resmsg, err := m.DelegateRPCWithHooks(ctx, delegator, chain, jsoff.NewRequestMessage(1, "eth_chainId", nil), nil)
+	assert.Nil(err)
+	assert.Equal("0x1", resmsg.(*jsoff.ResultMessage).Result)
+
+	// hooks also run on requests to a selected endpoint
+	assert.True(m.Intercepts(ctx, delegator, chain, jsoff.NewRequestMessage(1, "eth_chainId", nil)))
+	resmsg, err = m.DelegateRPCTo(ctx, delegator, chain, "eth01", jsoff.NewRequestMessage(1, "eth_chainId", nil), nil)
+	assert.Nil(err)
+	assert.Equal("0x1", resmsg.(*jsoff.ResultMessage).Result)
+
+	// the account hook rewrites the result
+	accHook := HookConfig{Source: `
+def after(req, resp):
+    resp["result"].pop("extra")
+    resp["result"]["meta"] = {"source": "nodemux"}
+`}
+	assert.Nil(accHook.Compile())
+	info := &RequestInfo{Hooks: []HookConfig{accHook}}
+	reqmsg := jsoff.NewRequestMessage(1, "eth_getBlockByNumber", []any{"latest", true})
+	resmsg, err = m.DelegateRPCWithHooks(info.AddTo(ctx), delegator, chain, reqmsg, nil)
+	assert.Nil(err)
+	assert.Equal([]any{"latest", false}, lastParams)
+	result := resmsg.(*jsoff.ResultMessage).Result.(map[string]any)
+	assert.Equal("0x10", result["number"])
+	assert.Equal(map[string]any{"source": "nodemux"}, result["meta"])
+	_, ok := result["extra"]
+	assert.False(ok)
+
+	// no hooks match, the delegator is called
+	resmsg, err = m.DelegateRPCWithHooks(ctx, delegator, chain, jsoff.NewRequestMessage(1, "net_version", nil), nil)
+	assert.Nil(err)
+	assert.Nil(resmsg)
+
+	// runaway scripts are stopped by the step limit
+	loopHook := HookConfig{MaxSteps: 1000, Source: `
+def before(req):
+    for i in range(1000000):
+        pass
+`}
+	assert.Nil(loopHook.Compile())
+	_, err = loopHook.before(m, ctx, chain, jsoff.NewRequestMessage(1, "eth_call", nil))
+	assert.NotNil(err)
+
+	// script files are reloaded once changed
+	path := filepath.Join(t.TempDir(), "hook.star")
+	writeScript := func(version string, mtime time.Time) {
+		os.WriteFile(path, []byte("def before(req):\n    return {\"result\": \""+version+"\"}\n"), 0644)
+		os.Chtimes(path, mtime, mtime)
+	}
+	writeScript("v1", time.Now().Add(-time.Minute))
+	fileHook := HookConfig{Script: path}
+	assert.Nil(fileHook.Compile())
+	action, err := fileHook.before(m, ctx, chain, jsoff.NewRequestMessage(1, "eth_call", nil))
+	assert.Nil(err)
+	assert.Equal("v1", action.Result)
+	writeScript("v2", time.Now())
+	fileHook.script.checkedAt = time.Time{}
+	action, err = fileHook.before(m, ctx, chain, jsoff.NewRequestMessage(1, "eth_call", nil))
+	assert.Nil(err)
+	assert.Equal("v2", action.Result)
+
+	// scripts are sandboxed
+	assert.NotNil((&HookConfig{Source: `load("os.star", "system")`}).Compile())
+	assert.NotNil((&HookConfig{}).Compile())
+	assert.True(HookConfig{Methods: []string{"eth_*"}}.Match("eth_call"))
+	assert.False(HookConfig{Methods: []string{"eth_call"}}.Match("eth_callMany"))
+}
+
+type testVerifier struct{}
+
+func (v testVerifier) Verifiable(method string) bool {
+	return true
+}
+
+func (v testVerifier) PinHeight(reqmsg *jsoff.RequestMessage, height int) (*jsoff.RequestMessage, bool) {
+	return jsoff.NewRequestMessage(reqmsg.Id, reqmsg.Method, []any{height}), true
+}
+
+func TestVerifyRPC(t *testing.T) {
+	assert := assert.New(t)
+
+	var mu sync.Mutex
+	pinned := make(map[float64]int)
+	newServer := func(result string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Params []any
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			mu.Lock()
+			pinned[req.Params[0].(float64)]++
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"jsonrpc":"2.0","id":1,"result":"` + result + `"}`))
+		}))
+	}
+
+	m := NewMultiplexer()
+	chain := ChainRef{Namespace: "ethereum", Network: "mainnet"}
+	for i, result := range []string{"0x1", "0x1", "0x2"} {
+		server := newServer(result)
+		defer server.Close()
+		name := fmt.Sprintf("eth%02d", i)
+		m.Add(NewEndpoint(name, EndpointConfig{
+			Chain: "ethereum/mainnet",
+			Url:   server.URL,
+		}))
+		m.nameIndex[name].Blockhead = &Block{Height: 100 - i}
+	}
+	m.chainIndex[chain].resetMaxTipHeight()
+
+	ctx := context.Background()
+	reqmsg := jsoff.NewRequestMessage(1, "eth_getBalance", []any{"0x0"})
+
+	// two of three endpoints agree, all pinned to the lowest height
+	resmsg, err := m.VerifyRPC(ctx, testVerifier{}, chain, reqmsg, VerifyConfig{Endpoints: 3})
+	assert.Nil(err)
+	assert.Equal("0x1", resmsg.(*jsoff.ResultMessage).Result)
+	assert.Equal(map[float64]int{98: 3}, pinned)
+
+	resmsg, err = m.VerifyRPC(ctx, testVerifier{}, chain, reqmsg, VerifyConfig{Endpoints: 3, Quorum: 3})
+	assert.Nil(err)
+	assert.True(resmsg.IsError())
+	assert.Equal(ErrVerifyDisagreement.Code, resmsg.MustError().Code)
+
+	resmsg, err = m.VerifyRPC(ctx, testVerifier{}, chain, reqmsg, VerifyConfig{Endpoints: 4, Quorum: 4})
+	assert.Nil(err)
+	assert.Equal(ErrVerifyUnavailable.Code, resmsg.MustError().Code)
+
+	vcfg, ok := ParseVerifyConfig("3/2")
+	assert.True(ok)
+	assert.Equal(VerifyConfig{Endpoints: 3, Quorum: 2}, *vcfg)
+	assert.Equal(2, VerifyConfig{Endpoints: 3}.quorum())
+	_, ok = ParseVerifyConfig("3/4")
+	assert.False(ok)
+}
+
+func TestSessionHeight(t *testing.T) {
+	assert := assert.New(t)
+
+	m := NewMultiplexer()
+	chain := addTestEndpoints(m, "eth01", "eth02")
+	setTestBlockheads(m, chain, map[string]*Block{
+		"eth01": {Height: 100},
+		"eth02": {Height: 98},
+	})
+	accept := func(ep *Endpoint, height int) bool {
+		return ep.Available("eth_call", height)
+	}
+
+	info := &RequestInfo{SessionId: "sess01"}
+	ctx := info.AddTo(context.Background())
+	assert.Equal(0, m.SessionHeight(ctx, chain))
+
+	// the session has seen the height of eth01
+	m.recordSessionHeight(ctx, m.nameIndex["eth01"])
+	assert.Equal(100, m.SessionHeight(ctx, chain))
+	for i := 0; i < 10; i++ {
+		ep, found := m.selectOverHeight(ctx, chain, -5, accept)
+		assert.True(found)
+		assert.Equal("eth01", ep.Name)
+	}
+
+	// the height of a session never goes down
+	m.recordSessionHeight(ctx, m.nameIndex["eth02"])
+	assert.Equal(100, m.SessionHeight(ctx, chain))
+
+	// so do the capability and the commitment selectors
+	for i := 0; i < 10; i++ {
+		ep, found := m.SelectWithCapability(ctx, chain, "eth_call", -5, "archive")
+		assert.True(found)
+		assert.Equal("eth01", ep.Name)
+
+		ep, found = m.SelectAtCommitment(ctx, chain, "eth_call", CommitmentFinalized, -5)
+		assert.True(found)
+		assert.Equal("eth01", ep.Name)
+	}
+
+	// fall back to other endpoints if none is at the session height
+	m.nameIndex["eth01"].Healthy = false
+	ep, found := m.selectOverHeight(ctx, chain, -5, accept)
+	assert.True(found)
+	assert.Equal("eth02", ep.Name)
+
+	// other sessions are not affected
+	other := (&RequestInfo{SessionId: "sess02"}).AddTo(context.Background())
+	assert.Equal(0, m.SessionHeight(other, chain))
+
+	// the least recently used sessions are evicted
+	sh := NewSessionHeights()
+	sh.maxEntries = 2
+	for i, sess := range []string{"s1", "s2", "s1", "s3"} {
+		sh.Update(sessionKey{Chain: chain, Session: sess}, 100+i)
+	}
+	assert.Equal(2, sh.Len())
+	assert.Equal(102, sh.Get(sessionKey{Chain: chain, Session: "s1"}))
+	assert.Equal(0, sh.Get(sessionKey{Chain: chain, Session: "s2"}))
+	assert.Equal(103, sh.Get(sessionKey{Chain: chain, Session: "s3"}))
+}
+
+func TestAffinity(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := NewConfig()
+	err := cfg.LoadYamldata([]byte(`
+chains:
+  ethereum/mainnet:
+    affinity:
+      key: from
+`))
+	assert.Nil(err)
+
+	m := NewMultiplexer()
+	m.cfg = cfg
+	chain := addTestEndpoints(m, "eth01", "eth02", "eth03")
+	setTestBlockheads(m, chain, map[string]*Block{
+		"eth01": {Height: 100},
+		"eth02": {Height: 100},
+		"eth03": {Height: 100},
+	})
+	accept := func(ep *Endpoint, height int) bool {
+		return ep.Available("eth_call", height)
+	}
+
+	selected := make(map[string]string)
+	for i := 0; i < 30; i++ {
+		from := fmt.Sprintf("0x%040X", i)
+		reqmsg := jsoff.NewRequestMessage(1, "eth_call", []any{map[string]any{"from": from}, "latest"})
+		ctx := m.AffinityContext(context.Background(), chain, "", nil, reqmsg)
+		assert.Equal(strings.ToLower(from), affinityKeyFromContext(ctx))
+		ep, found := m.selectOverHeight(ctx, chain, -2, accept)
+		assert.True(found)
+		selected[from] = ep.Name
+
+		// the same key hits the same endpoint
+		ep, _ = m.selectOverHeight(ctx, chain, -2, accept)
+		assert.Equal(selected[from], ep.Name)
+
+		// so do the capability and the commitment selectors
+		ep, _ = m.SelectWithCapability(ctx, chain, "eth_call", -2, "archive")
+		assert.Equal(selected[from], ep.Name)
+		ep, _ = m.SelectAtCommitment(ctx, chain, "eth_call", CommitmentFinalized, -2)
+		assert.Equal(selected[from], ep.Name)
+	}
+
+	names := make(map[string]bool)
+	for _, name := range selected {
+		names[name] = true
+	}
+	assert.Equal(3, len(names))
+
+	// only the keys of the gone endpoint move
+	m.nameIndex["eth02"].Healthy = false
+	for from, name := range selected {
+		ctx := context.WithValue(context.Background(), affinityKey, strings.ToLower(from))
+		ep, found := m.selectOverHeight(ctx, chain, -2, accept)
+		assert.True(found)
+		if name != "eth02" {
+			assert.Equal(name, ep.Name)
+		} else {
+			assert.NotEqual("eth02", ep.Name)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.RemoteAddr = "10.0.0.1:5678"
+	r.Header.Set("X-Client", "c1")
+	assert.Equal("10.0.0.1", AffinityConfig{Key: AffinityIP}.KeyOf("", r, nil))
+	assert.Equal("c1", AffinityConfig{Key: AffinityHeader, Header: "X-Client"}.KeyOf("", r, nil))
+	assert.Equal("acc01", AffinityConfig{Key: AffinityAccount}.KeyOf("acc01", r, nil))
+	assert.NotNil(AffinityConfig{Key: "cookie"}.validate())
+}
@@ -1,7 +1,28 @@
 package nodemuxcore
 
 import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+)
+
+const (
+	// the max distinct method labels when no allowlist is configured
+	defaultMetricsMaxMethods = 200
+
+	// the method label of methods beyond the allowlist
+	otherMethodLabel = "other"
+)
+
+var (
+	// latency buckets in seconds
+	LatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
 )
 
 var (
@@ -17,6 +38,12 @@ var (
 		Help:      "block tips of each chain/network/endpoint",
 	}, []string{"chain", "endpoint"})
 
+	metricsEndpointBlockCommitted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nodemux",
+		Name:      "endpoint_block_committed",
+		Help:      "safe and finalized block heights of each chain/network/endpoint",
+	}, []string{"chain", "endpoint", "commitment"})
+
 	metricsEndpointHealthy = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 		Namespace: "nodemux",
 		Name:      "endpoint_healthy",
@@ -34,12 +61,218 @@ var (
 		Name:      "endpoint_blockhead_count",
 		Help:      "the count of getting block head",
 	}, []string{"chain", "endpoint"})
+
+	metricsUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nodemux",
+		Name:      "upstream_request_duration_seconds",
+		Help:      "the latency of requests to endpoints",
+		Buckets:   LatencyBuckets,
+	}, []string{"chain", "endpoint", "method"})
+
+	metricsUpstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "upstream_errors_total",
+		Help:      "the count of endpoint errors by type (rpc, http or network) and code",
+	}, []string{"chain", "endpoint", "method", "type", "code"})
+
+	metricsUpstreamBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "upstream_bytes_total",
+		Help:      "the bytes sent to and received from endpoints",
+	}, []string{"chain", "endpoint", "direction"})
+
+	metricsUpstreamInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nodemux",
+		Name:      "upstream_inflight_requests",
+		Help:      "the count of requests being processed by endpoints",
+	}, []string{"chain", "endpoint"})
+
+	metricsVerifyDisagreements = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "verify_disagreements_total",
+		Help:      "the count of verified requests whose endpoints disagree",
+	}, []string{"chain", "method"})
+
+	metricsHookErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "hook_errors_total",
+		Help:      "the count of failed hook script calls",
+	}, []string{"chain", "phase"})
+
+	metricsCacheCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "cache_requests_total",
+		Help:      "the count of cache lookups by cache and result",
+	}, []string{"chain", "cache", "result"})
 )
 
+// Method labels are bounded, methods out of the allowlist or beyond
+// the max count are labeled as other
+type methodLabeler struct {
+	lock       sync.RWMutex
+	allowlist  map[string]bool
+	maxMethods int
+	seen       map[string]bool
+}
+
+var methodLabels = &methodLabeler{
+	maxMethods: defaultMetricsMaxMethods,
+	seen:       make(map[string]bool),
+}
+
+// Set the methods allowed as metrics labels, if the allowlist is
+// empty the first maxMethods distinct methods are allowed
+func SetMetricsMethods(allowlist []string, maxMethods int) {
+	methodLabels.lock.Lock()
+	defer methodLabels.lock.Unlock()
+	methodLabels.allowlist = nil
+	if len(allowlist) > 0 {
+		methodLabels.allowlist = make(map[string]bool)
+		for _, method := range allowlist {
+			methodLabels.allowlist[method] = true
+		}
+	}
+	if maxMethods <= 0 {
+		maxMethods = defaultMetricsMaxMethods
+	}
+	methodLabels.maxMethods = maxMethods
+	methodLabels.seen = make(map[string]bool)
+}
+
+// Get the metrics label of a method
+func MethodLabel(method string) string {
+	return methodLabels.label(method, true)
+}
+
+// Get the metrics label of a method by the response, methods not
+// found by the upstream are not admitted into the max count so that
+// junk methods of clients don't exhaust the labels
+func ResponseMethodLabel(method string, resmsg jsoff.Message) string {
+	admit := resmsg == nil || !resmsg.IsError() || resmsg.MustError().Code != jsoff.ErrMethodNotFound.Code
+	return methodLabels.label(method, admit)
+}
+
+func (ml *methodLabeler) label(method string, admit bool) string {
+	ml.lock.RLock()
+	if ml.allowlist != nil {
+		defer ml.lock.RUnlock()
+		if ml.allowlist[method] {
+			return method
+		}
+		return otherMethodLabel
+	}
+	seen := ml.seen[method]
+	ml.lock.RUnlock()
+	if seen {
+		return method
+	} else if !admit {
+		return otherMethodLabel
+	}
+
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
+	if len(ml.seen) >= ml.maxMethods {
+		return otherMethodLabel
+	}
+	ml.seen[method] = true
+	return method
+}
+
+// Classify an upstream error into type and code labels
+func upstreamErrorLabels(err error) (string, string) {
+	var rpcErr *jsoff.RPCError
+	var abnResp *jsoffnet.WrappedResponse
+	if errors.As(err, &rpcErr) {
+		return "rpc", strconv.Itoa(rpcErr.Code)
+	} else if errors.As(err, &abnResp) && abnResp.Response != nil {
+		return "http", strconv.Itoa(abnResp.Response.StatusCode)
+	}
+	return "network", ""
+}
+
+// the method label of upstream requests of non JSON-RPC apis, paths
+// are not labeled so as to keep the labels bounded
+func apiMethodLabel(api int) string {
+	return apiNames[api]
+}
+
+func (ep Endpoint) observeUpstream(methodLabel string, seconds float64) {
+	metricsUpstreamDuration.With(prometheus.Labels{
+		"chain":    ep.Chain.String(),
+		"endpoint": ep.Name,
+		"method":   methodLabel,
+	}).Observe(seconds)
+}
+
+func (ep Endpoint) incrUpstreamError(methodLabel string, method string, errType string, code string) {
+	metricsUpstreamErrors.With(prometheus.Labels{
+		"chain":    ep.Chain.String(),
+		"endpoint": ep.Name,
+		"method":   methodLabel,
+		"type":     errType,
+		"code":     code,
+	}).Inc()
+	recentErrors.add(UpstreamError{
+		Time:     time.Now(),
+		Chain:    ep.Chain.String(),
+		Endpoint: ep.Name,
+		Method:   method,
+		Type:     errType,
+		Code:     code,
+	})
+}
+
+func (ep Endpoint) addUpstreamBytes(direction string, n int64) {
+	if n <= 0 {
+		return
+	}
+	metricsUpstreamBytes.With(prometheus.Labels{
+		"chain":     ep.Chain.String(),
+		"endpoint":  ep.Name,
+		"direction": direction,
+	}).Add(float64(n))
+}
+
+func (ep Endpoint) upstreamInflight() prometheus.Gauge {
+	return metricsUpstreamInflight.With(ep.prometheusLabels())
+}
+
+// Record the result of a cache lookup in metrics and in the current
+// span, cache is either jsonrpc or presence
+func RecordCacheResult(ctx context.Context, chain ChainRef, cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	metricsCacheCount.With(prometheus.Labels{
+		"chain":  chain.String(),
+		"cache":  cache,
+		"result": result,
+	}).Inc()
+
+	if info := RequestInfoFromContext(ctx); info != nil {
+		info.SetCacheResult(cache, result)
+	}
+
+	if cache == "presence" {
+		SetSpanAttributes(ctx, AttrPresence.String(result))
+	} else {
+		SetSpanAttributes(ctx, AttrCacheResult.String(result))
+	}
+}
+
 func init() {
 	prometheus.MustRegister(metricsBlockTip)
 	prometheus.MustRegister(metricsEndpointBlockTip)
+	prometheus.MustRegister(metricsEndpointBlockCommitted)
 	prometheus.MustRegister(metricsEndpointHealthy)
 	prometheus.MustRegister(metricsEndpointRelayCount)
 	prometheus.MustRegister(metricsBlockheadCount)
+	prometheus.MustRegister(metricsUpstreamDuration)
+	prometheus.MustRegister(metricsUpstreamErrors)
+	prometheus.MustRegister(metricsUpstreamBytes)
+	prometheus.MustRegister(metricsUpstreamInflight)
+	prometheus.MustRegister(metricsCacheCount)
+	prometheus.MustRegister(metricsVerifyDisagreements)
+	prometheus.MustRegister(metricsHookErrors)
 }
@@ -0,0 +1,57 @@
+package nodemuxcore
+
+import (
+	"sync"
+	"time"
+)
+
+const recentErrorsSize = 100
+
+// an upstream error kept for the dashboard
+type UpstreamError struct {
+	Time     time.Time `json:"time"`
+	Chain    string    `json:"chain"`
+	Endpoint string    `json:"endpoint"`
+	Method   string    `json:"method"`
+	Type     string    `json:"type"`
+	Code     string    `json:"code,omitempty"`
+}
+
+// a ring buffer of the latest upstream errors
+type errorRing struct {
+	lock  sync.Mutex
+	items []UpstreamError
+	next  int
+}
+
+var recentErrors = &errorRing{
+	items: make([]UpstreamError, 0, recentErrorsSize),
+}
+
+func (ring *errorRing) add(e UpstreamError) {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	if len(ring.items) < recentErrorsSize {
+		ring.items = append(ring.items, e)
+	} else {
+		ring.items[ring.next] = e
+	}
+	ring.next = (ring.next + 1) % recentErrorsSize
+}
+
+// the errors from the latest to the oldest
+func (ring *errorRing) list() []UpstreamError {
+	ring.lock.Lock()
+	defer ring.lock.Unlock()
+	n := len(ring.items)
+	res := make([]UpstreamError, 0, n)
+	for i := 1; i <= n; i++ {
+		res = append(res, ring.items[(ring.next-i+n)%n])
+	}
+	return res
+}
+
+// The latest upstream errors, the latest comes first
+func RecentErrors() []UpstreamError {
+	return recentErrors.list()
+}
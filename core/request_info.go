@@ -0,0 +1,180 @@
+package nodemuxcore
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// the header carrying the request id from clients and to upstreams
+const RequestIdHeader = "X-Request-Id"
+
+type requestInfoKeyType int
+
+var requestInfoKey requestInfoKeyType
+
+// RequestInfo carries the per request settings from the server
+// layer down to the delegators, and collects what happened to the
+// request on the way back, e.g. the endpoints tried
+type RequestInfo struct {
+	// the unique id of the request
+	RequestId string
+
+	// the session of the request, the websocket session or the
+	// session named by HTTP clients, empty if there is no session
+	SessionId string
+
+	// the account name of the request, empty if the request is not
+	// bound to an account
+	Account string
+
+	// the maximum block range of a log query, 0 means unlimited
+	MaxLogsRange int
+
+	// the account is not allowed to call wallet methods
+	DenyWalletMethods bool
+
+	// the hooks of the account, which run after the hooks of the chain
+	Hooks []HookConfig
+
+	// verify the response against several endpoints, nil means
+	// the verify mode is off
+	Verify *VerifyConfig
+
+	lock         sync.Mutex
+	methods      []string
+	endpoints    []string
+	attempts     int
+	cacheResult  string
+	errorCode    int
+	upstreamTime time.Duration
+}
+
+func (info *RequestInfo) AddTo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, requestInfoKey, info)
+}
+
+// Get the request info attached to the context, nil is returned if
+// there is no request info
+func RequestInfoFromContext(ctx context.Context) *RequestInfo {
+	if v := ctx.Value(requestInfoKey); v != nil {
+		if info, ok := v.(*RequestInfo); ok {
+			return info
+		}
+	}
+	return nil
+}
+
+// Record a method of the request, a batch request has many
+func (info *RequestInfo) AddMethod(method string) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.methods = append(info.methods, method)
+}
+
+// Record an upstream attempt on the endpoint
+func (info *RequestInfo) AddAttempt(epName string) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.attempts++
+	for _, name := range info.endpoints {
+		if name == epName {
+			return
+		}
+	}
+	info.endpoints = append(info.endpoints, epName)
+}
+
+// Add the time spent on an upstream call
+func (info *RequestInfo) AddUpstreamTime(d time.Duration) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.upstreamTime += d
+}
+
+func (info *RequestInfo) SetCacheResult(cache string, result string) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.cacheResult = cache + ":" + result
+}
+
+// Record the JSON-RPC error code of the response
+func (info *RequestInfo) SetErrorCode(code int) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.errorCode = code
+}
+
+func (info *RequestInfo) Methods() []string {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return append([]string(nil), info.methods...)
+}
+
+func (info *RequestInfo) Endpoints() []string {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return append([]string(nil), info.endpoints...)
+}
+
+func (info *RequestInfo) Attempts() int {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.attempts
+}
+
+func (info *RequestInfo) CacheResult() string {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.cacheResult
+}
+
+func (info *RequestInfo) UpstreamTime() time.Duration {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.upstreamTime
+}
+
+func (info *RequestInfo) ErrorCode() int {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.errorCode
+}
+
+// record an upstream attempt to the request info of the context
+func recordAttempt(ctx context.Context, ep *Endpoint) {
+	if info := RequestInfoFromContext(ctx); info != nil {
+		info.AddAttempt(ep.Name)
+	}
+}
+
+// record the time spent on an upstream call to the request info of the context
+func recordUpstreamTime(ctx context.Context, d time.Duration) {
+	if info := RequestInfoFromContext(ctx); info != nil {
+		info.AddUpstreamTime(d)
+	}
+}
+
+// Add the request id and the session id of the context to log fields
+func RequestLogFields(ctx context.Context, fields log.Fields) log.Fields {
+	if info := RequestInfoFromContext(ctx); info != nil {
+		if info.RequestId != "" {
+			fields["requestId"] = info.RequestId
+		}
+		if info.SessionId != "" {
+			fields["session"] = info.SessionId
+		}
+	}
+	return fields
+}
+
+// Set the request id and the trace context to upstream request headers
+func injectUpstreamHeaders(ctx context.Context, header http.Header) {
+	if info := RequestInfoFromContext(ctx); info != nil && info.RequestId != "" {
+		header.Set(RequestIdHeader, info.RequestId)
+	}
+	injectTraceContext(ctx, header)
+}
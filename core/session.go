@@ -0,0 +1,183 @@
+package nodemuxcore
+
+// Session heights keep the reads of a client session consistent, a
+// session is only routed to endpoints at or above the highest block
+// height already served to it, so that a block number returned by
+// one call is available to the following calls
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	// the header and the cookie naming the session of HTTP clients,
+	// websocket connections are sessions by themselves
+	SessionHeader = "X-Nodemux-Session"
+	SessionCookie = "nodemux_session"
+
+	// sessions idle for longer are forgotten
+	sessionHeightTTL = time.Minute * 10
+
+	// the max sessions remembered, the least recently used ones are
+	// evicted first
+	sessionHeightMaxEntries = 100000
+
+	// the height spec of selections at any tip height, only the
+	// session height is checked
+	anyHeightSpec = 1
+)
+
+type sessionKey struct {
+	Chain   ChainRef
+	Account string
+	Session string
+}
+
+type sessionHeight struct {
+	key      sessionKey
+	height   int
+	expireAt time.Time
+}
+
+type SessionHeights struct {
+	lock       sync.Mutex
+	maxEntries int
+	heights    map[sessionKey]*list.Element
+	lru        *list.List
+}
+
+func NewSessionHeights() *SessionHeights {
+	return &SessionHeights{
+		maxEntries: sessionHeightMaxEntries,
+		heights:    make(map[sessionKey]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// the session key of the context, false if the request has no session
+func sessionKeyFromContext(ctx context.Context, chain ChainRef) (sessionKey, bool) {
+	if info := RequestInfoFromContext(ctx); info != nil && info.SessionId != "" {
+		return sessionKey{Chain: chain, Account: info.Account, Session: info.SessionId}, true
+	}
+	return sessionKey{}, false
+}
+
+// Get the min height of the session, 0 if unknown
+func (sh *SessionHeights) Get(key sessionKey) int {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	if elem, ok := sh.heights[key]; ok {
+		if v := elem.Value.(*sessionHeight); time.Now().Before(v.expireAt) {
+			return v.height
+		}
+	}
+	return 0
+}
+
+// Raise the min height of the session and extend its expiration
+func (sh *SessionHeights) Update(key sessionKey, height int) {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	now := time.Now()
+	if elem, ok := sh.heights[key]; ok {
+		v := elem.Value.(*sessionHeight)
+		if now.After(v.expireAt) || v.height < height {
+			v.height = height
+		}
+		v.expireAt = now.Add(sessionHeightTTL)
+		sh.lru.MoveToFront(elem)
+		return
+	}
+	sh.heights[key] = sh.lru.PushFront(&sessionHeight{
+		key:      key,
+		height:   height,
+		expireAt: now.Add(sessionHeightTTL),
+	})
+
+	// evict the expired and the least recently used sessions
+	for back := sh.lru.Back(); back != nil; back = sh.lru.Back() {
+		v := back.Value.(*sessionHeight)
+		if sh.lru.Len() <= sh.maxEntries && now.Before(v.expireAt) {
+			break
+		}
+		sh.lru.Remove(back)
+		delete(sh.heights, v.key)
+	}
+}
+
+// the count of remembered sessions
+func (sh *SessionHeights) Len() int {
+	sh.lock.Lock()
+	defer sh.lock.Unlock()
+	return sh.lru.Len()
+}
+
+// record the tip height of the endpoint which served the session
+func (m *Multiplexer) recordSessionHeight(ctx context.Context, ep *Endpoint) {
+	if ep.Blockhead == nil || ep.Blockhead.Height <= 0 {
+		return
+	}
+	if key, ok := sessionKeyFromContext(ctx, ep.Chain); ok {
+		m.sessionHeights.Update(key, ep.Blockhead.Height)
+	}
+}
+
+// Get the min height of the session of the context on the chain, 0
+// if the request has no session
+func (m *Multiplexer) SessionHeight(ctx context.Context, chain ChainRef) int {
+	if key, ok := sessionKeyFromContext(ctx, chain); ok {
+		return m.sessionHeights.Get(key)
+	}
+	return 0
+}
+
+// the absolute height of the height spec, non-positive specs are
+// relative to the max tip height
+func (m *Multiplexer) resolveHeight(chain ChainRef, heightSpec int) int {
+	if heightSpec > 0 {
+		return heightSpec
+	}
+	maxHeight, _ := m.MaxTipHeight(chain)
+	return maxHeight + heightSpec
+}
+
+// whether the tip of the endpoint is over height, any tip is over
+// the height of anyHeightSpec
+func overHeight(ep *Endpoint, height int) bool {
+	return height <= anyHeightSpec || (ep.Blockhead != nil && ep.Blockhead.Height >= height)
+}
+
+// Select an endpoint over the height spec and the min height of the
+// session of the context, endpoints below the session height are
+// selected only if none above is available, requests with an
+// affinity key are hashed to the endpoint
+func (m *Multiplexer) selectOverHeight(ctx context.Context, chain ChainRef, heightSpec int, accept func(ep *Endpoint, height int) bool) (*Endpoint, bool) {
+	key := affinityKeyFromContext(ctx)
+	selectOver := func(heightSpec int) (*Endpoint, bool) {
+		if key != "" {
+			return m.selectByAffinity(chain, key, m.resolveHeight(chain, heightSpec), accept)
+		}
+		return m.selectByWeight(chain, heightSpec, accept)
+	}
+
+	if sessHeight := m.SessionHeight(ctx, chain); sessHeight > m.resolveHeight(chain, heightSpec) {
+		if ep, found := selectOver(sessHeight); found {
+			return ep, true
+		}
+	}
+	return selectOver(heightSpec)
+}
+
+// All healthy endpoints over height, the ones over the session height
+// if there are any
+func (m *Multiplexer) SessionHealthyEndpoints(ctx context.Context, chain ChainRef, method string, height int) []*Endpoint {
+	if sessHeight := m.SessionHeight(ctx, chain); sessHeight > height {
+		if eps := m.AllHealthyEndpoints(chain, method, sessHeight); len(eps) > 0 {
+			return eps
+		}
+	}
+	return m.AllHealthyEndpoints(chain, method, height)
+}
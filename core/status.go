@@ -0,0 +1,103 @@
+package nodemuxcore
+
+import (
+	"sort"
+)
+
+// the status of an endpoint relative to the tip of its chain
+type EndpointStatus struct {
+	Name          string `json:"name"`
+	Healthy       bool   `json:"healthy"`
+	Rejected      string `json:"rejected,omitempty"`
+	Weight        int    `json:"weight"`
+	Height        int    `json:"height"`
+	Safe          int    `json:"safe,omitempty"`
+	Finalized     int    `json:"finalized,omitempty"`
+	Lag           int    `json:"lag"`
+	ClientVersion string `json:"client,omitempty"`
+}
+
+// Usable tells whether the endpoint is healthy and not behind the
+// tip by more than maxLag blocks, maxLag <= 0 means any lag is
+// acceptable
+func (st EndpointStatus) Usable(maxLag int) bool {
+	if !st.Healthy || st.Rejected != "" {
+		return false
+	}
+	return maxLag <= 0 || st.Lag <= maxLag
+}
+
+type ChainSummary struct {
+	Chain        string           `json:"chain"`
+	MaxTipHeight int              `json:"max_tip_height"`
+	HealthyCount int              `json:"healthy"`
+	Endpoints    []EndpointStatus `json:"endpoints"`
+}
+
+// Count the usable endpoints within maxLag
+func (summary ChainSummary) UsableCount(maxLag int) int {
+	cnt := 0
+	for _, st := range summary.Endpoints {
+		if st.Usable(maxLag) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// Summarize the endpoints of a chain, false is returned if the chain
+// has no endpoints
+func (m Multiplexer) ChainSummary(chain ChainRef) (ChainSummary, bool) {
+	epset, ok := m.chainIndex[chain]
+	if !ok {
+		return ChainSummary{}, false
+	}
+	summary := ChainSummary{
+		Chain:        chain.String(),
+		MaxTipHeight: epset.maxTipHeight,
+		Endpoints:    make([]EndpointStatus, 0, len(epset.items)),
+	}
+	for _, ep := range epset.items {
+		info := ep.Info()
+		st := EndpointStatus{
+			Name:          info.Name,
+			Healthy:       info.Healthy,
+			Rejected:      info.Rejected,
+			ClientVersion: info.ClientVersion,
+			Weight:        ep.Config.Weight,
+			Lag:           epset.maxTipHeight,
+		}
+		if st.Weight <= 0 {
+			// 100 is the default weight
+			st.Weight = 100
+		}
+		if info.Blockhead != nil {
+			st.Height = info.Blockhead.Height
+			st.Safe = info.Blockhead.Safe
+			st.Finalized = info.Blockhead.Finalized
+			st.Lag = epset.maxTipHeight - info.Blockhead.Height
+		}
+		if st.Usable(0) {
+			summary.HealthyCount++
+		}
+		summary.Endpoints = append(summary.Endpoints, st)
+	}
+	sort.Slice(summary.Endpoints, func(i, j int) bool {
+		return summary.Endpoints[i].Name < summary.Endpoints[j].Name
+	})
+	return summary, true
+}
+
+// Summarize all chains ordered by the chain name
+func (m Multiplexer) ChainSummaries() []ChainSummary {
+	summaries := make([]ChainSummary, 0, len(m.chainIndex))
+	for chain := range m.chainIndex {
+		if summary, ok := m.ChainSummary(chain); ok {
+			summaries = append(summaries, summary)
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Chain < summaries[j].Chain
+	})
+	return summaries
+}
@@ -36,6 +36,16 @@ func (m *Multiplexer) StartSync(rootCtx context.Context, fetch bool) {
 		go ep.GetClientVersion(ctx)
 	}
 
+	// verify network identities and probe capabilities
+	for _, ep := range m.nameIndex {
+		go m.runEndpointProbe(ctx, ep)
+	}
+
+	// track broadcasted txs
+	if m.cfg != nil && m.cfg.TxTracking.Enabled {
+		go m.runTxTracker(ctx)
+	}
+
 	// start syncer
 	if fetch {
 		for _, ep := range m.nameIndex {
@@ -101,6 +111,8 @@ func (m *Multiplexer) updateStatus(cs ChainStatus) error {
 	metricsEndpointBlockTip.With(
 		ep.prometheusLabels()).Set(
 		float64(block.Height))
+	ep.observeCommitted(CommitmentSafe, block.Safe)
+	ep.observeCommitted(CommitmentFinalized, block.Finalized)
 
 	if epset, ok := m.chainIndex[ep.Chain]; ok {
 		if heightChanged {
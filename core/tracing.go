@@ -0,0 +1,191 @@
+package nodemuxcore
+
+// OpenTelemetry tracing, spans are chained from the incoming request
+// to the delegator's decision and then to each upstream attempt
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/superisaac/nodemux"
+	defaultServiceName = "nodemux"
+)
+
+// span attribute keys
+const (
+	AttrChain       = attribute.Key("nodemux.chain")
+	AttrAccount     = attribute.Key("nodemux.account")
+	AttrRequestId   = attribute.Key("nodemux.request_id")
+	AttrMethod      = attribute.Key("rpc.method")
+	AttrEndpoint    = attribute.Key("nodemux.endpoint")
+	AttrHeightSpec  = attribute.Key("nodemux.height_spec")
+	AttrCacheResult = attribute.Key("nodemux.cache_result")
+	AttrPresence    = attribute.Key("nodemux.presence_cache")
+	AttrRPCError    = attribute.Key("rpc.jsonrpc.error_code")
+)
+
+var (
+	// whether to inject W3C traceparent headers into upstream requests
+	tracePropagate = false
+)
+
+type TracingConfig struct {
+	// the span exporter, otlp or stdout, empty means tracing is off
+	Exporter string `yaml:"exporter,omitempty" json:"exporter,omitempty"`
+
+	// the OTLP/HTTP collector, either host:port or a full URL,
+	// OTEL_EXPORTER_OTLP_ENDPOINT is used if empty
+	Endpoint string            `yaml:"endpoint,omitempty" json:"endpoint,omitempty"`
+	Insecure bool              `yaml:"insecure,omitempty" json:"insecure,omitempty"`
+	Headers  map[string]string `yaml:"headers,omitempty" json:"headers,omitempty"`
+
+	ServiceName string `yaml:"service_name,omitempty" json:"service_name,omitempty"`
+
+	// the ratio of traces sampled, 0 means sampling all
+	SampleRatio float64 `yaml:"sample_ratio,omitempty" json:"sample_ratio,omitempty"`
+
+	// propagate the trace context to upstream endpoints
+	Propagate bool `yaml:"propagate,omitempty" json:"propagate,omitempty"`
+}
+
+func (cfg *TracingConfig) ValidateValues() error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		return errors.Errorf("unknown tracing exporter %s", cfg.Exporter)
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return errors.New("tracing sample ratio must be in [0, 1]")
+	}
+	return nil
+}
+
+func (cfg TracingConfig) newExporter(ctx context.Context) (sdktrace.SpanExporter, error) {
+	switch cfg.Exporter {
+	case "stdout":
+		return NewStdoutSpanExporter(os.Stdout)
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if strings.Contains(cfg.Endpoint, "://") {
+			opts = append(opts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		} else if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+	return nil, errors.Errorf("unknown tracing exporter %s", cfg.Exporter)
+}
+
+// Create a span exporter which writes spans as JSON lines, mostly for
+// testing and debugging
+func NewStdoutSpanExporter(w io.Writer) (sdktrace.SpanExporter, error) {
+	return stdouttrace.New(stdouttrace.WithWriter(w))
+}
+
+// Setup the global tracer provider and propagator, the returned
+// function flushes and stops the exporter
+func SetupTracing(ctx context.Context, cfg *TracingConfig) (func(context.Context) error, error) {
+	if cfg == nil || cfg.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+	exporter, err := cfg.newExporter(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "new span exporter")
+	}
+	provider := NewTracerProvider(cfg, sdktrace.WithBatcher(exporter))
+	installTracerProvider(provider, cfg.Propagate)
+	return provider.Shutdown, nil
+}
+
+func NewTracerProvider(cfg *TracingConfig, opts ...sdktrace.TracerProviderOption) *sdktrace.TracerProvider {
+	serviceName := cfg.ServiceName
+	if serviceName == "" {
+		serviceName = defaultServiceName
+	}
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	opts = append([]sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName))),
+	}, opts...)
+	return sdktrace.NewTracerProvider(opts...)
+}
+
+func installTracerProvider(provider trace.TracerProvider, propagate bool) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracePropagate = propagate
+}
+
+// Start a span, spans other than the server spans are only started
+// within a trace, so that background syncing doesn't emit traces
+func StartSpan(ctx context.Context, name string, kind trace.SpanKind, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if kind != trace.SpanKindServer && !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+	return otel.Tracer(tracerName).Start(ctx, name,
+		trace.WithSpanKind(kind),
+		trace.WithAttributes(attrs...))
+}
+
+// End a span, the error if any is recorded
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Set attributes of the current span of the context
+func SetSpanAttributes(ctx context.Context, attrs ...attribute.KeyValue) {
+	trace.SpanFromContext(ctx).SetAttributes(attrs...)
+}
+
+// Extract the trace context from incoming http headers
+func ExtractTraceContext(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Carry the span of from into ctx, relayers delegate requests using
+// the root context rather than the request's context
+func ContextWithSpanFrom(ctx context.Context, from context.Context) context.Context {
+	return trace.ContextWithSpan(ctx, trace.SpanFromContext(from))
+}
+
+// Inject traceparent into upstream request headers if propagation is
+// configured
+func injectTraceContext(ctx context.Context, header http.Header) {
+	if !tracePropagate {
+		return
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
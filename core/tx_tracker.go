@@ -0,0 +1,275 @@
+package nodemuxcore
+
+// Tx tracker keeps broadcasted txs until they are mined, pending txs
+// are optionally rebroadcasted to endpoints which haven't accepted
+// them.
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"sync"
+	"time"
+)
+
+const (
+	TxPending = "pending"
+	TxMined   = "mined"
+	TxDropped = "dropped"
+
+	// the tx was neither found in a block nor pending when it's
+	// expired, it may be mined but not indexed
+	TxUnknown = "unknown"
+)
+
+// the endpoint cannot tell whether the tx is mined or pending
+var ErrTxStatusUnknown = errors.New("tx status unknown")
+
+// Delegators telling whether a tx is mined implement it
+type TxStatusDelegator interface {
+	// the height of the block including the tx, 0 if the tx is
+	// still pending, ErrTxStatusUnknown if it's neither
+	GetTxHeight(ctx context.Context, ep *Endpoint, txid string) (int, error)
+}
+
+// Tx status delegators preferring endpoints of a capability such as
+// txindex implement it
+type TxStatusCapability interface {
+	TxStatusCapability() string
+}
+
+// The state of a broadcasted tx
+type TrackedTx struct {
+	Chain        string    `json:"chain"`
+	TxId         string    `json:"txid"`
+	Status       string    `json:"status"`
+	Height       int       `json:"height,omitempty"`
+	Accepted     []string  `json:"accepted"`
+	Rebroadcasts int       `json:"rebroadcasts"`
+	SubmittedAt  time.Time `json:"submittedAt"`
+	UpdatedAt    time.Time `json:"updatedAt"`
+
+	chain ChainRef
+
+	// submit the tx again to an endpoint
+	resubmit func(ctx context.Context, ep *Endpoint) TxOutcome
+}
+
+func (tx TrackedTx) hasAccepted(epName string) bool {
+	for _, name := range tx.Accepted {
+		if name == epName {
+			return true
+		}
+	}
+	return false
+}
+
+type trackedTxKey struct {
+	chain ChainRef
+	txid  string
+}
+
+type TxTracker struct {
+	mutex sync.RWMutex
+	txs   map[trackedTxKey]*TrackedTx
+}
+
+func NewTxTracker() *TxTracker {
+	return &TxTracker{
+		txs: make(map[trackedTxKey]*TrackedTx),
+	}
+}
+
+func (t *TxTracker) add(cfg TxTrackingConfig, chain ChainRef, bc *TxBroadcast, resubmit func(ctx context.Context, ep *Endpoint) TxOutcome) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := trackedTxKey{chain: chain, txid: bc.TxId}
+	if _, ok := t.txs[key]; !ok && len(t.txs) >= cfg.MaxTxs {
+		t.evictOldest()
+	}
+
+	now := time.Now()
+	tx := &TrackedTx{
+		Chain:       chain.String(),
+		TxId:        bc.TxId,
+		Status:      TxPending,
+		SubmittedAt: now,
+		UpdatedAt:   now,
+		chain:       chain,
+		resubmit:    resubmit,
+	}
+	for _, ep := range bc.Accepted {
+		tx.Accepted = append(tx.Accepted, ep.Name)
+	}
+	t.txs[key] = tx
+}
+
+func (t *TxTracker) evictOldest() {
+	var oldest *TrackedTx
+	for _, tx := range t.txs {
+		if oldest == nil || tx.SubmittedAt.Before(oldest.SubmittedAt) {
+			oldest = tx
+		}
+	}
+	if oldest != nil {
+		delete(t.txs, trackedTxKey{chain: oldest.chain, txid: oldest.TxId})
+	}
+}
+
+// Get a copy of the tracked tx
+func (t *TxTracker) Get(chain ChainRef, txid string) (TrackedTx, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if tx, ok := t.txs[trackedTxKey{chain: chain, txid: txid}]; ok {
+		cp := *tx
+		cp.Accepted = append([]string{}, tx.Accepted...)
+		return cp, true
+	}
+	return TrackedTx{}, false
+}
+
+func (t *TxTracker) pendingTxs() []TrackedTx {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	txs := make([]TrackedTx, 0)
+	for _, tx := range t.txs {
+		if tx.Status == TxPending {
+			txs = append(txs, *tx)
+		}
+	}
+	return txs
+}
+
+func (t *TxTracker) update(chain ChainRef, txid string, fn func(tx *TrackedTx)) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if tx, ok := t.txs[trackedTxKey{chain: chain, txid: txid}]; ok {
+		fn(tx)
+		tx.UpdatedAt = time.Now()
+	}
+}
+
+// remove finished txs which are kept for longer than maxAge
+func (t *TxTracker) expire(maxAge time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for key, tx := range t.txs {
+		if tx.Status != TxPending && time.Since(tx.UpdatedAt) > maxAge {
+			delete(t.txs, key)
+		}
+	}
+}
+
+// Track a broadcasted tx if tx tracking is enabled
+func (m *Multiplexer) trackTx(chain ChainRef, bc *TxBroadcast, resubmit func(ctx context.Context, ep *Endpoint) TxOutcome) {
+	if m.cfg == nil || !m.cfg.TxTracking.Enabled || bc.TxId == "" || !bc.Outcome.Accepted() {
+		return
+	}
+	m.txTracker.add(m.cfg.TxTracking, chain, bc, resubmit)
+}
+
+// Get the state of a tracked tx
+func (m *Multiplexer) TrackedTx(chain ChainRef, txid string) (TrackedTx, bool) {
+	return m.txTracker.Get(chain, txid)
+}
+
+func (m *Multiplexer) runTxTracker(rootCtx context.Context) {
+	cfg := m.cfg.TxTracking
+	ticker := time.NewTicker(time.Duration(cfg.Interval) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rootCtx.Done():
+			return
+		case <-ticker.C:
+			m.checkTrackedTxs(rootCtx, cfg)
+		}
+	}
+}
+
+func (m *Multiplexer) checkTrackedTxs(ctx context.Context, cfg TxTrackingConfig) {
+	maxAge := time.Duration(cfg.MaxAge) * time.Second
+	for _, tx := range m.txTracker.pendingTxs() {
+		height, err := m.txHeight(ctx, tx)
+		if err == nil && height > 0 {
+			m.txTracker.update(tx.chain, tx.TxId, func(t *TrackedTx) {
+				t.Status = TxMined
+				t.Height = height
+			})
+			continue
+		}
+		unknown := errors.Is(err, ErrTxStatusUnknown)
+
+		if time.Since(tx.SubmittedAt) > maxAge {
+			status := TxDropped
+			if unknown {
+				status = TxUnknown
+			}
+			tx.chain.Log().Infof("tracked tx %s %s", tx.TxId, status)
+			m.txTracker.update(tx.chain, tx.TxId, func(t *TrackedTx) {
+				t.Status = status
+			})
+			continue
+		}
+
+		// a tx of unknown status may be mined already
+		if cfg.Rebroadcast && tx.resubmit != nil && !unknown {
+			m.rebroadcastTx(ctx, tx)
+		}
+	}
+	m.txTracker.expire(maxAge)
+}
+
+// query the height of the block including the tx from an endpoint at
+// the chain tip, endpoints of the capability the delegator prefers are
+// selected first
+func (m *Multiplexer) txHeight(ctx context.Context, tx TrackedTx) (int, error) {
+	factory := GetDelegatorFactory()
+	if support, _ := factory.SupportChain(tx.chain.Namespace); !support {
+		return 0, errors.New("chain not supported")
+	}
+	delegator := factory.GetBlockheadDelegator(tx.chain.Namespace)
+	statusDelegator, ok := delegator.(TxStatusDelegator)
+	if !ok {
+		return 0, errors.New("tx status not supported")
+	}
+	var ep *Endpoint
+	if capDelegator, ok := delegator.(TxStatusCapability); ok {
+		ep, ok = m.SelectWithCapability(ctx, tx.chain, "", 0, capDelegator.TxStatusCapability())
+	}
+	if ep == nil {
+		if ep, ok = m.SelectOverHeight(ctx, tx.chain, "", 0); !ok {
+			return 0, ErrNotAvailable
+		}
+	}
+	height, err := statusDelegator.GetTxHeight(ctx, ep, tx.TxId)
+	if err != nil && !errors.Is(err, ErrTxStatusUnknown) {
+		ep.Log().WithFields(log.Fields{
+			"txid": tx.TxId,
+		}).Warnf("get tx height error %s", err)
+	}
+	return height, err
+}
+
+// submit a pending tx to the healthy endpoints which haven't accepted
+// it, which are usually lagging ones
+func (m *Multiplexer) rebroadcastTx(ctx context.Context, tx TrackedTx) {
+	accepted := make([]string, 0)
+	for _, ep := range m.AllHealthyEndpoints(tx.chain, "", 0) {
+		if tx.hasAccepted(ep.Name) {
+			continue
+		}
+		if outcome := tx.resubmit(ctx, ep); outcome.Accepted() {
+			accepted = append(accepted, ep.Name)
+		}
+	}
+	m.txTracker.update(tx.chain, tx.TxId, func(t *TrackedTx) {
+		t.Rebroadcasts++
+		for _, epName := range accepted {
+			if !t.hasAccepted(epName) {
+				t.Accepted = append(t.Accepted, epName)
+			}
+		}
+	})
+}
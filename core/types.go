@@ -13,8 +13,22 @@ const (
 	ApiJSONRPCWS
 	ApiREST
 	ApiGraphQL
+	ApiGRPC
+	ApiElectrum
+	ApiGRPCWeb
 )
 
+// the names of api kinds used in configs, e.g. the keys of endpoint urls
+var apiNames = map[int]string{
+	ApiJSONRPC:   "jsonrpc",
+	ApiJSONRPCWS: "jsonrpc-ws",
+	ApiREST:      "rest",
+	ApiGraphQL:   "graphql",
+	ApiGRPC:      "grpc",
+	ApiElectrum:  "electrum",
+	ApiGRPCWeb:   "grpc-web",
+}
+
 type RPCResult struct {
 	Response jsoff.Message
 	Endpoint *Endpoint
@@ -25,6 +39,11 @@ type RPCResult struct {
 type Block struct {
 	Height int    `json:"height"`
 	Hash   string `json:"hash,omitempty"`
+
+	// the heights of the safe and finalized heads, zero means the
+	// commitment level is not reported by the chain
+	Safe      int `json:"safe,omitempty"`
+	Finalized int `json:"finalized,omitempty"`
 }
 
 type ChainRef struct {
@@ -42,12 +61,18 @@ type Endpoint struct {
 
 	// fetched
 	ClientVersion string
+	Capabilities  *Capabilities
+	Identity      *NetworkIdentity
+
+	// the reason why the endpoint is rejected, empty means accepted
+	Rejected string
 
 	// dynamic items
 	Healthy   bool
 	Blockhead *Block
 
 	client        *http.Client
+	grpcTransport http.RoundTripper
 	rpcHttpClient jsoffnet.Client
 	//rpcWSClient   *jsoffnet.WSClient
 
@@ -56,12 +81,15 @@ type Endpoint struct {
 }
 
 type EndpointInfo struct {
-	Name          string `json:"name"`
-	URLDigest     string `json:"urldigest"`
-	Chain         string `json:"chain"`
-	Healthy       bool   `json:"healthy"`
-	Blockhead     *Block `json:"head,omitempty"`
-	ClientVersion string `json:"client,omitempty"`
+	Name          string           `json:"name"`
+	URLDigest     string           `json:"urldigest"`
+	Chain         string           `json:"chain"`
+	Healthy       bool             `json:"healthy"`
+	Blockhead     *Block           `json:"head,omitempty"`
+	ClientVersion string           `json:"client,omitempty"`
+	Capabilities  *Capabilities    `json:"capabilities,omitempty"`
+	Identity      *NetworkIdentity `json:"identity,omitempty"`
+	Rejected      string           `json:"rejected,omitempty"`
 }
 
 type Weight struct {
@@ -92,6 +120,12 @@ type Multiplexer struct {
 
 	// a pool of redis clients
 	redisClients map[string]*redis.Client
+
+	// broadcasted txs tracked until mined
+	txTracker *TxTracker
+
+	// the min block heights of client sessions
+	sessionHeights *SessionHeights
 }
 
 // Delegators
@@ -102,7 +136,8 @@ type BlockheadDelegator interface {
 	// func should return false else the func returns true
 	StartSync(ctx context.Context, m *Multiplexer, ep *Endpoint) (started bool, err error)
 
-	// Get a block head
+	// Get a block head, the safe and finalized heights are set
+	// if the chain reports them
 	GetBlockhead(ctx context.Context, m *Multiplexer, ep *Endpoint) (*Block, error)
 
 	// Get the client version
@@ -114,6 +149,13 @@ type RPCDelegator interface {
 	DelegateRPC(ctx context.Context, b *Multiplexer, chain ChainRef, reqmsg *jsoff.RequestMessage, r *http.Request) (jsoff.Message, error)
 }
 
+// Optional interface of a RPC delegator which denies requests by the
+// request info, the denial applies to the requests sent to a selected
+// endpoint as well
+type DenyDelegator interface {
+	DenyRPC(ctx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, bool)
+}
+
 type RESTDelegator interface {
 	BlockheadDelegator
 	DelegateREST(ctx context.Context, b *Multiplexer, chain ChainRef, path string, w http.ResponseWriter, r *http.Request) error
@@ -124,11 +166,30 @@ type GraphQLDelegator interface {
 	DelegateGraphQL(ctx context.Context, b *Multiplexer, chain ChainRef, path string, w http.ResponseWriter, r *http.Request) error
 }
 
+// gRPC and gRPC-Web delegators, path is the gRPC method path such as
+// /cosmos.bank.v1beta1.Query/Balance
+type GRPCDelegator interface {
+	BlockheadDelegator
+	DelegateGRPC(ctx context.Context, b *Multiplexer, chain ChainRef, path string, w http.ResponseWriter, r *http.Request) error
+}
+
+// Electrum protocol delegators, the requests come from electrum
+// wallets over TCP or TLS
+type ElectrumDelegator interface {
+	BlockheadDelegator
+	DelegateElectrum(ctx context.Context, b *Multiplexer, chain ChainRef, reqmsg *jsoff.RequestMessage) (jsoff.Message, error)
+}
+
 type DelegatorFactory struct {
-	config          *NodemuxConfig
-	rpcDelegators   map[string]RPCDelegator
-	restDelegators  map[string]RESTDelegator
-	graphDelegators map[string]GraphQLDelegator
+	config             *NodemuxConfig
+	rpcDelegators      map[string]RPCDelegator
+	restDelegators     map[string]RESTDelegator
+	graphDelegators    map[string]GraphQLDelegator
+	grpcDelegators     map[string]GRPCDelegator
+	electrumDelegators map[string]ElectrumDelegator
+
+	// the api kinds of namespaces in the order of registration
+	apis map[string][]int
 }
 
 // chain stream
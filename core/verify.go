@@ -0,0 +1,213 @@
+package nodemuxcore
+
+// The verify mode sends a read request to several endpoints pinned to
+// the same block height, the response is returned only if a quorum of
+// the endpoints agree on it
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/superisaac/jsoff"
+)
+
+// the header selecting the verify mode, the value is n or n/quorum
+const VerifyHeader = "X-Nodemux-Verify"
+
+var (
+	ErrVerifyUnavailable  = &jsoff.RPCError{Code: -32063, Message: "not enough endpoints to verify"}
+	ErrVerifyDisagreement = &jsoff.RPCError{Code: -32064, Message: "endpoints disagree"}
+)
+
+type VerifyConfig struct {
+	// the number of endpoints the request is sent to
+	Endpoints int `yaml:"endpoints" json:"endpoints"`
+
+	// the number of endpoints which must agree, default is the
+	// majority of endpoints
+	Quorum int `yaml:"quorum,omitempty" json:"quorum,omitempty"`
+}
+
+func (vcfg VerifyConfig) quorum() int {
+	if vcfg.Quorum > 0 {
+		return vcfg.Quorum
+	}
+	return vcfg.Endpoints/2 + 1
+}
+
+// Parse the value of the verify header, n or n/quorum
+func ParseVerifyConfig(value string) (*VerifyConfig, bool) {
+	parts := strings.SplitN(strings.TrimSpace(value), "/", 2)
+	n, err := strconv.Atoi(parts[0])
+	if err != nil || n < 2 {
+		return nil, false
+	}
+	vcfg := &VerifyConfig{Endpoints: n}
+	if len(parts) == 2 {
+		quorum, err := strconv.Atoi(parts[1])
+		if err != nil || quorum <= 0 || quorum > n {
+			return nil, false
+		}
+		vcfg.Quorum = quorum
+	}
+	return vcfg, true
+}
+
+// Delegators supporting the verify mode
+type VerifyDelegator interface {
+	// Whether the method is a read which can be verified
+	Verifiable(method string) bool
+
+	// Pin the request to the block height, false is returned if
+	// the request cannot be pinned, then endpoints at the same
+	// tip height are selected
+	PinHeight(reqmsg *jsoff.RequestMessage, height int) (*jsoff.RequestMessage, bool)
+}
+
+type verifyResponse struct {
+	Endpoint string      `json:"endpoint"`
+	Result   interface{} `json:"result,omitempty"`
+	Error    interface{} `json:"error,omitempty"`
+}
+
+// select the endpoints to verify against and the pinned height
+func (m *Multiplexer) selectVerifyEndpoints(chain ChainRef, method string, n int, pinnable bool) ([]*Endpoint, int) {
+	var eps []*Endpoint
+	for _, ep := range m.AllHealthyEndpoints(chain, method, 0) {
+		if ep.Blockhead != nil {
+			eps = append(eps, ep)
+		}
+	}
+	sort.SliceStable(eps, func(i, j int) bool {
+		return eps[i].Blockhead.Height > eps[j].Blockhead.Height
+	})
+	if len(eps) == 0 {
+		return nil, 0
+	}
+
+	if pinnable {
+		// the highest n endpoints all have the lowest block of them
+		if len(eps) > n {
+			eps = eps[:n]
+		}
+		return eps, eps[len(eps)-1].Blockhead.Height
+	}
+
+	// the most endpoints at the same height, the higher wins on ties
+	counts := make(map[int]int)
+	height := 0
+	for _, ep := range eps {
+		h := ep.Blockhead.Height
+		counts[h]++
+		if counts[h] > counts[height] {
+			height = h
+		}
+	}
+	var selected []*Endpoint
+	for _, ep := range eps {
+		if ep.Blockhead.Height == height && len(selected) < n {
+			selected = append(selected, ep)
+		}
+	}
+	return selected, height
+}
+
+// the key of a response, responses with the same key agree
+func verifyKey(resmsg jsoff.Message) string {
+	if resmsg.IsError() {
+		rpcErr := resmsg.MustError()
+		return fmt.Sprintf("error:%d:%s", rpcErr.Code, rpcErr.Message)
+	}
+	if res, ok := resmsg.(*jsoff.ResultMessage); ok {
+		// maps are marshaled with sorted keys
+		data, err := json.Marshal(res.Result)
+		if err != nil {
+			return ""
+		}
+		return "result:" + string(data)
+	}
+	return ""
+}
+
+// Send the request to the endpoints of vcfg and return the response
+// agreed by a quorum of them
+func (m *Multiplexer) VerifyRPC(rootCtx context.Context, delegator VerifyDelegator, chain ChainRef, reqmsg *jsoff.RequestMessage, vcfg VerifyConfig) (jsoff.Message, error) {
+	ctx, span := StartSpan(rootCtx, "verify", trace.SpanKindInternal,
+		AttrChain.String(chain.String()),
+		AttrMethod.String(reqmsg.Method))
+	defer span.End()
+
+	quorum := vcfg.quorum()
+	// try pinning to tell whether the request can be pinned
+	_, pinnable := delegator.PinHeight(reqmsg, 1)
+	eps, height := m.selectVerifyEndpoints(chain, reqmsg.Method, vcfg.Endpoints, pinnable)
+	if len(eps) < quorum {
+		return ErrVerifyUnavailable.ToMessage(reqmsg), nil
+	}
+	pinned := reqmsg
+	if pinnable {
+		pinned, _ = delegator.PinHeight(reqmsg, height)
+	}
+
+	results := make([]RPCResult, len(eps))
+	wg := new(sync.WaitGroup)
+	for i, ep := range eps {
+		wg.Add(1)
+		go func(i int, ep *Endpoint) {
+			defer wg.Done()
+			resmsg, err := m.CallEndpointRPC(ctx, ep, pinned)
+			results[i] = RPCResult{Response: resmsg, Endpoint: ep, Err: err}
+		}(i, ep)
+	}
+	wg.Wait()
+
+	counts := make(map[string]int)
+	responses := make([]verifyResponse, 0, len(results))
+	for _, res := range results {
+		vres := verifyResponse{Endpoint: res.Endpoint.Name}
+		if res.Err != nil || res.Response == nil {
+			vres.Error = fmt.Sprintf("%v", res.Err)
+			responses = append(responses, vres)
+			continue
+		}
+		key := verifyKey(res.Response)
+		if key == "" {
+			continue
+		}
+		counts[key]++
+		if counts[key] >= quorum {
+			// the id of the pinned request is the same
+			return res.Response, nil
+		}
+		if res.Response.IsError() {
+			vres.Error = res.Response.MustError()
+		} else if r, ok := res.Response.(*jsoff.ResultMessage); ok {
+			vres.Result = r.Result
+		}
+		responses = append(responses, vres)
+	}
+
+	metricsVerifyDisagreements.With(prometheus.Labels{
+		"chain":  chain.String(),
+		"method": MethodLabel(reqmsg.Method),
+	}).Inc()
+	chain.Log().Warnf("endpoints disagree on %s at height %d", reqmsg.Method, height)
+	rpcErr := &jsoff.RPCError{
+		Code:    ErrVerifyDisagreement.Code,
+		Message: ErrVerifyDisagreement.Message,
+		Data: map[string]interface{}{
+			"height":    height,
+			"quorum":    quorum,
+			"responses": responses,
+		},
+	}
+	return rpcErr.ToMessage(reqmsg), nil
+}
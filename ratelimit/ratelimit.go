@@ -38,6 +38,12 @@ func (opts *RatelimitOptions) RedisKey() string {
 }
 
 func Incr(context context.Context, c *redis.Client, field string, limit int, optslist ...*RatelimitOptions) (ok bool, e error) {
+	return IncrBy(context, c, field, 1, limit, optslist...)
+}
+
+// Increase the count of the field by n, which is the cost of one
+// request that is worth several ones
+func IncrBy(context context.Context, c *redis.Client, field string, n int, limit int, optslist ...*RatelimitOptions) (ok bool, e error) {
 	opts := NewRatelimitOptions()
 	for _, srcopt := range optslist {
 		if srcopt == nil {
@@ -53,7 +59,7 @@ func Incr(context context.Context, c *redis.Client, field string, limit int, opt
 	}
 
 	key := opts.RedisKey()
-	i64value, err := c.HIncrBy(context, key, field, 1).Result()
+	i64value, err := c.HIncrBy(context, key, field, int64(n)).Result()
 	if err != nil {
 		return false, err
 	}
@@ -64,7 +70,7 @@ func Incr(context context.Context, c *redis.Client, field string, limit int, opt
 		return false, nil
 	} else if newValue <= valueBase {
 		// field has not being set previously
-		if err := c.HSet(context, key, field, valueBase).Err(); err != nil {
+		if err := c.HSet(context, key, field, valueBase+n-1).Err(); err != nil {
 			return false, err
 		}
 		expiration := opts.Span * 2
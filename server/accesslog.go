@@ -0,0 +1,397 @@
+package server
+
+// Access log, one structured record per client request is written to
+// a sink, which is stdout, a rotated file or a redis stream
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/nodemux/core"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const (
+	defaultAccessLogMaxSize     = 100 // megabytes
+	defaultAccessLogStore       = "accesslog"
+	defaultAccessLogStream      = "nodemux:accesslog"
+	defaultAccessLogStreamLen   = 100000
+	defaultAccessLogMaxBodySize = 4096
+	accessLogQueueSize          = 1024
+)
+
+type AccessLogConfig struct {
+	// stdout, file or redis
+	Sink string `yaml:"sink" json:"sink"`
+
+	// the log file and rotation settings of the file sink
+	Path       string `yaml:"path,omitempty" json:"path,omitempty"`
+	MaxSize    int    `yaml:"max_size,omitempty" json:"max_size,omitempty"`
+	MaxBackups int    `yaml:"max_backups,omitempty" json:"max_backups,omitempty"`
+	MaxAge     int    `yaml:"max_age,omitempty" json:"max_age,omitempty"`
+
+	// the redis store in nodemux config and the stream of the redis sink
+	Store        string `yaml:"store,omitempty" json:"store,omitempty"`
+	Stream       string `yaml:"stream,omitempty" json:"stream,omitempty"`
+	StreamMaxLen int64  `yaml:"stream_maxlen,omitempty" json:"stream_maxlen,omitempty"`
+
+	// the ratio of requests logged, 0 means logging all, requests
+	// with errors are always logged
+	SampleRate float64 `yaml:"sample_rate,omitempty" json:"sample_rate,omitempty"`
+
+	// accounts whose requests are all logged with request and
+	// response bodies
+	CaptureAccounts []string `yaml:"capture_accounts,omitempty" json:"capture_accounts,omitempty"`
+	MaxBodySize     int      `yaml:"max_body_size,omitempty" json:"max_body_size,omitempty"`
+}
+
+func (cfg *AccessLogConfig) validateValues() error {
+	if cfg == nil {
+		return nil
+	}
+	switch cfg.Sink {
+	case "stdout", "redis":
+	case "file":
+		if cfg.Path == "" {
+			return errors.New("access log, empty file path")
+		}
+	default:
+		return errors.Errorf("access log, unknown sink %s", cfg.Sink)
+	}
+	if cfg.SampleRate < 0 || cfg.SampleRate > 1 {
+		return errors.New("access log, sample rate must be in [0, 1]")
+	}
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = defaultAccessLogMaxSize
+	}
+	if cfg.Store == "" {
+		cfg.Store = defaultAccessLogStore
+	}
+	if cfg.Stream == "" {
+		cfg.Stream = defaultAccessLogStream
+	}
+	if cfg.StreamMaxLen <= 0 {
+		cfg.StreamMaxLen = defaultAccessLogStreamLen
+	}
+	if cfg.MaxBodySize <= 0 {
+		cfg.MaxBodySize = defaultAccessLogMaxBodySize
+	}
+	return nil
+}
+
+type AccessRecord struct {
+	Time         time.Time `json:"time"`
+	RequestId    string    `json:"request_id"`
+	Session      string    `json:"session,omitempty"`
+	Account      string    `json:"account"`
+	Chain        string    `json:"chain"`
+	Api          string    `json:"api"`
+	Method       string    `json:"method,omitempty"`
+	Path         string    `json:"path,omitempty"`
+	Endpoints    []string  `json:"endpoints,omitempty"`
+	Attempts     int       `json:"attempts"`
+	Cache        string    `json:"cache,omitempty"`
+	Status       int       `json:"status,omitempty"`
+	ErrorCode    int       `json:"error_code,omitempty"`
+	LatencyMS    float64   `json:"latency_ms"`
+	BytesIn      int64     `json:"bytes_in"`
+	BytesOut     int64     `json:"bytes_out"`
+	RequestBody  string    `json:"request_body,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+}
+
+func (rec AccessRecord) hasError() bool {
+	return rec.ErrorCode != 0 || rec.Status >= 400
+}
+
+// fill the record with what the request info collected
+func (rec *AccessRecord) fillInfo(info *nodemuxcore.RequestInfo) {
+	rec.RequestId = info.RequestId
+	rec.Session = info.SessionId
+	rec.Method = strings.Join(info.Methods(), ",")
+	rec.Endpoints = info.Endpoints()
+	rec.Attempts = info.Attempts()
+	rec.Cache = info.CacheResult()
+	rec.ErrorCode = info.ErrorCode()
+}
+
+type accessLogSink interface {
+	Write(ctx context.Context, data []byte) error
+	Close() error
+}
+
+type writerSink struct {
+	lock   sync.Mutex
+	writer io.Writer
+}
+
+func (sink *writerSink) Write(ctx context.Context, data []byte) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+	_, err := sink.writer.Write(append(data, '\n'))
+	return err
+}
+
+func (sink *writerSink) Close() error {
+	if closer, ok := sink.writer.(io.Closer); ok && sink.writer != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+type redisSink struct {
+	store  string
+	stream string
+	maxLen int64
+}
+
+func (sink redisSink) Write(ctx context.Context, data []byte) error {
+	c, ok := nodemuxcore.GetMultiplexer().RedisClient(sink.store)
+	if !ok {
+		return errors.Errorf("redis store %s not found", sink.store)
+	}
+	return c.XAdd(ctx, &redis.XAddArgs{
+		Stream: sink.stream,
+		MaxLen: sink.maxLen,
+		Approx: true,
+		Values: map[string]interface{}{"record": string(data)},
+	}).Err()
+}
+
+func (sink redisSink) Close() error {
+	return nil
+}
+
+type AccessLogger struct {
+	cfg     *AccessLogConfig
+	sink    accessLogSink
+	ch      chan *AccessRecord
+	capture map[string]bool
+}
+
+type accessLoggerKeyType int
+
+var accessLoggerKey accessLoggerKeyType
+
+func NewAccessLogger(cfg *AccessLogConfig) *AccessLogger {
+	var sink accessLogSink
+	switch cfg.Sink {
+	case "file":
+		sink = &writerSink{writer: &lumberjack.Logger{
+			Filename:   cfg.Path,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+		}}
+	case "redis":
+		sink = redisSink{
+			store:  cfg.Store,
+			stream: cfg.Stream,
+			maxLen: cfg.StreamMaxLen,
+		}
+	default:
+		sink = &writerSink{writer: os.Stdout}
+	}
+
+	capture := make(map[string]bool)
+	for _, account := range cfg.CaptureAccounts {
+		capture[account] = true
+	}
+	return &AccessLogger{
+		cfg:     cfg,
+		sink:    sink,
+		ch:      make(chan *AccessRecord, accessLogQueueSize),
+		capture: capture,
+	}
+}
+
+func (logger *AccessLogger) AddTo(ctx context.Context) context.Context {
+	return context.WithValue(ctx, accessLoggerKey, logger)
+}
+
+// Get the access logger of the context, nil if access log is not configured
+func AccessLoggerFromContext(ctx context.Context) *AccessLogger {
+	if v := ctx.Value(accessLoggerKey); v != nil {
+		if logger, ok := v.(*AccessLogger); ok {
+			return logger
+		}
+	}
+	return nil
+}
+
+// Whether the bodies of the account's requests are captured
+func (logger *AccessLogger) Captures(account string) bool {
+	return logger.capture[account]
+}
+
+func (logger *AccessLogger) sampled(rec *AccessRecord) bool {
+	if rec.hasError() || logger.Captures(rec.Account) {
+		return true
+	}
+	if logger.cfg.SampleRate <= 0 || logger.cfg.SampleRate >= 1 {
+		return true
+	}
+	return mrand.Float64() < logger.cfg.SampleRate
+}
+
+// Queue a record, the record is dropped if the queue is full so that
+// a slow sink never blocks requests
+func (logger *AccessLogger) Log(rec *AccessRecord) {
+	if !logger.sampled(rec) {
+		return
+	}
+	select {
+	case logger.ch <- rec:
+	default:
+		log.Warnf("access log queue is full, record %s dropped", rec.RequestId)
+	}
+}
+
+func (logger *AccessLogger) Run(rootCtx context.Context) {
+	ctx, cancel := context.WithCancel(rootCtx)
+	defer cancel()
+	defer logger.sink.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rec := <-logger.ch:
+			data, err := json.Marshal(rec)
+			if err != nil {
+				log.Warnf("access log, marshal record %s", err)
+				continue
+			}
+			if err := logger.sink.Write(ctx, data); err != nil {
+				log.Warnf("access log, write record %s", err)
+			}
+		}
+	}
+}
+
+func (logger *AccessLogger) truncateBody(data []byte) string {
+	if len(data) > logger.cfg.MaxBodySize {
+		return string(data[:logger.cfg.MaxBodySize])
+	}
+	return string(data)
+}
+
+func newRequestId() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf)
+}
+
+// Write an access record for each http request
+type AccessLogHandler struct {
+	rootCtx context.Context
+	next    http.Handler
+}
+
+func NewAccessLogHandler(rootCtx context.Context, next http.Handler) *AccessLogHandler {
+	return &AccessLogHandler{
+		rootCtx: rootCtx,
+		next:    next,
+	}
+}
+
+func (h *AccessLogHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	acc := AccFromContext(r.Context())
+	info := nodemuxcore.RequestInfoFromContext(r.Context())
+	logger := AccessLoggerFromContext(h.rootCtx)
+	if logger == nil || info == nil {
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	capture := 0
+	if logger.Captures(acc.Name) {
+		capture = logger.cfg.MaxBodySize
+	}
+	body := &countingReader{ReadCloser: r.Body, capture: capture}
+	r.Body = body
+	rw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK, capture: capture}
+
+	start := time.Now()
+	h.next.ServeHTTP(rw, r)
+
+	rec := &AccessRecord{
+		Time:      start,
+		Account:   acc.Name,
+		Chain:     acc.Chain.String(),
+		Api:       strings.TrimPrefix(traceRoute(r.URL.Path), "/"),
+		Path:      accountPath(r.URL.Path),
+		Status:    rw.status,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+		BytesIn:   body.read,
+		BytesOut:  rw.written,
+	}
+	rec.fillInfo(info)
+	if capture > 0 {
+		rec.RequestBody = logger.truncateBody(body.captured.Bytes())
+		rec.ResponseBody = logger.truncateBody(rw.captured.Bytes())
+	}
+	logger.Log(rec)
+}
+
+// Write an access record for a request message over websocket,
+// the sizes are the ones of the marshaled messages
+func (acc Acc) logWSMessage(rootCtx context.Context, info *nodemuxcore.RequestInfo, start time.Time, reqmsg *jsoff.RequestMessage, resmsg jsoff.Message, err error) {
+	acc.logStreamMessage(rootCtx, "jsonrpc-ws", info, start, reqmsg, resmsg, err)
+}
+
+// Write an access record for a request message over a persistent
+// connection of the api, such as websocket or electrum
+func (acc Acc) logStreamMessage(rootCtx context.Context, api string, info *nodemuxcore.RequestInfo, start time.Time, reqmsg *jsoff.RequestMessage, resmsg jsoff.Message, err error) {
+	logger := AccessLoggerFromContext(rootCtx)
+	if logger == nil {
+		return
+	}
+	rec := &AccessRecord{
+		Time:      start,
+		Account:   acc.Name,
+		Chain:     acc.Chain.String(),
+		Api:       api,
+		LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	rec.fillInfo(info)
+	if err != nil && rec.ErrorCode == 0 {
+		rec.Status = http.StatusBadGateway
+	}
+	reqData, _ := json.Marshal(reqmsg.Interface())
+	rec.BytesIn = int64(len(reqData))
+	var resData []byte
+	if resmsg != nil {
+		resData, _ = json.Marshal(resmsg.Interface())
+		rec.BytesOut = int64(len(resData))
+	}
+	if logger.Captures(acc.Name) {
+		rec.RequestBody = logger.truncateBody(reqData)
+		rec.ResponseBody = logger.truncateBody(resData)
+	}
+	logger.Log(rec)
+}
+
+// the path after the chain part, e.g. /blocks/latest of
+// /rest/acc/cosmos/mainnet/blocks/latest
+func accountPath(path string) string {
+	if matches := accRegex.FindStringSubmatch(path); len(matches) > 0 {
+		return path[len(matches[0]):]
+	}
+	return ""
+}
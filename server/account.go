@@ -12,7 +12,7 @@ type accountKeyType int
 var accountKey accountKeyType
 
 var (
-	accRegex = regexp.MustCompile(`^/(jsonrpc\-ws|jsonrpc|rest|graphql)/([^/]+)/([^/]+)/([^/]+)`)
+	accRegex = regexp.MustCompile(`^/(jsonrpc\-ws|jsonrpc|rest|graphql|grpc)/([^/]+)/([^/]+)/([^/]+)`)
 )
 
 type Acc struct {
@@ -28,6 +28,47 @@ func NewAccFromConfig(name string, cfg AccountConfig) *Acc {
 	}
 }
 
+// Build the request info passed to delegators
+func (acc Acc) RequestInfo() *nodemuxcore.RequestInfo {
+	return &nodemuxcore.RequestInfo{
+		Account:           acc.Name,
+		MaxLogsRange:      acc.Config.MaxLogsRange,
+		DenyWalletMethods: acc.Config.DenyWalletMethods,
+		Hooks:             acc.Config.Hooks,
+		Verify:            acc.Config.Verify,
+	}
+}
+
+// the verify mode asked by the header, which is honored only for
+// accounts allowing it up to max_verify endpoints
+func (acc Acc) verifyHeader(r *http.Request) (*nodemuxcore.VerifyConfig, bool) {
+	if acc.Config.MaxVerify <= 0 {
+		return nil, false
+	}
+	if v := r.Header.Get(nodemuxcore.VerifyHeader); v != "" {
+		if vcfg, ok := nodemuxcore.ParseVerifyConfig(v); ok && vcfg.Endpoints <= acc.Config.MaxVerify {
+			return vcfg, true
+		}
+	}
+	return nil, false
+}
+
+// turn on the verify mode if the client asks by the header
+func (acc Acc) applyVerifyHeader(info *nodemuxcore.RequestInfo, r *http.Request) {
+	if vcfg, ok := acc.verifyHeader(r); ok {
+		info.Verify = vcfg
+	}
+}
+
+// the count of requests charged against the ratelimit, a request
+// verified by the header is sent to as many endpoints
+func (acc Acc) requestCost(r *http.Request) int {
+	if vcfg, ok := acc.verifyHeader(r); ok {
+		return vcfg.Endpoints
+	}
+	return 1
+}
+
 func AccFromContext(ctx context.Context) *Acc {
 	if v := ctx.Value(accountKey); v != nil {
 		if acc, ok := v.(*Acc); ok {
@@ -50,6 +91,10 @@ func AccFromContext(ctx context.Context) *Acc {
 type AccHandler struct {
 	rootCtx context.Context
 	next    http.Handler
+
+	// the fixed account of an entrypoint, nil means the account is
+	// parsed from the url
+	acc *Acc
 }
 
 func NewAccHandler(rootCtx context.Context, next http.Handler) *AccHandler {
@@ -60,6 +105,10 @@ func NewAccHandler(rootCtx context.Context, next http.Handler) *AccHandler {
 }
 
 func (h *AccHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.acc != nil {
+		h.serveAcc(w, r, h.acc)
+		return
+	}
 	matches := accRegex.FindStringSubmatch(r.URL.Path)
 	if len(matches) < 5 {
 		w.WriteHeader(404)
@@ -76,10 +125,17 @@ func (h *AccHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Namespace: namespace,
 			Network:   network,
 		}
-		ctx := context.WithValue(r.Context(), accountKey, acc)
-		h.next.ServeHTTP(w, r.WithContext(ctx))
+		h.serveAcc(w, r, acc)
 		return
 	}
 	w.WriteHeader(404)
 	w.Write([]byte("not found"))
 }
+
+func (h *AccHandler) serveAcc(w http.ResponseWriter, r *http.Request, acc *Acc) {
+	nodemuxcore.SetSpanAttributes(r.Context(),
+		nodemuxcore.AttrAccount.String(acc.Name),
+		nodemuxcore.AttrChain.String(acc.Chain.String()))
+	ctx := context.WithValue(r.Context(), accountKey, acc)
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/nodemux/core"
@@ -57,5 +58,19 @@ func NewAdminHandler() *jsoffnet.Http1Handler {
 		return resInfos, nil
 	})
 
+	actor.OnTyped("nodemux_txStatus", func(chainRepr string, txid string) (*nodemuxcore.TrackedTx, error) {
+		m := nodemuxcore.GetMultiplexer()
+
+		chain, err := nodemuxcore.ParseChain(chainRepr)
+		if err != nil {
+			return nil, err
+		}
+		tx, ok := m.TrackedTx(chain, txid)
+		if !ok {
+			return nil, errors.Errorf("tx %s not tracked", txid)
+		}
+		return &tx, nil
+	})
+
 	return jsoffnet.NewHttp1Handler(actor)
 }
@@ -166,6 +166,12 @@ func CommandStartServer() {
 	rootCtx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	shutdownTracing, err := nodemuxcore.SetupTracing(rootCtx, serverCfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+	defer shutdownTracing(context.Background())
+
 	nosync := *pNoSyncEndpoints
 	b.StartSync(rootCtx, !nosync)
 
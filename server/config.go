@@ -10,6 +10,7 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/nodemux/core"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -22,6 +23,11 @@ type MetricsConfig struct {
 	Bind string
 	Auth *jsoffnet.AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
 	TLS  *jsoffnet.TLSConfig  `yaml:"tls:omitempty" json:"tls:omitempty"`
+
+	// the methods used as metrics labels, other methods are labeled
+	// as other. If empty the first max_methods methods are used
+	Methods    []string `yaml:"methods,omitempty" json:"methods,omitempty"`
+	MaxMethods int      `yaml:"max_methods,omitempty" json:"max_methods,omitempty"`
 }
 
 type AdminConfig struct {
@@ -32,8 +38,11 @@ type EntrypointConfig struct {
 	Account string
 	Chain   string
 	Bind    string
-	Auth    *jsoffnet.AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
-	TLS     *jsoffnet.TLSConfig  `yaml:"tls,omitempty" json:"tls,omitempty"`
+	// electrum listens for electrum wallets, the http api kinds
+	// of the chain are served if empty
+	Api  string               `yaml:"api,omitempty" json:"api,omitempty"`
+	Auth *jsoffnet.AuthConfig `yaml:"auth,omitempty" json:"auth,omitempty"`
+	TLS  *jsoffnet.TLSConfig  `yaml:"tls,omitempty" json:"tls,omitempty"`
 }
 
 type RatelimitConfig struct {
@@ -46,6 +55,30 @@ type RatelimitConfig struct {
 type AccountConfig struct {
 	Username  string          `yaml:"username" json:"username"`
 	Ratelimit RatelimitConfig `yaml:"ratelimit,omitempty" json:"ratelimit,omitempty"`
+
+	// the max block range of a log query such as eth_getLogs, 0
+	// means unlimited
+	MaxLogsRange int `yaml:"max_logs_range,omitempty" json:"max_logs_range,omitempty"`
+
+	// deny the wallet methods of node wallets, such as
+	// sendtoaddress of bitcoind
+	DenyWalletMethods bool `yaml:"deny_wallet_methods,omitempty" json:"deny_wallet_methods,omitempty"`
+
+	// hooks of the JSON-RPC requests of the account
+	Hooks []nodemuxcore.HookConfig `yaml:"hooks,omitempty" json:"hooks,omitempty"`
+
+	// verify reads against several endpoints
+	Verify *nodemuxcore.VerifyConfig `yaml:"verify,omitempty" json:"verify,omitempty"`
+
+	// the max endpoints clients may turn the verify mode on by the
+	// X-Nodemux-Verify header, each verified request is charged as
+	// many requests against the ratelimit, 0 means the header is
+	// ignored
+	MaxVerify int `yaml:"max_verify,omitempty" json:"max_verify,omitempty"`
+
+	// honor the sessions named by HTTP clients by the X-Nodemux-Session
+	// header or cookie, websocket connections are always sessions
+	Sessions bool `yaml:"sessions,omitempty" json:"sessions,omitempty"`
 }
 
 type ServerConfig struct {
@@ -57,6 +90,10 @@ type ServerConfig struct {
 	Entrypoints []EntrypointConfig       `yaml:"entrypoints,omitempty" json:"entrypoints,omitempty"`
 	Ratelimit   RatelimitConfig          `yaml:"ratelimit,omitempty" json:"ratelimit,omitempty"`
 	Accounts    map[string]AccountConfig `yaml:"accounts,omitempty" json:"accounts,omitempty"`
+
+	Tracing   *nodemuxcore.TracingConfig `yaml:"tracing,omitempty" json:"tracing,omitempty"`
+	AccessLog *AccessLogConfig           `yaml:"access_log,omitempty" json:"access_log,omitempty"`
+	Health    HealthConfig               `yaml:"health,omitempty" json:"health,omitempty"`
 }
 
 func NewServerConfig() *ServerConfig {
@@ -151,6 +188,18 @@ func (cfg *ServerConfig) validateValues() error {
 		}
 	}
 
+	if err := cfg.Tracing.ValidateValues(); err != nil {
+		return err
+	}
+
+	if err := cfg.AccessLog.validateValues(); err != nil {
+		return err
+	}
+
+	if err := cfg.Health.validateValues(); err != nil {
+		return err
+	}
+
 	for account, acccfg := range cfg.Accounts {
 		if strings.Contains(account, "/") || strings.Contains(account, " ") {
 			return fmt.Errorf("invalid account name '%s'", account)
@@ -163,6 +212,24 @@ func (cfg *ServerConfig) validateValues() error {
 			return fmt.Errorf("acc user ratelimit < 0, '%s'", account)
 		}
 
+		if acccfg.MaxLogsRange < 0 {
+			return fmt.Errorf("acc max logs range < 0, '%s'", account)
+		}
+
+		if acccfg.Verify != nil {
+			if acccfg.Verify.Endpoints < 2 {
+				return fmt.Errorf("acc verify endpoints < 2, '%s'", account)
+			}
+			if acccfg.Verify.Quorum < 0 || acccfg.Verify.Quorum > acccfg.Verify.Endpoints {
+				return fmt.Errorf("acc verify quorum out of range, '%s'", account)
+			}
+		}
+
+		for i := range acccfg.Hooks {
+			if err := acccfg.Hooks[i].Compile(); err != nil {
+				return errors.Wrapf(err, "acc '%s' hook %d", account, i)
+			}
+		}
 	}
 
 	for _, entrycfg := range cfg.Entrypoints {
@@ -191,6 +258,9 @@ func (cfg *EntrypointConfig) validateValues() error {
 	if cfg.Bind == "" {
 		return errors.New("entrypoint, bind address cannot be empty")
 	}
+	if cfg.Api != "" && cfg.Api != nodemuxcore.ApiName(nodemuxcore.ApiElectrum) {
+		return errors.Errorf("entrypoint, unsupported api %s", cfg.Api)
+	}
 	if cfg.TLS != nil {
 		err := cfg.TLS.ValidateValues()
 		if err != nil {
@@ -211,6 +281,10 @@ func (cfg *MetricsConfig) validateValues() error {
 		return nil
 	}
 
+	if cfg.MaxMethods < 0 {
+		return errors.New("metrics, max methods < 0")
+	}
+
 	if cfg.TLS != nil {
 		err := cfg.TLS.ValidateValues()
 		if err != nil {
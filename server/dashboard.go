@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/superisaac/nodemux/core"
+	"github.com/superisaac/nodemux/ratelimit"
+)
+
+//go:embed dashboard.html
+var dashboardPage []byte
+
+const (
+	dashboardPrefix = "/nodemux/dashboard"
+
+	// the max time of writing an event to a dashboard client
+	sseWriteTimeout = 10 * time.Second
+)
+
+type accountUsage struct {
+	Account string `json:"account"`
+	Used    int64  `json:"used"`
+	Limit   int    `json:"limit"`
+}
+
+// The embedded web dashboard, it is served behind the admin auth
+type DashboardHandler struct {
+	rootCtx context.Context
+}
+
+func NewDashboardHandler(rootCtx context.Context) *DashboardHandler {
+	return &DashboardHandler{rootCtx: rootCtx}
+}
+
+func (h *DashboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch strings.TrimPrefix(r.URL.Path, dashboardPrefix) {
+	case "", "/":
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardPage)
+	case "/api/chains":
+		writeJSON(w, nodemuxcore.GetMultiplexer().ChainSummaries())
+	case "/api/errors":
+		writeJSON(w, nodemuxcore.RecentErrors())
+	case "/api/accounts":
+		writeJSON(w, h.accountUsages(r.Context()))
+	case "/events":
+		h.serveEvents(w, r)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not found"))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// the usages of accounts in the current ratelimit span
+func (h *DashboardHandler) accountUsages(ctx context.Context) []accountUsage {
+	serverCfg := ServerConfigFromContext(h.rootCtx)
+	values := make(map[string]int64)
+	if c, ok := nodemuxcore.GetMultiplexer().RedisClient("ratelimit"); ok {
+		if v, err := ratelimit.Values(ctx, c); err == nil {
+			values = v
+		}
+	}
+
+	usages := make([]accountUsage, 0, len(serverCfg.Accounts))
+	for name, acccfg := range serverCfg.Accounts {
+		// the ratelimit field is the username if set
+		field := acccfg.Username
+		if field == "" {
+			field = name
+		}
+		usages = append(usages, accountUsage{
+			Account: name,
+			Used:    values[field],
+			Limit:   acccfg.Ratelimit.UserLimit(),
+		})
+	}
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Account < usages[j].Account
+	})
+	return usages
+}
+
+// Stream chain status updates from the chainhub as server sent events
+func (h *DashboardHandler) serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("streaming unsupported"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// the chainhub blocks on sending to subscribers, so its channel
+	// is drained by a goroutine which drops updates when the client
+	// falls behind
+	hub := nodemuxcore.GetMultiplexer().Chainhub()
+	hubCh := make(chan nodemuxcore.ChainStatus, 100)
+	hub.Sub(hubCh)
+	defer unsubChainhub(hub, hubCh)
+
+	ch := make(chan nodemuxcore.ChainStatus, 100)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case cs := <-hubCh:
+				select {
+				case ch <- cs:
+				default:
+				}
+			}
+		}
+	}()
+
+	// a stalled client is dropped instead of blocking
+	rc := http.NewResponseController(w)
+	write := func(format string, args ...interface{}) error {
+		rc.SetWriteDeadline(time.Now().Add(sseWriteTimeout))
+		if _, err := fmt.Fprintf(w, format, args...); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.rootCtx.Done():
+			return
+		case <-keepalive.C:
+			if err := write(": keepalive\n\n"); err != nil {
+				return
+			}
+		case cs := <-ch:
+			data, err := json.Marshal(map[string]interface{}{
+				"chain":    cs.Chain.String(),
+				"endpoint": cs.EndpointName,
+				"healthy":  cs.Healthy,
+				"head":     cs.Blockhead,
+			})
+			if err != nil {
+				continue
+			}
+			if err := write("event: head\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Unsubscribe the channel, the channel is drained for a while as the
+// chainhub may be blocked on sending to it before the unsub is handled
+func unsubChainhub(hub nodemuxcore.Chainhub, ch chan nodemuxcore.ChainStatus) {
+	hub.Unsub(ch)
+	go func() {
+		for {
+			select {
+			case <-ch:
+			case <-time.After(time.Second):
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,289 @@
+package server
+
+// Electrum protocol front-end, electrum wallets connect over TCP or
+// TLS and send newline delimited JSON-RPC messages, requests are
+// delegated to electrum endpoints while subscriptions of a client
+// connection are pinned to one upstream connection
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+	"github.com/superisaac/jsoff"
+	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/nodemux/core"
+)
+
+// the max requests of a session handled concurrently, reading of the
+// session waits until one of them is done
+const electrumSessionInflight = 32
+
+var (
+	errElectrumRatelimit = &jsoff.RPCError{Code: 429, Message: "rate limit exceeded!"}
+	errElectrumInternal  = &jsoff.RPCError{Code: -32603, Message: "server error"}
+)
+
+// the methods whose notifications follow the responses
+func isElectrumSubscription(method string) bool {
+	return strings.HasPrefix(method, "blockchain.") &&
+		(strings.HasSuffix(method, ".subscribe") || strings.HasSuffix(method, ".unsubscribe"))
+}
+
+type electrumSession struct {
+	rootCtx   context.Context
+	acc       *Acc
+	conn      net.Conn
+	sessionId string
+
+	writeLock sync.Mutex
+
+	// the semaphore of concurrent requests
+	inflight chan struct{}
+
+	// the upstream connection of subscriptions
+	subLock sync.Mutex
+	sub     *nodemuxcore.ElectrumClient
+}
+
+func startElectrumServer(rootCtx context.Context, acc *Acc, bind string, tlsConfigs ...*jsoffnet.TLSConfig) error {
+	listener, err := net.Listen("tcp", bind)
+	if err != nil {
+		return errors.Wrap(err, "net.Listen")
+	}
+	for _, tlsCfg := range tlsConfigs {
+		if tlsCfg == nil {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(tlsCfg.Certfile, tlsCfg.Keyfile)
+		if err != nil {
+			listener.Close()
+			return errors.Wrap(err, "tls.LoadX509KeyPair")
+		}
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{cert},
+		})
+		break
+	}
+
+	go func() {
+		<-rootCtx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if rootCtx.Err() != nil {
+				return nil
+			}
+			return errors.Wrap(err, "accept")
+		}
+		s := &electrumSession{
+			rootCtx:   rootCtx,
+			acc:       acc,
+			conn:      conn,
+			sessionId: newRequestId(),
+			inflight:  make(chan struct{}, electrumSessionInflight),
+		}
+		go s.serve()
+	}
+}
+
+func (s *electrumSession) log() *log.Entry {
+	return s.acc.Chain.Log().WithFields(log.Fields{
+		"session":    s.sessionId,
+		"remoteAddr": s.conn.RemoteAddr().String(),
+		"account":    s.acc.Name,
+	})
+}
+
+func (s *electrumSession) serve() {
+	ctx, cancel := context.WithCancel(s.rootCtx)
+	defer cancel()
+	defer s.close()
+	go func() {
+		<-ctx.Done()
+		s.conn.Close()
+	}()
+
+	metricsElectrumSessions.Inc()
+	defer metricsElectrumSessions.Dec()
+	s.log().Info("electrum session started")
+
+	// the session is closed on a line longer than the max size
+	scanner := nodemuxcore.NewElectrumScanner(s.conn)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		// the buffer of the scanner is reused by the next line
+		line = bytes.Clone(line)
+		// requests are handled concurrently, responses are
+		// matched by ids at the client side
+		select {
+		case s.inflight <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		go func() {
+			defer func() { <-s.inflight }()
+			s.handleLine(ctx, line)
+		}()
+	}
+	err := scanner.Err()
+	if err == nil {
+		err = io.EOF
+	}
+	s.log().Infof("electrum session closed, %s", err)
+}
+
+func (s *electrumSession) close() {
+	s.subLock.Lock()
+	defer s.subLock.Unlock()
+	if s.sub != nil {
+		s.sub.Close()
+		s.sub = nil
+	}
+}
+
+func (s *electrumSession) write(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		s.log().Warnf("json marshal error %s", err)
+		return
+	}
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	if _, err := s.conn.Write(append(data, '\n')); err != nil {
+		s.log().Warnf("write error %s", err)
+		s.conn.Close()
+	}
+}
+
+// a line is either a message or a batch of messages
+func (s *electrumSession) handleLine(ctx context.Context, line []byte) {
+	if line[0] != '[' {
+		if resmsg := s.handleMessage(ctx, line); resmsg != nil {
+			s.write(resmsg.Interface())
+		}
+		return
+	}
+
+	var batch []json.RawMessage
+	if err := json.Unmarshal(line, &batch); err != nil {
+		s.write(map[string]any{
+			"jsonrpc": "2.0",
+			"id":      nil,
+			"error":   map[string]any{"code": -32700, "message": "parse error"},
+		})
+		return
+	}
+	results := make([]any, 0, len(batch))
+	for _, data := range batch {
+		if resmsg := s.handleMessage(ctx, data); resmsg != nil {
+			results = append(results, resmsg.Interface())
+		}
+	}
+	if len(results) > 0 {
+		s.write(results)
+	}
+}
+
+func (s *electrumSession) handleMessage(ctx context.Context, data []byte) jsoff.Message {
+	msg, err := jsoff.ParseBytes(data)
+	if err != nil || !msg.IsRequest() {
+		// notifications from clients are ignored
+		return nil
+	}
+	reqmsg, _ := msg.(*jsoff.RequestMessage)
+
+	accName := s.acc.Config.Username
+	if accName == "" {
+		accName = s.acc.Name
+	}
+	ok, err := checkRatelimitOf(ctx, s.conn.RemoteAddr().String(), accName, s.acc.Config.Ratelimit, true, 1)
+	if err != nil {
+		s.log().Errorf("error while checking ratelimit %s", err)
+		return errElectrumInternal.ToMessage(reqmsg)
+	} else if !ok {
+		return errElectrumRatelimit.ToMessage(reqmsg)
+	}
+
+	// each message is a request of its own
+	info := s.acc.RequestInfo()
+	info.RequestId = newRequestId()
+	info.SessionId = s.sessionId
+	info.AddMethod(reqmsg.Method)
+	ctx = info.AddTo(ctx)
+	ctx, span := s.acc.startDelegateSpan(ctx, reqmsg.Method)
+	defer span.End()
+
+	start := time.Now()
+	var resmsg jsoff.Message
+	if isElectrumSubscription(reqmsg.Method) {
+		resmsg, err = s.subscribe(ctx, reqmsg)
+	} else {
+		delegator := nodemuxcore.GetDelegatorFactory().GetElectrumDelegator(s.acc.Chain.Namespace)
+		resmsg, err = delegator.DelegateElectrum(ctx, nodemuxcore.GetMultiplexer(), s.acc.Chain, reqmsg)
+	}
+	s.acc.observeRPC(ctx, reqmsg.Method, start, resmsg, err)
+	s.acc.Chain.Log().WithFields(nodemuxcore.RequestLogFields(ctx, log.Fields{
+		"method":      reqmsg.Method,
+		"timeSpentMS": time.Since(start).Milliseconds(),
+		"account":     s.acc.Name,
+	})).Info("delegate electrum")
+	s.acc.logStreamMessage(s.rootCtx, "electrum", info, start, reqmsg, resmsg, err)
+	if err != nil {
+		return errElectrumInternal.ToMessage(reqmsg)
+	}
+	return resmsg
+}
+
+// Relay subscriptions over the upstream connection of the session,
+// notifications are forwarded back to the client. The client
+// connection is closed if the upstream connection breaks so that the
+// client reconnects and subscribes again
+func (s *electrumSession) subscribe(ctx context.Context, reqmsg *jsoff.RequestMessage) (jsoff.Message, error) {
+	s.subLock.Lock()
+	if err := ctx.Err(); err != nil {
+		// the session is closed
+		s.subLock.Unlock()
+		return nil, err
+	}
+	if s.sub == nil {
+		m := nodemuxcore.GetMultiplexer()
+		ep, found := m.SelectApiOverHeight(ctx, s.acc.Chain, nodemuxcore.ApiElectrum, reqmsg.Method, -1)
+		if !found {
+			s.subLock.Unlock()
+			return nodemuxcore.ErrNotAvailable.ToMessage(reqmsg), nil
+		}
+		sub, err := ep.DialElectrum(s.rootCtx)
+		if err != nil {
+			s.subLock.Unlock()
+			return nil, err
+		}
+		sub.OnNotify(func(ntfmsg *jsoff.NotifyMessage) {
+			s.write(ntfmsg.Interface())
+		})
+		go func() {
+			<-sub.Done()
+			s.conn.Close()
+		}()
+		s.log().WithFields(log.Fields{"through": ep.Name}).Info("pair electrum session")
+		s.sub = sub
+	}
+	sub := s.sub
+	s.subLock.Unlock()
+	return sub.Call(ctx, reqmsg)
+}
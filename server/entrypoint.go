@@ -5,8 +5,86 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
+	"strings"
 )
 
+func newApiRelayer(rootCtx context.Context, acc *Acc, api int) http.Handler {
+	switch api {
+	case nodemuxcore.ApiJSONRPC:
+		rpc1 := NewJSONRPCRelayer(rootCtx)
+		rpc1.acc = acc
+		return rpc1
+	case nodemuxcore.ApiJSONRPCWS:
+		rpc1 := NewJSONRPCWSRelayer(rootCtx)
+		rpc1.acc = acc
+		return rpc1
+	case nodemuxcore.ApiREST:
+		rest1 := NewRESTRelayer(rootCtx)
+		rest1.acc = acc
+		return rest1
+	case nodemuxcore.ApiGRPC:
+		grpc1 := NewGRPCRelayer(rootCtx)
+		grpc1.acc = acc
+		return grpc1
+	default:
+		graph1 := NewGraphQLRelayer(rootCtx)
+		graph1.acc = acc
+		return graph1
+	}
+}
+
+// Serve all api kinds of a chain on one bind, the primary api is
+// served at /, gRPC requests are told by the content type and
+// websocket requests by the upgrade header, other apis are served
+// under /jsonrpc, /rest and /graphql
+type EntrypointHandler struct {
+	primary  http.Handler
+	ws       http.Handler
+	grpc     http.Handler
+	prefixed map[string]http.Handler
+}
+
+func NewEntrypointHandler(rootCtx context.Context, acc *Acc, apis []int) *EntrypointHandler {
+	h := &EntrypointHandler{
+		prefixed: make(map[string]http.Handler),
+	}
+	for i, api := range apis {
+		relayer := newApiRelayer(rootCtx, acc, api)
+		if i == 0 {
+			h.primary = relayer
+		}
+		switch api {
+		case nodemuxcore.ApiJSONRPC:
+			h.ws = newApiRelayer(rootCtx, acc, nodemuxcore.ApiJSONRPCWS)
+		case nodemuxcore.ApiGRPC:
+			h.grpc = relayer
+		}
+		if i > 0 && api != nodemuxcore.ApiGRPC {
+			prefix := "/" + nodemuxcore.ApiName(api)
+			h.prefixed[prefix] = http.StripPrefix(prefix, relayer)
+		}
+	}
+	return h
+}
+
+func (h *EntrypointHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.ws != nil && strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		h.ws.ServeHTTP(w, r)
+		return
+	}
+	if h.grpc != nil && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		h.grpc.ServeHTTP(w, r)
+		return
+	}
+	for prefix, relayer := range h.prefixed {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			relayer.ServeHTTP(w, r)
+			return
+		}
+	}
+	h.primary.ServeHTTP(w, r)
+}
+
 func startEntrypointServer(rootCtx context.Context, entryCfg EntrypointConfig, serverCfg *ServerConfig) {
 	acccfg, ok := serverCfg.Accounts[entryCfg.Account]
 	if !ok {
@@ -17,35 +95,43 @@ func startEntrypointServer(rootCtx context.Context, entryCfg EntrypointConfig, s
 	acc := NewAccFromConfig(entryCfg.Account, acccfg)
 	acc.Chain = nodemuxcore.MustParseChain(entryCfg.Chain)
 
-	support, rpcType := nodemuxcore.GetDelegatorFactory().SupportChain(acc.Chain.Namespace)
-	if !support {
-		log.Warnf("entry point for chain %s not supported", acc.Chain)
+	// electrum is served on its own bind as electrum wallets
+	// connect over TCP or TLS, the other api kinds share http
+	apis := make([]int, 0)
+	hasElectrum := false
+	for _, api := range nodemuxcore.GetDelegatorFactory().SupportedApis(acc.Chain.Namespace) {
+		if api == nodemuxcore.ApiElectrum {
+			hasElectrum = true
+		} else {
+			apis = append(apis, api)
+		}
+	}
+	if entryCfg.Api == nodemuxcore.ApiName(nodemuxcore.ApiElectrum) || (len(apis) == 0 && hasElectrum) {
+		if !hasElectrum {
+			log.Warnf("electrum entry point for chain %s not supported", acc.Chain)
+			return
+		}
+		// http auth doesn't apply to electrum
+		log.Infof("electrum server %s listens at %s", acc.Chain, entryCfg.Bind)
+		err := startElectrumServer(rootCtx, acc, entryCfg.Bind, entryCfg.TLS, serverCfg.TLS)
+		if err != nil {
+			log.Println("electrum server error ---", err)
+		}
 		return
 	}
-	var handler http.Handler
-	if rpcType == nodemuxcore.ApiJSONRPC {
-		rpc1 := NewJSONRPCRelayer(rootCtx)
-		rpc1.acc = acc
-		handler = rpc1
-	} else if rpcType == nodemuxcore.ApiJSONRPCWS {
-		rpc1 := NewJSONRPCWSRelayer(rootCtx)
-		rpc1.acc = acc
-		handler = rpc1
-	} else if rpcType == nodemuxcore.ApiREST {
-		rest1 := NewRESTRelayer(rootCtx)
-		rest1.acc = acc
-		handler = rest1
-	} else {
-		graph1 := NewGraphQLRelayer(rootCtx)
-		graph1.acc = acc
-		handler = graph1
+	if len(apis) == 0 {
+		log.Warnf("entry point for chain %s not supported", acc.Chain)
+		return
 	}
+
+	handler := NewEntrypointHandler(rootCtx, acc, apis)
 	log.Infof("entrypoint server %s listens at %s", acc.Chain, entryCfg.Bind)
 
 	err := startServer(rootCtx, entryCfg.Bind,
-		relayHandler(
+		entrypointRelayHandler(
 			rootCtx,
 			serverCfg.Auth,
+			acc,
 			handler),
 		entryCfg.TLS, serverCfg.TLS)
 	if err != nil {
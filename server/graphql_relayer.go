@@ -41,7 +41,11 @@ func (h *GraphQLRelayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err := delegator.DelegateGraphQL(h.rootCtx, m, acc.Chain, path, w, r)
+	ctx := m.AffinityContext(acc.delegateContext(h.rootCtx, r, path), acc.Chain, acc.Name, r, nil)
+	ctx, span := acc.startDelegateSpan(ctx, path)
+	defer span.End()
+
+	err := delegator.DelegateGraphQL(ctx, m, acc.Chain, path, w, r)
 	if err != nil {
 		requestLog(r).Warnf("error delegate graphql %s", err)
 		w.WriteHeader(500)
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/superisaac/nodemux/core"
+)
+
+// gRPC and gRPC-Web Handler, the gRPC method path follows the chain
+// part, e.g. /grpc/acc/cosmos/mainnet/cosmos.bank.v1beta1.Query/Balance
+type GRPCRelayer struct {
+	rootCtx context.Context
+	regex   *regexp.Regexp
+	acc     *Acc
+}
+
+func NewGRPCRelayer(rootCtx context.Context) *GRPCRelayer {
+	return &GRPCRelayer{
+		rootCtx: rootCtx,
+		regex:   regexp.MustCompile(`^/grpc/([^/]+/[^/]+/[^/]+)(/.+)$`),
+	}
+}
+
+// write an UNAVAILABLE status as a gRPC response
+func writeGRPCUnavailable(w http.ResponseWriter, r *http.Request, message string) {
+	contentType := "application/grpc"
+	if nodemuxcore.IsGRPCWeb(r) {
+		contentType = r.Header.Get("Content-Type")
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Grpc-Status", "14")
+	w.Header().Set("Grpc-Message", message)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *GRPCRelayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	acc := h.acc
+	method := r.URL.Path
+	if acc == nil {
+		acc = AccFromContext(r.Context())
+		if acc == nil {
+			w.WriteHeader(404)
+			w.Write([]byte("acc not found"))
+			return
+		}
+
+		matches := h.regex.FindStringSubmatch(r.URL.Path)
+		if len(matches) < 3 {
+			requestLog(r).Warnf("http url pattern failed")
+			w.WriteHeader(404)
+			w.Write([]byte("not found"))
+			return
+		}
+		method = matches[2]
+	}
+
+	m := nodemuxcore.GetMultiplexer()
+
+	delegator := nodemuxcore.GetDelegatorFactory().GetGRPCDelegator(acc.Chain.Namespace)
+	if delegator == nil {
+		w.WriteHeader(404)
+		w.Write([]byte("backend not found"))
+		return
+	}
+
+	ctx := m.AffinityContext(acc.delegateContext(h.rootCtx, r, method), acc.Chain, acc.Name, r, nil)
+	ctx, span := acc.startDelegateSpan(ctx, method)
+	defer span.End()
+
+	err := delegator.DelegateGRPC(ctx, m, acc.Chain, method, w, r)
+	if err != nil {
+		requestLog(r).Warnf("error delegate grpc %s", err)
+		writeGRPCUnavailable(w, r, "upstream unavailable")
+	}
+} // GRPCRelayer.ServeHTTP
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/nodemux/core"
+)
+
+// the readiness condition, every chain must have at least min_healthy
+// healthy endpoints which lag behind the tip no more than max_lag blocks
+type HealthConfig struct {
+	MinHealthy int `yaml:"min_healthy,omitempty" json:"min_healthy,omitempty"`
+	MaxLag     int `yaml:"max_lag,omitempty" json:"max_lag,omitempty"`
+
+	// the chains checked, all chains with endpoints are checked if empty
+	Chains []string `yaml:"chains,omitempty" json:"chains,omitempty"`
+}
+
+func (cfg *HealthConfig) validateValues() error {
+	if cfg.MinHealthy <= 0 {
+		cfg.MinHealthy = 1
+	}
+	if cfg.MaxLag < 0 {
+		return errors.New("health max_lag < 0")
+	}
+	for _, chainRepr := range cfg.Chains {
+		if _, err := nodemuxcore.ParseChain(chainRepr); err != nil {
+			return errors.Wrapf(err, "health chain %s", chainRepr)
+		}
+	}
+	return nil
+}
+
+// Check the readiness, the reasons of chains not ready are returned
+func (cfg HealthConfig) notReadyReasons(m *nodemuxcore.Multiplexer) []string {
+	var summaries []nodemuxcore.ChainSummary
+	reasons := make([]string, 0)
+	if len(cfg.Chains) > 0 {
+		for _, chainRepr := range cfg.Chains {
+			chain, _ := nodemuxcore.ParseChain(chainRepr)
+			summary, ok := m.ChainSummary(chain)
+			if !ok {
+				reasons = append(reasons, fmt.Sprintf("%s has no endpoints", chainRepr))
+				continue
+			}
+			summaries = append(summaries, summary)
+		}
+	} else {
+		summaries = m.ChainSummaries()
+	}
+
+	minHealthy := cfg.MinHealthy
+	if minHealthy <= 0 {
+		minHealthy = 1
+	}
+	for _, summary := range summaries {
+		if cnt := summary.UsableCount(cfg.MaxLag); cnt < minHealthy {
+			reasons = append(reasons, fmt.Sprintf(
+				"%s has %d healthy endpoints, %d required",
+				summary.Chain, cnt, minHealthy))
+		}
+	}
+	return reasons
+}
+
+// Liveness, the process is alive as long as it responds
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("ok"))
+}
+
+type ReadyzHandler struct {
+	cfg HealthConfig
+}
+
+func NewReadyzHandler(cfg HealthConfig) *ReadyzHandler {
+	return &ReadyzHandler{cfg: cfg}
+}
+
+func (h *ReadyzHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reasons := h.cfg.notReadyReasons(nodemuxcore.GetMultiplexer())
+	w.Header().Set("Content-Type", "text/plain")
+	if len(reasons) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(strings.Join(reasons, "\n")))
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head><title>nodemux status</title></head>
+<body>
+{{range .}}
+<h2>{{.Chain}}</h2>
+<p>max tip height {{.MaxTipHeight}}, {{.HealthyCount}} healthy</p>
+<table border="1" cellpadding="4">
+<tr><th>endpoint</th><th>healthy</th><th>height</th><th>lag</th><th>client</th><th>rejected</th></tr>
+{{range .Endpoints}}
+<tr><td>{{.Name}}</td><td>{{.Healthy}}</td><td>{{.Height}}</td><td>{{.Lag}}</td><td>{{.ClientVersion}}</td><td>{{.Rejected}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
+
+// Summarize the chains in JSON, or in HTML if the client asks for it
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	summaries := nodemuxcore.GetMultiplexer().ChainSummaries()
+	if r.URL.Query().Get("format") == "html" || strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := statusTemplate.Execute(w, summaries); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summaries)
+}
@@ -5,6 +5,9 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff/net"
+	"github.com/superisaac/nodemux/core"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 	"net/http"
 )
 
@@ -15,9 +18,11 @@ func requestLog(r *http.Request) *log.Entry {
 }
 
 func startServer(rootCtx context.Context, bind string, handler http.Handler, tlsConfigs ...*jsoffnet.TLSConfig) error {
+	// HTTP/2 is negotiated over TLS, h2c serves gRPC clients over
+	// plain TCP
 	return jsoffnet.ListenAndServe(
 		rootCtx, bind,
-		handler,
+		h2c.NewHandler(handler, &http2.Server{}),
 		tlsConfigs...)
 }
 
@@ -46,10 +51,24 @@ func adminHandler(_ context.Context, authCfg *jsoffnet.AuthConfig, next http.Han
 }
 
 func relayHandler(rootCtx context.Context, authCfg *jsoffnet.AuthConfig, next http.Handler) http.Handler {
+	return wrapRelayHandler(rootCtx, authCfg, nil, next)
+}
+
+// the relay handler of an entrypoint, whose account is fixed
+func entrypointRelayHandler(rootCtx context.Context, authCfg *jsoffnet.AuthConfig, acc *Acc, next http.Handler) http.Handler {
+	return wrapRelayHandler(rootCtx, authCfg, acc, next)
+}
+
+func wrapRelayHandler(rootCtx context.Context, authCfg *jsoffnet.AuthConfig, acc *Acc, next http.Handler) http.Handler {
 	h0 := NewRatelimitHandler(rootCtx, next)
-	h1 := NewAccHandler(rootCtx, h0)
+	hm := NewMetricsHandler(h0)
+	ha := NewAccessLogHandler(rootCtx, hm)
+	hr := NewRequestIdHandler(ha)
+	h1 := NewAccHandler(rootCtx, hr)
+	h1.acc = acc
 	h2 := jsoffnet.NewAuthHandler(authCfg, h1)
-	return h2
+	h3 := NewTraceHandler(h2)
+	return h3
 }
 
 func StartHTTPServer(rootCtx context.Context, serverCfg *ServerConfig) {
@@ -64,19 +83,37 @@ func StartHTTPServer(rootCtx context.Context, serverCfg *ServerConfig) {
 		adminAuth = serverCfg.Admin.Auth
 	}
 
+	nodemuxcore.SetMetricsMethods(
+		serverCfg.Metrics.Methods,
+		serverCfg.Metrics.MaxMethods)
+
 	rootCtx = serverCfg.AddTo(rootCtx)
+	if serverCfg.AccessLog != nil {
+		accessLogger := NewAccessLogger(serverCfg.AccessLog)
+		go accessLogger.Run(rootCtx)
+		rootCtx = accessLogger.AddTo(rootCtx)
+	}
 	serverMux := http.NewServeMux()
 	serverMux.Handle("/metrics", adminHandler(
 		rootCtx,
 		serverCfg.Metrics.Auth,
 		promhttp.Handler()))
 
+	// health and status are not authenticated for probes
+	serverMux.HandleFunc("/healthz", healthzHandler)
+	serverMux.Handle("/readyz", NewReadyzHandler(serverCfg.Health))
+	serverMux.HandleFunc("/status", statusHandler)
+
 	if adminAuth != nil && (len(adminAuth.Basic) > 0 || len(adminAuth.Bearer) > 0 || (adminAuth.Jwt != nil && adminAuth.Jwt.Secret != "")) {
 		// admin Auth must be set before the request of /nodemux
 		serverMux.Handle("/nodemux", adminHandler(
 			rootCtx,
 			adminAuth,
 			NewAdminHandler()))
+		serverMux.Handle(dashboardPrefix+"/", adminHandler(
+			rootCtx,
+			adminAuth,
+			NewDashboardHandler(rootCtx)))
 	}
 
 	serverMux.Handle("/jsonrpc/", relayHandler(
@@ -98,6 +135,11 @@ func StartHTTPServer(rootCtx context.Context, serverCfg *ServerConfig) {
 		serverCfg.Auth,
 		NewGraphQLRelayer(rootCtx)))
 
+	serverMux.Handle("/grpc/", relayHandler(
+		rootCtx,
+		serverCfg.Auth,
+		NewGRPCRelayer(rootCtx)))
+
 	for _, entryCfg := range serverCfg.Entrypoints {
 		go startEntrypointServer(rootCtx, entryCfg, serverCfg)
 	}
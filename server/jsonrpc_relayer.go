@@ -63,26 +63,31 @@ func (h *JSONRPCRelayer) delegateRPC(req *jsoffnet.RPCRequest) (interface{}, err
 		}
 	}
 
-	start := time.Now()
+	ctx := m.AffinityContext(acc.delegateContext(h.rootCtx, r, reqmsg.Method), acc.Chain, acc.Name, r, reqmsg)
+	ctx, span := acc.startDelegateSpan(ctx, reqmsg.Method)
+	defer span.End()
+
+	// the endpoint selected by the client still goes through the
+	// hooks and the denial of the delegator
+	epName := ""
 	if ep := m.SelectEndpointFromHttp(acc.Chain, reqmsg.Method, r); ep != nil {
-		resmsg, err := m.CallEndpointRPC(h.rootCtx, ep, reqmsg)
-		acc.Chain.Log().WithFields(log.Fields{
-			"method":      reqmsg.Method,
-			"timeSpentMS": time.Since(start).Milliseconds(),
-			"account":     acc.Name,
-			"through":     ep.Name,
-		}).Info("direct delegate jsonrpc")
-		return resmsg, err
-	} else {
-		resmsg, err := delegator.DelegateRPC(h.rootCtx, m, acc.Chain, reqmsg, r)
-		// metrics the call time
-		acc.Chain.Log().WithFields(log.Fields{
-			"method":      reqmsg.Method,
-			"timeSpentMS": time.Since(start).Milliseconds(),
-			"account":     acc.Name,
-		}).Info("delegate jsonrpc")
-		return resmsg, err
+		epName = ep.Name
+	}
+
+	start := time.Now()
+	resmsg, err := m.DelegateRPCTo(ctx, delegator, acc.Chain, epName, reqmsg, r)
+	acc.observeRPC(ctx, reqmsg.Method, start, resmsg, err)
+	// metrics the call time
+	fields := log.Fields{
+		"method":      reqmsg.Method,
+		"timeSpentMS": time.Since(start).Milliseconds(),
+		"account":     acc.Name,
+	}
+	if epName != "" {
+		fields["through"] = epName
 	}
+	acc.Chain.Log().WithFields(nodemuxcore.RequestLogFields(ctx, fields)).Info("delegate jsonrpc")
+	return resmsg, err
 }
 
 func (h *JSONRPCRelayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
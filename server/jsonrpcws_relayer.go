@@ -3,11 +3,13 @@ package server
 import (
 	"context"
 	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
 	"github.com/superisaac/jsoff"
 	"github.com/superisaac/jsoff/net"
 	"github.com/superisaac/nodemux/core"
 	"net/http"
 	"net/url"
+	"time"
 )
 
 var (
@@ -34,8 +36,10 @@ func NewJSONRPCWSRelayer(rootCtx context.Context) *JSONRPCWSRelayer {
 		r := req.HttpRequest()
 		acc := AccFromContext(r.Context())
 		accName := ""
+		cost := 1
 		var ratelimit RatelimitConfig
 		if acc != nil {
+			cost = acc.requestCost(r)
 			accName = acc.Config.Username
 			if accName == "" {
 				accName = acc.Name
@@ -45,7 +49,7 @@ func NewJSONRPCWSRelayer(rootCtx context.Context) *JSONRPCWSRelayer {
 			serverCfg := ServerConfigFromContext(rootCtx)
 			ratelimit = serverCfg.Ratelimit
 		}
-		ok, err := checkRatelimit(r, accName, ratelimit, true)
+		ok, err := checkRatelimit(r, accName, ratelimit, true, cost)
 		if err != nil {
 			return nil, err
 		} else if !ok {
@@ -61,6 +65,7 @@ func NewJSONRPCWSRelayer(rootCtx context.Context) *JSONRPCWSRelayer {
 }
 
 func (h *JSONRPCWSRelayer) onClose(s jsoffnet.RPCSession) {
+	log.WithFields(log.Fields{"session": s.SessionID()}).Info("websocket session closed")
 	delete(wsPairs, s.SessionID())
 	metricsWSPairsCount.Set(float64(len(wsPairs)))
 }
@@ -86,12 +91,20 @@ func (h *JSONRPCWSRelayer) delegateRPC(req *jsoffnet.RPCRequest) (interface{}, e
 	}
 
 	m := nodemuxcore.GetMultiplexer()
+	delegator := nodemuxcore.GetDelegatorFactory().GetRPCDelegator(acc.Chain.Namespace)
 
-	if destWs, ok := wsPairs[session.SessionID()]; ok {
+	// requests which hooks or the denial apply to are delegated
+	// rather than relayed verbatim to the paired websocket
+	intercept := false
+	if reqmsg, ok := msg.(*jsoff.RequestMessage); ok && delegator != nil {
+		intercept = m.Intercepts(acc.RequestInfo().AddTo(r.Context()), delegator, acc.Chain, reqmsg)
+	}
+
+	if destWs, ok := wsPairs[session.SessionID()]; ok && !intercept {
 		// a existing dest ws conn found, relay the message to it
 		err := destWs.Send(h.rootCtx, msg)
 		return nil, err
-	} else if ep, found := m.SelectWebsocketEndpoint(acc.Chain, "", -2); found {
+	} else if ep, found := m.SelectWebsocketEndpointFor(m.AffinityContext(r.Context(), acc.Chain, acc.Name, r, nil), acc.Chain, "", -2); found && !intercept {
 		// the first time a websocket connection connects
 		// select an available dest websocket connection
 		// make a pair (session, destWs)
@@ -106,6 +119,11 @@ func (h *JSONRPCWSRelayer) delegateRPC(req *jsoffnet.RPCRequest) (interface{}, e
 		destWs.OnClose(func() {
 			h.onClose(session)
 		})
+		acc.Chain.Log().WithFields(log.Fields{
+			"session": session.SessionID(),
+			"account": acc.Name,
+			"through": ep.Name,
+		}).Info("pair websocket session")
 		wsPairs[session.SessionID()] = destWs
 		metricsWSPairsCount.Set(float64(len(wsPairs)))
 		err = destWs.Send(h.rootCtx, msg)
@@ -113,7 +131,6 @@ func (h *JSONRPCWSRelayer) delegateRPC(req *jsoffnet.RPCRequest) (interface{}, e
 	} else if msg.IsRequest() {
 		// if no dest websocket connection is available and msg is a request message
 		// it's still ok to deliver the message to http endpoints
-		delegator := nodemuxcore.GetDelegatorFactory().GetRPCDelegator(acc.Chain.Namespace)
 		reqmsg, _ := msg.(*jsoff.RequestMessage)
 		if delegator == nil {
 			return nil, jsoffnet.SimpleResponse{
@@ -122,7 +139,25 @@ func (h *JSONRPCWSRelayer) delegateRPC(req *jsoffnet.RPCRequest) (interface{}, e
 			}
 		}
 
-		resmsg, err := delegator.DelegateRPC(h.rootCtx, m, acc.Chain, reqmsg, r)
+		// each message over the websocket is a request of its own
+		info := acc.RequestInfo()
+		info.RequestId = newRequestId()
+		info.SessionId = session.SessionID()
+		acc.applyVerifyHeader(info, r)
+		info.AddMethod(reqmsg.Method)
+		ctx := info.AddTo(nodemuxcore.ContextWithSpanFrom(h.rootCtx, r.Context()))
+		ctx = m.AffinityContext(ctx, acc.Chain, acc.Name, r, reqmsg)
+		ctx, span := acc.startDelegateSpan(ctx, reqmsg.Method)
+		defer span.End()
+		start := time.Now()
+		resmsg, err := m.DelegateRPCWithHooks(ctx, delegator, acc.Chain, reqmsg, r)
+		acc.observeRPC(ctx, reqmsg.Method, start, resmsg, err)
+		acc.Chain.Log().WithFields(nodemuxcore.RequestLogFields(ctx, log.Fields{
+			"method":      reqmsg.Method,
+			"timeSpentMS": time.Since(start).Milliseconds(),
+			"account":     acc.Name,
+		})).Info("delegate jsonrpc over websocket")
+		acc.logWSMessage(h.rootCtx, info, start, reqmsg, resmsg, err)
 		return resmsg, err
 	} else {
 		// the last way, return back
@@ -1,10 +1,19 @@
 package server
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/superisaac/jsoff"
 	"github.com/superisaac/nodemux/core"
 	"github.com/superisaac/nodemux/ratelimit"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
 )
 
 var (
@@ -13,8 +22,210 @@ var (
 		Name:      "websocket_pairs_count",
 		Help:      "the count of websocket pairs",
 	})
+
+	metricsElectrumSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "nodemux",
+		Name:      "electrum_sessions_count",
+		Help:      "the count of electrum client connections",
+	})
+
+	metricsAccountRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "account_http_requests_total",
+		Help:      "the count of http requests by account, route and status",
+	}, []string{"account", "chain", "route", "status"})
+
+	metricsAccountHttpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nodemux",
+		Name:      "account_http_request_duration_seconds",
+		Help:      "the latency of http requests by account and route",
+		Buckets:   nodemuxcore.LatencyBuckets,
+	}, []string{"account", "chain", "route"})
+
+	metricsAccountBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "account_bytes_total",
+		Help:      "the bytes received from and sent to clients",
+	}, []string{"account", "chain", "direction"})
+
+	metricsAccountInflight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "nodemux",
+		Name:      "account_inflight_requests",
+		Help:      "the count of requests being processed",
+	}, []string{"account", "chain"})
+
+	metricsAccountRPCDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "nodemux",
+		Name:      "account_rpc_duration_seconds",
+		Help:      "the latency of delegated rpc requests by account and method",
+		Buckets:   nodemuxcore.LatencyBuckets,
+	}, []string{"account", "chain", "method"})
+
+	metricsAccountRPCErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "nodemux",
+		Name:      "account_rpc_errors_total",
+		Help:      "the count of rpc error responses by account, method and error code",
+	}, []string{"account", "chain", "method", "code"})
 )
 
+// the chain label of an account, chains without endpoints are
+// labeled as unknown as the chain part of URL is given by clients
+func (acc Acc) chainLabel() string {
+	if nodemuxcore.GetMultiplexer().HasChain(acc.Chain) {
+		return acc.Chain.String()
+	}
+	return "unknown"
+}
+
+// Observe a delegated rpc request of an account
+func (acc Acc) observeRPC(ctx context.Context, method string, start time.Time, resmsg jsoff.Message, err error) {
+	chain := acc.chainLabel()
+	methodLabel := nodemuxcore.ResponseMethodLabel(method, resmsg)
+	metricsAccountRPCDuration.With(prometheus.Labels{
+		"account": acc.Name,
+		"chain":   chain,
+		"method":  methodLabel,
+	}).Observe(time.Since(start).Seconds())
+
+	code := ""
+	if err != nil {
+		code = "error"
+	} else if resmsg != nil && resmsg.IsError() {
+		errCode := resmsg.MustError().Code
+		code = strconv.Itoa(errCode)
+		if info := nodemuxcore.RequestInfoFromContext(ctx); info != nil {
+			info.SetErrorCode(errCode)
+		}
+	}
+	if code != "" {
+		metricsAccountRPCErrors.With(prometheus.Labels{
+			"account": acc.Name,
+			"chain":   chain,
+			"method":  methodLabel,
+			"code":    code,
+		}).Inc()
+	}
+}
+
+// a response writer recording the status and the size of the
+// response, up to capture bytes of the response body are also kept,
+// websocket hijacking and flushing are passed through
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status   int
+	written  int64
+	capture  int
+	captured bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(data []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	captureBody(&w.captured, data[:n], w.capture)
+	return n, err
+}
+
+func (w *recordingResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *recordingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *recordingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		// a hijacked connection is a websocket
+		w.status = http.StatusSwitchingProtocols
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("response writer is not a hijacker")
+}
+
+type countingReader struct {
+	io.ReadCloser
+	read     int64
+	capture  int
+	captured bytes.Buffer
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.read += int64(n)
+	captureBody(&r.captured, p[:n], r.capture)
+	return n, err
+}
+
+// keep data in buf until it holds limit bytes
+func captureBody(buf *bytes.Buffer, data []byte, limit int) {
+	if room := limit - buf.Len(); room > 0 {
+		if len(data) > room {
+			data = data[:room]
+		}
+		buf.Write(data)
+	}
+}
+
+// metrics http requests per account
+type MetricsHandler struct {
+	next http.Handler
+}
+
+func NewMetricsHandler(next http.Handler) *MetricsHandler {
+	return &MetricsHandler{
+		next: next,
+	}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	acc := AccFromContext(r.Context())
+	chain := acc.chainLabel()
+	route := traceRoute(r.URL.Path)
+
+	inflight := metricsAccountInflight.With(prometheus.Labels{
+		"account": acc.Name,
+		"chain":   chain,
+	})
+	inflight.Inc()
+	defer inflight.Dec()
+
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+	mw := &recordingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+	start := time.Now()
+	h.next.ServeHTTP(mw, r)
+
+	metricsAccountHttpDuration.With(prometheus.Labels{
+		"account": acc.Name,
+		"chain":   chain,
+		"route":   route,
+	}).Observe(time.Since(start).Seconds())
+	metricsAccountRequests.With(prometheus.Labels{
+		"account": acc.Name,
+		"chain":   chain,
+		"route":   route,
+		"status":  strconv.Itoa(mw.status),
+	}).Inc()
+	metricsAccountBytes.With(prometheus.Labels{
+		"account":   acc.Name,
+		"chain":     chain,
+		"direction": "received",
+	}).Add(float64(body.read))
+	metricsAccountBytes.With(prometheus.Labels{
+		"account":   acc.Name,
+		"chain":     chain,
+		"direction": "sent",
+	}).Add(float64(mw.written))
+}
+
 // Ratelimit collector
 var ratelimitDesc = prometheus.NewDesc(
 	"nodemux_ratelimit_value",
@@ -49,5 +260,12 @@ func (collector RatelimitCollector) Collect(ch chan<- prometheus.Metric) {
 
 func init() {
 	prometheus.MustRegister(
-		metricsWSPairsCount, NewRatelimitCollector())
+		metricsWSPairsCount, metricsElectrumSessions, NewRatelimitCollector())
+	prometheus.MustRegister(
+		metricsAccountRequests,
+		metricsAccountHttpDuration,
+		metricsAccountBytes,
+		metricsAccountInflight,
+		metricsAccountRPCDuration,
+		metricsAccountRPCErrors)
 }
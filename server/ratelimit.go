@@ -37,7 +37,11 @@ func (handler *RatelimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		accName = ""
 	}
 
-	ok, err := checkRatelimit(r, accName, ratelimit, false)
+	cost := 1
+	if acc != nil {
+		cost = acc.requestCost(r)
+	}
+	ok, err := checkRatelimit(r, accName, ratelimit, false, cost)
 	if err != nil {
 		requestLog(r).Errorf("error while checking ratelimit %s", err)
 		w.Header().Set("Content-Type", "application/json")
@@ -68,26 +72,34 @@ func (handler *RatelimitHandler) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	}
 }
 
-func checkRatelimit(r *http.Request, accountName string, ratelimitCfg RatelimitConfig, fromWebsocket bool) (bool, error) {
+func checkRatelimit(r *http.Request, accountName string, ratelimitCfg RatelimitConfig, fromWebsocket bool, cost int) (bool, error) {
+	return checkRatelimitOf(r.Context(), r.RemoteAddr, accountName, ratelimitCfg, fromWebsocket, cost)
+}
+
+// check the ratelimit of the account or the remote address, requests
+// over persistent connections have doubled limits, a request is
+// counted as cost requests
+func checkRatelimitOf(ctx context.Context, remoteAddr string, accountName string, ratelimitCfg RatelimitConfig, persistent bool, cost int) (bool, error) {
 	m := nodemuxcore.GetMultiplexer()
 	factor := 1
-	if fromWebsocket {
+	if persistent {
 		factor = 2
 	}
 	if c, ok := m.RedisClient("ratelimit"); ok {
 		if accountName != "" {
 			// use account based limit
-			return ratelimit.Incr(
-				r.Context(),
+			return ratelimit.IncrBy(
+				ctx,
 				c,
 				//"u"+accName,
 				accountName,
+				cost,
 				ratelimitCfg.UserLimit()*factor)
 		} else {
 			// per IP based ratelimit
-			return ratelimit.Incr(
-				r.Context(),
-				c, r.RemoteAddr,
+			return ratelimit.IncrBy(
+				ctx,
+				c, remoteAddr, cost,
 				ratelimitCfg.IPLimit()*factor)
 		}
 	}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/superisaac/nodemux/core"
+)
+
+var requestIdRegex = regexp.MustCompile(`^[a-zA-Z0-9\-_.:]{1,128}$`)
+
+// Attach a request info with the request id to each request, the
+// X-Request-Id header sent by the client is honored if it's valid,
+// so is the session named by the X-Nodemux-Session header or cookie
+// if the account allows sessions, the diagnostic headers are returned
+// along with the response
+type RequestIdHandler struct {
+	next http.Handler
+}
+
+func NewRequestIdHandler(next http.Handler) *RequestIdHandler {
+	return &RequestIdHandler{
+		next: next,
+	}
+}
+
+func (h *RequestIdHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	acc := AccFromContext(r.Context())
+	info := acc.RequestInfo()
+	info.RequestId = r.Header.Get(nodemuxcore.RequestIdHeader)
+	if !requestIdRegex.MatchString(info.RequestId) {
+		info.RequestId = newRequestId()
+	}
+	if acc.Config.Sessions {
+		info.SessionId = httpSessionId(r)
+	}
+	nodemuxcore.SetSpanAttributes(r.Context(),
+		nodemuxcore.AttrRequestId.String(info.RequestId))
+
+	w.Header().Set(nodemuxcore.RequestIdHeader, info.RequestId)
+	dw := &diagnosticResponseWriter{ResponseWriter: w, info: info}
+	h.next.ServeHTTP(dw, r.WithContext(info.AddTo(r.Context())))
+}
+
+// the session named by the header or the cookie, sessions of invalid
+// names are ignored
+func httpSessionId(r *http.Request) string {
+	sessionId := r.Header.Get(nodemuxcore.SessionHeader)
+	if sessionId == "" {
+		if cookie, err := r.Cookie(nodemuxcore.SessionCookie); err == nil {
+			sessionId = cookie.Value
+		}
+	}
+	if requestIdRegex.MatchString(sessionId) {
+		return sessionId
+	}
+	return ""
+}
+
+// a response writer which sets the diagnostic headers collected by the
+// request info right before the response header is written
+type diagnosticResponseWriter struct {
+	http.ResponseWriter
+	info        *nodemuxcore.RequestInfo
+	wroteHeader bool
+}
+
+func (w *diagnosticResponseWriter) setDiagnosticHeaders() {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if endpoints := w.info.Endpoints(); len(endpoints) > 0 {
+		header.Set("X-Nodemux-Endpoint", strings.Join(endpoints, ","))
+	}
+	if attempts := w.info.Attempts(); attempts > 0 {
+		header.Set("X-Nodemux-Attempts", strconv.Itoa(attempts))
+		header.Set("X-Nodemux-Upstream-Ms",
+			strconv.FormatInt(w.info.UpstreamTime().Milliseconds(), 10))
+	}
+	if cacheResult := w.info.CacheResult(); cacheResult != "" {
+		header.Set("X-Nodemux-Cache", cacheResult)
+	}
+}
+
+func (w *diagnosticResponseWriter) WriteHeader(status int) {
+	w.setDiagnosticHeaders()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *diagnosticResponseWriter) Write(data []byte) (int, error) {
+	w.setDiagnosticHeaders()
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *diagnosticResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *diagnosticResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *diagnosticResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hijacker, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hijacker.Hijack()
+	}
+	return nil, nil, errors.New("response writer is not a hijacker")
+}
@@ -65,7 +65,11 @@ func (h *RESTRelayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Body = io.NopCloser(bytes.NewBuffer(body))
 	}
 
-	err := delegator.DelegateREST(h.rootCtx, m, acc.Chain, method, w, r)
+	ctx := m.AffinityContext(acc.delegateContext(h.rootCtx, r, method), acc.Chain, acc.Name, r, nil)
+	ctx, span := acc.startDelegateSpan(ctx, method)
+	defer span.End()
+
+	err := delegator.DelegateREST(ctx, m, acc.Chain, method, w, r)
 	if err != nil {
 		requestLog(r).Warnf("error delegate rest %s", err)
 		w.WriteHeader(500)
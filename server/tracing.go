@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/superisaac/nodemux/core"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Start a server span for each incoming request, a traceparent header
+// sent by the client is honored
+type TraceHandler struct {
+	next http.Handler
+}
+
+func NewTraceHandler(next http.Handler) *TraceHandler {
+	return &TraceHandler{
+		next: next,
+	}
+}
+
+// the route of a request path, the account part is not included as
+// it's the credential of the request
+func traceRoute(path string) string {
+	parts := strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)
+	return "/" + parts[0]
+}
+
+func (h *TraceHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route := traceRoute(r.URL.Path)
+	ctx := nodemuxcore.ExtractTraceContext(r.Context(), r.Header)
+	ctx, span := nodemuxcore.StartSpan(ctx, r.Method+" "+route, trace.SpanKindServer,
+		attribute.String("http.request.method", r.Method),
+		attribute.String("http.route", route))
+	defer span.End()
+
+	h.next.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// The context passed to delegators, which is derived from the root
+// context and carries the span and the request info of the request
+func (acc Acc) delegateContext(rootCtx context.Context, r *http.Request, method string) context.Context {
+	ctx := nodemuxcore.ContextWithSpanFrom(rootCtx, r.Context())
+	info := nodemuxcore.RequestInfoFromContext(r.Context())
+	if info == nil {
+		info = acc.RequestInfo()
+	}
+	acc.applyVerifyHeader(info, r)
+	info.AddMethod(method)
+	return info.AddTo(ctx)
+}
+
+func (acc Acc) startDelegateSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return nodemuxcore.StartSpan(ctx, "delegate", trace.SpanKindInternal,
+		nodemuxcore.AttrChain.String(acc.Chain.String()),
+		nodemuxcore.AttrAccount.String(acc.Name),
+		nodemuxcore.AttrMethod.String(method))
+}